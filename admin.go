@@ -0,0 +1,355 @@
+package main
+
+import (
+        "database/sql"
+        "embed"
+        "fmt"
+        "html/template"
+        "log"
+        "net/http"
+        "net/url"
+        "strconv"
+        "strings"
+
+        "github.com/gorilla/mux"
+        "golang.org/x/crypto/bcrypt"
+)
+
+//go:embed admin/*.html
+var adminTemplates embed.FS
+
+const adminPageSize = 25
+
+var adminFuncs = template.FuncMap{
+        "add": func(a, b int) int { return a + b },
+}
+
+// Compared against when the user name is unknown, so a failed login takes
+// as long either way
+var adminDummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// AdminConsole serves server-rendered pages under /admin for browsing and
+// editing items. Admins sign in with a password to a session from the
+// SessionManager, and every form carries its CSRF token.
+type AdminConsole struct {
+        users    map[string][]byte // bcrypt hashes by user name
+        sessions *SessionManager
+        search   *SearchIndex
+        pages    map[string]*template.Template
+}
+
+// Parse ADMIN_USERS, comma-separated name:bcrypt-hash pairs
+func NewAdminConsole(users string, sessions *SessionManager, search *SearchIndex) (*AdminConsole, error) {
+        c := &AdminConsole{users: map[string][]byte{}, sessions: sessions, search: search, pages: map[string]*template.Template{}}
+        for _, pair := range strings.FieldsFunc(users, func(r rune) bool { return r == ',' }) {
+                name, hash, ok := strings.Cut(strings.TrimSpace(pair), ":")
+                if !ok || name == "" {
+                        return nil, fmt.Errorf("admin user %q is not name:bcrypt-hash", pair)
+                }
+                if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+                        return nil, fmt.Errorf("admin user %s: %v", name, err)
+                }
+                c.users[name] = []byte(hash)
+        }
+
+        for _, page := range []string{"login.html", "list.html", "form.html", "delete.html"} {
+                tmpl, err := template.New(page).Funcs(adminFuncs).ParseFS(adminTemplates, "admin/layout.html", "admin/"+page)
+                if err != nil {
+                        return nil, err
+                }
+                c.pages[page] = tmpl
+        }
+        return c, nil
+}
+
+// Handler routes the console. The session middleware runs before the
+// tenant, replica and audit middleware, so they see the signed-in admin
+// as the principal and the tenant their session is bound to. Signing in
+// and out happens before there is a tenant, as does rebuilding the search
+// index, which covers every tenant.
+func (c *AdminConsole) Handler() http.Handler {
+        router := mux.NewRouter().PathPrefix("/admin").Subrouter()
+        router.Use(c.sessions.Middleware, c.sessions.RequireCSRF, c.Middleware)
+
+        router.HandleFunc("/login", c.loginForm).Methods("GET")
+        router.HandleFunc("/login", c.login).Methods("POST")
+        router.HandleFunc("/logout", c.logout).Methods("POST")
+        router.HandleFunc("/search/rebuild", c.rebuildSearch).Methods("POST")
+
+        items := router.NewRoute().Subrouter()
+        items.Use(tenancy.Middleware, replicas.Middleware, audit.Middleware)
+        items.Handle("/", http.RedirectHandler("/admin/items", http.StatusSeeOther)).Methods("GET")
+        items.HandleFunc("/items", c.list).Methods("GET")
+        items.HandleFunc("/items/new", c.newForm).Methods("GET")
+        items.HandleFunc("/items", c.create).Methods("POST")
+        items.HandleFunc("/items/{id}/edit", c.editForm).Methods("GET")
+        items.HandleFunc("/items/{id}", c.update).Methods("POST")
+        items.HandleFunc("/items/{id}/delete", c.confirmDelete).Methods("GET")
+        items.HandleFunc("/items/{id}/delete", c.delete).Methods("POST")
+        return router
+}
+
+// What every page template gets
+type adminPage struct {
+        User  string
+        CSRF  string
+        Flash []string
+        Error string
+        Next  string // Where to go after signing in
+
+        Items []Item
+        Query string
+        Page  int
+        Pages int
+
+        Item   Item
+        Errors ValidationError
+}
+
+// Middleware sends anyone not signed in as an admin to the login page
+func (c *AdminConsole) Middleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.URL.Path != "/admin/login" && c.admin(r) == "" {
+                        http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+                        return
+                }
+                next.ServeHTTP(w, r)
+        })
+}
+
+// The signed-in admin, or "" if the session is not an admin's. Users
+// signed in through the identity provider are not admins, whatever their
+// name.
+func (c *AdminConsole) admin(r *http.Request) string {
+        if s := requestUserSession(r); s != nil && s.Values[oidcIssuerValue] == "" && c.users[s.User] != nil {
+                return s.User
+        }
+        return ""
+}
+
+// render fills in the session's part of page and writes the template
+func (c *AdminConsole) render(w http.ResponseWriter, r *http.Request, status int, name string, page adminPage) {
+        page.User = c.admin(r)
+        page.CSRF = c.sessions.CSRFToken(w, r)
+        if s := requestUserSession(r); s != nil && s.Values["flash"] != "" {
+                page.Flash = []string{s.Values["flash"]}
+                delete(s.Values, "flash")
+                if err := c.sessions.Save(r.Context(), s); err != nil {
+                        dbError(w, err)
+                        return
+                }
+        }
+
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Header().Set("Cache-Control", "no-store")
+        w.WriteHeader(status)
+        if err := c.pages[name].ExecuteTemplate(w, "layout", page); err != nil {
+                log.Printf("admin: rendering %s: %v", name, err)
+        }
+}
+
+// redirect sends the browser on after a form, with a message for the next page
+func (c *AdminConsole) redirect(w http.ResponseWriter, r *http.Request, to, flash string) {
+        if s := requestUserSession(r); s != nil && flash != "" {
+                s.Values["flash"] = flash
+                if err := c.sessions.Save(r.Context(), s); err != nil {
+                        dbError(w, err)
+                        return
+                }
+        }
+        http.Redirect(w, r, to, http.StatusSeeOther)
+}
+
+func (c *AdminConsole) loginForm(w http.ResponseWriter, r *http.Request) {
+        c.render(w, r, http.StatusOK, "login.html", adminPage{Next: r.URL.Query().Get("next")})
+}
+
+func (c *AdminConsole) login(w http.ResponseWriter, r *http.Request) {
+        name, next := r.PostFormValue("username"), r.PostFormValue("next")
+        hash, known := c.users[name]
+        if !known {
+                hash = adminDummyHash
+        }
+        if bcrypt.CompareHashAndPassword(hash, []byte(r.PostFormValue("password"))) != nil || !known {
+                log.Printf("admin: failed login for %q from %s", name, r.RemoteAddr)
+                c.render(w, r, http.StatusUnauthorized, "login.html", adminPage{Error: "Wrong user name or password", Next: next})
+                return
+        }
+
+        // Admins may manage any tenant; the session is bound to the one
+        // the login page was opened for
+        tenant, err := tenancy.LoginTenant(r)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if _, err := c.sessions.Login(w, r, name, tenant); err != nil {
+                dbError(w, err)
+                return
+        }
+
+        // Only follow paths in the console, so the login page cannot be
+        // used to send admins elsewhere
+        if !strings.HasPrefix(next, "/admin/") {
+                next = "/admin/items"
+        }
+        http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (c *AdminConsole) logout(w http.ResponseWriter, r *http.Request) {
+        if err := c.sessions.Logout(w, r); err != nil {
+                dbError(w, err)
+                return
+        }
+        http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+// List items a page at a time; q narrows them to search results, best first
+func (c *AdminConsole) list(w http.ResponseWriter, r *http.Request) {
+        page := adminPage{Query: strings.TrimSpace(r.URL.Query().Get("q")), Page: 1}
+        if v := r.URL.Query().Get("page"); v != "" {
+                n, err := strconv.Atoi(v)
+                if err != nil || n < 1 {
+                        http.Error(w, "invalid page", http.StatusBadRequest)
+                        return
+                }
+                page.Page = n
+        }
+
+        var items []Item
+        if page.Query != "" {
+                for _, hit := range c.search.Search(requestTenant(r), page.Query, 0) {
+                        items = append(items, hit.Item)
+                }
+        } else {
+                err := dbBreaker.Do(r.Context(), func() error {
+                        return replicas.Read(r.Context(), func(conn *DB) (err error) {
+                                items, err = listItemsFiltered(conn, requestTenant(r), ItemFilter{})
+                                return err
+                        })
+                })
+                if err != nil {
+                        dbError(w, err)
+                        return
+                }
+        }
+
+        page.Pages = (len(items) + adminPageSize - 1) / adminPageSize
+        start := (page.Page - 1) * adminPageSize
+        if start < len(items) {
+                page.Items = items[start:min(start+adminPageSize, len(items))]
+        }
+        c.render(w, r, http.StatusOK, "list.html", page)
+}
+
+func (c *AdminConsole) newForm(w http.ResponseWriter, r *http.Request) {
+        c.render(w, r, http.StatusOK, "form.html", adminPage{})
+}
+
+func (c *AdminConsole) create(w http.ResponseWriter, r *http.Request) {
+        item := Item{Name: r.PostFormValue("name"), Desc: r.PostFormValue("desc")}
+        err := dbBreaker.Do(r.Context(), func() (err error) {
+                item, err = insertItem(requestActor(r), item)
+                return err
+        })
+        if c.formError(w, r, item, err) {
+                return
+        }
+        c.redirect(w, r, "/admin/items/"+strconv.Itoa(item.ID)+"/edit", "Created "+item.Name)
+}
+
+// adminItem loads the item named in the path, writing a 404 or other
+// error page if it cannot
+func (c *AdminConsole) adminItem(w http.ResponseWriter, r *http.Request) (Item, bool) {
+        id, err := strconv.Atoi(mux.Vars(r)["id"])
+        if err != nil {
+                http.Error(w, "Invalid ID", http.StatusBadRequest)
+                return Item{}, false
+        }
+        var item Item
+        err = dbBreaker.Do(r.Context(), func() (err error) {
+                item, err = cache.Get(requestTenant(r), id, loadItem)
+                return err
+        })
+        if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return item, false
+        } else if err != nil {
+                dbError(w, err)
+                return item, false
+        }
+        return item, true
+}
+
+func (c *AdminConsole) editForm(w http.ResponseWriter, r *http.Request) {
+        if item, ok := c.adminItem(w, r); ok {
+                c.render(w, r, http.StatusOK, "form.html", adminPage{Item: item})
+        }
+}
+
+func (c *AdminConsole) update(w http.ResponseWriter, r *http.Request) {
+        item, ok := c.adminItem(w, r)
+        if !ok {
+                return
+        }
+        item.Name, item.Desc = r.PostFormValue("name"), r.PostFormValue("desc")
+        err := dbBreaker.Do(r.Context(), func() (err error) {
+                item, err = saveItem(requestActor(r), item)
+                return err
+        })
+        if c.formError(w, r, item, err) {
+                return
+        }
+        c.redirect(w, r, "/admin/items/"+strconv.Itoa(item.ID)+"/edit", "Saved "+item.Name)
+}
+
+// formError shows the form again with what went wrong, if anything did
+func (c *AdminConsole) formError(w http.ResponseWriter, r *http.Request, item Item, err error) bool {
+        switch err := err.(type) {
+        case nil:
+                return false
+        case ValidationError:
+                c.render(w, r, http.StatusUnprocessableEntity, "form.html", adminPage{Item: item, Errors: err})
+        default:
+                if err == errQuotaExceeded {
+                        c.render(w, r, http.StatusForbidden, "form.html", adminPage{Item: item, Error: "This tenant has reached its item quota"})
+                } else if err == sql.ErrNoRows {
+                        http.NotFound(w, r)
+                } else {
+                        dbError(w, err)
+                }
+        }
+        return true
+}
+
+func (c *AdminConsole) confirmDelete(w http.ResponseWriter, r *http.Request) {
+        if item, ok := c.adminItem(w, r); ok {
+                c.render(w, r, http.StatusOK, "delete.html", adminPage{Item: item})
+        }
+}
+
+func (c *AdminConsole) delete(w http.ResponseWriter, r *http.Request) {
+        item, ok := c.adminItem(w, r)
+        if !ok {
+                return
+        }
+        err := dbBreaker.Do(r.Context(), func() error { return removeItem(requestActor(r), item.ID) })
+        if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return
+        } else if err != nil {
+                dbError(w, err)
+                return
+        }
+        c.redirect(w, r, "/admin/items", "Deleted "+item.Name)
+}
+
+// Rebuild the search index from the database, for every tenant
+func (c *AdminConsole) rebuildSearch(w http.ResponseWriter, r *http.Request) {
+        if err := c.search.Rebuild(listAllItems); err != nil {
+                dbError(w, err)
+                return
+        }
+        log.Printf("admin: %s rebuilt the search index", c.admin(r))
+        c.redirect(w, r, "/admin/items", "Rebuilt the search index")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+        "database/sql"
+        "io"
+        "net/http"
+        "net/http/cookiejar"
+        "net/http/httptest"
+        "net/url"
+        "strconv"
+        "strings"
+        "testing"
+        "time"
+
+        "golang.org/x/crypto/bcrypt"
+)
+
+// adminBrowser is a browser session with the console: it keeps cookies
+// and does not follow redirects, so tests can check where they lead
+type adminBrowser struct {
+        t      *testing.T
+        srv    *httptest.Server
+        client *http.Client
+}
+
+// newAdminBrowser serves a console with the admin ann, password hunter2
+func newAdminBrowser(t *testing.T) *adminBrowser {
+        t.Helper()
+        hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+        if err != nil {
+                t.Fatal(err)
+        }
+        sessions := NewSessionManager(NewMemorySessionStore(), "secret", time.Hour, time.Hour)
+        console, err := NewAdminConsole("ann:"+string(hash), sessions, NewSearchIndex())
+        if err != nil {
+                t.Fatal(err)
+        }
+        srv := httptest.NewServer(console.Handler())
+        t.Cleanup(srv.Close)
+
+        jar, _ := cookiejar.New(nil)
+        client := &http.Client{
+                Jar:           jar,
+                CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+        }
+        return &adminBrowser{t: t, srv: srv, client: client}
+}
+
+// csrf is the token the last page set, as its forms would send it
+func (b *adminBrowser) csrf() string {
+        u, _ := url.Parse(b.srv.URL)
+        for _, cookie := range b.client.Jar.Cookies(u) {
+                if cookie.Name == csrfCookie {
+                        return cookie.Value
+                }
+        }
+        return ""
+}
+
+// get fetches a page and returns the status, body and redirect target
+func (b *adminBrowser) get(path string) (int, string, string) {
+        b.t.Helper()
+        resp, err := b.client.Get(b.srv.URL + path)
+        if err != nil {
+                b.t.Fatal(err)
+        }
+        return b.read(resp)
+}
+
+// post submits a form and returns the status, body and redirect target
+func (b *adminBrowser) post(path string, form url.Values) (int, string, string) {
+        b.t.Helper()
+        resp, err := b.client.PostForm(b.srv.URL+path, form)
+        if err != nil {
+                b.t.Fatal(err)
+        }
+        return b.read(resp)
+}
+
+func (b *adminBrowser) read(resp *http.Response) (int, string, string) {
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        return resp.StatusCode, string(body), resp.Header.Get("Location")
+}
+
+// login signs ann in, failing the test if that does not work
+func (b *adminBrowser) login() {
+        b.t.Helper()
+        b.get("/admin/login")
+        code, _, to := b.post("/admin/login", url.Values{"username": {"ann"}, "password": {"hunter2"}, csrfField: {b.csrf()}})
+        if code != http.StatusSeeOther || to != "/admin/items" {
+                b.t.Fatalf("login: %d to %q", code, to)
+        }
+}
+
+func TestAdminRequiresLogin(t *testing.T) {
+        newTestEnv(t)
+        b := newAdminBrowser(t)
+
+        for _, path := range []string{"/admin/items", "/admin/items/new", "/admin/items/1/edit"} {
+                code, _, to := b.get(path)
+                if code != http.StatusSeeOther || to != "/admin/login?next="+url.QueryEscape(path) {
+                        t.Errorf("%s signed out: %d to %q", path, code, to)
+                }
+        }
+
+        b.get("/admin/login")
+        code, body, _ := b.post("/admin/login", url.Values{"username": {"ann"}, "password": {"wrong"}, csrfField: {b.csrf()}})
+        if code != http.StatusUnauthorized || !strings.Contains(body, "Wrong user name or password") {
+                t.Errorf("wrong password: %d", code)
+        }
+        if code, _, _ := b.get("/admin/items"); code != http.StatusSeeOther {
+                t.Errorf("items after a failed login: %d", code)
+        }
+
+        b.login()
+        if code, _, _ := b.get("/admin/items"); code != http.StatusOK {
+                t.Errorf("items signed in: %d", code)
+        }
+}
+
+func TestAdminRejectsBadCSRFTokens(t *testing.T) {
+        newTestEnv(t)
+        b := newAdminBrowser(t)
+
+        // Before login, so another site cannot sign a browser in
+        b.get("/admin/login")
+        for name, token := range map[string]string{"missing": "", "wrong": "nonce.signature"} {
+                form := url.Values{"username": {"ann"}, "password": {"hunter2"}}
+                if token != "" {
+                        form.Set(csrfField, token)
+                }
+                if code, _, _ := b.post("/admin/login", form); code != http.StatusForbidden {
+                        t.Errorf("login with a %s token: got %d, want 403", name, code)
+                }
+        }
+
+        // And after, so it cannot change items in the admin's name
+        b.login()
+        for name, token := range map[string]string{"missing": "", "wrong": "nonce.signature"} {
+                form := url.Values{"name": {"widget"}}
+                if token != "" {
+                        form.Set(csrfField, token)
+                }
+                if code, _, _ := b.post("/admin/items", form); code != http.StatusForbidden {
+                        t.Errorf("create with a %s token: got %d, want 403", name, code)
+                }
+        }
+        if items, _ := listItems(defaultTenant); len(items) != 0 {
+                t.Errorf("items created without a token: %+v", items)
+        }
+}
+
+// Each form changes the item and leaves an audit entry naming the admin
+func TestAdminFormsChangeItems(t *testing.T) {
+        newTestEnv(t)
+        b := newAdminBrowser(t)
+        b.login()
+
+        code, _, to := b.post("/admin/items", url.Values{"name": {"widget"}, "desc": {"blue"}, csrfField: {b.csrf()}})
+        if code != http.StatusSeeOther || !strings.HasSuffix(to, "/edit") {
+                t.Fatalf("create: %d to %q", code, to)
+        }
+        id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(to, "/admin/items/"), "/edit"))
+        if err != nil {
+                t.Fatalf("create went to %q", to)
+        }
+        if _, body, _ := b.get("/admin/items"); !strings.Contains(body, "widget") || !strings.Contains(body, "Created widget") {
+                t.Errorf("list does not show the new item:\n%s", body)
+        }
+
+        path := "/admin/items/" + strconv.Itoa(id)
+        if _, body, _ := b.get(path + "/edit"); !strings.Contains(body, `value="widget"`) {
+                t.Errorf("edit form does not hold the item:\n%s", body)
+        }
+        if code, _, _ := b.post(path, url.Values{"name": {"gadget"}, "desc": {"red"}, csrfField: {b.csrf()}}); code != http.StatusSeeOther {
+                t.Fatalf("update: %d", code)
+        }
+        if item, _ := loadItem(defaultTenant, id); item.Name != "gadget" || item.Desc != "red" {
+                t.Errorf("after update: %+v", item)
+        }
+
+        // An invalid edit shows the form again and changes nothing
+        if code, _, _ := b.post(path, url.Values{"name": {""}, csrfField: {b.csrf()}}); code != http.StatusUnprocessableEntity {
+                t.Errorf("update without a name: got %d, want 422", code)
+        }
+
+        if code, _, to := b.post(path+"/delete", url.Values{csrfField: {b.csrf()}}); code != http.StatusSeeOther || to != "/admin/items" {
+                t.Fatalf("delete: %d to %q", code, to)
+        }
+        if _, err := loadItem(defaultTenant, id); err != sql.ErrNoRows {
+                t.Errorf("after delete: %v", err)
+        }
+
+        var routes []string
+        for _, e := range auditEntries(t, defaultTenant) {
+                if e.Principal != "ann" || e.ItemID != id {
+                        t.Errorf("entry %+v", e)
+                }
+                routes = append(routes, e.Route+" "+e.Outcome)
+        }
+        want := []string{
+                "POST /admin/items success",
+                "POST /admin/items/{id} success",
+                "POST /admin/items/{id} failure",
+                "POST /admin/items/{id}/delete success",
+        }
+        if strings.Join(routes, "\n") != strings.Join(want, "\n") {
+                t.Errorf("audit entries:\n%s\nwant:\n%s", strings.Join(routes, "\n"), strings.Join(want, "\n"))
+        }
+}
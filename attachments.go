@@ -0,0 +1,434 @@
+package main
+
+import (
+        "bufio"
+        "context"
+        "crypto/subtle"
+        "database/sql"
+        "encoding/base64"
+        "encoding/hex"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "mime"
+        "mime/multipart"
+        "net/http"
+        "path"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// Attachment describes a file stored against an item
+type Attachment struct {
+        ID          int       `json:"id"`
+        ItemID      jsonID    `json:"item_id"`
+        Filename    string    `json:"filename"`
+        ContentType string    `json:"content_type"` // Sniffed from the content, not taken from the client
+        Size        int64     `json:"size"`
+        SHA256      string    `json:"sha256"`
+        CreatedAt   time.Time `json:"created_at"`
+}
+
+// Content types accepted for upload, matched against the sniffed type
+var attachmentTypes = []string{"image/", "application/pdf", "text/plain", "application/zip"}
+
+// AttachmentService stores item attachments in a BlobStore with their
+// metadata in the database
+type AttachmentService struct {
+        blobs   BlobStore
+        maxSize int64
+}
+
+// Create an attachment service accepting files up to maxSize bytes
+func NewAttachmentService(blobs BlobStore, maxSize int64) *AttachmentService {
+        return &AttachmentService{blobs: blobs, maxSize: maxSize}
+}
+
+// Blobs for one item share a prefix so they can be removed together
+func itemBlobPrefix(itemID int) string {
+        return fmt.Sprintf("items/%d", itemID)
+}
+
+func attachmentKey(itemID, attachmentID int) string {
+        return fmt.Sprintf("%s/%d", itemBlobPrefix(itemID), attachmentID)
+}
+
+// How long an upload may take before its unfinished row counts as abandoned
+const abandonedUploadAge = time.Hour
+
+// Apply removes a deleted item's blobs; the rows go with the item through
+// the foreign key. It is an EventBus handler. Events may come late or
+// twice, after a revert has brought the item back under the same ID and
+// it has new attachments, so only blobs with no row left are removed:
+// an upload writes its row before its blob.
+func (s *AttachmentService) Apply(event ItemEvent) {
+        if event.Type != EventItemDeleted {
+                return
+        }
+        if err := s.deleteUnreferenced(event.ItemID); err != nil {
+                log.Printf("attachments: cleaning up item %d: %v", event.ItemID, err)
+        }
+}
+
+func (s *AttachmentService) deleteUnreferenced(itemID int) error {
+        keys, err := s.blobs.List(itemBlobPrefix(itemID))
+        if err != nil {
+                return err
+        }
+        conn := itemDB(itemID)
+        for _, key := range keys {
+                id, err := strconv.Atoi(path.Base(key))
+                if err != nil {
+                        continue // Not an attachment
+                }
+                var exists int
+                err = conn.QueryRow("SELECT 1 FROM attachments WHERE id = ? AND item_id = ?", id, itemID).Scan(&exists)
+                if err == nil {
+                        continue
+                } else if err != sql.ErrNoRows {
+                        return err
+                }
+                if err := s.blobs.Delete(key); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+// Run removes abandoned uploads until ctx is cancelled
+func (s *AttachmentService) Run(ctx context.Context) {
+        ticker := time.NewTicker(10 * time.Minute)
+        defer ticker.Stop()
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                        if err := s.sweep(time.Now().Add(-abandonedUploadAge)); err != nil {
+                                log.Printf("attachments: removing abandoned uploads: %v", err)
+                        }
+                }
+        }
+}
+
+// sweep deletes the rows and blobs of uploads started before cutoff that
+// never finished, such as when the server stopped mid-upload
+func (s *AttachmentService) sweep(cutoff time.Time) error {
+        for _, conn := range itemDBs() {
+                rows, err := conn.Query("SELECT id, item_id FROM attachments WHERE sha256 = '' AND created_at < ?", cutoff.UTC())
+                if err != nil {
+                        return err
+                }
+                type upload struct{ id, itemID int }
+                abandoned := []upload{}
+                for rows.Next() {
+                        var u upload
+                        if err := rows.Scan(&u.id, &u.itemID); err != nil {
+                                rows.Close()
+                                return err
+                        }
+                        abandoned = append(abandoned, u)
+                }
+                rows.Close()
+                if err := rows.Err(); err != nil {
+                        return err
+                }
+
+                for _, u := range abandoned {
+                        // The row goes first, so the upload cannot finish after its blob is gone
+                        result, err := conn.Exec("DELETE FROM attachments WHERE id = ? AND sha256 = ''", u.id)
+                        if err != nil {
+                                return err
+                        }
+                        if n, _ := result.RowsAffected(); n == 0 {
+                                continue // Finished meanwhile
+                        }
+                        if err := s.blobs.Delete(attachmentKey(u.itemID, u.id)); err != nil {
+                                return err
+                        }
+                }
+        }
+        return nil
+}
+
+func allowedAttachmentType(contentType string) bool {
+        mediaType, _, _ := mime.ParseMediaType(contentType)
+        for _, allowed := range attachmentTypes {
+                if strings.HasSuffix(allowed, "/") && strings.HasPrefix(mediaType, allowed) || mediaType == allowed {
+                        return true
+                }
+        }
+        return false
+}
+
+func itemExists(tenant string, id int) (bool, error) {
+        var exists int
+        err := itemDB(id).QueryRow("SELECT 1 FROM items WHERE id = ? AND tenant_id = ?", id, tenant).Scan(&exists)
+        if err == sql.ErrNoRows {
+                return false, nil
+        }
+        return err == nil, err
+}
+
+// Upload a file as multipart field "file": POST /items/{id}/attachments.
+// An optional "sha256" field or X-Checksum-SHA256 header is verified
+// against what was received.
+func (s *AttachmentService) upload(w http.ResponseWriter, r *http.Request) {
+        itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+        if err != nil {
+                http.Error(w, "Invalid ID", http.StatusBadRequest)
+                return
+        }
+        tenant := requestTenant(r)
+        if ok, err := itemExists(tenant, itemID); err != nil {
+                dbError(w, err)
+                return
+        } else if !ok {
+                http.NotFound(w, r)
+                return
+        }
+
+        // Leave room for the multipart framing around the file
+        r.Body = http.MaxBytesReader(w, r.Body, s.maxSize+64*1024)
+        reader, err := r.MultipartReader()
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        expected := strings.ToLower(r.Header.Get("X-Checksum-SHA256"))
+        var part *multipart.Part
+        for {
+                p, err := reader.NextPart()
+                if err == io.EOF {
+                        break
+                } else if err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                if p.FormName() == "sha256" {
+                        v, _ := io.ReadAll(io.LimitReader(p, 128))
+                        expected = strings.ToLower(strings.TrimSpace(string(v)))
+                        continue
+                }
+                if p.FormName() == "file" {
+                        part = p
+                        break
+                }
+        }
+        if part == nil {
+                http.Error(w, "file is required", http.StatusBadRequest)
+                return
+        }
+
+        // Sniff the type from the first bytes rather than trusting the client
+        buffered := bufio.NewReaderSize(part, 512)
+        head, _ := buffered.Peek(512)
+        contentType := http.DetectContentType(head)
+        if !allowedAttachmentType(contentType) {
+                http.Error(w, "Unsupported attachment type "+contentType, http.StatusUnsupportedMediaType)
+                return
+        }
+
+        filename := path.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+        if filename == "." || filename == "/" {
+                filename = "attachment"
+        }
+
+        // Attachments live on their item's shard. The row is written under
+        // the item's lock, so a rebalance moving the item takes it along.
+        reserved, err := newID("attachments")
+        var id int
+        if err == nil {
+                err = inItemTx(itemID, func(tx *Tx) error {
+                        if _, err := lockItem(tx, tenant, itemID); err != nil {
+                                return err
+                        }
+                        id, err = insertRow(tx, reserved, "attachments", "tenant_id, item_id, filename, content_type, size, sha256, created_at",
+                                tenant, itemID, filename, contentType, 0, "", modifiedNow())
+                        return err
+                })
+        }
+        if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return
+        } else if err != nil {
+                dbError(w, err)
+                return
+        }
+        key := attachmentKey(itemID, id)
+
+        // Undo the row and blob if anything below fails
+        discard := func() {
+                s.blobs.Delete(key)
+                itemDB(itemID).Exec("DELETE FROM attachments WHERE id = ? AND tenant_id = ?", id, tenant)
+        }
+
+        // One byte over the limit is enough to know the file is too big
+        size, sum, err := s.blobs.Put(key, io.LimitReader(buffered, s.maxSize+1))
+        if err != nil {
+                discard()
+                var tooLarge *http.MaxBytesError
+                if errors.As(err, &tooLarge) {
+                        http.Error(w, "attachment too large", http.StatusRequestEntityTooLarge)
+                        return
+                }
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if size > s.maxSize {
+                discard()
+                http.Error(w, fmt.Sprintf("attachment exceeds %d bytes", s.maxSize), http.StatusRequestEntityTooLarge)
+                return
+        }
+        if expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(sum)) != 1 {
+                discard()
+                http.Error(w, "checksum mismatch", http.StatusBadRequest)
+                return
+        }
+
+        err = inItemTx(itemID, func(tx *Tx) error {
+                if _, err := lockItem(tx, tenant, itemID); err != nil {
+                        return err
+                }
+                _, err := tx.Exec("UPDATE attachments SET size = ?, sha256 = ? WHERE id = ? AND tenant_id = ?", size, sum, id, tenant)
+                return err
+        })
+        if err != nil {
+                discard()
+                if err == sql.ErrNoRows {
+                        http.NotFound(w, r) // Deleted while uploading
+                        return
+                }
+                dbError(w, err)
+                return
+        }
+
+        attachment, err := loadAttachment(tenant, itemID, id)
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(attachment)
+}
+
+const attachmentColumns = "id, item_id, filename, content_type, size, sha256, created_at"
+
+func scanAttachment(row scanner) (Attachment, error) {
+        var a Attachment
+        err := row.Scan(&a.ID, &a.ItemID, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.CreatedAt)
+        return a, err
+}
+
+// Load an attachment; uploads still in progress are not visible
+func loadAttachment(tenant string, itemID, id int) (Attachment, error) {
+        return scanAttachment(itemDB(itemID).QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ? AND item_id = ? AND tenant_id = ? AND sha256 <> ''", id, itemID, tenant))
+}
+
+// List an item's attachments: GET /items/{id}/attachments
+func (s *AttachmentService) list(w http.ResponseWriter, r *http.Request) {
+        itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+        if err != nil {
+                http.Error(w, "Invalid ID", http.StatusBadRequest)
+                return
+        }
+
+        rows, err := itemDB(itemID).Query("SELECT "+attachmentColumns+" FROM attachments WHERE item_id = ? AND tenant_id = ? AND sha256 <> '' ORDER BY id", itemID, requestTenant(r))
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        defer rows.Close()
+
+        attachments := []Attachment{}
+        for rows.Next() {
+                a, err := scanAttachment(rows)
+                if err != nil {
+                        dbError(w, err)
+                        return
+                }
+                attachments = append(attachments, a)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(attachments)
+}
+
+func attachmentIDs(r *http.Request) (int, int, error) {
+        params := mux.Vars(r)
+        itemID, err := strconv.Atoi(params["id"])
+        if err != nil {
+                return 0, 0, err
+        }
+        id, err := strconv.Atoi(params["attachmentId"])
+        return itemID, id, err
+}
+
+// Download an attachment, honouring Range and conditional headers:
+// GET /items/{id}/attachments/{attachmentId}
+func (s *AttachmentService) download(w http.ResponseWriter, r *http.Request) {
+        itemID, id, err := attachmentIDs(r)
+        if err != nil {
+                http.Error(w, "Invalid ID", http.StatusBadRequest)
+                return
+        }
+
+        a, err := loadAttachment(requestTenant(r), itemID, id)
+        if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return
+        } else if err != nil {
+                dbError(w, err)
+                return
+        }
+
+        blob, err := s.blobs.Open(attachmentKey(itemID, id))
+        if err == errBlobNotFound {
+                http.NotFound(w, r)
+                return
+        } else if err != nil {
+                dbError(w, err)
+                return
+        }
+        defer blob.Close()
+
+        sum, _ := hex.DecodeString(a.SHA256)
+        h := w.Header()
+        h.Set("Content-Type", a.ContentType)
+        h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+        h.Set("X-Content-Type-Options", "nosniff")
+        h.Set("ETag", `"`+a.SHA256+`"`)
+        h.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+        http.ServeContent(w, r, a.Filename, a.CreatedAt, blob)
+}
+
+// Remove an attachment: DELETE /items/{id}/attachments/{attachmentId}
+func (s *AttachmentService) remove(w http.ResponseWriter, r *http.Request) {
+        itemID, id, err := attachmentIDs(r)
+        if err != nil {
+                http.Error(w, "Invalid ID", http.StatusBadRequest)
+                return
+        }
+
+        result, err := itemDB(itemID).Exec("DELETE FROM attachments WHERE id = ? AND item_id = ? AND tenant_id = ?", id, itemID, requestTenant(r))
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        if n, _ := result.RowsAffected(); n == 0 {
+                http.NotFound(w, r)
+                return
+        }
+        if err := s.blobs.Delete(attachmentKey(itemID, id)); err != nil {
+                log.Printf("attachments: deleting blob %d: %v", id, err)
+        }
+
+        w.WriteHeader(http.StatusNoContent)
+}
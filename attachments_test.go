@@ -0,0 +1,119 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "mime/multipart"
+        "net/http"
+        "net/http/httptest"
+        "strconv"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// newAttachmentServer serves uploads and downloads from a fresh blob store
+func newAttachmentServer(e *testEnv) (*AttachmentService, *LocalBlobStore, *httptest.Server) {
+        e.t.Helper()
+        blobs, err := NewLocalBlobStore(e.t.TempDir())
+        if err != nil {
+                e.t.Fatal(err)
+        }
+        s := NewAttachmentService(blobs, 1<<20)
+        srv := e.serve(func(router *mux.Router) {
+                router.HandleFunc("/items/{id}/attachments", s.upload).Methods("POST")
+                router.HandleFunc("/items/{id}/attachments/{attachmentId}", s.download).Methods("GET")
+        })
+        return s, blobs, srv
+}
+
+func uploadAttachment(t *testing.T, srv *httptest.Server, itemID int, content string) Attachment {
+        t.Helper()
+        var body bytes.Buffer
+        mw := multipart.NewWriter(&body)
+        part, _ := mw.CreateFormFile("file", "notes.txt")
+        part.Write([]byte(content))
+        mw.Close()
+        resp, err := http.Post(srv.URL+"/items/"+strconv.Itoa(itemID)+"/attachments", mw.FormDataContentType(), &body)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusCreated {
+                t.Fatalf("upload: %d", resp.StatusCode)
+        }
+        var a Attachment
+        if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+                t.Fatal(err)
+        }
+        return a
+}
+
+func attachmentURL(srv *httptest.Server, a Attachment) string {
+        return srv.URL + "/items/" + strconv.Itoa(int(a.ItemID)) + "/attachments/" + strconv.Itoa(a.ID)
+}
+
+func TestLateDeleteKeepsAttachmentsOfRevertedItem(t *testing.T) {
+        s, _, srv := newAttachmentServer(newTestEnv(t))
+        actor := Actor{Tenant: defaultTenant}
+
+        item, err := insertItem(actor, Item{Name: "widget"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        old := uploadAttachment(t, srv, item.ID, "before the delete")
+        if err := removeItem(actor, item.ID); err != nil {
+                t.Fatal(err)
+        }
+        if _, err := revertItem(actor, item.ID, 1); err != nil {
+                t.Fatal(err)
+        }
+        current := uploadAttachment(t, srv, item.ID, "after the revert")
+
+        // The delete event arrives after the revert, and again on redelivery
+        deleted := ItemEvent{Type: EventItemDeleted, Tenant: defaultTenant, ItemID: item.ID}
+        s.Apply(deleted)
+        s.Apply(deleted)
+
+        if code, body := do(t, "GET", attachmentURL(srv, current), "", nil); code != http.StatusOK || body != "after the revert" {
+                t.Errorf("attachment made after the revert: %d %q", code, body)
+        }
+        if _, err := s.blobs.Open(attachmentKey(item.ID, old.ID)); err != errBlobNotFound {
+                t.Errorf("blob of the deleted attachment kept: %v", err)
+        }
+}
+
+func TestSweepRemovesAbandonedUploads(t *testing.T) {
+        e := newTestEnv(t)
+        s, blobs, srv := newAttachmentServer(e)
+        item, err := insertItem(Actor{Tenant: defaultTenant}, Item{Name: "widget"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        done := uploadAttachment(t, srv, item.ID, "finished")
+
+        // An upload the server stopped in the middle of: a row with no checksum
+        if _, err := e.DB.Exec("INSERT INTO attachments (id, tenant_id, item_id, filename, content_type, size, sha256, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+                900, defaultTenant, item.ID, "partial.txt", "text/plain", 0, "", time.Now().UTC().Add(-2*abandonedUploadAge)); err != nil {
+                t.Fatal(err)
+        }
+        if _, _, err := blobs.Put(attachmentKey(item.ID, 900), bytes.NewReader([]byte("part"))); err != nil {
+                t.Fatal(err)
+        }
+
+        if err := s.sweep(time.Now().Add(-abandonedUploadAge)); err != nil {
+                t.Fatal(err)
+        }
+        var n int
+        e.DB.QueryRow("SELECT COUNT(*) FROM attachments WHERE id = 900").Scan(&n)
+        if n != 0 {
+                t.Error("abandoned row kept")
+        }
+        if _, err := blobs.Open(attachmentKey(item.ID, 900)); err != errBlobNotFound {
+                t.Errorf("abandoned blob kept: %v", err)
+        }
+        if code, _ := do(t, "GET", attachmentURL(srv, done), "", nil); code != http.StatusOK {
+                t.Errorf("finished upload swept: %d", code)
+        }
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+        "context"
+        "crypto/rand"
+        "crypto/sha256"
+        "database/sql"
+        "encoding/hex"
+        "encoding/json"
+        "log"
+        "net/http"
+        "sort"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/gorilla/mux"
+        "google.golang.org/grpc"
+        "google.golang.org/grpc/metadata"
+        "google.golang.org/grpc/status"
+)
+
+// Hash the first entry chains from
+const auditGenesis = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// AuditEntry records one mutation attempt. Each entry's hash covers its
+// fields and the previous entry's hash, so editing or removing a row
+// breaks the chain from that point on.
+type AuditEntry struct {
+        ID         int64           `json:"id"`
+        Tenant     string          `json:"tenant"`
+        OccurredAt time.Time       `json:"occurred_at"`
+        Principal  string          `json:"principal"`
+        RequestID  string          `json:"request_id"`
+        Route      string          `json:"route"` // Method and route template, gRPC method or WebSocket op
+        ItemID     int             `json:"item_id,omitempty"`
+        Before     json.RawMessage `json:"before"`
+        After      json.RawMessage `json:"after"`
+        Outcome    string          `json:"outcome"` // success or failure
+        Status     string          `json:"status"`  // The revision written, or the HTTP status, gRPC code or error message of a failure
+        PrevHash   string          `json:"prev_hash"`
+        Hash       string          `json:"hash"`
+
+        tx *Tx // Where a pending entry was last written
+}
+
+// Whether a pending entry went in with the change it records
+func (e *AuditEntry) committed() bool {
+        return e.tx != nil && e.tx.committed
+}
+
+type auditKey struct{}
+
+// withAuditEntry carries a request's pending entry to the store, which
+// writes it in the transaction of each change the request makes
+func withAuditEntry(ctx context.Context, e *AuditEntry) context.Context {
+        return context.WithValue(ctx, auditKey{}, e)
+}
+
+func contextAuditEntry(ctx context.Context) *AuditEntry {
+        e, _ := ctx.Value(auditKey{}).(*AuditEntry)
+        return e
+}
+
+// Compute an entry's hash from everything but its ID and own hash
+func (e AuditEntry) computeHash() string {
+        e.ID = 0
+        e.Hash = ""
+        body, _ := json.Marshal(e)
+        sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), body...))
+        return hex.EncodeToString(sum[:])
+}
+
+// AuditLog appends entries to the audit_log table. Changes to items
+// write their entries in their own transaction, on the item's database;
+// the log appends attempts that changed nothing, and other requests,
+// once they finish. Each tenant has its own chain on each database.
+type AuditLog struct {
+        db *DB
+        mu sync.Mutex // Saves a round of lock waits on audit_heads within one process
+}
+
+// Create an audit log on db
+func NewAuditLog(db *DB) *AuditLog {
+        return &AuditLog{db: db}
+}
+
+// The databases holding entries: every one items are on
+func (a *AuditLog) dbs() []*DB {
+        if shards == nil {
+                return []*DB{a.db}
+        }
+        return itemDBs()
+}
+
+// Append chains an entry onto its tenant's log in a transaction of its own
+func (a *AuditLog) Append(e AuditEntry) error {
+        a.mu.Lock()
+        defer a.mu.Unlock()
+
+        tx, err := a.db.Begin()
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback()
+        if err := appendEntry(tx, &e); err != nil {
+                return err
+        }
+        return tx.Commit()
+}
+
+// appendEntry chains e onto its tenant's log within tx. The tenant's head
+// row is locked until tx ends, so appends from every instance form a
+// single chain.
+func appendEntry(tx *Tx, e *AuditEntry) error {
+        err := tx.QueryRow("SELECT hash FROM audit_heads WHERE tenant_id = ? FOR UPDATE", e.Tenant).Scan(&e.PrevHash)
+        if err == sql.ErrNoRows {
+                if _, err := tx.Exec("INSERT IGNORE INTO audit_heads (tenant_id, hash, since_id) VALUES (?, ?, 0)", e.Tenant, auditGenesis); err != nil {
+                        return err
+                }
+                err = tx.QueryRow("SELECT hash FROM audit_heads WHERE tenant_id = ? FOR UPDATE", e.Tenant).Scan(&e.PrevHash)
+        }
+        if err != nil {
+                return err
+        }
+        e.OccurredAt = e.OccurredAt.UTC().Truncate(time.Microsecond)
+        e.Hash = e.computeHash()
+
+        id, err := auditID(tx)
+        if err != nil {
+                return err
+        }
+        assigned, err := insertRow(tx, id, "audit_log", "tenant_id, occurred_at, principal, request_id, route, item_id, `before`, `after`, outcome, status, prev_hash, hash",
+                e.Tenant, e.OccurredAt, e.Principal, e.RequestID, e.Route, e.ItemID, nullJSON(e.Before), nullJSON(e.After), e.Outcome, e.Status, e.PrevHash, e.Hash)
+        if err != nil {
+                return err
+        }
+        e.ID = int64(assigned)
+        _, err = tx.Exec("UPDATE audit_heads SET hash = ? WHERE tenant_id = ?", e.Hash, e.Tenant)
+        return err
+}
+
+// auditID allocates an entry's ID. Sharded, entries are on every shard,
+// so they number from a counter on the main database, within tx when
+// that is where it runs, and Query can merge and page them by ID.
+func auditID(tx *Tx) (int, error) {
+        switch {
+        case shards == nil:
+                return 0, nil
+        case tx.db == shards.main:
+                return takeID(tx, "audit_log")
+        default:
+                return shards.nextID("audit_log")
+        }
+}
+
+// recordChange writes the pending entry of the actor's request, if any,
+// for a change to an item within the change's transaction. after is nil
+// for a delete.
+func recordChange(tx *Tx, actor Actor, action string, before, after *Item) error {
+        pending := actor.Audit
+        if pending == nil {
+                return nil
+        }
+        e := *pending
+        e.tx = nil
+        e.Outcome, e.Status = outcome(false), action
+        e.Before, e.After = auditSnapshot(before), auditSnapshot(after)
+        if after != nil {
+                e.ItemID = after.ID
+        } else if before != nil {
+                e.ItemID = before.ID
+        }
+        if err := appendEntry(tx, &e); err != nil {
+                return err
+        }
+        pending.ItemID, pending.tx = e.ItemID, tx
+        return nil
+}
+
+func auditSnapshot(item *Item) json.RawMessage {
+        if item == nil {
+                return nil
+        }
+        body, _ := json.Marshal(item)
+        return body
+}
+
+// Record appends an entry, logging rather than failing the caller
+func (a *AuditLog) Record(e AuditEntry) {
+        if a == nil {
+                return
+        }
+        if err := a.Append(e); err != nil {
+                log.Printf("audit: %s %s: %v", e.RequestID, e.Route, err)
+        }
+}
+
+func nullJSON(v json.RawMessage) interface{} {
+        if len(v) == 0 {
+                return nil
+        }
+        return string(v)
+}
+
+// AuditFilter selects one tenant's entries; other zero fields match everything
+type AuditFilter struct {
+        Tenant    string
+        From, To  time.Time
+        Principal string
+        ItemID    int
+        AfterID   int64 // Cursor: only entries with a larger ID
+        Limit     int
+}
+
+const auditColumns = "id, tenant_id, occurred_at, principal, request_id, route, item_id, `before`, `after`, outcome, status, prev_hash, hash"
+
+func scanAuditEntry(row scanner) (AuditEntry, error) {
+        var e AuditEntry
+        var before, after sql.NullString
+        err := row.Scan(&e.ID, &e.Tenant, &e.OccurredAt, &e.Principal, &e.RequestID, &e.Route, &e.ItemID, &before, &after, &e.Outcome, &e.Status, &e.PrevHash, &e.Hash)
+        if before.Valid {
+                e.Before = json.RawMessage(before.String)
+        }
+        if after.Valid {
+                e.After = json.RawMessage(after.String)
+        }
+        return e, err
+}
+
+// Query returns matching entries in log order
+func (a *AuditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+        conds := []string{"tenant_id = ?", "id > ?"}
+        args := []interface{}{f.Tenant, f.AfterID}
+        if !f.From.IsZero() {
+                conds = append(conds, "occurred_at >= ?")
+                args = append(args, f.From.UTC())
+        }
+        if !f.To.IsZero() {
+                conds = append(conds, "occurred_at < ?")
+                args = append(args, f.To.UTC())
+        }
+        if f.Principal != "" {
+                conds = append(conds, "principal = ?")
+                args = append(args, f.Principal)
+        }
+        if f.ItemID != 0 {
+                conds = append(conds, "item_id = ?")
+                args = append(args, f.ItemID)
+        }
+        args = append(args, f.Limit)
+
+        // Each database gives its first page; the first of those together
+        // are the page
+        entries := []AuditEntry{}
+        for _, conn := range a.dbs() {
+                rows, err := conn.Query("SELECT "+auditColumns+" FROM audit_log WHERE "+strings.Join(conds, " AND ")+" ORDER BY id LIMIT ?", args...)
+                if err != nil {
+                        return nil, err
+                }
+                for rows.Next() {
+                        e, err := scanAuditEntry(rows)
+                        if err != nil {
+                                rows.Close()
+                                return nil, err
+                        }
+                        entries = append(entries, e)
+                }
+                rows.Close()
+                if err := rows.Err(); err != nil {
+                        return nil, err
+                }
+        }
+        sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+        if len(entries) > f.Limit {
+                entries = entries[:f.Limit]
+        }
+        return entries, nil
+}
+
+// AuditVerification is the result of walking the chain
+type AuditVerification struct {
+        OK       bool   `json:"ok"`
+        Entries  int    `json:"entries"`
+        BrokenAt int64  `json:"broken_at,omitempty"` // First entry that does not chain
+        Reason   string `json:"reason,omitempty"`
+}
+
+// Verify walks a tenant's chain on each database, recomputing every hash
+// from the start up to the head, which also catches entries cut from the
+// end. Entries appended after the head is read are left for next time.
+func (a *AuditLog) Verify(tenant string) (AuditVerification, error) {
+        var result AuditVerification
+        for _, conn := range a.dbs() {
+                if ok, err := verifyChain(conn, tenant, &result); !ok || err != nil {
+                        return result, err
+                }
+        }
+        result.OK = true
+        return result, nil
+}
+
+// verifyChain checks one database's chain for tenant, adding to result
+func verifyChain(conn *DB, tenant string, result *AuditVerification) (bool, error) {
+        // Entries up to since_id were chained with other tenants' before
+        // each tenant had its own chain, and are not checked
+        var head string
+        var since int64
+        err := conn.QueryRow("SELECT hash, since_id FROM audit_heads WHERE tenant_id = ?", tenant).Scan(&head, &since)
+        if err == sql.ErrNoRows {
+                // No chain here, so there should be no entries either
+                var n int
+                if err := conn.QueryRow("SELECT COUNT(*) FROM audit_log WHERE tenant_id = ?", tenant).Scan(&n); err != nil {
+                        return false, err
+                }
+                if n > 0 {
+                        result.Reason = "entries with no recorded head"
+                        return false, nil
+                }
+                return true, nil
+        } else if err != nil {
+                return false, err
+        }
+
+        rows, err := conn.Query("SELECT "+auditColumns+" FROM audit_log WHERE tenant_id = ? AND id > ? ORDER BY id", tenant, since)
+        if err != nil {
+                return false, err
+        }
+        defer rows.Close()
+
+        prev := auditGenesis
+        for prev != head && rows.Next() {
+                e, err := scanAuditEntry(rows)
+                if err != nil {
+                        return false, err
+                }
+                result.Entries++
+                if e.PrevHash != prev {
+                        result.BrokenAt, result.Reason = e.ID, "previous hash does not match"
+                        return false, nil
+                }
+                if e.computeHash() != e.Hash {
+                        result.BrokenAt, result.Reason = e.ID, "entry hash does not match its contents"
+                        return false, nil
+                }
+                prev = e.Hash
+        }
+        if err := rows.Err(); err != nil {
+                return false, err
+        }
+        if prev != head {
+                result.Reason = "log ends before the recorded head"
+                return false, nil
+        }
+        return true, nil
+}
+
+// Snapshot an item for an entry; nil if it does not exist
+func auditItem(tenant string, id int) json.RawMessage {
+        item, err := loadItem(tenant, id)
+        if err != nil {
+                return nil
+        }
+        return auditSnapshot(&item)
+}
+
+// A request ID from the client, or a fresh one
+func requestID(id string) string {
+        if id != "" && len(id) <= 128 {
+                return id
+        }
+        b := make([]byte, 16)
+        rand.Read(b)
+        return hex.EncodeToString(b)
+}
+
+func outcome(failed bool) string {
+        if failed {
+                return "failure"
+        }
+        return "success"
+}
+
+// auditRecorder keeps the status
+type auditRecorder struct {
+        http.ResponseWriter
+        status int
+}
+
+func (rec *auditRecorder) WriteHeader(status int) {
+        rec.status = status
+        rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *auditRecorder) Flush() {
+        if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+                f.Flush()
+        }
+}
+
+// Middleware records every mutating request routed by mux. Changes to
+// items write their own entries; for anything else, routes under
+// /items/{id} log the item before and after, and others log what they
+// pass to auditResult. Response bodies are never logged, as some carry
+// secrets.
+func (a *AuditLog) Middleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+
+                entry := AuditEntry{
+                        Tenant:     requestTenant(r),
+                        OccurredAt: time.Now(),
+                        Principal:  requestPrincipal(r),
+                        RequestID:  requestID(r.Header.Get("X-Request-ID")),
+                        Route:      r.Method + " " + r.URL.Path,
+                }
+                w.Header().Set("X-Request-ID", entry.RequestID)
+
+                itemRoute := false
+                if route := mux.CurrentRoute(r); route != nil {
+                        if tmpl, err := route.GetPathTemplate(); err == nil {
+                                entry.Route = r.Method + " " + tmpl
+                                // The admin console edits items under /admin/items/{id}
+                                itemRoute = strings.HasPrefix(unversionedPath(strings.TrimPrefix(tmpl, "/admin")), "/items/{id}")
+                        }
+                }
+                if itemRoute {
+                        entry.ItemID, _ = strconv.Atoi(mux.Vars(r)["id"])
+                        entry.Before = auditItem(entry.Tenant, entry.ItemID)
+                }
+
+                rec := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+                pending := entry
+                next.ServeHTTP(rec, r.WithContext(withAuditEntry(r.Context(), &pending)))
+                if pending.committed() {
+                        return // Written with the change
+                }
+
+                entry.Status = strconv.Itoa(rec.status)
+                entry.Outcome = outcome(rec.status >= 400)
+                if itemRoute {
+                        entry.After = auditItem(entry.Tenant, entry.ItemID)
+                } else {
+                        entry.After = pending.After
+                }
+                a.Record(entry)
+        })
+}
+
+// auditResult sets what the entry for a route outside /items/{id} records
+// as its after value, so the handler chooses a view without secrets
+func auditResult(r *http.Request, v interface{}) {
+        if e := contextAuditEntry(r.Context()); e != nil {
+                e.After, _ = json.Marshal(v)
+        }
+}
+
+// Item ID carried by an ItemService request
+type itemIDRequest interface {
+        GetId() int64
+}
+
+// UnaryInterceptor records ItemService mutations made over gRPC
+func (a *AuditLog) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+        method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+        if a == nil || !strings.HasPrefix(info.FullMethod, "/items.v1.ItemService/") ||
+                !(strings.HasPrefix(method, "Create") || strings.HasPrefix(method, "Update") || strings.HasPrefix(method, "Delete")) {
+                return handler(ctx, req)
+        }
+
+        entry := AuditEntry{
+                Tenant:     contextTenant(ctx),
+                OccurredAt: time.Now(),
+                Principal:  contextPrincipal(ctx),
+                Route:      info.FullMethod,
+        }
+        if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-request-id")) > 0 {
+                entry.RequestID = requestID(md.Get("x-request-id")[0])
+        } else {
+                entry.RequestID = requestID("")
+        }
+        if r, ok := req.(itemIDRequest); ok {
+                entry.ItemID = int(r.GetId())
+                entry.Before = auditItem(entry.Tenant, entry.ItemID)
+        }
+
+        pending := entry
+        resp, err := handler(withAuditEntry(ctx, &pending), req)
+        if pending.committed() {
+                return resp, err
+        }
+
+        if record, ok := resp.(*ItemRecord); ok && err == nil {
+                entry.ItemID = int(record.GetId())
+        }
+        if entry.ItemID != 0 {
+                entry.After = auditItem(entry.Tenant, entry.ItemID)
+        }
+        entry.Status = status.Code(err).String()
+        entry.Outcome = outcome(err != nil)
+        a.Record(entry)
+        return resp, err
+}
+
+// Query the log: GET /audit?from=&to=&principal=&item_id=&after_id=&limit=
+func (a *AuditLog) serveQuery(w http.ResponseWriter, r *http.Request) {
+        q := r.URL.Query()
+        f := AuditFilter{Tenant: requestTenant(r), Principal: q.Get("principal"), Limit: 100}
+
+        var err error
+        for name, dst := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+                if v := q.Get(name); v != "" {
+                        if *dst, err = time.Parse(time.RFC3339Nano, v); err != nil {
+                                http.Error(w, name+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+                                return
+                        }
+                }
+        }
+        if v := q.Get("item_id"); v != "" {
+                if f.ItemID, err = strconv.Atoi(v); err != nil {
+                        http.Error(w, "Invalid item_id", http.StatusBadRequest)
+                        return
+                }
+        }
+        if v := q.Get("after_id"); v != "" {
+                if f.AfterID, err = strconv.ParseInt(v, 10, 64); err != nil {
+                        http.Error(w, "Invalid after_id", http.StatusBadRequest)
+                        return
+                }
+        }
+        if v := q.Get("limit"); v != "" {
+                n, err := strconv.Atoi(v)
+                if err != nil || n < 1 || n > 1000 {
+                        http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+                        return
+                }
+                f.Limit = n
+        }
+
+        entries, err := a.Query(f)
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(entries)
+}
+
+// Check the caller's tenant's hash chain: GET /audit/verify
+func (a *AuditLog) serveVerify(w http.ResponseWriter, r *http.Request) {
+        result, err := a.Verify(requestTenant(r))
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        if !result.OK {
+                w.WriteHeader(http.StatusConflict)
+        }
+        json.NewEncoder(w).Encode(result)
+}
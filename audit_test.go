@@ -0,0 +1,169 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "strconv"
+        "strings"
+        "testing"
+
+        "github.com/gorilla/mux"
+)
+
+func auditRoutes(router *mux.Router) {
+        router.HandleFunc("/items", createItem).Methods("POST")
+        router.HandleFunc("/items/{id}", updateItem).Methods("PUT")
+        router.HandleFunc("/audit", audit.serveQuery).Methods("GET")
+        router.HandleFunc("/audit/verify", audit.serveVerify).Methods("GET")
+}
+
+func auditEntries(t *testing.T, tenant string) []AuditEntry {
+        t.Helper()
+        entries, err := audit.Query(AuditFilter{Tenant: tenant, Limit: 100})
+        if err != nil {
+                t.Fatal(err)
+        }
+        return entries
+}
+
+// A change and its entry commit together, or neither does
+func TestAuditEntryCommitsWithTheChange(t *testing.T) {
+        e := newTestEnv(t)
+        srv := e.serve(auditRoutes)
+
+        code, body := do(t, "POST", srv.URL+"/items", `{"name":"widget"}`, map[string]string{"X-Request-ID": "create-1"})
+        var item Item
+        if code != http.StatusCreated || json.Unmarshal([]byte(body), &item) != nil {
+                t.Fatalf("create: %d %s", code, body)
+        }
+        entries := auditEntries(t, defaultTenant)
+        if len(entries) != 1 {
+                t.Fatalf("got %d entries, want 1", len(entries))
+        }
+        if e := entries[0]; e.RequestID != "create-1" || e.Route != "POST /items" || e.ItemID != item.ID ||
+                e.Outcome != "success" || e.Status != RevisionCreated || e.Before != nil || e.After == nil {
+                t.Errorf("entry %+v", e)
+        }
+
+        // A missing item is an attempt that changed nothing, recorded afterwards
+        if code, _ := do(t, "PUT", srv.URL+"/items/404", `{"name":"ghost"}`, nil); code != http.StatusNotFound {
+                t.Fatalf("update missing: %d", code)
+        }
+        if entries := auditEntries(t, defaultTenant); len(entries) != 2 || entries[1].Outcome != "failure" || entries[1].Status != "404" {
+                t.Fatalf("failure entry %+v", entries)
+        }
+
+        // When the entry cannot be written, the change is not made
+        if _, err := e.DB.Exec("DROP TABLE audit_heads"); err != nil {
+                t.Fatal(err)
+        }
+        url := srv.URL + "/items/" + strconv.Itoa(item.ID)
+        if code, _ := do(t, "PUT", url, `{"name":"gadget"}`, nil); code != http.StatusInternalServerError {
+                t.Errorf("update without an audit log: got %d, want 500", code)
+        }
+        if got, _ := loadItem(defaultTenant, item.ID); got.Name != "widget" {
+                t.Errorf("unaudited change made: %q", got.Name)
+        }
+}
+
+// A webhook's secret is only for whoever created it, so the log keeps the
+// webhook without it
+func TestAuditLeavesOutWebhookSecrets(t *testing.T) {
+        e := newTestEnv(t)
+        srv := e.serve(func(router *mux.Router) {
+                router.HandleFunc("/webhooks", newTestDispatcher(e.DB).createWebhook).Methods("POST")
+        })
+
+        hook := createTestWebhook(t, srv, "http://127.0.0.1:1/hook")
+        if hook.Secret == "" {
+                t.Fatal("no secret returned to the creator")
+        }
+        entries := auditEntries(t, defaultTenant)
+        if len(entries) != 1 || entries[0].Route != "POST /webhooks" || entries[0].Outcome != "success" {
+                t.Fatalf("entries %+v", entries)
+        }
+        var logged Webhook
+        if err := json.Unmarshal(entries[0].After, &logged); err != nil || logged.ID != hook.ID || logged.URL != hook.URL {
+                t.Errorf("after %s, %v", entries[0].After, err)
+        }
+        if raw, _ := json.Marshal(entries); strings.Contains(string(raw), hook.Secret) {
+                t.Errorf("secret in the log: %s", raw)
+        }
+}
+
+// Each tenant's chain verifies on its own, so one tenant can check its
+// log without reading another's, and damage to one leaves the other intact
+func TestAuditVerifyIsPerTenant(t *testing.T) {
+        e := newTestEnv(t, withTokens(""))
+        srv := e.serve(auditRoutes)
+
+        for _, tenant := range []string{"acme", "acme", "globex"} {
+                if code, body := do(t, "POST", srv.URL+"/items", `{"name":"widget"}`, bearer(tenant, "ann")); code != http.StatusCreated {
+                        t.Fatalf("create for %s: %d %s", tenant, code, body)
+                }
+        }
+
+        verify := func(tenant string) (int, AuditVerification) {
+                code, body := do(t, "GET", srv.URL+"/audit/verify", "", bearer(tenant, "ann"))
+                var result AuditVerification
+                if err := json.Unmarshal([]byte(body), &result); err != nil {
+                        t.Fatalf("verify for %s: %d %s", tenant, code, body)
+                }
+                return code, result
+        }
+        if code, result := verify("acme"); code != http.StatusOK || !result.OK || result.Entries != 2 {
+                t.Errorf("acme: %d %+v", code, result)
+        }
+
+        globex := auditEntries(t, "globex")
+        if _, err := e.DB.Exec("UPDATE audit_log SET principal = 'mallory' WHERE id = ?", globex[0].ID); err != nil {
+                t.Fatal(err)
+        }
+        if code, result := verify("globex"); code != http.StatusConflict || result.BrokenAt != globex[0].ID {
+                t.Errorf("globex after tampering: %d %+v", code, result)
+        }
+        if code, result := verify("acme"); code != http.StatusOK || !result.OK {
+                t.Errorf("acme after globex's log was damaged: %d %+v", code, result)
+        }
+}
+
+// Sharded, entries are written on the shard of the item they record and
+// numbered from the main database, so they merge into one page by ID
+func TestAuditEntriesAcrossShards(t *testing.T) {
+        e := newTestEnv(t)
+        shards = newTestShards(e)
+        if err := shards.syncCounters(); err != nil {
+                t.Fatal(err)
+        }
+        srv := e.serve(auditRoutes)
+
+        on := map[*DB]int{}
+        for i := 0; i < 20; i++ {
+                code, body := do(t, "POST", srv.URL+"/items", `{"name":"widget"}`, nil)
+                var item Item
+                if code != http.StatusCreated || json.Unmarshal([]byte(body), &item) != nil {
+                        t.Fatalf("create: %d %s", code, body)
+                }
+                on[itemDB(item.ID)]++
+        }
+        if len(on) != 2 {
+                t.Fatalf("items all on one shard: %v", on)
+        }
+
+        entries := auditEntries(t, defaultTenant)
+        if len(entries) != 20 {
+                t.Fatalf("got %d entries, want 20", len(entries))
+        }
+        for i := 1; i < len(entries); i++ {
+                if entries[i].ID <= entries[i-1].ID {
+                        t.Fatalf("entries out of order or sharing IDs: %d after %d", entries[i].ID, entries[i-1].ID)
+                }
+        }
+        page, err := audit.Query(AuditFilter{Tenant: defaultTenant, AfterID: entries[9].ID, Limit: 5})
+        if err != nil || len(page) != 5 || page[0].ID != entries[10].ID {
+                t.Errorf("second page %v, %v", page, err)
+        }
+        if result, err := audit.Verify(defaultTenant); err != nil || !result.OK || result.Entries != 20 {
+                t.Errorf("verify: %+v, %v", result, err)
+        }
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+        "crypto/sha256"
+        "encoding/hex"
+        "errors"
+        "io"
+        "os"
+        "path/filepath"
+        "strings"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps opaque file contents under slash-separated keys
+type BlobStore interface {
+        // Put writes r under key and returns its size and SHA-256
+        Put(key string, r io.Reader) (int64, string, error)
+        Open(key string) (io.ReadSeekCloser, error) // Seekable for range requests
+        Delete(key string) error
+        // List returns the keys of the blobs directly under prefix/
+        List(prefix string) ([]string, error)
+}
+
+// LocalBlobStore keeps blobs as files under a directory
+type LocalBlobStore struct {
+        root string
+}
+
+// Create a blob store rooted at dir, creating it if needed
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+        if err := os.MkdirAll(dir, 0o755); err != nil {
+                return nil, err
+        }
+        return &LocalBlobStore{root: dir}, nil
+}
+
+// Map a key to a file path, refusing keys that would escape the root
+func (s *LocalBlobStore) path(key string) (string, error) {
+        clean := filepath.Clean("/" + key)
+        if clean == "/" || strings.Contains(key, "..") {
+                return "", errors.New("invalid blob key")
+        }
+        return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+// Put writes to a temporary file first so readers never see a partial blob
+func (s *LocalBlobStore) Put(key string, r io.Reader) (int64, string, error) {
+        path, err := s.path(key)
+        if err != nil {
+                return 0, "", err
+        }
+        if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+                return 0, "", err
+        }
+
+        tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+        if err != nil {
+                return 0, "", err
+        }
+        defer os.Remove(tmp.Name()) // No-op once renamed
+
+        hash := sha256.New()
+        size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+        if err == nil {
+                err = tmp.Sync()
+        }
+        if cerr := tmp.Close(); err == nil {
+                err = cerr
+        }
+        if err != nil {
+                return 0, "", err
+        }
+        if err := os.Rename(tmp.Name(), path); err != nil {
+                return 0, "", err
+        }
+        return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *LocalBlobStore) Open(key string) (io.ReadSeekCloser, error) {
+        path, err := s.path(key)
+        if err != nil {
+                return nil, err
+        }
+        f, err := os.Open(path)
+        if os.IsNotExist(err) {
+                return nil, errBlobNotFound
+        }
+        return f, err
+}
+
+func (s *LocalBlobStore) Delete(key string) error {
+        path, err := s.path(key)
+        if err != nil {
+                return err
+        }
+        if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+                return err
+        }
+        return nil
+}
+
+func (s *LocalBlobStore) List(prefix string) ([]string, error) {
+        path, err := s.path(prefix)
+        if err != nil {
+                return nil, err
+        }
+        entries, err := os.ReadDir(path)
+        if os.IsNotExist(err) {
+                return nil, nil
+        } else if err != nil {
+                return nil, err
+        }
+        keys := []string{}
+        for _, e := range entries {
+                if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") { // Skip uploads in progress
+                        keys = append(keys, prefix+"/"+e.Name())
+                }
+        }
+        return keys, nil
+}
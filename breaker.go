@@ -0,0 +1,342 @@
+package main
+
+import (
+        "context"
+        "database/sql/driver"
+        "encoding/json"
+        "errors"
+        "io"
+        "log"
+        "math"
+        "math/rand"
+        "net"
+        "net/http"
+        "strconv"
+        "strings"
+        "sync"
+        "syscall"
+        "time"
+
+        "github.com/go-sql-driver/mysql"
+        "github.com/lib/pq"
+        "github.com/mattn/go-sqlite3"
+)
+
+type BreakerState int
+
+const (
+        BreakerClosed   BreakerState = iota // Calls go through
+        BreakerOpen                         // Calls fail fast until the cool-down ends
+        BreakerHalfOpen                     // One probe call decides whether to close
+)
+
+func (s BreakerState) String() string {
+        switch s {
+        case BreakerOpen:
+                return "open"
+        case BreakerHalfOpen:
+                return "half-open"
+        }
+        return "closed"
+}
+
+var errCircuitOpen = errors.New("database unavailable")
+
+// Guards the primary and every shard through their DB handles, and sets
+// how handlers retry; nil lets every call through once
+var dbBreaker *CircuitBreaker
+
+// CircuitBreaker stops calls to the database after threshold connection
+// failures in a row, so a flapping database is not hammered while it
+// recovers. After coolDown one probe call is let through: if it reaches
+// the database the breaker closes, otherwise it opens again.
+type CircuitBreaker struct {
+        name      string
+        threshold int
+        coolDown  time.Duration
+        retries   int           // Extra attempts at a transient error
+        backoff   time.Duration // Ceiling of the first retry's delay, doubled each retry
+        maxDelay  time.Duration
+
+        mu       sync.Mutex
+        state    BreakerState
+        failures int // Consecutive connection failures
+        lastErr  error
+        openedAt time.Time
+        probing  bool
+        trips    int
+}
+
+func NewCircuitBreaker(name string, threshold int, coolDown time.Duration) *CircuitBreaker {
+        return &CircuitBreaker{
+                name:      name,
+                threshold: threshold,
+                coolDown:  coolDown,
+                retries:   3,
+                backoff:   50 * time.Millisecond,
+                maxDelay:  time.Second,
+        }
+}
+
+// Do runs fn, retrying transient errors with jittered backoff. fn must be
+// safe to run again: a whole transaction, never a statement inside one.
+// It is not run again once a write may have gone through, such as when
+// the connection drops during COMMIT. While the breaker is open the DB
+// handles fail fn with errCircuitOpen, which is not retried.
+func (b *CircuitBreaker) Do(ctx context.Context, fn func() error) error {
+        if b == nil {
+                return fn()
+        }
+        for attempt := 0; ; attempt++ {
+                err := fn()
+                if err == nil || !retryable(err) || attempt == b.retries {
+                        return err
+                }
+
+                select {
+                case <-time.After(b.delay(attempt)):
+                case <-ctx.Done():
+                        return err
+                }
+        }
+}
+
+// Full jitter: anywhere up to the exponential delay, so callers that
+// failed together do not retry together
+func (b *CircuitBreaker) delay(attempt int) time.Duration {
+        d := b.backoff << attempt
+        if d > b.maxDelay || d <= 0 {
+                d = b.maxDelay
+        }
+        return time.Duration(rand.Int63n(int64(d)))
+}
+
+// allow lets a call through or fails it with errCircuitOpen. probe is
+// set for the one call let through to test a database that was out; its
+// outcome must be recorded as the probe's.
+func (b *CircuitBreaker) allow() (probe bool, err error) {
+        if b == nil {
+                return false, nil
+        }
+        b.mu.Lock()
+        defer b.mu.Unlock()
+
+        switch b.state {
+        case BreakerOpen:
+                if time.Since(b.openedAt) < b.coolDown {
+                        return false, errCircuitOpen
+                }
+                b.setState(BreakerHalfOpen)
+        case BreakerHalfOpen:
+                if b.probing {
+                        return false, errCircuitOpen
+                }
+        default:
+                return false, nil
+        }
+        b.probing = true
+        return true, nil
+}
+
+// record counts a call's outcome. Only connection failures count against
+// the database; any other answer, even an error, shows it is up. Only the
+// probe's own outcome lets the next probe through.
+func (b *CircuitBreaker) record(err error, probe bool) {
+        if b == nil {
+                return
+        }
+        b.mu.Lock()
+        defer b.mu.Unlock()
+
+        if probe {
+                b.probing = false
+        }
+        switch {
+        case isContextError(err):
+                // The caller gave up, which says nothing about the database
+        case connectionError(err):
+                b.failures++
+                b.lastErr = err
+                if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+                        b.openedAt = time.Now()
+                        b.trips++
+                        b.setState(BreakerOpen)
+                }
+        default:
+                b.failures = 0
+                b.setState(BreakerClosed)
+        }
+}
+
+// setState logs every change of state; b.mu must be held
+func (b *CircuitBreaker) setState(state BreakerState) {
+        if state == b.state {
+                return
+        }
+        if state == BreakerOpen {
+                log.Printf("breaker %s: %s -> open after %d failures, last: %v", b.name, b.state, b.failures, b.lastErr)
+        } else {
+                log.Printf("breaker %s: %s -> %s", b.name, b.state, state)
+        }
+        b.state = state
+}
+
+// Seconds until the breaker lets a probe through, for Retry-After
+func (b *CircuitBreaker) retryAfter() int {
+        if b == nil {
+                return 1
+        }
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        left := b.coolDown - time.Since(b.openedAt)
+        if b.state != BreakerOpen || left < time.Second {
+                return 1
+        }
+        return int(math.Ceil(left.Seconds()))
+}
+
+func (b *CircuitBreaker) serveStatus(w http.ResponseWriter, r *http.Request) {
+        b.mu.Lock()
+        status := struct {
+                Name      string     `json:"name"`
+                State     string     `json:"state"`
+                Failures  int        `json:"failures"`
+                Threshold int        `json:"threshold"`
+                Trips     int        `json:"trips"`
+                OpenedAt  *time.Time `json:"opened_at,omitempty"`
+                LastError string     `json:"last_error,omitempty"`
+        }{
+                Name:      b.name,
+                State:     b.state.String(),
+                Failures:  b.failures,
+                Threshold: b.threshold,
+                Trips:     b.trips,
+        }
+        if !b.openedAt.IsZero() {
+                openedAt := b.openedAt
+                status.OpenedAt = &openedAt
+        }
+        if b.lastErr != nil {
+                status.LastError = b.lastErr.Error()
+        }
+        b.mu.Unlock()
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(status)
+}
+
+// Write a database error: 503 with Retry-After while the database is out
+// of reach, so clients back off too, and 500 otherwise. What the database
+// said stays in the log, since it names tables and columns.
+func dbError(w http.ResponseWriter, err error) {
+        if err == errCircuitOpen || connectionError(err) {
+                log.Printf("database unavailable: %v", err)
+                w.Header().Set("Retry-After", strconv.Itoa(dbBreaker.retryAfter()))
+                http.Error(w, errCircuitOpen.Error(), http.StatusServiceUnavailable)
+                return
+        }
+        http.Error(w, dbErrorMessage(err), http.StatusInternalServerError)
+}
+
+// dbErrorMessage logs err and returns what a client may be told of it,
+// for replies other than an HTTP response
+func dbErrorMessage(err error) string {
+        if err == errCircuitOpen || connectionError(err) {
+                log.Printf("database unavailable: %v", err)
+                return errCircuitOpen.Error()
+        }
+        log.Printf("database error: %v", err)
+        return "Internal error; details are in the server log"
+}
+
+// outcomeUnknownError is a connection lost after a write was sent, which
+// the database may have applied. Running the write again could apply it
+// twice, so it is never retried.
+type outcomeUnknownError struct {
+        err error
+}
+
+func (e *outcomeUnknownError) Error() string { return e.err.Error() }
+func (e *outcomeUnknownError) Unwrap() error { return e.err }
+
+// Mark a write's connection failure as having an unknown outcome
+func outcomeUnknown(err error) error {
+        if connectionError(err) {
+                return &outcomeUnknownError{err}
+        }
+        return err
+}
+
+// Whether err may go away if the call is made again: lost connections and
+// lock conflicts the database resolved by giving up on one side. A
+// connection lost once a write was sent is not.
+func retryable(err error) bool {
+        var unknown *outcomeUnknownError
+        if errors.As(err, &unknown) {
+                return false
+        }
+        if connectionError(err) {
+                return true
+        }
+
+        var myErr *mysql.MySQLError
+        if errors.As(err, &myErr) {
+                return myErr.Number == 1213 || myErr.Number == 1205 // Deadlock, lock wait timeout
+        }
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) {
+                return pqErr.Code == "40001" || pqErr.Code == "40P01" // Serialization failure, deadlock
+        }
+        var liteErr sqlite3.Error
+        if errors.As(err, &liteErr) {
+                return liteErr.Code == sqlite3.ErrBusy || liteErr.Code == sqlite3.ErrLocked
+        }
+        return false
+}
+
+// Whether err is a unique constraint refusing a second row with the same key
+func duplicateKey(err error) bool {
+        var myErr *mysql.MySQLError
+        if errors.As(err, &myErr) {
+                return myErr.Number == 1062
+        }
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) {
+                return pqErr.Code == "23505"
+        }
+        var liteErr sqlite3.Error
+        if errors.As(err, &liteErr) {
+                return liteErr.ExtendedCode == sqlite3.ErrConstraintUnique || liteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+        }
+        // Errors from other shards arrive flattened to text
+        msg := err.Error()
+        return strings.Contains(msg, "Duplicate entry") || strings.Contains(msg, "duplicate key value") || strings.Contains(msg, "UNIQUE constraint failed")
+}
+
+// Whether err means the database could not be reached at all
+func connectionError(err error) bool {
+        if err == nil || isContextError(err) {
+                return false
+        }
+        if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+                errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+                errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+                return true
+        }
+        var netErr net.Error
+        if errors.As(err, &netErr) {
+                return true
+        }
+        // Errors from other shards arrive flattened to text
+        msg := err.Error()
+        for _, s := range []string{"connection refused", "connection reset", "broken pipe", "bad connection", "invalid connection"} {
+                if strings.Contains(msg, s) {
+                        return true
+                }
+        }
+        return false
+}
+
+func isContextError(err error) bool {
+        return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
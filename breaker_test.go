@@ -0,0 +1,93 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+)
+
+func TestBreakerOnlyProbeEndsProbing(t *testing.T) {
+        b := NewCircuitBreaker("test", 1, time.Millisecond)
+        b.record(io.EOF, false) // Opens at the threshold
+        time.Sleep(2 * time.Millisecond)
+
+        probe, err := b.allow()
+        if err != nil || !probe {
+                t.Fatalf("after the cool-down: %v, %v; want the probe", probe, err)
+        }
+        // A call that began before the breaker opened finishes meanwhile
+        b.record(context.Canceled, false)
+        if _, err := b.allow(); err != errCircuitOpen {
+                t.Errorf("second call let through while the probe is out: %v", err)
+        }
+        b.record(nil, true)
+        if probe, err := b.allow(); err != nil || probe {
+                t.Errorf("after a good probe: %v, %v; want closed", probe, err)
+        }
+}
+
+func TestBreakerRetriesOnlyBeforeCommit(t *testing.T) {
+        b := NewCircuitBreaker("test", 100, time.Second)
+        b.backoff = time.Microsecond
+
+        for _, tc := range []struct {
+                name  string
+                err   error
+                calls int
+        }{
+                {"connection lost before commit", io.ErrUnexpectedEOF, b.retries + 1},
+                {"connection lost during commit", outcomeUnknown(io.ErrUnexpectedEOF), 1},
+                {"breaker open", errCircuitOpen, 1},
+        } {
+                calls := 0
+                err := b.Do(context.Background(), func() error {
+                        calls++
+                        return tc.err
+                })
+                if calls != tc.calls || !errors.Is(err, io.ErrUnexpectedEOF) && err != errCircuitOpen {
+                        t.Errorf("%s: %d calls, %v; want %d calls", tc.name, calls, err, tc.calls)
+                }
+        }
+        if !connectionError(outcomeUnknown(io.EOF)) {
+                t.Errorf("unknown outcome no longer counts as a connection error")
+        }
+}
+
+func TestBreakerGuardsDB(t *testing.T) {
+        conn := newTestEnv(t).DB
+        conn.Breaker = NewCircuitBreaker("test", 1, time.Hour)
+        conn.Breaker.record(io.EOF, false)
+
+        var n int
+        if err := conn.QueryRow("SELECT COUNT(*) FROM items").Scan(&n); err != errCircuitOpen {
+                t.Errorf("query while open: %v, want errCircuitOpen", err)
+        }
+        if _, err := insertItem(Actor{Tenant: defaultTenant}, Item{Name: "widget"}); err != errCircuitOpen {
+                t.Errorf("insert while open: %v, want errCircuitOpen", err)
+        }
+}
+
+// Every route answers a failed query the same way, without what the
+// database said
+func TestDBErrorsStayInTheLog(t *testing.T) {
+        conn := newTestEnv(t).DB
+        if _, err := conn.Exec("DROP TABLE tags"); err != nil {
+                t.Fatal(err)
+        }
+        rec := httptest.NewRecorder()
+        getTags(rec, httptest.NewRequest("GET", "/tags", nil))
+        if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "tags") {
+                t.Errorf("got %d %q", rec.Code, rec.Body.String())
+        }
+
+        rec = httptest.NewRecorder()
+        dbError(rec, errCircuitOpen)
+        if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+                t.Errorf("circuit open: got %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+        }
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+        "container/list"
+        "encoding/json"
+        "math"
+        "math/rand"
+        "strconv"
+        "sync"
+        "time"
+)
+
+// CacheEntry is what a backend stores for a single item
+type CacheEntry struct {
+        Value   []byte        `json:"value"`   // JSON encoded Item
+        Delta   time.Duration `json:"delta"`   // How long the last load took
+        Expires time.Time     `json:"expires"` // Hard expiry
+}
+
+// CacheBackend is implemented by anything that can hold cache entries.
+// The in-memory LRU is the default; a shared store such as Redis or
+// memcached can be plugged in so several API instances share one cache.
+type CacheBackend interface {
+        Get(key string) (CacheEntry, bool)
+        Set(key string, entry CacheEntry)
+        Delete(key string)
+}
+
+// LRUCache is an in-memory CacheBackend with a fixed capacity
+type LRUCache struct {
+        mu       sync.Mutex
+        capacity int
+        order    *list.List // Front is most recently used
+        entries  map[string]*list.Element
+}
+
+type lruElement struct {
+        key   string
+        entry CacheEntry
+}
+
+// Create an LRU backend holding at most capacity entries
+func NewLRUCache(capacity int) *LRUCache {
+        return &LRUCache{
+                capacity: capacity,
+                order:    list.New(),
+                entries:  make(map[string]*list.Element),
+        }
+}
+
+func (c *LRUCache) Get(key string) (CacheEntry, bool) {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        el, ok := c.entries[key]
+        if !ok {
+                return CacheEntry{}, false
+        }
+        e := el.Value.(*lruElement)
+        if time.Now().After(e.entry.Expires) {
+                c.order.Remove(el)
+                delete(c.entries, key)
+                return CacheEntry{}, false
+        }
+        c.order.MoveToFront(el)
+        return e.entry, true
+}
+
+func (c *LRUCache) Set(key string, entry CacheEntry) {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        if el, ok := c.entries[key]; ok {
+                el.Value.(*lruElement).entry = entry
+                c.order.MoveToFront(el)
+                return
+        }
+        c.entries[key] = c.order.PushFront(&lruElement{key: key, entry: entry})
+
+        // Evict the least recently used entries once over capacity
+        for c.order.Len() > c.capacity {
+                oldest := c.order.Back()
+                c.order.Remove(oldest)
+                delete(c.entries, oldest.Value.(*lruElement).key)
+        }
+}
+
+func (c *LRUCache) Delete(key string) {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        if el, ok := c.entries[key]; ok {
+                c.order.Remove(el)
+                delete(c.entries, key)
+        }
+}
+
+// call is an in-flight or completed load shared by concurrent callers
+type call struct {
+        wg    sync.WaitGroup
+        item  Item
+        err   error
+        stale bool // Set when the key is invalidated mid-load
+}
+
+// ItemCache is a read-through cache in front of item lookups.
+// It protects the database from a thundering herd in two ways:
+//   - concurrent misses for the same key are coalesced into one load
+//   - entries are recomputed early with a probability that grows as
+//     they approach expiry (XFetch), so hot keys rarely expire at once
+type ItemCache struct {
+        backend CacheBackend
+        ttl     time.Duration
+        beta    float64 // > 1 favours earlier recomputation
+
+        mu       sync.Mutex
+        inflight map[string]*call
+}
+
+// Create an item cache on top of the given backend
+func NewItemCache(backend CacheBackend, ttl time.Duration) *ItemCache {
+        return &ItemCache{
+                backend:  backend,
+                ttl:      ttl,
+                beta:     1.0,
+                inflight: make(map[string]*call),
+        }
+}
+
+func itemKey(tenant string, id int) string {
+        return "item:" + tenant + ":" + strconv.Itoa(id)
+}
+
+// Get returns the item from cache, calling load on a miss or when the
+// entry is chosen for early recomputation
+func (c *ItemCache) Get(tenant string, id int, load func(string, int) (Item, error)) (Item, error) {
+        key := itemKey(tenant, id)
+
+        if entry, ok := c.backend.Get(key); ok && !c.shouldRecompute(entry) {
+                var item Item
+                if err := json.Unmarshal(entry.Value, &item); err == nil {
+                        item.Tenant = tenant
+                        return item, nil
+                }
+        }
+
+        return c.load(key, tenant, id, load)
+}
+
+// shouldRecompute implements probabilistic early expiration:
+// now - delta * beta * ln(rand) >= expiry
+func (c *ItemCache) shouldRecompute(entry CacheEntry) bool {
+        gap := float64(entry.Delta) * c.beta * -math.Log(rand.Float64())
+        return time.Now().Add(time.Duration(gap)).After(entry.Expires)
+}
+
+// load runs at most one loader per key; other callers wait for its result
+func (c *ItemCache) load(key, tenant string, id int, load func(string, int) (Item, error)) (Item, error) {
+        c.mu.Lock()
+        if cl, ok := c.inflight[key]; ok {
+                c.mu.Unlock()
+                cl.wg.Wait()
+                return cl.item, cl.err
+        }
+        cl := &call{}
+        cl.wg.Add(1)
+        c.inflight[key] = cl
+        c.mu.Unlock()
+
+        start := time.Now()
+        cl.item, cl.err = load(tenant, id)
+        delta := time.Since(start)
+
+        c.mu.Lock()
+        // Skip the write if the key was invalidated while we were loading,
+        // otherwise a stale row could be cached right after an update
+        if cl.err == nil && !cl.stale {
+                if value, err := json.Marshal(cl.item); err == nil {
+                        c.backend.Set(key, CacheEntry{
+                                Value:   value,
+                                Delta:   delta,
+                                Expires: time.Now().Add(c.ttl),
+                        })
+                }
+        }
+        if c.inflight[key] == cl {
+                delete(c.inflight, key)
+        }
+        c.mu.Unlock()
+        cl.wg.Done()
+
+        return cl.item, cl.err
+}
+
+// Invalidate drops the cached item after it was updated or deleted
+func (c *ItemCache) Invalidate(tenant string, id int) {
+        key := itemKey(tenant, id)
+
+        c.mu.Lock()
+        if cl, ok := c.inflight[key]; ok {
+                cl.stale = true
+                delete(c.inflight, key)
+        }
+        c.mu.Unlock()
+
+        c.backend.Delete(key)
+}
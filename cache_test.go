@@ -0,0 +1,116 @@
+package main
+
+import (
+        "sync"
+        "sync/atomic"
+        "testing"
+        "time"
+)
+
+// A stampede of misses for one key costs a single load
+func TestItemCacheCoalescesConcurrentMisses(t *testing.T) {
+        c := NewItemCache(NewLRUCache(10), time.Minute)
+        var loads int32
+        started, release := make(chan struct{}), make(chan struct{})
+        load := func(tenant string, id int) (Item, error) {
+                if atomic.AddInt32(&loads, 1) == 1 {
+                        close(started)
+                }
+                <-release
+                return Item{ID: id, Name: "widget"}, nil
+        }
+
+        const callers = 20
+        var wg sync.WaitGroup
+        got := make(chan Item, callers)
+        get := func() {
+                defer wg.Done()
+                item, err := c.Get("acme", 1, load)
+                if err != nil {
+                        t.Error(err)
+                }
+                got <- item
+        }
+        wg.Add(callers)
+        go get()
+        <-started // The first load is in flight; everyone else joins it
+        for i := 1; i < callers; i++ {
+                go get()
+        }
+        close(release)
+        wg.Wait()
+        close(got)
+
+        if n := atomic.LoadInt32(&loads); n != 1 {
+                t.Errorf("loaded %d times, want 1", n)
+        }
+        for item := range got {
+                if item.Name != "widget" {
+                        t.Errorf("got %+v", item)
+                }
+        }
+}
+
+// A load that was running when its item changed must not cache what it read
+func TestItemCacheInvalidateDuringLoad(t *testing.T) {
+        c := NewItemCache(NewLRUCache(10), time.Minute)
+        var loads int32
+        started, release := make(chan struct{}), make(chan struct{})
+        load := func(tenant string, id int) (Item, error) {
+                if atomic.AddInt32(&loads, 1) == 1 {
+                        close(started)
+                        <-release
+                        return Item{ID: id, Name: "before"}, nil
+                }
+                return Item{ID: id, Name: "after"}, nil
+        }
+
+        done := make(chan Item)
+        go func() {
+                item, _ := c.Get("acme", 1, load)
+                done <- item
+        }()
+        <-started
+        c.Invalidate("acme", 1)
+        close(release)
+        if item := <-done; item.Name != "before" {
+                t.Errorf("in-flight caller got %+v", item)
+        }
+
+        if item, _ := c.Get("acme", 1, load); item.Name != "after" || atomic.LoadInt32(&loads) != 2 {
+                t.Errorf("got %+v after %d loads; want the row read again", item, loads)
+        }
+}
+
+func TestItemCacheRecomputesNearExpiry(t *testing.T) {
+        c := NewItemCache(NewLRUCache(10), time.Minute)
+        if c.shouldRecompute(CacheEntry{Delta: time.Millisecond, Expires: time.Now().Add(time.Hour)}) {
+                t.Error("fresh entry recomputed")
+        }
+        if !c.shouldRecompute(CacheEntry{Delta: time.Millisecond, Expires: time.Now().Add(-time.Second)}) {
+                t.Error("expired entry served")
+        }
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+        c := NewLRUCache(2)
+        entry := CacheEntry{Value: []byte(`{}`), Expires: time.Now().Add(time.Minute)}
+        c.Set("a", entry)
+        c.Set("b", entry)
+        c.Get("a") // b is now the least recently used
+        c.Set("c", entry)
+
+        if _, ok := c.Get("b"); ok {
+                t.Error("least recently used entry kept")
+        }
+        for _, key := range []string{"a", "c"} {
+                if _, ok := c.Get(key); !ok {
+                        t.Errorf("%s evicted", key)
+                }
+        }
+
+        c.Set("d", CacheEntry{Value: []byte(`{}`), Expires: time.Now().Add(-time.Second)})
+        if _, ok := c.Get("d"); ok {
+                t.Error("expired entry returned")
+        }
+}
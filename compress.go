@@ -0,0 +1,208 @@
+package main
+
+import (
+        "bufio"
+        "compress/gzip"
+        "io"
+        "mime"
+        "net"
+        "net/http"
+        "strconv"
+        "strings"
+
+        "github.com/andybalholm/brotli"
+)
+
+// Encodings we can produce, most preferred first
+var compressEncodings = []string{"br", "gzip"}
+
+// compress negotiates Content-Encoding for responses of at least minSize bytes.
+// Smaller bodies, event streams and WebSocket upgrades pass through untouched.
+func compress(next http.Handler, minSize int) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.Header.Get("Upgrade") != "" {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+
+                addVary(w.Header(), "Accept-Encoding")
+                encoding := chooseEncoding(r.Header.Get("Accept-Encoding"))
+                if encoding == "" || r.Method == http.MethodHead {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+
+                cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize, status: http.StatusOK}
+                defer cw.Close()
+                next.ServeHTTP(cw, r)
+        })
+}
+
+// chooseEncoding picks the best supported coding from Accept-Encoding, or ""
+func chooseEncoding(header string) string {
+        best, bestQ := "", 0.0
+        for _, part := range strings.Split(header, ",") {
+                fields := strings.Split(strings.TrimSpace(part), ";")
+                coding := strings.ToLower(strings.TrimSpace(fields[0]))
+                q := 1.0
+                for _, param := range fields[1:] {
+                        param = strings.TrimSpace(param)
+                        if strings.HasPrefix(param, "q=") {
+                                if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+                                        q = v
+                                }
+                        }
+                }
+                if q <= 0 {
+                        continue
+                }
+
+                for _, supported := range compressEncodings {
+                        if coding != supported && coding != "*" {
+                                continue
+                        }
+                        // Prefer the higher q; on a tie keep the earlier (preferred) coding
+                        if q > bestQ || (q == bestQ && rank(supported) < rank(best)) {
+                                best, bestQ = supported, q
+                        }
+                        break
+                }
+        }
+        return best
+}
+
+func rank(encoding string) int {
+        for i, e := range compressEncodings {
+                if e == encoding {
+                        return i
+                }
+        }
+        return len(compressEncodings)
+}
+
+// compressWriter buffers the start of the body until it knows whether the
+// response is big enough to be worth compressing
+type compressWriter struct {
+        http.ResponseWriter
+        encoding string
+        minSize  int
+        status   int
+
+        buf     []byte
+        decided bool
+        enc     io.WriteCloser // Nil when passing through
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+        cw.status = status
+        if !cw.decided && !cw.compressible() {
+                cw.passThrough()
+        }
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+        if !cw.decided {
+                if !cw.compressible() {
+                        cw.passThrough()
+                } else {
+                        cw.buf = append(cw.buf, p...)
+                        if len(cw.buf) < cw.minSize {
+                                return len(p), nil
+                        }
+                        if err := cw.startCompression(); err != nil {
+                                return 0, err
+                        }
+                        return len(p), nil
+                }
+        }
+
+        if cw.enc != nil {
+                return cw.enc.Write(p)
+        }
+        return cw.ResponseWriter.Write(p)
+}
+
+// compressible reports whether the response so far could be compressed
+func (cw *compressWriter) compressible() bool {
+        h := cw.Header()
+        if h.Get("Content-Encoding") != "" {
+                return false
+        }
+        if cw.status < 200 || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+                return false
+        }
+        if cw.status == http.StatusPartialContent || h.Get("Content-Range") != "" {
+                return false // Ranges refer to the identity bytes
+        }
+        mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+        switch {
+        case mediaType == "text/event-stream":
+                return false // Compression would hold back events until the buffer fills
+        case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"),
+                mediaType == "application/zip", mediaType == "application/gzip":
+                return false // Already compressed
+        }
+        return true
+}
+
+func (cw *compressWriter) startCompression() error {
+        cw.decided = true
+        h := cw.Header()
+        h.Set("Content-Encoding", cw.encoding)
+        h.Del("Content-Length")
+        if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+                h.Set("ETag", "W/"+etag) // The bytes differ from the identity representation
+        }
+        cw.ResponseWriter.WriteHeader(cw.status)
+
+        if cw.encoding == "br" {
+                cw.enc = brotli.NewWriterLevel(cw.ResponseWriter, brotli.DefaultCompression)
+        } else {
+                cw.enc = gzip.NewWriter(cw.ResponseWriter)
+        }
+        _, err := cw.enc.Write(cw.buf)
+        cw.buf = nil
+        return err
+}
+
+// passThrough sends the headers and any buffered bytes uncompressed
+func (cw *compressWriter) passThrough() {
+        cw.decided = true
+        cw.ResponseWriter.WriteHeader(cw.status)
+        if len(cw.buf) > 0 {
+                cw.ResponseWriter.Write(cw.buf)
+                cw.buf = nil
+        }
+}
+
+// Flush sends what we have; a body flushed early is never compressed
+func (cw *compressWriter) Flush() {
+        if !cw.decided {
+                cw.passThrough()
+        }
+        if f, ok := cw.enc.(interface{ Flush() error }); ok {
+                f.Flush()
+        }
+        if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+                f.Flush()
+        }
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+        if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+                cw.decided = true
+                return h.Hijack()
+        }
+        return nil, nil, http.ErrNotSupported
+}
+
+// Close finishes the response once the handler returns
+func (cw *compressWriter) Close() error {
+        if !cw.decided {
+                cw.passThrough()
+        }
+        if cw.enc != nil {
+                return cw.enc.Close()
+        }
+        return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+        "bufio"
+        "bytes"
+        "compress/gzip"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/andybalholm/brotli"
+)
+
+func TestChooseEncoding(t *testing.T) {
+        for header, want := range map[string]string{
+                "":                          "",
+                "identity":                  "",
+                "gzip":                      "gzip",
+                "gzip, br":                  "br",
+                "br;q=0.5, gzip":            "gzip",
+                "br;q=0, gzip;q=0.1":        "gzip",
+                "*":                         "br",
+                "*;q=0.5, gzip;q=0.8":       "gzip",
+                "GZIP":                      "gzip",
+                "deflate, br;q=0, gzip;q=0": "",
+        } {
+                if got := chooseEncoding(header); got != want {
+                        t.Errorf("Accept-Encoding %q: got %q, want %q", header, got, want)
+                }
+        }
+}
+
+// serveCompressed runs one request through compress and returns the recording
+func serveCompressed(h http.HandlerFunc, acceptEncoding string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("GET", "/items", nil)
+        req.Header.Set("Accept-Encoding", acceptEncoding)
+        rec := httptest.NewRecorder()
+        compress(h, 1024).ServeHTTP(rec, req)
+        return rec
+}
+
+func decode(t *testing.T, encoding string, body io.Reader) string {
+        t.Helper()
+        var r io.Reader
+        switch encoding {
+        case "br":
+                r = brotli.NewReader(body)
+        case "gzip":
+                zr, err := gzip.NewReader(body)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                r = zr
+        default:
+                r = body
+        }
+        b, err := io.ReadAll(r)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return string(b)
+}
+
+func TestCompressLargeBodies(t *testing.T) {
+        body := `{"items":[` + strings.Repeat(`{"name":"widget"},`, 200) + `{}]}`
+        handler := func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Type", "application/json")
+                w.Header().Set("Content-Length", "0") // Stale once compressed
+                w.Header().Set("ETag", `"v1"`)
+                // Written in pieces that only pass the threshold together
+                for i := 0; i < len(body); i += 100 {
+                        io.WriteString(w, body[i:min(i+100, len(body))])
+                }
+        }
+
+        for accept, want := range map[string]string{"gzip, br": "br", "gzip": "gzip"} {
+                rec := serveCompressed(handler, accept)
+                h := rec.Header()
+                if got := h.Get("Content-Encoding"); got != want {
+                        t.Errorf("%s: Content-Encoding %q, want %q", accept, got, want)
+                        continue
+                }
+                if got := decode(t, want, rec.Body); got != body {
+                        t.Errorf("%s: body did not round-trip", accept)
+                }
+                if h.Get("Content-Length") != "" {
+                        t.Errorf("%s: Content-Length kept", accept)
+                }
+                if got := h.Get("ETag"); got != `W/"v1"` {
+                        t.Errorf("%s: ETag %q, want it weakened", accept, got)
+                }
+                if got := h.Get("Vary"); got != "Accept-Encoding" {
+                        t.Errorf("%s: Vary %q", accept, got)
+                }
+        }
+}
+
+func TestCompressPassesThrough(t *testing.T) {
+        large := strings.Repeat("x", 4096)
+        for _, tc := range []struct {
+                name    string
+                accept  string
+                handler http.HandlerFunc
+                body    string
+        }{
+                {"below the threshold", "br", func(w http.ResponseWriter, r *http.Request) {
+                        io.WriteString(w, "small")
+                }, "small"},
+                {"no acceptable coding", "identity", func(w http.ResponseWriter, r *http.Request) {
+                        io.WriteString(w, large)
+                }, large},
+                {"already encoded", "gzip", func(w http.ResponseWriter, r *http.Request) {
+                        w.Header().Set("Content-Encoding", "zstd")
+                        io.WriteString(w, large)
+                }, large},
+                {"image", "gzip", func(w http.ResponseWriter, r *http.Request) {
+                        w.Header().Set("Content-Type", "image/png")
+                        io.WriteString(w, large)
+                }, large},
+                {"range", "gzip", func(w http.ResponseWriter, r *http.Request) {
+                        w.Header().Set("Content-Range", "bytes 0-4095/8192")
+                        w.WriteHeader(http.StatusPartialContent)
+                        io.WriteString(w, large)
+                }, large},
+                {"not modified", "gzip", func(w http.ResponseWriter, r *http.Request) {
+                        w.WriteHeader(http.StatusNotModified)
+                }, ""},
+        } {
+                rec := serveCompressed(tc.handler, tc.accept)
+                if enc := rec.Header().Get("Content-Encoding"); enc != "" && enc != "zstd" {
+                        t.Errorf("%s: compressed with %s", tc.name, enc)
+                }
+                if rec.Body.String() != tc.body {
+                        t.Errorf("%s: body changed", tc.name)
+                }
+                if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+                        t.Errorf("%s: Vary %q", tc.name, got)
+                }
+        }
+}
+
+// An event stream must reach the client as each event is flushed, not
+// once the compressor's buffer fills or the handler returns
+func TestCompressFlushesEventStreams(t *testing.T) {
+        release := make(chan struct{})
+        srv := httptest.NewServer(compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Type", "text/event-stream")
+                io.WriteString(w, "data: first\n\n")
+                w.(http.Flusher).Flush()
+                <-release
+        }), 1024))
+        defer srv.Close()
+        defer close(release)
+
+        req, _ := http.NewRequest("GET", srv.URL, nil)
+        req.Header.Set("Accept-Encoding", "br, gzip")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+                t.Errorf("event stream compressed with %s", enc)
+        }
+
+        line := make(chan string, 1)
+        go func() {
+                s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+                line <- s
+        }()
+        select {
+        case got := <-line:
+                if got != "data: first\n" {
+                        t.Errorf("got %q", got)
+                }
+        case <-time.After(5 * time.Second):
+                t.Fatal("flushed event did not reach the client")
+        }
+}
+
+// A body flushed before it reaches the threshold goes out uncompressed
+func TestCompressEarlyFlushPassesThrough(t *testing.T) {
+        rec := serveCompressed(func(w http.ResponseWriter, r *http.Request) {
+                io.WriteString(w, "partial ")
+                w.(http.Flusher).Flush()
+                io.WriteString(w, strings.Repeat("x", 2048))
+        }, "gzip")
+        if !rec.Flushed {
+                t.Error("flush did not reach the underlying writer")
+        }
+        if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+                t.Errorf("compressed with %s after an early flush", enc)
+        }
+        if !bytes.HasPrefix(rec.Body.Bytes(), []byte("partial x")) {
+                t.Errorf("body %.20q", rec.Body.String())
+        }
+}
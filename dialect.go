@@ -0,0 +1,206 @@
+package main
+
+import (
+        "context"
+        "database/sql"
+        "strings"
+)
+
+// Dialect hides the differences between SQL backends. Queries across the
+// service are written once in MySQL syntax, with ? placeholders and
+// backtick-quoted identifiers, and each dialect rebinds them.
+type Dialect interface {
+        Name() string
+        // Rebind rewrites a MySQL-syntax query for this backend
+        Rebind(query string) string
+        // Returning reports whether inserts read their ID back with RETURNING
+        // rather than LastInsertId
+        Returning() bool
+        // MigrationsTable creates the table recording applied migrations
+        MigrationsTable() string
+        // Migrations lists schema changes in the same versions as every other dialect
+        Migrations() []string
+}
+
+// MySQL is the reference dialect, so queries pass through unchanged
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string               { return "mysql" }
+func (mysqlDialect) Rebind(query string) string { return query }
+func (mysqlDialect) Returning() bool            { return false }
+func (mysqlDialect) Migrations() []string       { return migrations }
+
+func (mysqlDialect) MigrationsTable() string {
+        return `CREATE TABLE IF NOT EXISTS schema_migrations (
+                version INT PRIMARY KEY,
+                applied_at DATETIME(6) NOT NULL
+        )`
+}
+
+// DB is a database handle that rebinds queries for its dialect. Every
+// call goes through its breaker, so all callers fail fast alike while the
+// database is out of reach.
+type DB struct {
+        *sql.DB
+        Dialect Dialect
+        Breaker *CircuitBreaker // nil lets every call through
+}
+
+// Open a database by DSN. postgres:// and postgresql:// URLs use Postgres,
+// sqlite:// paths use SQLite; anything else is taken as a MySQL DSN.
+func openDB(dsn string) (*DB, error) {
+        driver, dialect := "mysql", Dialect(mysqlDialect{})
+        switch {
+        case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+                driver, dialect = "postgres", postgresDialect{}
+        case strings.HasPrefix(dsn, "sqlite://"):
+                driver, dialect = "sqlite3", sqliteDialect{}
+                var err error
+                if dsn, err = sqliteDSN(dsn); err != nil {
+                        return nil, err
+                }
+        }
+        conn, err := sql.Open(driver, dsn)
+        if err != nil {
+                return nil, err
+        }
+        return &DB{DB: conn, Dialect: dialect}, nil
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+        return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+        probe, err := db.Breaker.allow()
+        if err != nil {
+                return nil, err
+        }
+        result, err := db.DB.ExecContext(ctx, db.Dialect.Rebind(query), args...)
+        db.Breaker.record(err, probe)
+        return result, outcomeUnknown(err)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+        return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+        probe, err := db.Breaker.allow()
+        if err != nil {
+                return nil, err
+        }
+        rows, err := db.DB.QueryContext(ctx, db.Dialect.Rebind(query), args...)
+        db.Breaker.record(err, probe)
+        return rows, err
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *Row {
+        probe, err := db.Breaker.allow()
+        if err != nil {
+                return &Row{err: err}
+        }
+        return &Row{row: db.DB.QueryRow(db.Dialect.Rebind(query), args...), breaker: db.Breaker, probe: probe}
+}
+
+// InsertID runs an INSERT and returns the new row's id
+func (db *DB) InsertID(query string, args ...interface{}) (int64, error) {
+        probe, err := db.Breaker.allow()
+        if err != nil {
+                return 0, err
+        }
+        id, err := insertID(db.DB, db.Dialect, query, args)
+        db.Breaker.record(err, probe)
+        return id, outcomeUnknown(err)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+        probe, err := db.Breaker.allow()
+        if err != nil {
+                return nil, err
+        }
+        tx, err := db.DB.Begin()
+        db.Breaker.record(err, probe)
+        if err != nil {
+                return nil, err
+        }
+        return &Tx{Tx: tx, Dialect: db.Dialect, db: db}, nil
+}
+
+// Tx is a transaction that rebinds queries for its dialect. Its
+// statements already hold a connection, so the breaker only hears how
+// they went.
+type Tx struct {
+        *sql.Tx
+        Dialect   Dialect
+        db        *DB  // Where it began
+        committed bool // Known to have committed
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+        result, err := tx.Tx.Exec(tx.Dialect.Rebind(query), args...)
+        tx.db.Breaker.record(err, false)
+        return result, err
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+        rows, err := tx.Tx.Query(tx.Dialect.Rebind(query), args...)
+        tx.db.Breaker.record(err, false)
+        return rows, err
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *Row {
+        return &Row{row: tx.Tx.QueryRow(tx.Dialect.Rebind(query), args...), breaker: tx.db.Breaker}
+}
+
+// InsertID runs an INSERT and returns the new row's id
+func (tx *Tx) InsertID(query string, args ...interface{}) (int64, error) {
+        id, err := insertID(tx.Tx, tx.Dialect, query, args)
+        tx.db.Breaker.record(err, false)
+        return id, err
+}
+
+// Commit reports a lost connection as an unknown outcome: the database
+// may have committed before it went
+func (tx *Tx) Commit() error {
+        err := tx.Tx.Commit()
+        tx.db.Breaker.record(err, false)
+        tx.committed = err == nil
+        return outcomeUnknown(err)
+}
+
+// Row is the result of QueryRow, whose error reaches the breaker on Scan
+type Row struct {
+        row     *sql.Row
+        err     error // Set when the breaker turned the query away
+        breaker *CircuitBreaker
+        probe   bool
+}
+
+func (r *Row) Scan(dest ...interface{}) error {
+        if r.err != nil {
+                return r.err
+        }
+        err := r.row.Scan(dest...)
+        r.breaker.record(err, r.probe)
+        return err
+}
+
+// What *sql.DB and *sql.Tx have in common
+type execQuerier interface {
+        Exec(query string, args ...interface{}) (sql.Result, error)
+        QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func insertID(conn execQuerier, dialect Dialect, query string, args []interface{}) (int64, error) {
+        if dialect.Returning() {
+                var id int64
+                err := conn.QueryRow(dialect.Rebind(query)+" RETURNING id", args...).Scan(&id)
+                return id, err
+        }
+        result, err := conn.Exec(dialect.Rebind(query), args...)
+        if err != nil {
+                return 0, err
+        }
+        return result.LastInsertId()
+}
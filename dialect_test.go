@@ -0,0 +1,78 @@
+package main
+
+import (
+        "path/filepath"
+        "testing"
+)
+
+func TestPostgresRebind(t *testing.T) {
+        for query, want := range map[string]string{
+                "SELECT id FROM items WHERE id = ? AND tenant_id = ?": "SELECT id FROM items WHERE id = $1 AND tenant_id = $2",
+                "SELECT `desc` FROM items WHERE name = ?":             `SELECT "desc" FROM items WHERE name = $1`,
+                // Placeholders and backticks inside string literals are data
+                "SELECT '?', '`x`', 'it''s ?' FROM items WHERE id = ?":         "SELECT '?', '`x`', 'it''s ?' FROM items WHERE id = $1",
+                "INSERT IGNORE INTO item_tags (item_id, tag_id) VALUES (?, ?)": "INSERT INTO item_tags (item_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+                "INSERT INTO items (name, `desc`) VALUES (?, ?)":               `INSERT INTO items (name, "desc") VALUES ($1, $2)`,
+                "SELECT id FROM items WHERE id = ? FOR UPDATE":                 "SELECT id FROM items WHERE id = $1 FOR UPDATE",
+                "UPDATE items SET name = 'INSERT IGNORE ' WHERE id = ?":        "UPDATE items SET name = 'INSERT IGNORE ' WHERE id = $1",
+                // Locking clauses stay where MySQL puts them, which Postgres also takes
+                "SELECT revision FROM item_revisions WHERE item_id = ? ORDER BY revision LIMIT 1 FOR UPDATE": "SELECT revision FROM item_revisions WHERE item_id = $1 ORDER BY revision LIMIT 1 FOR UPDATE",
+                "SELECT COUNT(*) FROM (SELECT id FROM items WHERE tenant_id = ? FOR UPDATE) locked":          "SELECT COUNT(*) FROM (SELECT id FROM items WHERE tenant_id = $1 FOR UPDATE) locked",
+        } {
+                if got := (postgresDialect{}).Rebind(query); got != want {
+                        t.Errorf("Rebind(%q)\n got %q\nwant %q", query, got, want)
+                }
+        }
+}
+
+func TestSQLiteRebind(t *testing.T) {
+        for query, want := range map[string]string{
+                "SELECT `desc` FROM items WHERE id = ?":                                             "SELECT `desc` FROM items WHERE id = ?",
+                "INSERT IGNORE INTO item_tags (item_id, tag_id) VALUES (?, ?)":                      "INSERT OR IGNORE INTO item_tags (item_id, tag_id) VALUES (?, ?)",
+                "SELECT id FROM items WHERE id = ? FOR UPDATE":                                      "SELECT id FROM items WHERE id = ?",
+                "SELECT COUNT(*) FROM (SELECT id FROM items WHERE tenant_id = ? FOR UPDATE) locked": "SELECT COUNT(*) FROM (SELECT id FROM items WHERE tenant_id = ?) locked",
+        } {
+                if got := (sqliteDialect{}).Rebind(query); got != want {
+                        t.Errorf("Rebind(%q)\n got %q\nwant %q", query, got, want)
+                }
+        }
+}
+
+// returningDialect is SQLite reading inserted IDs back as Postgres does
+type returningDialect struct{ sqliteDialect }
+
+func (returningDialect) Returning() bool { return true }
+
+func TestInsertIDReturning(t *testing.T) {
+        conn, err := openDB("sqlite://" + filepath.Join(t.TempDir(), "r.db"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        if _, err := conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY AUTOINCREMENT, `desc` TEXT)"); err != nil {
+                t.Fatal(err)
+        }
+
+        // Each insert's ID is one more than the last, whichever way it is read
+        var last int64
+        for _, d := range []Dialect{sqliteDialect{}, returningDialect{}} {
+                conn.Dialect = d
+                id, err := conn.InsertID("INSERT INTO t (`desc`) VALUES (?)", "direct")
+                if err != nil || id != last+1 {
+                        t.Errorf("returning %v: got %d, %v; want %d", d.Returning(), id, err, last+1)
+                }
+
+                tx, err := conn.Begin()
+                if err != nil {
+                        t.Fatal(err)
+                }
+                id, err = tx.InsertID("INSERT INTO t (`desc`) VALUES (?)", "in a transaction")
+                if err != nil || id != last+2 {
+                        t.Errorf("returning %v in a transaction: got %d, %v; want %d", d.Returning(), id, err, last+2)
+                }
+                if err := tx.Commit(); err != nil {
+                        t.Fatal(err)
+                }
+                last += 2
+        }
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "fmt"
+        "io"
+        "net/http"
+        "os"
+        "sync"
+        "time"
+)
+
+// Event types emitted when items change
+const (
+        EventItemCreated = "item.created"
+        EventItemUpdated = "item.updated"
+        EventItemDeleted = "item.deleted"
+)
+
+// ItemEvent describes a single change to an item
+type ItemEvent struct {
+        ID         int64     `json:"id"` // Outbox row ID, increases monotonically
+        Tenant     string    `json:"-"`  // Subscribers only see their own tenant's events
+        Type       string    `json:"type"`
+        ItemID     int       `json:"item_id"`
+        Item       *Item     `json:"item,omitempty"` // State after the change, or the deleted row
+        OccurredAt time.Time `json:"occurred_at"`
+}
+
+// EventSink receives events from the outbox relay.
+// Publish may be called more than once for the same event, so
+// consumers should de-duplicate on ItemEvent.ID. IDs are taken when the
+// row is inserted but rows commit in any order, so an event can follow
+// one with a higher ID: compare against the IDs seen, not the highest.
+type EventSink interface {
+        Publish(ctx context.Context, event ItemEvent) error
+}
+
+// WriterSink writes one JSON event per line
+type WriterSink struct {
+        mu sync.Mutex
+        w  io.Writer
+}
+
+// Create a sink that prints events to stdout
+func NewStdoutSink() *WriterSink {
+        return &WriterSink{w: os.Stdout}
+}
+
+// Create a sink that appends events to a file
+func NewFileSink(path string) (*WriterSink, error) {
+        f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+        if err != nil {
+                return nil, err
+        }
+        return &WriterSink{w: f}, nil
+}
+
+func (s *WriterSink) Publish(ctx context.Context, event ItemEvent) error {
+        line, err := json.Marshal(event)
+        if err != nil {
+                return err
+        }
+
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        _, err = s.w.Write(append(line, '\n'))
+        return err
+}
+
+// WebhookSink POSTs each event as JSON to a URL
+type WebhookSink struct {
+        URL    string
+        Client *http.Client
+}
+
+// Create a sink that posts events to url
+func NewWebhookSink(url string) *WebhookSink {
+        return &WebhookSink{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *WebhookSink) Publish(ctx context.Context, event ItemEvent) error {
+        body, err := json.Marshal(event)
+        if err != nil {
+                return err
+        }
+
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+        if err != nil {
+                return err
+        }
+        req.Header.Set("Content-Type", "application/json")
+
+        resp, err := s.Client.Do(req)
+        if err != nil {
+                return err
+        }
+        defer resp.Body.Close()
+        io.Copy(io.Discard, resp.Body)
+
+        if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+                return fmt.Errorf("webhook %s returned %s", s.URL, resp.Status)
+        }
+        return nil
+}
+
+// How many recent event IDs a subscriber remembers to drop repeats.
+// Repeats come from the relay retrying a batch, so they are never far
+// behind the first delivery.
+const seenEventsSize = 4096
+
+// seenEvents remembers the last few thousand event IDs. It is not safe
+// for concurrent use.
+type seenEvents struct {
+        ids   map[int64]struct{}
+        order []int64 // Ring of the remembered IDs, oldest at next
+        next  int
+}
+
+func newSeenEvents(size int) *seenEvents {
+        return &seenEvents{ids: make(map[int64]struct{}, size), order: make([]int64, 0, size)}
+}
+
+// add records id and reports whether it is new
+func (s *seenEvents) add(id int64) bool {
+        if _, ok := s.ids[id]; ok {
+                return false
+        }
+        if len(s.order) < cap(s.order) {
+                s.order = append(s.order, id)
+        } else {
+                delete(s.ids, s.order[s.next])
+                s.order[s.next] = id
+                s.next = (s.next + 1) % len(s.order)
+        }
+        s.ids[id] = struct{}{}
+        return true
+}
+
+// EventBus delivers events to in-process subscribers.
+// Handlers run on the publisher's goroutine and must not block.
+type EventBus struct {
+        mu       sync.RWMutex
+        nextID   int
+        handlers map[int]func(ItemEvent)
+}
+
+// Create an empty event bus
+func NewEventBus() *EventBus {
+        return &EventBus{handlers: make(map[int]func(ItemEvent))}
+}
+
+// Subscribe registers fn and returns a function that removes it
+func (b *EventBus) Subscribe(fn func(ItemEvent)) func() {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+
+        id := b.nextID
+        b.nextID++
+        b.handlers[id] = fn
+
+        return func() {
+                b.mu.Lock()
+                defer b.mu.Unlock()
+                delete(b.handlers, id)
+        }
+}
+
+func (b *EventBus) Publish(ctx context.Context, event ItemEvent) error {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+
+        for _, fn := range b.handlers {
+                fn(event)
+        }
+        return nil
+}
+
+// MultiSink publishes to every sink and fails if any of them fails
+type MultiSink []EventSink
+
+func (m MultiSink) Publish(ctx context.Context, event ItemEvent) error {
+        for _, sink := range m {
+                if err := sink.Publish(ctx, event); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+        "crypto"
+        "crypto/rand"
+        "crypto/rsa"
+        "crypto/sha256"
+        "crypto/subtle"
+        "encoding/base64"
+        "encoding/json"
+        "math/big"
+        "net/http"
+        "net/url"
+        "strings"
+        "sync"
+        "time"
+)
+
+// FakeIdP is an OpenID Connect provider for tests, so the whole login
+// flow runs without the company IdP or a network. It signs everyone in
+// without asking: as the login_hint if the client sends one, otherwise as
+// DefaultUser, in the tenant Tenants maps them to. It only knows one
+// client, and insists on PKCE.
+type FakeIdP struct {
+        Issuer       string
+        ClientID     string
+        ClientSecret string
+        DefaultUser  string
+        Tenants      map[string]string // Tenant claim by user; none for the default tenant
+        AccessTTL    time.Duration     // How long access tokens last
+
+        mu      sync.Mutex
+        keys    []fakeIdPKey // Newest first; older ones stay published after a rotation
+        codes   map[string]fakeIdPGrant
+        refresh map[string]fakeIdPGrant
+}
+
+type fakeIdPKey struct {
+        id  string
+        key *rsa.PrivateKey
+}
+
+// What a code or refresh token was issued for
+type fakeIdPGrant struct {
+        user        string
+        redirectURI string
+        challenge   string
+        nonce       string
+        expires     time.Time
+}
+
+func NewFakeIdP(issuer, clientID, clientSecret string) (*FakeIdP, error) {
+        idp := &FakeIdP{
+                Issuer:       strings.TrimSuffix(issuer, "/"),
+                ClientID:     clientID,
+                ClientSecret: clientSecret,
+                DefaultUser:  "alice",
+                Tenants:      map[string]string{},
+                AccessTTL:    5 * time.Minute,
+                codes:        map[string]fakeIdPGrant{},
+                refresh:      map[string]fakeIdPGrant{},
+        }
+        if err := idp.RotateKey(); err != nil {
+                return nil, err
+        }
+        return idp, nil
+}
+
+// RotateKey signs new tokens with a new key. The old key stays in the
+// JWKS, as a real provider's does until tokens signed with it expire.
+func (idp *FakeIdP) RotateKey() error {
+        key, err := rsa.GenerateKey(rand.Reader, 2048)
+        if err != nil {
+                return err
+        }
+        idp.mu.Lock()
+        defer idp.mu.Unlock()
+        idp.keys = append([]fakeIdPKey{{id: randomToken()[:16], key: key}}, idp.keys...)
+        return nil
+}
+
+// Revoke ends user's refresh tokens, as if an administrator disabled them
+func (idp *FakeIdP) Revoke(user string) {
+        idp.mu.Lock()
+        defer idp.mu.Unlock()
+        for token, grant := range idp.refresh {
+                if grant.user == user {
+                        delete(idp.refresh, token)
+                }
+        }
+}
+
+func (idp *FakeIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/.well-known/openid-configuration":
+                idp.serveDiscovery(w, r)
+        case "/authorize":
+                idp.serveAuthorize(w, r)
+        case "/token":
+                idp.serveToken(w, r)
+        case "/keys":
+                idp.serveKeys(w, r)
+        default:
+                http.NotFound(w, r)
+        }
+}
+
+func (idp *FakeIdP) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "issuer":                                idp.Issuer,
+                "authorization_endpoint":                idp.Issuer + "/authorize",
+                "token_endpoint":                        idp.Issuer + "/token",
+                "jwks_uri":                              idp.Issuer + "/keys",
+                "response_types_supported":              []string{"code"},
+                "grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+                "subject_types_supported":               []string{"public"},
+                "id_token_signing_alg_values_supported": []string{"RS256"},
+                "code_challenge_methods_supported":      []string{"S256"},
+                "scopes_supported":                      []string{"openid", "email", "profile", "offline_access"},
+        })
+}
+
+func (idp *FakeIdP) serveKeys(w http.ResponseWriter, r *http.Request) {
+        idp.mu.Lock()
+        keys := []map[string]string{}
+        for _, k := range idp.keys {
+                keys = append(keys, map[string]string{
+                        "kty": "RSA",
+                        "use": "sig",
+                        "alg": "RS256",
+                        "kid": k.id,
+                        "n":   base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+                        "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+                })
+        }
+        idp.mu.Unlock()
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// Sign the user in straight away and send the browser back with a code
+func (idp *FakeIdP) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+        q := r.URL.Query()
+        redirectURI, err := url.Parse(q.Get("redirect_uri"))
+        if err != nil || !redirectURI.IsAbs() || q.Get("client_id") != idp.ClientID {
+                // Never redirect to a URI we cannot vouch for
+                http.Error(w, "unknown client or redirect_uri", http.StatusBadRequest)
+                return
+        }
+        reply := func(params url.Values) {
+                params.Set("state", q.Get("state"))
+                redirectURI.RawQuery = params.Encode()
+                http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+        }
+        switch {
+        case q.Get("response_type") != "code":
+                reply(url.Values{"error": {"unsupported_response_type"}})
+                return
+        case !strings.Contains(" "+q.Get("scope")+" ", " openid "):
+                reply(url.Values{"error": {"invalid_scope"}, "error_description": {"openid scope required"}})
+                return
+        case q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256":
+                reply(url.Values{"error": {"invalid_request"}, "error_description": {"PKCE with S256 required"}})
+                return
+        }
+
+        user := q.Get("login_hint")
+        if user == "" {
+                user = idp.DefaultUser
+        }
+        code := randomToken()
+        idp.mu.Lock()
+        idp.codes[code] = fakeIdPGrant{
+                user:        user,
+                redirectURI: redirectURI.String(),
+                challenge:   q.Get("code_challenge"),
+                nonce:       q.Get("nonce"),
+                expires:     time.Now().Add(time.Minute),
+        }
+        idp.mu.Unlock()
+        reply(url.Values{"code": {code}})
+}
+
+func (idp *FakeIdP) serveToken(w http.ResponseWriter, r *http.Request) {
+        tokenError := func(status int, code, description string) {
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(status)
+                json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+        }
+        if r.Method != http.MethodPost {
+                tokenError(http.StatusMethodNotAllowed, "invalid_request", "POST required")
+                return
+        }
+        id, secret, ok := r.BasicAuth()
+        if ok {
+                id, _ = url.QueryUnescape(id)
+                secret, _ = url.QueryUnescape(secret)
+        } else {
+                id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+        }
+        if id != idp.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(idp.ClientSecret)) != 1 {
+                tokenError(http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+                return
+        }
+
+        // Codes and refresh tokens are single use, whether or not the
+        // request succeeds
+        var grant fakeIdPGrant
+        idp.mu.Lock()
+        switch r.PostFormValue("grant_type") {
+        case "authorization_code":
+                code := r.PostFormValue("code")
+                grant, ok = idp.codes[code]
+                delete(idp.codes, code)
+                sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+                ok = ok && time.Now().Before(grant.expires) &&
+                        grant.redirectURI == r.PostFormValue("redirect_uri") &&
+                        base64.RawURLEncoding.EncodeToString(sum[:]) == grant.challenge
+        case "refresh_token":
+                token := r.PostFormValue("refresh_token")
+                grant, ok = idp.refresh[token]
+                delete(idp.refresh, token)
+                grant.nonce = "" // Only the first ID token answers the login request
+        default:
+                idp.mu.Unlock()
+                tokenError(http.StatusBadRequest, "unsupported_grant_type", "")
+                return
+        }
+        if !ok {
+                idp.mu.Unlock()
+                tokenError(http.StatusBadRequest, "invalid_grant", "code or refresh token is invalid, expired or used")
+                return
+        }
+        refreshToken := randomToken()
+        idp.refresh[refreshToken] = fakeIdPGrant{user: grant.user}
+        key := idp.keys[0]
+        idp.mu.Unlock()
+
+        now := time.Now()
+        claims := map[string]interface{}{
+                "iss":            idp.Issuer,
+                "sub":            grant.user,
+                "aud":            idp.ClientID,
+                "iat":            now.Unix(),
+                "exp":            now.Add(time.Hour).Unix(),
+                "email":          grant.user + "@example.com",
+                "email_verified": true,
+                "name":           grant.user,
+        }
+        if grant.nonce != "" {
+                claims["nonce"] = grant.nonce
+        }
+        if tenant := idp.Tenants[grant.user]; tenant != "" {
+                claims["tenant"] = tenant
+        }
+        idToken, err := key.sign(claims)
+        if err != nil {
+                tokenError(http.StatusInternalServerError, "server_error", err.Error())
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "access_token":  randomToken(),
+                "token_type":    "Bearer",
+                "expires_in":    int(idp.AccessTTL.Seconds()),
+                "refresh_token": refreshToken,
+                "id_token":      idToken,
+        })
+}
+
+// sign makes a compact RS256 JWT
+func (k fakeIdPKey) sign(claims map[string]interface{}) (string, error) {
+        header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": k.id})
+        if err != nil {
+                return "", err
+        }
+        payload, err := json.Marshal(claims)
+        if err != nil {
+                return "", err
+        }
+        signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+        sum := sha256.Sum256([]byte(signed))
+        sig, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, sum[:])
+        if err != nil {
+                return "", err
+        }
+        return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
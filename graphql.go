@@ -0,0 +1,372 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "net/http"
+        "strconv"
+        "strings"
+
+        "github.com/graphql-go/graphql"
+        "github.com/graphql-go/graphql/language/ast"
+        "github.com/graphql-go/graphql/language/parser"
+)
+
+var itemType = graphql.NewObject(graphql.ObjectConfig{
+        Name: "Item",
+        Fields: graphql.Fields{
+                "id":   &graphql.Field{Type: graphql.NewNonNull(graphql.ID)}, // IDs pass 2^31, too big for Int
+                "name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+                "desc": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+        },
+})
+
+var itemPageType = graphql.NewObject(graphql.ObjectConfig{
+        Name: "ItemPage",
+        Fields: graphql.Fields{
+                "items":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(itemType)))},
+                "totalCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+                "hasMore":    &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+        },
+})
+
+var itemChangeType = graphql.NewObject(graphql.ObjectConfig{
+        Name: "ItemChange",
+        Fields: graphql.Fields{
+                "id":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+                "type":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+                "itemId": &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+                "item":   &graphql.Field{Type: itemType},
+        },
+})
+
+// Fields resolve through the json tags on these structs
+type itemPage struct {
+        Items      []Item `json:"items"`
+        TotalCount int    `json:"totalCount"`
+        HasMore    bool   `json:"hasMore"`
+}
+
+var graphqlSchema = mustGraphQLSchema()
+
+func mustGraphQLSchema() graphql.Schema {
+        query := graphql.NewObject(graphql.ObjectConfig{
+                Name: "Query",
+                Fields: graphql.Fields{
+                        "item": &graphql.Field{
+                                Type: itemType,
+                                Args: graphql.FieldConfigArgument{
+                                        "id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+                                },
+                                Resolve: resolveItem,
+                        },
+                        "items": &graphql.Field{
+                                Type: graphql.NewNonNull(itemPageType),
+                                Args: graphql.FieldConfigArgument{
+                                        "limit":        &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 50},
+                                        "offset":       &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+                                        "ids":          &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.ID))},
+                                        "nameContains": &graphql.ArgumentConfig{Type: graphql.String},
+                                },
+                                Resolve: resolveItems,
+                        },
+                },
+        })
+
+        mutation := graphql.NewObject(graphql.ObjectConfig{
+                Name: "Mutation",
+                Fields: graphql.Fields{
+                        "createItem": &graphql.Field{
+                                Type: graphql.NewNonNull(itemType),
+                                Args: graphql.FieldConfigArgument{
+                                        "name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+                                        "desc": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+                                },
+                                Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                                        return insertItem(contextActor(p.Context), Item{Name: p.Args["name"].(string), Desc: p.Args["desc"].(string)})
+                                },
+                        },
+                        "updateItem": &graphql.Field{
+                                Type: graphql.NewNonNull(itemType),
+                                Args: graphql.FieldConfigArgument{
+                                        "id":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+                                        "name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+                                        "desc": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+                                },
+                                Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                                        id, err := idArg(p.Args["id"])
+                                        if err != nil {
+                                                return nil, err
+                                        }
+                                        item := Item{ID: id, Name: p.Args["name"].(string), Desc: p.Args["desc"].(string)}
+                                        return saveItem(contextActor(p.Context), item)
+                                },
+                        },
+                        "deleteItem": &graphql.Field{
+                                Type: graphql.NewNonNull(graphql.Boolean),
+                                Args: graphql.FieldConfigArgument{
+                                        "id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+                                },
+                                Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                                        id, err := idArg(p.Args["id"])
+                                        if err != nil {
+                                                return false, err
+                                        }
+                                        err = removeItem(contextActor(p.Context), id)
+                                        if err == sql.ErrNoRows {
+                                                return false, nil
+                                        } else if err != nil {
+                                                return false, err
+                                        }
+                                        return true, nil
+                                },
+                        },
+                },
+        })
+
+        subscription := graphql.NewObject(graphql.ObjectConfig{
+                Name: "Subscription",
+                Fields: graphql.Fields{
+                        "itemChanged": &graphql.Field{
+                                Type: graphql.NewNonNull(itemChangeType),
+                                Args: graphql.FieldConfigArgument{
+                                        "ids": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.ID))},
+                                },
+                                Subscribe: subscribeItemChanged,
+                                Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+                                        return p.Source, nil
+                                },
+                        },
+                },
+        })
+
+        schema, err := graphql.NewSchema(graphql.SchemaConfig{
+                Query:        query,
+                Mutation:     mutation,
+                Subscription: subscription,
+        })
+        if err != nil {
+                panic(err)
+        }
+        return schema
+}
+
+func resolveItem(p graphql.ResolveParams) (interface{}, error) {
+        id, err := idArg(p.Args["id"])
+        if err != nil {
+                return nil, err
+        }
+        item, err := cache.Get(contextTenant(p.Context), id, loadItem)
+        if err == sql.ErrNoRows {
+                return nil, nil // Missing items resolve to null, like a 404 from GET /items/{id}
+        }
+        if err != nil {
+                return nil, err
+        }
+        return item, nil
+}
+
+func resolveItems(p graphql.ResolveParams) (interface{}, error) {
+        limit, offset := p.Args["limit"].(int), p.Args["offset"].(int)
+        if limit < 0 || offset < 0 {
+                return nil, errors.New("limit and offset must not be negative")
+        }
+
+        ids, err := idSet(p.Args["ids"])
+        if err != nil {
+                return nil, err
+        }
+        if ids != nil && len(ids) == 0 {
+                return itemPage{Items: []Item{}}, nil // ids: [] matches nothing
+        }
+        contains, _ := p.Args["nameContains"].(string)
+        filter := ItemFilter{NameContains: contains}
+        for id := range ids {
+                filter.IDs = append(filter.IDs, id)
+        }
+
+        items, total, err := pageItems(db, contextTenant(p.Context), filter, limit, offset)
+        if err != nil {
+                return nil, err
+        }
+        return itemPage{Items: items, TotalCount: total, HasMore: offset+len(items) < total}, nil
+}
+
+// The item ID in an ID argument, which arrives as a string
+func idArg(arg interface{}) (int, error) {
+        id, err := strconv.Atoi(fmt.Sprint(arg))
+        if err != nil {
+                return 0, fmt.Errorf("invalid item ID %q", fmt.Sprint(arg))
+        }
+        return id, nil
+}
+
+// Convert an optional [ID!] argument to a set; nil means no filter
+func idSet(arg interface{}) (map[int]bool, error) {
+        list, ok := arg.([]interface{})
+        if !ok {
+                return nil, nil
+        }
+        set := map[int]bool{}
+        for _, v := range list {
+                id, err := idArg(v)
+                if err != nil {
+                        return nil, err
+                }
+                set[id] = true
+        }
+        return set, nil
+}
+
+// Change payload exposed to the itemChanged subscription
+type itemChange struct {
+        ID     int64  `json:"id"`
+        Type   string `json:"type"`
+        ItemID int    `json:"itemId"`
+        Item   *Item  `json:"item"`
+}
+
+func subscribeItemChanged(p graphql.ResolveParams) (interface{}, error) {
+        ids, err := idSet(p.Args["ids"])
+        if err != nil {
+                return nil, err
+        }
+        ctx := p.Context
+        tenant := contextTenant(ctx)
+
+        changes := make(chan interface{})
+        queue := make(chan ItemEvent, 64)
+        unsubscribe := bus.Subscribe(func(event ItemEvent) {
+                if event.Tenant != tenant || ids != nil && !ids[event.ItemID] {
+                        return
+                }
+                select {
+                case queue <- event:
+                default: // Drop for slow subscribers rather than stall the bus
+                }
+        })
+
+        go func() {
+                defer close(changes)
+                defer unsubscribe()
+
+                seen := newSeenEvents(seenEventsSize)
+                for {
+                        select {
+                        case <-ctx.Done():
+                                return
+                        case event := <-queue:
+                                if !seen.add(event.ID) {
+                                        continue
+                                }
+                                change := itemChange{
+                                        ID:     event.ID,
+                                        Type:   strings.TrimPrefix(event.Type, "item."),
+                                        ItemID: event.ItemID,
+                                        Item:   event.Item,
+                                }
+                                select {
+                                case changes <- change:
+                                case <-ctx.Done():
+                                        return
+                                }
+                        }
+                }
+        }()
+        return changes, nil
+}
+
+// Body of a GraphQL-over-HTTP request
+type graphqlRequest struct {
+        Query         string                 `json:"query"`
+        OperationName string                 `json:"operationName"`
+        Variables     map[string]interface{} `json:"variables"`
+}
+
+// Execute a GraphQL request: GET or POST /graphql.
+// Subscriptions are streamed as Server-Sent Events. Mutations must be
+// POSTed, so they pass the CSRF check and the audit log like any write.
+func serveGraphQL(w http.ResponseWriter, r *http.Request) {
+        var req graphqlRequest
+        if r.Method == http.MethodGet {
+                req.Query = r.URL.Query().Get("query")
+                req.OperationName = r.URL.Query().Get("operationName")
+                if vars := r.URL.Query().Get("variables"); vars != "" {
+                        if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+                                http.Error(w, err.Error(), http.StatusBadRequest)
+                                return
+                        }
+                }
+        } else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if r.Method == http.MethodGet && operationType(req) == ast.OperationTypeMutation {
+                w.Header().Set("Allow", "POST")
+                http.Error(w, "mutations must be sent with POST", http.StatusMethodNotAllowed)
+                return
+        }
+
+        params := graphql.Params{
+                Schema:         graphqlSchema,
+                RequestString:  req.Query,
+                VariableValues: req.Variables,
+                OperationName:  req.OperationName,
+                Context:        withPrincipal(r.Context(), requestPrincipal(r)),
+        }
+
+        if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+                streamGraphQL(w, r, params)
+                return
+        }
+
+        result := graphql.Do(params)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+}
+
+// The type of operation a request runs, or "" if it names none that
+// parses, which execution then reports
+func operationType(req graphqlRequest) string {
+        doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+        if err != nil {
+                return ""
+        }
+        for _, def := range doc.Definitions {
+                op, ok := def.(*ast.OperationDefinition)
+                if !ok {
+                        continue
+                }
+                if req.OperationName == "" || op.Name != nil && op.Name.Value == req.OperationName {
+                        return op.Operation
+                }
+        }
+        return ""
+}
+
+// Send each subscription result as an SSE "next" event, then "complete"
+func streamGraphQL(w http.ResponseWriter, r *http.Request, params graphql.Params) {
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+                http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.WriteHeader(http.StatusOK)
+        flusher.Flush()
+
+        for result := range graphql.Subscribe(params) {
+                data, err := json.Marshal(result)
+                if err != nil {
+                        continue
+                }
+                fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+                flusher.Flush()
+        }
+        fmt.Fprint(w, "event: complete\ndata:\n\n")
+        flusher.Flush()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+        "net/http"
+        "net/url"
+        "strings"
+        "testing"
+
+        "github.com/gorilla/mux"
+)
+
+func graphQLRoutes(router *mux.Router) {
+        router.HandleFunc("/graphql", serveGraphQL).Methods("GET", "POST")
+}
+
+func TestGraphQLRejectsMutationsOverGET(t *testing.T) {
+        srv := newTestEnv(t).serve(graphQLRoutes)
+
+        mutation := url.QueryEscape(`mutation { createItem(name: "sneaky") { id } }`)
+        if code, body := do(t, "GET", srv.URL+"/graphql?query="+mutation, "", nil); code != http.StatusMethodNotAllowed {
+                t.Errorf("mutation over GET: got %d %s, want 405", code, body)
+        }
+        if items, _ := listItems(defaultTenant); len(items) != 0 {
+                t.Errorf("mutation over GET created %v", items)
+        }
+
+        query := url.QueryEscape(`{ items { totalCount } }`)
+        if code, body := do(t, "GET", srv.URL+"/graphql?query="+query, "", nil); code != http.StatusOK || !strings.Contains(body, `"totalCount":0`) {
+                t.Errorf("query over GET: got %d %s", code, body)
+        }
+        code, body := do(t, "POST", srv.URL+"/graphql", `{"query":"mutation { createItem(name: \"fine\") { id } }"}`, nil)
+        if code != http.StatusOK || strings.Contains(body, "errors") {
+                t.Errorf("mutation over POST: got %d %s", code, body)
+        }
+}
+
+func TestGraphQLItemsFilterAndPageInSQL(t *testing.T) {
+        srv := newTestEnv(t).serve(graphQLRoutes)
+        for _, name := range []string{"Red widget", "blue widget", "100% widget", "gadget", "widget_x"} {
+                if _, err := insertItem(Actor{Tenant: defaultTenant}, Item{Name: name}); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        insertItem(Actor{Tenant: "globex"}, Item{Name: "globex widget"})
+
+        tests := []struct{ query, want string }{
+                {`{ items(nameContains: "WIDGET", limit: 2) { items { name } totalCount hasMore } }`,
+                        `{"data":{"items":{"hasMore":true,"items":[{"name":"Red widget"},{"name":"blue widget"}],"totalCount":4}}}`},
+                {`{ items(nameContains: "widget", limit: 2, offset: 2) { items { name } hasMore } }`,
+                        `{"data":{"items":{"hasMore":false,"items":[{"name":"100% widget"},{"name":"widget_x"}]}}}`},
+                {`{ items(nameContains: "%") { totalCount } }`, `{"data":{"items":{"totalCount":1}}}`},
+                {`{ items(nameContains: "t_x") { totalCount } }`, `{"data":{"items":{"totalCount":1}}}`},
+                {`{ items(ids: ["1", "4"]) { items { name } } }`, `{"data":{"items":{"items":[{"name":"Red widget"},{"name":"gadget"}]}}}`},
+                {`{ items(ids: []) { totalCount } }`, `{"data":{"items":{"totalCount":0}}}`},
+                {`{ items(offset: 10) { items { name } totalCount } }`, `{"data":{"items":{"items":[],"totalCount":5}}}`},
+        }
+        for _, tc := range tests {
+                _, body := do(t, "GET", srv.URL+"/graphql?query="+url.QueryEscape(tc.query), "", nil)
+                if strings.TrimSpace(body) != tc.want {
+                        t.Errorf("%s\n got %s\nwant %s", tc.query, strings.TrimSpace(body), tc.want)
+                }
+        }
+}
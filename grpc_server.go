@@ -0,0 +1,167 @@
+package main
+
+import (
+        "context"
+        "database/sql"
+        "net"
+
+        "google.golang.org/grpc"
+        "google.golang.org/grpc/codes"
+        "google.golang.org/grpc/health"
+        healthpb "google.golang.org/grpc/health/grpc_health_v1"
+        "google.golang.org/grpc/reflection"
+        "google.golang.org/grpc/status"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative items.proto
+
+// itemServer implements ItemService on top of the same store as the REST API
+type itemServer struct {
+        UnimplementedItemServiceServer
+}
+
+// Create a gRPC server with ItemService, health and reflection registered
+func newGRPCServer() *grpc.Server {
+        server := grpc.NewServer(
+                grpc.ChainUnaryInterceptor(tenancy.UnaryInterceptor, audit.UnaryInterceptor),
+                grpc.StreamInterceptor(tenancy.StreamInterceptor),
+        )
+        RegisterItemServiceServer(server, &itemServer{})
+
+        healthServer := health.NewServer()
+        healthServer.SetServingStatus("items.v1.ItemService", healthpb.HealthCheckResponse_SERVING)
+        healthpb.RegisterHealthServer(server, healthServer)
+
+        reflection.Register(server)
+        return server
+}
+
+// Serve gRPC on addr until the listener fails
+func serveGRPC(addr string) error {
+        lis, err := net.Listen("tcp", addr)
+        if err != nil {
+                return err
+        }
+        return newGRPCServer().Serve(lis)
+}
+
+func toRecord(item Item) *ItemRecord {
+        return &ItemRecord{Id: int64(item.ID), Name: item.Name, Desc: item.Desc}
+}
+
+// Map store errors onto gRPC status codes
+func grpcError(err error) error {
+        if err == sql.ErrNoRows {
+                return status.Error(codes.NotFound, "item not found")
+        }
+        if err == errQuotaExceeded {
+                return status.Error(codes.ResourceExhausted, err.Error())
+        }
+        if _, invalid := err.(ValidationError); invalid {
+                return status.Error(codes.InvalidArgument, err.Error())
+        }
+        if err == errCircuitOpen || connectionError(err) {
+                return status.Error(codes.Unavailable, errCircuitOpen.Error())
+        }
+        return status.Error(codes.Internal, dbErrorMessage(err))
+}
+
+func (s *itemServer) GetItem(ctx context.Context, req *GetItemRequest) (*ItemRecord, error) {
+        item, err := cache.Get(contextTenant(ctx), int(req.GetId()), loadItem)
+        if err != nil {
+                return nil, grpcError(err)
+        }
+        return toRecord(item), nil
+}
+
+func (s *itemServer) ListItems(ctx context.Context, req *ListItemsRequest) (*ListItemsResponse, error) {
+        items, err := listItems(contextTenant(ctx))
+        if err != nil {
+                return nil, grpcError(err)
+        }
+
+        resp := &ListItemsResponse{}
+        for _, item := range items {
+                resp.Items = append(resp.Items, toRecord(item))
+        }
+        return resp, nil
+}
+
+func (s *itemServer) CreateItem(ctx context.Context, req *CreateItemRequest) (*ItemRecord, error) {
+        item, err := insertItem(contextActor(ctx), Item{Name: req.GetName(), Desc: req.GetDesc()})
+        if err != nil {
+                return nil, grpcError(err)
+        }
+        return toRecord(item), nil
+}
+
+func (s *itemServer) UpdateItem(ctx context.Context, req *UpdateItemRequest) (*ItemRecord, error) {
+        item, err := saveItem(contextActor(ctx), Item{ID: int(req.GetId()), Name: req.GetName(), Desc: req.GetDesc()})
+        if err != nil {
+                return nil, grpcError(err)
+        }
+        return toRecord(item), nil
+}
+
+func (s *itemServer) DeleteItem(ctx context.Context, req *DeleteItemRequest) (*DeleteItemResponse, error) {
+        if err := removeItem(contextActor(ctx), int(req.GetId())); err != nil {
+                return nil, grpcError(err)
+        }
+        return &DeleteItemResponse{}, nil
+}
+
+var changeTypes = map[string]ItemChange_Type{
+        EventItemCreated: ItemChange_TYPE_CREATED,
+        EventItemUpdated: ItemChange_TYPE_UPDATED,
+        EventItemDeleted: ItemChange_TYPE_DELETED,
+}
+
+func (s *itemServer) Watch(req *WatchRequest, stream grpc.ServerStreamingServer[ItemChange]) error {
+        ids := map[int64]bool{}
+        for _, id := range req.GetIds() {
+                ids[id] = true
+        }
+        tenant := contextTenant(stream.Context())
+
+        changes := make(chan ItemEvent, 64)
+        overrun := make(chan struct{})
+        unsubscribe := bus.Subscribe(func(event ItemEvent) {
+                if event.Tenant != tenant || len(ids) > 0 && !ids[int64(event.ItemID)] {
+                        return
+                }
+                select {
+                case changes <- event:
+                case <-overrun:
+                default:
+                        close(overrun) // Too slow; end the stream so the client re-watches
+                }
+        })
+        defer unsubscribe()
+
+        seen := newSeenEvents(seenEventsSize)
+        for {
+                select {
+                case <-stream.Context().Done():
+                        return nil
+                case <-overrun:
+                        return status.Error(codes.ResourceExhausted, "watcher fell too far behind")
+                case event := <-changes:
+                        if !seen.add(event.ID) {
+                                continue // Duplicate from at-least-once delivery
+                        }
+
+                        change := &ItemChange{
+                                EventId:          event.ID,
+                                Type:             changeTypes[event.Type],
+                                ItemId:           int64(event.ItemID),
+                                OccurredAtUnixMs: event.OccurredAt.UnixMilli(),
+                        }
+                        if event.Item != nil {
+                                change.Item = toRecord(*event.Item)
+                        }
+                        if err := stream.Send(change); err != nil {
+                                return err
+                        }
+                }
+        }
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+        "context"
+        "io"
+        "net"
+        "testing"
+        "time"
+
+        "google.golang.org/grpc"
+        "google.golang.org/grpc/codes"
+        "google.golang.org/grpc/credentials/insecure"
+        "google.golang.org/grpc/metadata"
+        "google.golang.org/grpc/status"
+        "google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCClient serves newGRPCServer over an in-memory listener and
+// returns a client connected to it
+func newGRPCClient(t *testing.T) ItemServiceClient {
+        t.Helper()
+        lis := bufconn.Listen(1 << 20)
+        server := newGRPCServer()
+        go server.Serve(lis)
+        t.Cleanup(server.Stop)
+
+        conn, err := grpc.NewClient("passthrough:///bufnet",
+                grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+                grpc.WithTransportCredentials(insecure.NewCredentials()))
+        if err != nil {
+                t.Fatal(err)
+        }
+        t.Cleanup(func() { conn.Close() })
+        return NewItemServiceClient(conn)
+}
+
+// asTenant authenticates calls with a token for tenant
+func asTenant(tenant string) context.Context {
+        return metadata.AppendToOutgoingContext(context.Background(), "authorization", bearer(tenant, "ann")["Authorization"])
+}
+
+func wantCode(t *testing.T, what string, err error, code codes.Code) {
+        t.Helper()
+        if got := status.Code(err); got != code {
+                t.Errorf("%s: got %v (%v), want %v", what, got, err, code)
+        }
+}
+
+func TestGRPCItemCRUD(t *testing.T) {
+        newTestEnv(t, withTokens(""))
+        client := newGRPCClient(t)
+        ctx := asTenant("acme")
+
+        created, err := client.CreateItem(ctx, &CreateItemRequest{Name: "widget", Desc: "blue"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        got, err := client.GetItem(ctx, &GetItemRequest{Id: created.Id})
+        if err != nil || got.Name != "widget" || got.Desc != "blue" {
+                t.Fatalf("get: %+v, %v", got, err)
+        }
+
+        updated, err := client.UpdateItem(ctx, &UpdateItemRequest{Id: created.Id, Name: "gadget"})
+        if err != nil || updated.Name != "gadget" {
+                t.Fatalf("update: %+v, %v", updated, err)
+        }
+        list, err := client.ListItems(ctx, &ListItemsRequest{})
+        if err != nil || len(list.Items) != 1 || list.Items[0].Name != "gadget" {
+                t.Fatalf("list: %+v, %v", list, err)
+        }
+
+        // Other tenants see nothing
+        _, err = client.GetItem(asTenant("globex"), &GetItemRequest{Id: created.Id})
+        wantCode(t, "get from another tenant", err, codes.NotFound)
+
+        if _, err := client.DeleteItem(ctx, &DeleteItemRequest{Id: created.Id}); err != nil {
+                t.Fatal(err)
+        }
+        _, err = client.GetItem(ctx, &GetItemRequest{Id: created.Id})
+        wantCode(t, "get after delete", err, codes.NotFound)
+        _, err = client.DeleteItem(ctx, &DeleteItemRequest{Id: created.Id})
+        wantCode(t, "delete twice", err, codes.NotFound)
+}
+
+func TestGRPCErrorCodes(t *testing.T) {
+        conn := newTestEnv(t, withTokens("")).DB
+        client := newGRPCClient(t)
+        if _, err := conn.Exec("INSERT INTO tenant_quotas (tenant_id, max_items, requests_per_second, burst) VALUES ('small', 1, 50, 100)"); err != nil {
+                t.Fatal(err)
+        }
+
+        _, err := client.ListItems(context.Background(), &ListItemsRequest{})
+        wantCode(t, "no token", err, codes.Unauthenticated)
+
+        forged := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+signToken("wrong", map[string]interface{}{"tenant": "acme"}))
+        _, err = client.ListItems(forged, &ListItemsRequest{})
+        wantCode(t, "forged token", err, codes.Unauthenticated)
+
+        _, err = client.CreateItem(asTenant("acme"), &CreateItemRequest{Name: " "})
+        wantCode(t, "blank name", err, codes.InvalidArgument)
+
+        _, err = client.UpdateItem(asTenant("acme"), &UpdateItemRequest{Id: 404, Name: "ghost"})
+        wantCode(t, "update missing item", err, codes.NotFound)
+
+        ctx := asTenant("small")
+        if _, err := client.CreateItem(ctx, &CreateItemRequest{Name: "first"}); err != nil {
+                t.Fatal(err)
+        }
+        _, err = client.CreateItem(ctx, &CreateItemRequest{Name: "second"})
+        wantCode(t, "over quota", err, codes.ResourceExhausted)
+
+        // An open breaker fails calls fast rather than reaching the database
+        conn.Breaker = NewCircuitBreaker("test", 1, time.Hour)
+        conn.Breaker.record(io.EOF, false)
+        defer func() { conn.Breaker = nil }()
+        _, err = client.GetItem(asTenant("acme"), &GetItemRequest{Id: 1})
+        wantCode(t, "database down", err, codes.Unavailable)
+}
+
+func TestGRPCWatchStreamsRelayedChanges(t *testing.T) {
+        conn := newTestEnv(t, withTokens("")).DB
+        client := newGRPCClient(t)
+
+        ctx, cancel := context.WithTimeout(asTenant("acme"), 5*time.Second)
+        defer cancel()
+        stream, err := client.Watch(ctx, &WatchRequest{})
+        if err != nil {
+                t.Fatal(err)
+        }
+        changes := make(chan *ItemChange)
+        go func() {
+                for {
+                        change, err := stream.Recv()
+                        if err != nil {
+                                close(changes)
+                                return
+                        }
+                        changes <- change
+                }
+        }()
+
+        // Another tenant's change is filtered out of the stream
+        if _, err := client.CreateItem(asTenant("globex"), &CreateItemRequest{Name: "theirs"}); err != nil {
+                t.Fatal(err)
+        }
+        created, err := client.CreateItem(asTenant("acme"), &CreateItemRequest{Name: "ours"})
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        // The stream may not have subscribed yet, so relay the outbox and
+        // republish until the change arrives; duplicates are dropped
+        relay := NewOutboxRelay(conn, bus)
+        if _, err := relay.relayBatch(ctx); err != nil {
+                t.Fatal(err)
+        }
+        events, err := conn.Query("SELECT id, tenant_id, event_type, item_id, created_at FROM outbox ORDER BY id")
+        if err != nil {
+                t.Fatal(err)
+        }
+        published := []ItemEvent{}
+        for events.Next() {
+                var event ItemEvent
+                if err := events.Scan(&event.ID, &event.Tenant, &event.Type, &event.ItemID, &event.OccurredAt); err != nil {
+                        t.Fatal(err)
+                }
+                published = append(published, event)
+        }
+        events.Close()
+
+        ticker := time.NewTicker(20 * time.Millisecond)
+        defer ticker.Stop()
+        for {
+                select {
+                case change, ok := <-changes:
+                        if !ok {
+                                t.Fatalf("stream ended: %v", ctx.Err())
+                        }
+                        if change.ItemId != created.Id || change.Type != ItemChange_TYPE_CREATED {
+                                t.Fatalf("got %+v, want the creation of item %d", change, created.Id)
+                        }
+                        return
+                case <-ticker.C:
+                        for _, event := range published {
+                                bus.Publish(ctx, event)
+                        }
+                }
+        }
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "encoding/xml"
+        "errors"
+        "net/http"
+        "sort"
+        "strconv"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// What a revision records
+const (
+        RevisionCreated  = "created"
+        RevisionUpdated  = "updated"
+        RevisionDeleted  = "deleted"
+        RevisionReverted = "reverted"
+)
+
+// FieldChange is one field's old and new value. From is nil when the item
+// did not exist before, To is nil when it was deleted.
+type FieldChange struct {
+        From *string `json:"from"`
+        To   *string `json:"to"`
+}
+
+// fieldChanges is a revision's diff, by field name
+type fieldChanges map[string]FieldChange
+
+// XML has no maps, so it lists the changes in field order
+func (d fieldChanges) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+        type change struct {
+                Field string  `xml:"field,attr"`
+                From  *string `xml:"from"`
+                To    *string `xml:"to"`
+        }
+        fields := make([]string, 0, len(d))
+        for field := range d {
+                fields = append(fields, field)
+        }
+        sort.Strings(fields)
+        changes := make([]change, len(fields))
+        for i, field := range fields {
+                changes[i] = change{field, d[field].From, d[field].To}
+        }
+        return e.EncodeElement(struct {
+                Changes []change `xml:"change"`
+        }{changes}, start)
+}
+
+// Revision is an item as it stood after one mutation
+type Revision struct {
+        XMLName      xml.Name     `json:"-" xml:"revision"`
+        ItemID       jsonID       `json:"item_id" xml:"item_id"`
+        Revision     int          `json:"revision" xml:"revision"`
+        Action       string       `json:"action" xml:"action"`
+        Principal    string       `json:"principal" xml:"principal"`
+        Name         string       `json:"name" xml:"name"`
+        Desc         string       `json:"desc" xml:"desc"`
+        Diff         fieldChanges `json:"diff" xml:"diff"`
+        RevertedFrom int          `json:"reverted_from,omitempty" xml:"reverted_from,omitempty"` // Set on reverts
+        CreatedAt    time.Time    `json:"created_at" xml:"created_at"`
+}
+
+// revisionList is an item's history, with a root element in XML
+type revisionList []Revision
+
+func (l revisionList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+        return encodeXMLList(e, "revisions", []Revision(l))
+}
+
+// Item returns the item the revision describes
+func (rev Revision) Item() Item {
+        return Item{ID: int(rev.ItemID), Name: rev.Name, Desc: rev.Desc, UpdatedAt: rev.CreatedAt}
+}
+
+// diffItems lists the fields that differ between two versions of an item
+func diffItems(before, after *Item) map[string]FieldChange {
+        fields := func(item *Item) map[string]*string {
+                if item == nil {
+                        return map[string]*string{"name": nil, "desc": nil}
+                }
+                return map[string]*string{"name": &item.Name, "desc": &item.Desc}
+        }
+        from, to := fields(before), fields(after)
+
+        diff := map[string]FieldChange{}
+        for field := range from {
+                a, b := from[field], to[field]
+                if a == nil || b == nil || *a != *b {
+                        diff[field] = FieldChange{From: a, To: b}
+                }
+        }
+        return diff
+}
+
+// writeRevision appends the next revision of an item within tx. after is
+// the item as stored, or for a delete the row that was removed.
+func writeRevision(tx *Tx, action string, actor Actor, before, after *Item, revertedFrom int) error {
+        diff := diffItems(before, after)
+        if action == RevisionDeleted {
+                diff = diffItems(before, nil)
+        }
+        return appendRevision(tx, action, actor, before, after, diff, revertedFrom)
+}
+
+// appendRevision writes a revision with a diff the caller worked out, for
+// changes such as links that are not item fields. Every change to an item
+// writes one, so the change's audit entry goes in with it.
+func appendRevision(tx *Tx, action string, actor Actor, before, after *Item, diff map[string]FieldChange, revertedFrom int) error {
+        body, err := json.Marshal(diff)
+        if err != nil {
+                return err
+        }
+
+        next, err := nextRevision(tx, after.ID)
+        if err != nil {
+                return err
+        }
+
+        var from interface{}
+        if revertedFrom != 0 {
+                from = revertedFrom
+        }
+        // Share the item's timestamp so asOf lookups line up with Last-Modified
+        at := after.UpdatedAt
+        if action == RevisionDeleted {
+                at = modifiedNow()
+        }
+        _, err = tx.Exec("INSERT INTO item_revisions (tenant_id, item_id, revision, action, principal, name, `desc`, diff, reverted_from, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+                actor.Tenant, after.ID, next, action, actor.Principal, after.Name, after.Desc, string(body), from, at)
+        if err != nil {
+                return err
+        }
+        if action == RevisionDeleted {
+                after = nil
+        }
+        return recordChange(tx, actor, action, before, after)
+}
+
+// lockHistory locks an item's first revision, which every writer of its
+// history takes before anything else in it. It holds whether or not the
+// item itself still exists, so reverts of a deleted item take turns too.
+func lockHistory(tx *Tx, id int) error {
+        var first int
+        err := tx.QueryRow("SELECT revision FROM item_revisions WHERE item_id = ? ORDER BY revision LIMIT 1 FOR UPDATE", id).Scan(&first)
+        if err == sql.ErrNoRows {
+                return nil // A new item; its ID is not anyone else's yet
+        }
+        return err
+}
+
+// nextRevision numbers the revision about to be written. The last one is
+// read with a locking read once the history is locked, so it is the
+// latest committed rather than what the transaction saw when it began.
+func nextRevision(tx *Tx, id int) (int, error) {
+        if err := lockHistory(tx, id); err != nil {
+                return 0, err
+        }
+        var last int
+        err := tx.QueryRow("SELECT revision FROM item_revisions WHERE item_id = ? ORDER BY revision DESC LIMIT 1 FOR UPDATE", id).Scan(&last)
+        if err != nil && err != sql.ErrNoRows {
+                return 0, err
+        }
+        return last + 1, nil
+}
+
+const revisionColumns = "item_id, revision, action, principal, name, `desc`, diff, reverted_from, created_at"
+
+type scanner interface {
+        Scan(dest ...interface{}) error
+}
+
+func scanRevision(row scanner) (Revision, error) {
+        var rev Revision
+        var diff []byte
+        var from sql.NullInt64
+        if err := row.Scan(&rev.ItemID, &rev.Revision, &rev.Action, &rev.Principal, &rev.Name, &rev.Desc, &diff, &from, &rev.CreatedAt); err != nil {
+                return rev, err
+        }
+        rev.RevertedFrom = int(from.Int64)
+        return rev, json.Unmarshal(diff, &rev.Diff)
+}
+
+// List an item's revisions, oldest first, reading from conn
+func listRevisions(conn *DB, tenant string, id int) ([]Revision, error) {
+        if shards != nil {
+                conn = shards.For(id) // Shards have no replicas
+        }
+        rows, err := conn.Query("SELECT "+revisionColumns+" FROM item_revisions WHERE item_id = ? AND tenant_id = ? ORDER BY revision", id, tenant)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        revs := []Revision{}
+        for rows.Next() {
+                rev, err := scanRevision(rows)
+                if err != nil {
+                        return nil, err
+                }
+                revs = append(revs, rev)
+        }
+        return revs, rows.Err()
+}
+
+// Load an item as it was at a point in time, reading from conn. It
+// returns sql.ErrNoRows if the item did not exist then.
+func loadItemAsOf(conn *DB, tenant string, id int, at time.Time) (Item, error) {
+        if shards != nil {
+                conn = shards.For(id)
+        }
+        row := conn.QueryRow("SELECT "+revisionColumns+" FROM item_revisions WHERE item_id = ? AND tenant_id = ? AND created_at <= ? ORDER BY revision DESC LIMIT 1", id, tenant, at.UTC())
+        rev, err := scanRevision(row)
+        if err != nil {
+                return Item{}, err
+        }
+        if rev.Action == RevisionDeleted {
+                return Item{}, sql.ErrNoRows
+        }
+        item := rev.Item()
+        item.Tenant = tenant
+        return item, nil
+}
+
+// Restore an item to an earlier revision by recording it as a new one.
+// A deleted item is recreated under its old ID.
+func revertItem(actor Actor, id, revision int) (Item, error) {
+        var item Item
+        err := inItemTx(id, func(tx *Tx) error {
+                // Lock the item, if it still exists, then its history, in the
+                // order every other writer and a rebalance take them
+                var before *Item
+                current, err := lockItem(tx, actor.Tenant, id)
+                if err == nil {
+                        before = &current
+                } else if err != sql.ErrNoRows {
+                        return err
+                }
+                if err := lockHistory(tx, id); err != nil {
+                        return err
+                }
+
+                target, err := scanRevision(tx.QueryRow("SELECT "+revisionColumns+" FROM item_revisions WHERE item_id = ? AND tenant_id = ? AND revision = ?", id, actor.Tenant, revision))
+                if err != nil {
+                        return err
+                }
+                if target.Action == RevisionDeleted {
+                        return errRevertToDeleted
+                }
+
+                item = Item{ID: id, Name: target.Name, Desc: target.Desc, UpdatedAt: modifiedNow(), Tenant: actor.Tenant}
+                event := EventItemUpdated
+                if before != nil {
+                        _, err = tx.Exec("UPDATE items SET name = ?, `desc` = ?, updated_at = ? WHERE id = ? AND tenant_id = ?", item.Name, item.Desc, item.UpdatedAt, id, actor.Tenant)
+                } else {
+                        if err := tenancy.checkItemQuota(tx, actor.Tenant); err != nil {
+                                return err
+                        }
+                        event = EventItemCreated
+                        _, err = tx.Exec("INSERT INTO items (id, tenant_id, name, `desc`, updated_at) VALUES (?, ?, ?, ?, ?)", id, actor.Tenant, item.Name, item.Desc, item.UpdatedAt)
+                }
+                if err != nil {
+                        return err
+                }
+
+                if err := writeRevision(tx, RevisionReverted, actor, before, &item, revision); err != nil {
+                        return err
+                }
+                return writeOutbox(tx, event, id, &item)
+        })
+        if err != nil {
+                return Item{}, err
+        }
+        cache.Invalidate(actor.Tenant, id)
+        return item, nil
+}
+
+var errRevertToDeleted = errors.New("cannot revert to a deleted revision")
+
+// List an item's revisions: GET /items/{id}/history
+func getHistory(w http.ResponseWriter, r *http.Request) {
+        id, err := strconv.Atoi(mux.Vars(r)["id"])
+        if err != nil {
+                http.Error(w, "Invalid ID", http.StatusBadRequest)
+                return
+        }
+        if !acceptable(w, r, false) {
+                return
+        }
+
+        var revs []Revision
+        err = replicas.Read(r.Context(), func(conn *DB) (err error) {
+                revs, err = listRevisions(conn, requestTenant(r), id)
+                return err
+        })
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        if len(revs) == 0 {
+                http.NotFound(w, r)
+                return
+        }
+
+        writeResponse(w, r, http.StatusOK, revisionList(revs))
+}
+
+// Restore a revision: POST /items/{id}/revisions/{revision}/revert
+func revertRevision(w http.ResponseWriter, r *http.Request) {
+        params := mux.Vars(r)
+        id, err := strconv.Atoi(params["id"])
+        if err != nil {
+                http.Error(w, "Invalid ID", http.StatusBadRequest)
+                return
+        }
+        revision, err := strconv.Atoi(params["revision"])
+        if err != nil {
+                http.Error(w, "Invalid revision", http.StatusBadRequest)
+                return
+        }
+        if !acceptable(w, r, false) {
+                return
+        }
+
+        item, err := revertItem(requestActor(r), id, revision)
+        if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return
+        } else if err == errQuotaExceeded {
+                http.Error(w, err.Error(), http.StatusForbidden)
+                return
+        } else if err == errRevertToDeleted {
+                http.Error(w, err.Error(), http.StatusConflict)
+                return
+        } else if err != nil {
+                dbError(w, err)
+                return
+        }
+
+        writeResponse(w, r, http.StatusOK, item)
+}
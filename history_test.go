@@ -0,0 +1,174 @@
+package main
+
+import (
+        "encoding/json"
+        "encoding/xml"
+        "net/http"
+        "strconv"
+        "strings"
+        "sync"
+        "testing"
+
+        "github.com/gorilla/mux"
+)
+
+// Reverts of a deleted item have no item row to queue on, so they must
+// queue on its history rather than both take the next revision number
+func TestConcurrentRevertsNumberRevisionsInTurn(t *testing.T) {
+        conn := newTestEnv(t).DB
+        actor := Actor{Tenant: defaultTenant}
+        item, err := insertItem(actor, Item{Name: "widget"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        if err := removeItem(actor, item.ID); err != nil {
+                t.Fatal(err)
+        }
+
+        const reverts = 8
+        var wg sync.WaitGroup
+        errs := make(chan error, reverts)
+        for i := 0; i < reverts; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        if _, err := revertItem(actor, item.ID, 1); err != nil {
+                                errs <- err
+                        }
+                }()
+        }
+        wg.Wait()
+        close(errs)
+        for err := range errs {
+                t.Error(err)
+        }
+
+        revs, err := listRevisions(conn, defaultTenant, item.ID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if len(revs) != 2+reverts {
+                t.Fatalf("got %d revisions, want %d", len(revs), 2+reverts)
+        }
+        seen := map[int]bool{}
+        for _, rev := range revs {
+                seen[rev.Revision] = true
+        }
+        for n := 1; n <= len(revs); n++ {
+                if !seen[n] {
+                        t.Errorf("revision %d missing from %v", n, seen)
+                }
+        }
+}
+
+func historyRoutes(router *mux.Router) {
+        versionRoutes(router, func(router *mux.Router) {
+                router.HandleFunc("/items/{id}/history", getHistory).Methods("GET")
+        })
+}
+
+func TestHistoryErrorsStayInTheLog(t *testing.T) {
+        e := newTestEnv(t)
+        srv := e.serve(historyRoutes)
+
+        item, err := insertItem(Actor{Tenant: defaultTenant}, Item{Name: "widget"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        if _, err := e.DB.Exec("DROP TABLE item_revisions"); err != nil {
+                t.Fatal(err)
+        }
+        code, body := do(t, "GET", srv.URL+"/items/"+strconv.Itoa(item.ID)+"/history", "", nil)
+        if code != http.StatusInternalServerError || strings.Contains(body, "item_revisions") {
+                t.Errorf("got %d %q", code, body)
+        }
+}
+
+func TestHistoryInV2(t *testing.T) {
+        srv := newTestEnv(t).serve(historyRoutes)
+
+        actor := Actor{Tenant: defaultTenant}
+        item, err := insertItem(actor, Item{Name: "widget", Desc: "plain"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        item.Desc = "shiny"
+        if _, err := saveItem(actor, item); err != nil {
+                t.Fatal(err)
+        }
+
+        code, body := do(t, "GET", srv.URL+"/v2/items/"+strconv.Itoa(item.ID)+"/history", "", nil)
+        var revs []struct {
+                Revision int                    `json:"revision"`
+                Item     map[string]interface{} `json:"item"`
+                Diff     map[string]FieldChange `json:"diff"`
+        }
+        if code != http.StatusOK || json.Unmarshal([]byte(body), &revs) != nil || len(revs) != 2 {
+                t.Fatalf("history: %d %s", code, body)
+        }
+        for _, rev := range revs {
+                if rev.Revision == 2 {
+                        if rev.Item["id"] != strconv.Itoa(item.ID) || rev.Item["description"] != "shiny" {
+                                t.Errorf("item in the wrong shape: %v", rev.Item)
+                        }
+                        if change, ok := rev.Diff["description"]; !ok || *change.To != "shiny" || len(rev.Diff) != 1 {
+                                t.Errorf("diff %v", rev.Diff)
+                        }
+                }
+        }
+}
+
+func TestHistoryNegotiatesResponses(t *testing.T) {
+        srv := newTestEnv(t).serve(historyRoutes)
+
+        actor := Actor{Tenant: defaultTenant}
+        item, err := insertItem(actor, Item{Name: "widget", Desc: "plain"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        item.Desc = "shiny"
+        if _, err := saveItem(actor, item); err != nil {
+                t.Fatal(err)
+        }
+        path := "/items/" + strconv.Itoa(item.ID) + "/history"
+
+        for _, accept := range []string{"image/png", "text/csv"} {
+                if code, _ := do(t, "GET", srv.URL+path, "", map[string]string{"Accept": accept}); code != http.StatusNotAcceptable {
+                        t.Errorf("history as %s: got %d, want 406", accept, code)
+                }
+        }
+
+        type change struct {
+                Field string `xml:"field,attr"`
+                To    string `xml:"to"`
+        }
+        var v1 struct {
+                XMLName   xml.Name `xml:"revisions"`
+                Revisions []struct {
+                        Revision int      `xml:"revision"`
+                        Desc     string   `xml:"desc"`
+                        Diff     []change `xml:"diff>change"`
+                } `xml:"revision"`
+        }
+        code, body := do(t, "GET", srv.URL+path, "", map[string]string{"Accept": "application/xml"})
+        if code != http.StatusOK || xml.Unmarshal([]byte(body), &v1) != nil || len(v1.Revisions) != 2 {
+                t.Fatalf("v1 history as XML: %d %s", code, body)
+        }
+        if rev := v1.Revisions[1]; rev.Desc != "shiny" || len(rev.Diff) != 1 || rev.Diff[0] != (change{"desc", "shiny"}) {
+                t.Errorf("v1 revision %+v", rev)
+        }
+
+        var v2 struct {
+                Revisions []struct {
+                        Item ItemV2   `xml:"item"`
+                        Diff []change `xml:"diff>change"`
+                } `xml:"revision"`
+        }
+        code, body = do(t, "GET", srv.URL+"/v2"+path, "", map[string]string{"Accept": "application/xml"})
+        if code != http.StatusOK || xml.Unmarshal([]byte(body), &v2) != nil || len(v2.Revisions) != 2 {
+                t.Fatalf("v2 history as XML: %d %s", code, body)
+        }
+        if rev := v2.Revisions[1]; rev.Item.Description != "shiny" || len(rev.Diff) != 1 || rev.Diff[0] != (change{"description", "shiny"}) {
+                t.Errorf("v2 revision %+v", rev)
+        }
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+        "fmt"
+        "net/http"
+        "strings"
+        "time"
+)
+
+// Clients may keep item responses but must revalidate them before reuse
+const itemCacheControl = "no-cache"
+
+// setValidators writes Cache-Control, Last-Modified and ETag for a
+// resource and answers 304 Not Modified if the client's copy is current.
+// It returns true when the 304 has been sent.
+func setValidators(w http.ResponseWriter, r *http.Request, modified time.Time, etag string) bool {
+        h := w.Header()
+        h.Set("Cache-Control", itemCacheControl)
+        addVary(h, "Accept")
+        if etag != "" {
+                h.Set("ETag", etag)
+        }
+        if !modified.IsZero() {
+                h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+        }
+
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+                return false
+        }
+
+        // If-None-Match wins over If-Modified-Since when both are sent
+        if match := r.Header.Get("If-None-Match"); match != "" {
+                if etag != "" && etagMatches(match, etag) {
+                        w.WriteHeader(http.StatusNotModified)
+                        return true
+                }
+                return false
+        }
+        if since := r.Header.Get("If-Modified-Since"); since != "" && !modified.IsZero() {
+                t, err := http.ParseTime(since)
+                // Last-Modified has one-second resolution, so compare at that precision
+                if err == nil && !modified.Truncate(time.Second).After(t) {
+                        w.WriteHeader(http.StatusNotModified)
+                        return true
+                }
+        }
+        return false
+}
+
+// addVary appends a field name to Vary unless it is already listed
+func addVary(h http.Header, field string) {
+        for _, v := range h.Values("Vary") {
+                for _, existing := range strings.Split(v, ",") {
+                        if strings.EqualFold(strings.TrimSpace(existing), field) {
+                                return
+                        }
+                }
+        }
+        h.Add("Vary", field)
+}
+
+// etagMatches does the weak comparison If-None-Match calls for
+func etagMatches(header, etag string) bool {
+        want := strings.TrimPrefix(etag, "W/")
+        for _, candidate := range strings.Split(header, ",") {
+                candidate = strings.TrimSpace(candidate)
+                if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+                        return true
+                }
+        }
+        return false
+}
+
+// Validator for a single item
+func itemETag(item Item) string {
+        return fmt.Sprintf(`W/"%d-%d"`, item.ID, item.UpdatedAt.UnixNano())
+}
+
+// Validators for a list: the newest modification and a tag that also
+// changes when items are deleted
+func listValidators(items []Item) (time.Time, string) {
+        var latest time.Time
+        for _, item := range items {
+                if item.UpdatedAt.After(latest) {
+                        latest = item.UpdatedAt
+                }
+        }
+        return latest, fmt.Sprintf(`W/"%d-%d"`, len(items), latest.UnixNano())
+}
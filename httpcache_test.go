@@ -0,0 +1,100 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "strconv"
+        "testing"
+        "time"
+)
+
+func TestSetValidators(t *testing.T) {
+        modified := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+        etag := `W/"1-2"`
+        for _, tc := range []struct {
+                name    string
+                method  string
+                headers map[string]string
+                want    bool
+        }{
+                {"no conditions", "GET", nil, false},
+                {"matching tag", "GET", map[string]string{"If-None-Match": `"1-2"`}, true},
+                {"one of several tags", "GET", map[string]string{"If-None-Match": `W/"0-0", W/"1-2"`}, true},
+                {"any tag", "HEAD", map[string]string{"If-None-Match": "*"}, true},
+                {"stale tag", "GET", map[string]string{"If-None-Match": `W/"1-1"`}, false},
+                {"stale tag wins over a current date", "GET", map[string]string{
+                        "If-None-Match":     `W/"1-1"`,
+                        "If-Modified-Since": modified.Format(http.TimeFormat),
+                }, false},
+                {"same second", "GET", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, true},
+                {"modified since", "GET", map[string]string{"If-Modified-Since": modified.Add(-time.Second).Format(http.TimeFormat)}, false},
+                {"unsafe method", "PUT", map[string]string{"If-None-Match": etag}, false},
+        } {
+                req := httptest.NewRequest(tc.method, "/items/1", nil)
+                for k, v := range tc.headers {
+                        req.Header.Set(k, v)
+                }
+                rec := httptest.NewRecorder()
+                got := setValidators(rec, req, modified, etag)
+                if got != tc.want {
+                        t.Errorf("%s: answered 304 = %v, want %v", tc.name, got, tc.want)
+                }
+                if got && rec.Code != http.StatusNotModified {
+                        t.Errorf("%s: status %d", tc.name, rec.Code)
+                }
+                h := rec.Header()
+                if h.Get("ETag") != etag || h.Get("Last-Modified") != "Wed, 01 May 2024 12:00:00 GMT" ||
+                        h.Get("Cache-Control") != itemCacheControl || h.Get("Vary") != "Accept" {
+                        t.Errorf("%s: headers %v", tc.name, h)
+                }
+        }
+}
+
+func TestAddVaryOnce(t *testing.T) {
+        h := http.Header{}
+        h.Set("Vary", "Origin, accept")
+        addVary(h, "Accept")
+        addVary(h, "Accept-Encoding")
+        addVary(h, "accept-encoding")
+        if got := h.Values("Vary"); len(got) != 2 || got[1] != "Accept-Encoding" {
+                t.Errorf("Vary %q", got)
+        }
+}
+
+// An item answers 304 to its own tag, through compression, until it changes
+func TestItemNotModifiedUntilChanged(t *testing.T) {
+        srv := httptest.NewServer(compress(newTestEnv(t).serve(itemRoutes).Config.Handler, 1024))
+        defer srv.Close()
+
+        code, body := do(t, "POST", srv.URL+"/items", `{"name":"widget"}`, nil)
+        if code != http.StatusCreated {
+                t.Fatalf("create: %d %s", code, body)
+        }
+        var item Item
+        if err := json.Unmarshal([]byte(body), &item); err != nil {
+                t.Fatal(err)
+        }
+        url := srv.URL + "/items/" + strconv.Itoa(item.ID)
+
+        resp, err := http.Get(url)
+        if err != nil {
+                t.Fatal(err)
+        }
+        resp.Body.Close()
+        etag := resp.Header.Get("ETag")
+        if etag == "" {
+                t.Fatal("no ETag")
+        }
+
+        headers := map[string]string{"If-None-Match": etag, "Accept-Encoding": "gzip"}
+        if code, body := do(t, "GET", url, "", headers); code != http.StatusNotModified || body != "" {
+                t.Errorf("unchanged: got %d %q, want 304", code, body)
+        }
+        if code, _ := do(t, "PUT", url, `{"name":"gadget"}`, nil); code != http.StatusOK {
+                t.Fatalf("update: %d", code)
+        }
+        if code, _ := do(t, "GET", url, "", headers); code != http.StatusOK {
+                t.Errorf("changed: got %d, want 200", code)
+        }
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+        "crypto/rand"
+        "encoding/binary"
+        "encoding/json"
+        "fmt"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+// IDGenerator hands out unique, time-ordered item IDs without asking the
+// database, so items can be created on any shard or offline
+type IDGenerator interface {
+        NextID() (int64, error)
+}
+
+// Set from ITEM_IDS; nil leaves item IDs to the database or shard counters
+var itemIDs IDGenerator
+
+// Make a generator for ITEM_IDS: "snowflake", which needs a NODE_ID unique
+// to this instance, or "random", which risks collisions instead
+func newIDGenerator(mode, node string) (IDGenerator, error) {
+        switch mode {
+        case "snowflake":
+                n, err := strconv.Atoi(node)
+                if err != nil {
+                        return nil, fmt.Errorf("snowflake IDs need NODE_ID between 0 and %d", maxNodeID)
+                }
+                return NewSnowflake(n)
+        case "random":
+                return NewRandomIDGenerator(), nil
+        }
+        return nil, fmt.Errorf("unknown ID generator %q", mode)
+}
+
+const (
+        snowflakeNodeBits = 10
+        snowflakeSeqBits  = 12
+        maxNodeID         = 1<<snowflakeNodeBits - 1
+        maxSequence       = 1<<snowflakeSeqBits - 1
+
+        // Longer steps back than this fail rather than stall every insert
+        maxClockRegression = 50 * time.Millisecond
+)
+
+// Snowflake milliseconds count from here; 41 bits of them last until 2093
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Snowflake makes 63-bit IDs from 41 bits of milliseconds, a 10-bit node
+// ID and a 12-bit sequence, so each node can make 4096 IDs a millisecond.
+// It only guards against the clock going back while it runs; after a
+// restart the node relies on the clock being right.
+type Snowflake struct {
+        node int64
+        now  func() time.Time
+
+        mu   sync.Mutex
+        last int64 // Milliseconds of the last ID
+        seq  int64
+}
+
+func NewSnowflake(node int) (*Snowflake, error) {
+        if node < 0 || node > maxNodeID {
+                return nil, fmt.Errorf("node ID %d out of range 0-%d", node, maxNodeID)
+        }
+        return &Snowflake{node: int64(node), now: time.Now}, nil
+}
+
+func (s *Snowflake) NextID() (int64, error) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        ms := s.millis()
+        if ms < s.last {
+                // Wait out a small step back, such as an NTP correction;
+                // carrying on would reissue IDs already handed out
+                behind := time.Duration(s.last-ms) * time.Millisecond
+                if behind > maxClockRegression {
+                        return 0, fmt.Errorf("clock moved back %s, refusing to generate IDs", behind)
+                }
+                ms = s.waitFor(s.last)
+        }
+
+        if ms == s.last {
+                s.seq = (s.seq + 1) & maxSequence
+                if s.seq == 0 {
+                        ms = s.waitFor(s.last + 1)
+                }
+        } else {
+                s.seq = 0
+        }
+        if ms >= 1<<41 {
+                return 0, fmt.Errorf("snowflake timestamp overflow")
+        }
+        s.last = ms
+        return ms<<(snowflakeNodeBits+snowflakeSeqBits) | s.node<<snowflakeSeqBits | s.seq, nil
+}
+
+func (s *Snowflake) millis() int64 {
+        return s.now().Sub(snowflakeEpoch).Milliseconds()
+}
+
+// Sleep until the clock reaches ms
+func (s *Snowflake) waitFor(ms int64) int64 {
+        for {
+                now := s.millis()
+                if now >= ms {
+                        return now
+                }
+                time.Sleep(time.Duration(ms-now) * time.Millisecond)
+        }
+}
+
+// RandomIDGenerator makes 63-bit IDs from 41 bits of milliseconds since
+// the snowflake epoch and 22 random bits, counted up within a millisecond
+// so each instance's IDs stay ordered. It needs no node ID, but instances
+// do not coordinate: two that each make an ID in the same millisecond
+// collide about once in 2^21 such pairs, and more often as the rate
+// grows. A collision fails the insert on the primary key rather than
+// overwriting an item. Use snowflake IDs where that is not acceptable.
+type RandomIDGenerator struct {
+        now func() time.Time
+
+        mu      sync.Mutex
+        last    int64 // Milliseconds of the last ID
+        entropy int64
+}
+
+const randomIDBits = 22
+
+func NewRandomIDGenerator() *RandomIDGenerator {
+        return &RandomIDGenerator{now: time.Now}
+}
+
+func (g *RandomIDGenerator) NextID() (int64, error) {
+        g.mu.Lock()
+        defer g.mu.Unlock()
+
+        // A clock that went back keeps counting from the last millisecond
+        // seen, so IDs stay ordered
+        ms := g.now().Sub(snowflakeEpoch).Milliseconds()
+        if ms < g.last {
+                ms = g.last
+        }
+
+        if ms == g.last {
+                g.entropy++
+                if g.entropy >= 1<<randomIDBits {
+                        // Out of IDs for this millisecond; borrow the next
+                        ms++
+                        g.entropy = randomEntropy()
+                }
+        } else {
+                g.entropy = randomEntropy()
+        }
+        if ms >= 1<<41 {
+                return 0, fmt.Errorf("random ID timestamp overflow")
+        }
+        g.last = ms
+        return ms<<randomIDBits | g.entropy, nil
+}
+
+// A random start for a millisecond's IDs, in the lower half of the range
+// so counting up from it rarely runs out
+func randomEntropy() int64 {
+        var b [4]byte
+        rand.Read(b[:])
+        return int64(binary.BigEndian.Uint32(b[:]) >> (32 - randomIDBits + 1))
+}
+
+// jsonID is an item ID as JSON carries it: a string, since generated IDs
+// are past 2^53, beyond what JavaScript numbers hold exactly. Numbers are
+// still read, for clients that send them.
+type jsonID int
+
+func (id jsonID) MarshalJSON() ([]byte, error) {
+        return []byte(`"` + strconv.Itoa(int(id)) + `"`), nil
+}
+
+func (id *jsonID) UnmarshalJSON(b []byte) error {
+        n, err := strconv.Atoi(strings.Trim(string(b), `"`))
+        if err != nil {
+                return fmt.Errorf("invalid item ID %s", b)
+        }
+        *id = jsonID(n)
+        return nil
+}
+
+// Items and events keep int IDs in Go; only their JSON swaps in jsonID
+
+func (item Item) MarshalJSON() ([]byte, error) {
+        type plain Item
+        return json.Marshal(struct {
+                ID jsonID `json:"id"`
+                plain
+        }{jsonID(item.ID), plain(item)})
+}
+
+func (item *Item) UnmarshalJSON(b []byte) error {
+        type plain Item
+        v := struct {
+                ID jsonID `json:"id"`
+                *plain
+        }{plain: (*plain)(item)}
+        if err := json.Unmarshal(b, &v); err != nil {
+                return err
+        }
+        item.ID = int(v.ID)
+        return nil
+}
+
+func (event ItemEvent) MarshalJSON() ([]byte, error) {
+        type plain ItemEvent
+        return json.Marshal(struct {
+                ItemID jsonID `json:"item_id"`
+                plain
+        }{jsonID(event.ItemID), plain(event)})
+}
+
+func (event *ItemEvent) UnmarshalJSON(b []byte) error {
+        type plain ItemEvent
+        v := struct {
+                ItemID jsonID `json:"item_id"`
+                *plain
+        }{plain: (*plain)(event)}
+        if err := json.Unmarshal(b, &v); err != nil {
+                return err
+        }
+        event.ItemID = int(v.ItemID)
+        return nil
+}
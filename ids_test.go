@@ -0,0 +1,51 @@
+package main
+
+import (
+        "encoding/json"
+        "strings"
+        "testing"
+        "time"
+)
+
+func TestItemIDsEncodeAsStrings(t *testing.T) {
+        const big = 1<<53 + 1 // Rounds to 2^53 as a JavaScript number
+        body, err := json.Marshal(Item{ID: big, Name: "widget"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !strings.Contains(string(body), `"id":"9007199254740993"`) {
+                t.Errorf("item encoded as %s, want the ID as a string", body)
+        }
+        body, _ = json.Marshal(ItemEvent{ID: 7, ItemID: big})
+        if !strings.Contains(string(body), `"item_id":"9007199254740993"`) || !strings.Contains(string(body), `"id":7`) {
+                t.Errorf("event encoded as %s, want the item ID as a string", body)
+        }
+
+        for _, in := range []string{`{"id":"9007199254740993"}`, `{"id":9007199254740993}`} {
+                var item Item
+                if err := json.Unmarshal([]byte(in), &item); err != nil || item.ID != big {
+                        t.Errorf("decoding %s: got %d, %v", in, item.ID, err)
+                }
+        }
+}
+
+func TestRandomIDsIncrease(t *testing.T) {
+        now := time.Now()
+        g := NewRandomIDGenerator()
+        g.now = func() time.Time { return now }
+
+        last, _ := g.NextID()
+        for i := 0; i < 1000; i++ {
+                if i == 500 {
+                        now = now.Add(-time.Second) // The clock stepping back keeps order
+                }
+                id, err := g.NextID()
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if id <= last {
+                        t.Fatalf("ID %d after %d", id, last)
+                }
+                last = id
+        }
+}
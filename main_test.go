@@ -0,0 +1,122 @@
+package main
+
+import (
+        "crypto/hmac"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/json"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "path/filepath"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// testEnv is a fresh SQLite database with the package globals the
+// handlers use pointed at it
+type testEnv struct {
+        t  *testing.T
+        DB *DB
+}
+
+// A testOption changes the environment before the test uses it
+type testOption func(*testEnv)
+
+// withTokens makes requests authenticate with tokens signed with
+// testTokenSecret, and name tenants by subdomains of baseDomain if set
+func withTokens(baseDomain string) testOption {
+        return func(e *testEnv) {
+                tenancy = NewTenancy(e.DB, baseDomain, []byte(testTokenSecret))
+        }
+}
+
+// newTestEnv migrates a fresh SQLite database and points the globals at
+// it and at a cache, event bus and audit log of its own, with no shards
+// or replicas. The globals are put back when the test ends, so tests do
+// not depend on the order they run in.
+func newTestEnv(t *testing.T, opts ...testOption) *testEnv {
+        t.Helper()
+        conn, err := openDB("sqlite://" + filepath.Join(t.TempDir(), "items.db"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if err := migrate(conn); err != nil {
+                t.Fatal(err)
+        }
+
+        oldDB, oldCache, oldBus, oldAudit, oldTenancy, oldReplicas, oldShards := db, cache, bus, audit, tenancy, replicas, shards
+        t.Cleanup(func() {
+                db, cache, bus, audit, tenancy, replicas, shards = oldDB, oldCache, oldBus, oldAudit, oldTenancy, oldReplicas, oldShards
+                conn.Close()
+        })
+        db = conn
+        cache = NewItemCache(NewLRUCache(100), time.Minute)
+        bus = NewEventBus()
+        audit = NewAuditLog(conn)
+        tenancy = NewTenancy(conn, "", nil)
+        replicas, shards = nil, nil
+
+        e := &testEnv{t: t, DB: conn}
+        for _, opt := range opts {
+                opt(e)
+        }
+        return e
+}
+
+// serve starts a server for the routes route adds, behind the middleware
+// main puts in front of the API, and stops it when the test ends
+func (e *testEnv) serve(route func(router *mux.Router)) *httptest.Server {
+        router := mux.NewRouter()
+        router.Use(tenancy.Middleware, replicas.Middleware, audit.Middleware)
+        route(router)
+        srv := httptest.NewServer(router)
+        e.t.Cleanup(srv.Close)
+        return srv
+}
+
+// itemRoutes adds the item CRUD routes the way main does
+func itemRoutes(router *mux.Router) {
+        versionRoutes(router, func(router *mux.Router) {
+                router.HandleFunc("/items", getItems).Methods("GET")
+                router.HandleFunc("/items/{id}", getItem).Methods("GET")
+                router.HandleFunc("/items", createItem).Methods("POST")
+                router.HandleFunc("/items/{id}", updateItem).Methods("PUT")
+                router.HandleFunc("/items/{id}", deleteItem).Methods("DELETE")
+        })
+}
+
+// signToken makes an HS256 bearer token such as Tenancy accepts
+func signToken(secret string, claims map[string]interface{}) string {
+        header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+        payload, _ := json.Marshal(claims)
+        signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+        mac := hmac.New(sha256.New, []byte(secret))
+        mac.Write([]byte(signed))
+        return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// do sends a request with the given headers and returns the status and body
+func do(t *testing.T, method, url, body string, headers map[string]string) (int, string) {
+        t.Helper()
+        req, err := http.NewRequest(method, url, strings.NewReader(body))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if body != "" {
+                req.Header.Set("Content-Type", "application/json")
+        }
+        for k, v := range headers {
+                req.Header.Set(k, v)
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        b, _ := io.ReadAll(resp.Body)
+        return resp.StatusCode, string(b)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+        "fmt"
+        "time"
+)
+
+// Schema changes, applied in order at startup and recorded in
+// schema_migrations. Append new entries; never edit a released one.
+// Other dialects keep their own list with the same versions.
+var migrations = []string{
+        // 1: items
+        "CREATE TABLE IF NOT EXISTS items (" +
+                "id INT AUTO_INCREMENT PRIMARY KEY, " +
+                "name VARCHAR(255) NOT NULL, " +
+                "`desc` TEXT NOT NULL)",
+        // 2: transactional outbox
+        "CREATE TABLE IF NOT EXISTS outbox (" +
+                "id BIGINT AUTO_INCREMENT PRIMARY KEY, " +
+                "event_type VARCHAR(64) NOT NULL, " +
+                "item_id INT NOT NULL, " +
+                "payload JSON NULL, " +
+                "created_at DATETIME(6) NOT NULL, " +
+                "published_at DATETIME(6) NULL, " +
+                "attempts INT NOT NULL DEFAULT 0, " +
+                "last_error TEXT NULL, " +
+                "INDEX idx_outbox_unpublished (published_at, id))",
+        // 3: modification time for Last-Modified
+        "ALTER TABLE items ADD COLUMN updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)",
+        // 4: tags
+        "CREATE TABLE IF NOT EXISTS tags (" +
+                "id INT AUTO_INCREMENT PRIMARY KEY, " +
+                "name VARCHAR(255) NOT NULL UNIQUE)",
+        // 5: item <-> tag links
+        "CREATE TABLE IF NOT EXISTS item_tags (" +
+                "item_id INT NOT NULL, " +
+                "tag_id INT NOT NULL, " +
+                "PRIMARY KEY (item_id, tag_id), " +
+                "INDEX (tag_id), " +
+                "CONSTRAINT item_tags_item_fk FOREIGN KEY (item_id) REFERENCES items (id) ON DELETE CASCADE, " +
+                "CONSTRAINT item_tags_tag_fk FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE)",
+        // 6: category tree
+        "CREATE TABLE IF NOT EXISTS categories (" +
+                "id INT AUTO_INCREMENT PRIMARY KEY, " +
+                "name VARCHAR(255) NOT NULL, " +
+                "parent_id INT NULL, " +
+                "INDEX (parent_id), " +
+                "CONSTRAINT categories_parent_fk FOREIGN KEY (parent_id) REFERENCES categories (id) ON DELETE CASCADE)",
+        // 7: item <-> category links
+        "CREATE TABLE IF NOT EXISTS item_categories (" +
+                "item_id INT NOT NULL, " +
+                "category_id INT NOT NULL, " +
+                "PRIMARY KEY (item_id, category_id), " +
+                "INDEX (category_id), " +
+                "CONSTRAINT item_categories_item_fk FOREIGN KEY (item_id) REFERENCES items (id) ON DELETE CASCADE, " +
+                "CONSTRAINT item_categories_category_fk FOREIGN KEY (category_id) REFERENCES categories (id) ON DELETE CASCADE)",
+        // 8: revision history; kept after the item is deleted
+        "CREATE TABLE IF NOT EXISTS item_revisions (" +
+                "item_id INT NOT NULL, " +
+                "revision INT NOT NULL, " +
+                "action VARCHAR(16) NOT NULL, " +
+                "principal VARCHAR(255) NOT NULL, " +
+                "name VARCHAR(255) NOT NULL, " +
+                "`desc` TEXT NOT NULL, " +
+                "diff JSON NOT NULL, " +
+                "reverted_from INT NULL, " +
+                "created_at DATETIME(6) NOT NULL, " +
+                "PRIMARY KEY (item_id, revision), " +
+                "INDEX (item_id, created_at))",
+        // 9: a first revision for items that predate history
+        "INSERT INTO item_revisions (item_id, revision, action, principal, name, `desc`, diff, created_at) " +
+                "SELECT id, 1, 'created', 'migration', name, `desc`, '{}', updated_at FROM items",
+        // 10: hash-chained audit log; before/after are TEXT so the stored
+        // bytes are exactly the ones hashed
+        "CREATE TABLE IF NOT EXISTS audit_log (" +
+                "id BIGINT AUTO_INCREMENT PRIMARY KEY, " +
+                "occurred_at DATETIME(6) NOT NULL, " +
+                "principal VARCHAR(255) NOT NULL, " +
+                "request_id VARCHAR(128) NOT NULL, " +
+                "route VARCHAR(255) NOT NULL, " +
+                "item_id INT NOT NULL DEFAULT 0, " +
+                "`before` MEDIUMTEXT NULL, " +
+                "`after` MEDIUMTEXT NULL, " +
+                "outcome VARCHAR(16) NOT NULL, " +
+                "status VARCHAR(255) NOT NULL, " +
+                "prev_hash CHAR(64) NOT NULL, " +
+                "hash CHAR(64) NOT NULL, " +
+                "INDEX (occurred_at), " +
+                "INDEX (principal), " +
+                "INDEX (item_id))",
+        // 11: the latest audit hash, locked to serialise appends
+        "CREATE TABLE IF NOT EXISTS audit_head (" +
+                "id TINYINT PRIMARY KEY, " +
+                "hash CHAR(64) NOT NULL)",
+        // 12
+        "INSERT IGNORE INTO audit_head (id, hash) VALUES (1, '" + auditGenesis + "')",
+        // 13: attachment metadata; the blobs live in the BlobStore
+        "CREATE TABLE IF NOT EXISTS attachments (" +
+                "id INT AUTO_INCREMENT PRIMARY KEY, " +
+                "item_id INT NOT NULL, " +
+                "filename VARCHAR(255) NOT NULL, " +
+                "content_type VARCHAR(255) NOT NULL, " +
+                "size BIGINT NOT NULL, " +
+                "sha256 CHAR(64) NOT NULL, " +
+                "created_at DATETIME(6) NOT NULL, " +
+                "INDEX (item_id), " +
+                "CONSTRAINT attachments_item_fk FOREIGN KEY (item_id) REFERENCES items (id) ON DELETE CASCADE)",
+        // 14-20: tenant scoping; existing rows belong to the default tenant
+        "ALTER TABLE items ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default', ADD INDEX (tenant_id, id)",
+        "ALTER TABLE tags ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default', DROP INDEX name, ADD UNIQUE (tenant_id, name)",
+        "ALTER TABLE categories ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default', ADD INDEX (tenant_id)",
+        "ALTER TABLE item_revisions ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'",
+        "ALTER TABLE audit_log ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default', ADD INDEX (tenant_id, id)",
+        "ALTER TABLE attachments ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'",
+        "ALTER TABLE outbox ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'",
+        // 21: per-tenant overrides of defaultQuota
+        "CREATE TABLE IF NOT EXISTS tenant_quotas (" +
+                "tenant_id VARCHAR(64) PRIMARY KEY, " +
+                "max_items INT NOT NULL, " +
+                "requests_per_second DOUBLE NOT NULL, " +
+                "burst INT NOT NULL)",
+        // 22-23: heartbeat written on the primary to measure replica lag
+        "CREATE TABLE IF NOT EXISTS replica_heartbeat (" +
+                "id TINYINT PRIMARY KEY, " +
+                "beat_at DATETIME(6) NOT NULL)",
+        "INSERT IGNORE INTO replica_heartbeat (id, beat_at) VALUES (1, '1970-01-01 00:00:00')",
+        // 24-25: ID counters for rows spread over shards
+        "CREATE TABLE IF NOT EXISTS id_counters (" +
+                "name VARCHAR(32) PRIMARY KEY, " +
+                "last_id BIGINT NOT NULL)",
+        "INSERT IGNORE INTO id_counters (name, last_id) VALUES ('items', 0), ('attachments', 0)",
+        // 26: where a forwarded shard event came from, so it is only forwarded once
+        "ALTER TABLE outbox ADD COLUMN source VARCHAR(128) NULL, ADD UNIQUE (source)",
+        // 27-36: 64-bit item IDs for generated IDs; the foreign keys come
+        // off while the columns they join change type
+        "ALTER TABLE item_tags DROP FOREIGN KEY item_tags_item_fk, MODIFY item_id BIGINT NOT NULL",
+        "ALTER TABLE item_categories DROP FOREIGN KEY item_categories_item_fk, MODIFY item_id BIGINT NOT NULL",
+        "ALTER TABLE attachments DROP FOREIGN KEY attachments_item_fk, MODIFY item_id BIGINT NOT NULL",
+        "ALTER TABLE items MODIFY id BIGINT AUTO_INCREMENT",
+        "ALTER TABLE item_tags ADD CONSTRAINT item_tags_item_fk FOREIGN KEY (item_id) REFERENCES items (id) ON DELETE CASCADE",
+        "ALTER TABLE item_categories ADD CONSTRAINT item_categories_item_fk FOREIGN KEY (item_id) REFERENCES items (id) ON DELETE CASCADE",
+        "ALTER TABLE attachments ADD CONSTRAINT attachments_item_fk FOREIGN KEY (item_id) REFERENCES items (id) ON DELETE CASCADE",
+        "ALTER TABLE item_revisions MODIFY item_id BIGINT NOT NULL",
+        "ALTER TABLE audit_log MODIFY item_id BIGINT NOT NULL DEFAULT 0",
+        "ALTER TABLE outbox MODIFY item_id BIGINT NOT NULL",
+        // 37: browser sessions, keyed by a hash of the session ID
+        "CREATE TABLE IF NOT EXISTS sessions (" +
+                "id CHAR(64) PRIMARY KEY, " +
+                "principal VARCHAR(255) NOT NULL, " +
+                "data TEXT NOT NULL, " +
+                "created_at DATETIME(6) NOT NULL, " +
+                "last_seen_at DATETIME(6) NOT NULL, " +
+                "expires_at DATETIME(6) NOT NULL, " +
+                "INDEX (expires_at))",
+        // 38-39: lease electing the one instance that rebalances shards, and
+        // the ring it last finished placing every item for
+        "CREATE TABLE IF NOT EXISTS shard_rebalance (" +
+                "id TINYINT PRIMARY KEY, " +
+                "holder VARCHAR(255) NOT NULL, " +
+                "expires_at DATETIME(6) NOT NULL, " +
+                "ring VARCHAR(1024) NOT NULL)",
+        "INSERT IGNORE INTO shard_rebalance (id, holder, expires_at, ring) VALUES (1, '', '1970-01-01 00:00:00', '')",
+        // 40-41: webhook subscriptions and their deliveries, shared by every
+        // instance. event_key names the webhook and outbox event a delivery
+        // was made for, so instances relaying the same event queue it once;
+        // replays leave it NULL.
+        "CREATE TABLE IF NOT EXISTS webhooks (" +
+                "id INT AUTO_INCREMENT PRIMARY KEY, " +
+                "tenant_id VARCHAR(64) NOT NULL, " +
+                "url VARCHAR(2048) NOT NULL, " +
+                "events TEXT NOT NULL, " +
+                "secret VARCHAR(255) NOT NULL, " +
+                "created_at DATETIME(6) NOT NULL, " +
+                "INDEX (tenant_id))",
+        "CREATE TABLE IF NOT EXISTS webhook_deliveries (" +
+                "id BIGINT AUTO_INCREMENT PRIMARY KEY, " +
+                "webhook_id INT NOT NULL, " +
+                "tenant_id VARCHAR(64) NOT NULL, " +
+                "event TEXT NOT NULL, " +
+                "event_key VARCHAR(64) NULL, " +
+                "status VARCHAR(16) NOT NULL, " +
+                "attempts INT NOT NULL DEFAULT 0, " +
+                "last_status INT NOT NULL DEFAULT 0, " +
+                "last_error TEXT NULL, " +
+                "next_retry DATETIME(6) NOT NULL, " +
+                "updated_at DATETIME(6) NOT NULL, " +
+                "UNIQUE (event_key), " +
+                "INDEX (status, next_retry), " +
+                "INDEX (webhook_id, id), " +
+                "INDEX (tenant_id, status))",
+        // 42-45: an audit chain per tenant on each database, so a tenant's log
+        // can be checked alone and a change's entry written in the change's
+        // transaction. Entries already written were chained across tenants
+        // and are left out of the new chains by since_id.
+        "CREATE TABLE IF NOT EXISTS audit_heads (" +
+                "tenant_id VARCHAR(64) PRIMARY KEY, " +
+                "hash CHAR(64) NOT NULL, " +
+                "since_id BIGINT NOT NULL DEFAULT 0)",
+        "INSERT IGNORE INTO audit_heads (tenant_id, hash, since_id) " +
+                "SELECT tenant_id, '" + auditGenesis + "', MAX(id) FROM audit_log GROUP BY tenant_id",
+        "INSERT IGNORE INTO id_counters (name, last_id) VALUES ('audit_log', 0)",
+        "DROP TABLE IF EXISTS audit_head",
+        // 46: a row per tenant that inserts lock to check the item quota in turn
+        "CREATE TABLE IF NOT EXISTS tenant_locks (tenant_id VARCHAR(64) PRIMARY KEY)",
+}
+
+// Stands in for a version that needs no change on some backend, keeping
+// the version numbers of every dialect in step
+const noMigration = "SELECT 1"
+
+// Apply any migrations the database has not seen yet
+func migrate(db *DB) error {
+        if _, err := db.Exec(db.Dialect.MigrationsTable()); err != nil {
+                return err
+        }
+
+        var current int
+        if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+                return err
+        }
+
+        steps := db.Dialect.Migrations()
+        for i := current; i < len(steps); i++ {
+                version := i + 1
+                if _, err := db.Exec(steps[i]); err != nil {
+                        return fmt.Errorf("migration %d: %v", version, err)
+                }
+                if _, err := db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", version, time.Now().UTC()); err != nil {
+                        return fmt.Errorf("migration %d: %v", version, err)
+                }
+        }
+        return nil
+}
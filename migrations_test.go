@@ -0,0 +1,163 @@
+package main
+
+import (
+        "path/filepath"
+        "regexp"
+        "sort"
+        "strings"
+        "testing"
+)
+
+// The tables a migration creates, changes or fills
+var migrationTables = regexp.MustCompile("(?i)(?:CREATE TABLE(?: IF NOT EXISTS)?|ALTER TABLE|INSERT(?: IGNORE| OR IGNORE)? INTO|UPDATE|DELETE FROM|DROP TABLE(?: IF EXISTS)?|INDEX(?: IF NOT EXISTS)? \\w+ ON) [\"`]?(\\w+)")
+
+func tablesChanged(step string) string {
+        seen := map[string]bool{}
+        var tables []string
+        for _, m := range migrationTables.FindAllStringSubmatch(step, -1) {
+                if name := strings.ToLower(m[1]); !seen[name] {
+                        seen[name] = true
+                        tables = append(tables, name)
+                }
+        }
+        sort.Strings(tables)
+        return strings.Join(tables, ", ")
+}
+
+// Each version changes the same tables on every backend, or is
+// noMigration where that backend needs no change
+func TestDialectsShareMigrationVersions(t *testing.T) {
+        if len(postgresMigrations) != len(migrations) || len(sqliteMigrations) != len(migrations) {
+                t.Fatalf("MySQL has %d migrations, Postgres %d, SQLite %d; versions must line up",
+                        len(migrations), len(postgresMigrations), len(sqliteMigrations))
+        }
+        for i, step := range migrations {
+                want := tablesChanged(step)
+                for name, steps := range map[string][]string{"Postgres": postgresMigrations, "SQLite": sqliteMigrations} {
+                        if steps[i] == noMigration {
+                                continue
+                        }
+                        if got := tablesChanged(steps[i]); got != want {
+                                t.Errorf("migration %d changes %s on MySQL but %s on %s", i+1, want, got, name)
+                        }
+                }
+        }
+}
+
+// Migrations are not rebound, so the other dialects must not use MySQL's
+// spellings. SQLite takes backticks; Postgres does not.
+func TestDialectMigrationsAvoidMySQLSyntax(t *testing.T) {
+        mysqlOnly := []string{"AUTO_INCREMENT", "INSERT IGNORE", "ON DUPLICATE KEY", " MODIFY ", "FOREIGN_KEY_CHECKS", "ENGINE="}
+        for name, d := range map[string]struct {
+                steps []string
+                also  []string
+        }{
+                "Postgres": {postgresMigrations, []string{"`", "DATETIME", "TINYINT", "DOUBLE NOT NULL"}},
+                "SQLite":   {sqliteMigrations, []string{"DROP FOREIGN KEY", "DATETIME("}},
+        } {
+                for i, step := range d.steps {
+                        for _, syntax := range append(mysqlOnly, d.also...) {
+                                if strings.Contains(strings.ToUpper(step), syntax) {
+                                        t.Errorf("%s migration %d uses %q", name, i+1, strings.TrimSpace(syntax))
+                                }
+                        }
+                }
+        }
+}
+
+// MySQL only drops a foreign key by name, and the names it makes up
+// depend on the order keys were added, so every key is named
+func TestMySQLForeignKeysAreNamed(t *testing.T) {
+        named := regexp.MustCompile(`CONSTRAINT (\w+) FOREIGN KEY`)
+        dropped := regexp.MustCompile(`DROP FOREIGN KEY (\w+)`)
+        live := map[string]bool{}
+        for i, step := range migrations {
+                version := i + 1
+                if n := strings.Count(step, "FOREIGN KEY ("); n != len(named.FindAllString(step, -1)) {
+                        t.Errorf("migration %d adds a foreign key without naming it", version)
+                }
+                for _, m := range dropped.FindAllStringSubmatch(step, -1) {
+                        if !live[m[1]] {
+                                t.Errorf("migration %d drops foreign key %s, which no earlier migration created", version, m[1])
+                        }
+                        delete(live, m[1])
+                }
+                for _, m := range named.FindAllStringSubmatch(step, -1) {
+                        if live[m[1]] {
+                                t.Errorf("migration %d adds foreign key %s twice", version, m[1])
+                        }
+                        live[m[1]] = true
+                }
+        }
+}
+
+// stepsDialect is SQLite with its own list of migrations
+type stepsDialect struct {
+        sqliteDialect
+        steps []string
+}
+
+func (d stepsDialect) Migrations() []string { return d.steps }
+
+func TestMigrateAppliesEachVersionOnce(t *testing.T) {
+        conn, err := openDB("sqlite://" + filepath.Join(t.TempDir(), "m.db"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        version := func() int {
+                var v int
+                if err := conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&v); err != nil {
+                        t.Fatal(err)
+                }
+                return v
+        }
+
+        steps := []string{
+                "CREATE TABLE a (id INT)",
+                "INSERT INTO a (id) VALUES (1)",
+        }
+        conn.Dialect = stepsDialect{steps: steps}
+        if err := migrate(conn); err != nil {
+                t.Fatal(err)
+        }
+        if err := migrate(conn); err != nil {
+                t.Fatalf("second run: %v", err)
+        }
+        var rows int
+        conn.QueryRow("SELECT COUNT(*) FROM a").Scan(&rows)
+        if v := version(); v != 2 || rows != 1 {
+                t.Errorf("at version %d with %d rows, want 2 and 1", v, rows)
+        }
+
+        // A failing step stops the run at the version before it
+        conn.Dialect = stepsDialect{steps: append(steps, "INSERT INTO a (id) VALUES (2)", "NOT SQL", "INSERT INTO a (id) VALUES (3)")}
+        err = migrate(conn)
+        if err == nil || !strings.HasPrefix(err.Error(), "migration 4:") {
+                t.Errorf("got %v, want migration 4 to fail", err)
+        }
+        if v := version(); v != 3 {
+                t.Errorf("at version %d after the failure, want 3", v)
+        }
+
+        // Fixed, the run resumes from there
+        conn.Dialect = stepsDialect{steps: append(steps, "INSERT INTO a (id) VALUES (2)", "SELECT 1", "INSERT INTO a (id) VALUES (3)")}
+        if err := migrate(conn); err != nil {
+                t.Fatal(err)
+        }
+        conn.QueryRow("SELECT COUNT(*) FROM a").Scan(&rows)
+        if v := version(); v != 5 || rows != 3 {
+                t.Errorf("at version %d with %d rows, want 5 and 3", v, rows)
+        }
+}
+
+func TestSQLiteSchemaMigrates(t *testing.T) {
+        conn := newTestEnv(t).DB
+        var v int
+        if err := conn.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&v); err != nil {
+                t.Fatal(err)
+        }
+        if v != len(sqliteMigrations) {
+                t.Errorf("at version %d, want %d", v, len(sqliteMigrations))
+        }
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+        "encoding/csv"
+        "encoding/json"
+        "encoding/xml"
+        "errors"
+        "fmt"
+        "io"
+        "mime"
+        "net/http"
+        "sort"
+        "strconv"
+        "strings"
+
+        "github.com/vmihailenco/msgpack/v5"
+)
+
+// Media types understood by writeResponse and decodeRequest
+const (
+        mediaJSON    = "application/json"
+        mediaXML     = "application/xml"
+        mediaCSV     = "text/csv"
+        mediaMsgpack = "application/msgpack"
+)
+
+// Aliases clients commonly send, mapped to the canonical type
+var mediaAliases = map[string]string{
+        "application/json":        mediaJSON,
+        "application/xml":         mediaXML,
+        "text/xml":                mediaXML,
+        "text/csv":                mediaCSV,
+        "application/msgpack":     mediaMsgpack,
+        "application/x-msgpack":   mediaMsgpack,
+        "application/vnd.msgpack": mediaMsgpack,
+}
+
+// Order used when the client accepts several types equally
+var responseTypes = []string{mediaJSON, mediaXML, mediaCSV, mediaMsgpack}
+
+var errNotAcceptable = errors.New("not acceptable")
+
+// itemList gives a list of items a root element in XML
+type itemList struct {
+        XMLName xml.Name      `xml:"items"`
+        Items   []interface{} `xml:"item"`
+}
+
+// encodeXMLList writes a list under a root element, for lists whose JSON
+// is a bare array. Their elements name themselves with XMLName.
+func encodeXMLList(e *xml.Encoder, root string, list interface{}) error {
+        return e.EncodeElement(struct{ List interface{} }{list}, xml.StartElement{Name: xml.Name{Local: root}})
+}
+
+type acceptRange struct {
+        mediaType string
+        q         float64
+}
+
+// negotiate picks the response type from the Accept header.
+// CSV is only offered for lists of items.
+func negotiate(r *http.Request, list bool) (string, error) {
+        header := r.Header.Get("Accept")
+        if header == "" {
+                return mediaJSON, nil
+        }
+
+        ranges := []acceptRange{}
+        for _, part := range strings.Split(header, ",") {
+                mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+                if err != nil {
+                        continue
+                }
+                q := 1.0
+                if v, ok := params["q"]; ok {
+                        if q, err = strconv.ParseFloat(v, 64); err != nil {
+                                continue
+                        }
+                }
+                if q > 0 {
+                        ranges = append(ranges, acceptRange{mediaType, q})
+                }
+        }
+        sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+        for _, ar := range ranges {
+                for _, candidate := range responseTypes {
+                        if candidate == mediaCSV && !list {
+                                continue
+                        }
+                        if mediaMatches(ar.mediaType, candidate) {
+                                return candidate, nil
+                        }
+                }
+        }
+        return "", errNotAcceptable
+}
+
+// mediaMatches reports whether an Accept range such as text/* covers candidate
+func mediaMatches(accept, candidate string) bool {
+        if accept == "*/*" {
+                return true
+        }
+        if strings.HasSuffix(accept, "/*") {
+                // text/* also covers text/xml, an alias of application/xml
+                for alias, canonical := range mediaAliases {
+                        if canonical == candidate && strings.HasPrefix(alias, strings.TrimSuffix(accept, "*")) {
+                                return true
+                        }
+                }
+                return false
+        }
+        return mediaAliases[accept] == candidate
+}
+
+// acceptable negotiates the response type before a handler does any
+// work, so a request that cannot be answered changes nothing and a 304
+// is only sent for a representation the client takes. It writes a 406
+// and returns false if no supported type is acceptable.
+func acceptable(w http.ResponseWriter, r *http.Request, list bool) bool {
+        addVary(w.Header(), "Accept")
+        if _, err := negotiate(r, list); err != nil {
+                supported := "application/json, application/xml, application/msgpack"
+                if list {
+                        supported += ", text/csv"
+                }
+                http.Error(w, "Not Acceptable; supported types: "+supported, http.StatusNotAcceptable)
+                return false
+        }
+        return true
+}
+
+// writeResponse encodes v in the format the client asked for, in the
+// shape of the request's API version. v is an Item, a []Item, or a body
+// the handler has already put in the version's shape. The handler must
+// have checked the request is acceptable first.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+        items, list := v.([]Item)
+        _, single := v.(Item)
+        version := requestVersion(r)
+        body := version.wire(v)
+
+        mediaType, err := negotiate(r, list)
+        if err != nil {
+                mediaType = mediaJSON // Unreachable once acceptable has passed
+        }
+
+        addVary(w.Header(), "Accept")
+        w.Header().Set("Content-Type", mediaType)
+        w.WriteHeader(status)
+
+        switch mediaType {
+        case mediaXML:
+                io.WriteString(w, xml.Header)
+                if list {
+                        root := itemList{}
+                        for _, item := range items {
+                                root.Items = append(root.Items, version.wire(item))
+                        }
+                        xml.NewEncoder(w).Encode(root)
+                } else if single {
+                        xml.NewEncoder(w).EncodeElement(body, xml.StartElement{Name: xml.Name{Local: "item"}})
+                } else {
+                        xml.NewEncoder(w).Encode(body)
+                }
+        case mediaCSV:
+                writeItemsCSV(w, items, version.csvHeader)
+        case mediaMsgpack:
+                enc := msgpack.NewEncoder(w)
+                enc.SetCustomStructTag("json")
+                enc.Encode(body)
+        default:
+                json.NewEncoder(w).Encode(body)
+        }
+}
+
+func writeItemsCSV(w io.Writer, items []Item, header []string) error {
+        cw := csv.NewWriter(w)
+        cw.Write(header)
+        for _, item := range items {
+                cw.Write([]string{strconv.Itoa(item.ID), item.Name, item.Desc})
+        }
+        cw.Flush()
+        return cw.Error()
+}
+
+// decodeRequest reads the request body according to its Content-Type,
+// mapping an Item from the request's API version. It writes a 415 or 400
+// response and returns false on failure.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+        item, isItem := v.(*Item)
+        var body wireItem
+        if version := requestVersion(r); isItem && version.newBody != nil {
+                body = version.newBody()
+                v = body
+        }
+
+        mediaType := mediaJSON
+        if header := r.Header.Get("Content-Type"); header != "" {
+                parsed, _, err := mime.ParseMediaType(header)
+                if err != nil {
+                        http.Error(w, "Invalid Content-Type", http.StatusBadRequest)
+                        return false
+                }
+                mediaType = mediaAliases[parsed]
+        }
+
+        var err error
+        switch mediaType {
+        case mediaJSON:
+                err = json.NewDecoder(r.Body).Decode(v)
+        case mediaXML:
+                err = xml.NewDecoder(r.Body).Decode(v)
+        case mediaMsgpack:
+                dec := msgpack.NewDecoder(r.Body)
+                dec.SetCustomStructTag("json")
+                err = dec.Decode(v)
+        default:
+                http.Error(w, fmt.Sprintf("Unsupported Media Type; send %s, %s or %s", mediaJSON, mediaXML, mediaMsgpack), http.StatusUnsupportedMediaType)
+                return false
+        }
+
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return false
+        }
+        if body != nil {
+                *item = body.item()
+        }
+        return true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+        "net/http"
+        "strconv"
+        "testing"
+)
+
+func TestUnacceptableRequestChangesNothing(t *testing.T) {
+        srv := newTestEnv(t).serve(itemRoutes)
+        csv := map[string]string{"Accept": "text/csv"} // Only offered for lists
+
+        if code, _ := do(t, "POST", srv.URL+"/items", `{"name":"widget"}`, csv); code != http.StatusNotAcceptable {
+                t.Fatalf("create: got %d, want 406", code)
+        }
+        if items, _ := listItems(defaultTenant); len(items) != 0 {
+                t.Fatalf("406 response still created %v", items)
+        }
+
+        item, err := insertItem(Actor{Tenant: defaultTenant}, Item{Name: "widget"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        url := srv.URL + "/items/" + strconv.Itoa(item.ID)
+        if code, _ := do(t, "PUT", url, `{"name":"renamed"}`, csv); code != http.StatusNotAcceptable {
+                t.Errorf("update: got %d, want 406", code)
+        }
+        if got, _ := loadItem(defaultTenant, item.ID); got.Name != "widget" {
+                t.Errorf("406 response still updated the item to %q", got.Name)
+        }
+
+        // A matching validator is no reason to skip negotiation
+        req, _ := http.NewRequest("GET", url, nil)
+        req.Header.Set("Accept", "text/csv")
+        req.Header.Set("If-None-Match", itemETag(item))
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+                t.Fatal(err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusNotAcceptable {
+                t.Errorf("conditional get: got %d, want 406", resp.StatusCode)
+        }
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+        "context"
+        "crypto/subtle"
+        "errors"
+        "fmt"
+        "log"
+        "net/http"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/coreos/go-oidc/v3/oidc"
+        "github.com/gorilla/mux"
+        "golang.org/x/oauth2"
+)
+
+const (
+        // Session values of a user signed in through the provider
+        oidcIssuerValue  = "oidc_issuer"
+        oidcRefreshValue = "oidc_refresh_token"
+        oidcExpiryValue  = "oidc_expiry"
+
+        oidcLoginCookie  = "oidc_login"
+        oidcLoginTimeout = 10 * time.Minute
+)
+
+var (
+        errIdPUnavailable = errors.New("identity provider unavailable")
+        errOIDCNoRefresh  = errors.New("no refresh token")
+        errOIDCOtherUser  = errors.New("refreshed ID token is for another user or tenant")
+)
+
+// OIDCLogin signs users in to the item API through an OpenID Connect
+// provider, with the authorization code flow and PKCE, and starts a
+// session for them with the SessionManager. The session lasts as long as
+// the provider keeps refreshing its tokens, so a user disabled there is
+// signed out here once their access token expires.
+//
+// The discovery document is fetched again every discoveryTTL; go-oidc
+// caches the JWKS and fetches it again when a token names a key it has
+// not seen, as it will after the provider rotates keys.
+type OIDCLogin struct {
+        issuer       string
+        oauth        oauth2.Config // Endpoint comes from discovery
+        sessions     *SessionManager
+        client       *http.Client
+        discoveryTTL time.Duration
+
+        mu           sync.Mutex
+        provider     *oidc.Provider
+        discoveredAt time.Time
+
+        refreshMu  sync.Mutex
+        refreshing map[string]*oidcRefresh // By the refresh token being spent
+}
+
+// One refresh, shared by the requests that arrive while it runs or soon
+// after: a refresh token may only be spent once
+type oidcRefresh struct {
+        done  chan struct{}
+        token *oauth2.Token
+        err   error
+}
+
+// What the browser carries from /auth/login to /auth/callback
+type oidcPending struct {
+        State    string
+        Nonce    string
+        Verifier string
+        Next     string
+        Started  time.Time
+}
+
+func NewOIDCLogin(issuer, clientID, clientSecret, redirectURL string, scopes []string, sessions *SessionManager) *OIDCLogin {
+        return &OIDCLogin{
+                issuer: strings.TrimSuffix(issuer, "/"),
+                oauth: oauth2.Config{
+                        ClientID:     clientID,
+                        ClientSecret: clientSecret,
+                        RedirectURL:  redirectURL,
+                        Scopes:       scopes,
+                },
+                sessions:     sessions,
+                client:       &http.Client{Timeout: 10 * time.Second},
+                discoveryTTL: time.Hour,
+                refreshing:   map[string]*oidcRefresh{},
+        }
+}
+
+// Handler routes the login flow under /auth
+func (l *OIDCLogin) Handler() http.Handler {
+        router := mux.NewRouter().PathPrefix("/auth").Subrouter()
+        router.Use(l.sessions.Middleware)
+
+        router.HandleFunc("/login", l.login).Methods("GET")
+        router.HandleFunc("/callback", l.callback).Methods("GET")
+        router.HandleFunc("/logout", l.logout).Methods("POST")
+        return router
+}
+
+// discover returns the provider's configuration, fetching it again once
+// it is older than discoveryTTL. If the provider cannot be reached the
+// last one fetched is used, and fetching is tried again in a minute.
+func (l *OIDCLogin) discover(ctx context.Context) (*oidc.Provider, error) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        if l.provider != nil && time.Since(l.discoveredAt) < l.discoveryTTL {
+                return l.provider, nil
+        }
+
+        provider, err := oidc.NewProvider(oidc.ClientContext(ctx, l.client), l.issuer)
+        if err != nil {
+                if l.provider == nil {
+                        return nil, fmt.Errorf("%w: %v", errIdPUnavailable, err)
+                }
+                log.Printf("oidc: discovery failed, using the last one: %v", err)
+                l.discoveredAt = time.Now().Add(time.Minute - l.discoveryTTL)
+                return l.provider, nil
+        }
+        l.provider, l.discoveredAt = provider, time.Now()
+        return provider, nil
+}
+
+func (l *OIDCLogin) config(provider *oidc.Provider) *oauth2.Config {
+        config := l.oauth
+        config.Endpoint = provider.Endpoint()
+        return &config
+}
+
+// Send the browser to the provider. next is where to go once signed in;
+// login_hint is passed on to the provider.
+func (l *OIDCLogin) login(w http.ResponseWriter, r *http.Request) {
+        provider, err := l.discover(r.Context())
+        if err != nil {
+                log.Printf("oidc: %v", err)
+                http.Error(w, errIdPUnavailable.Error(), http.StatusBadGateway)
+                return
+        }
+
+        pending := oidcPending{
+                State:    randomToken(),
+                Nonce:    randomToken(),
+                Verifier: oauth2.GenerateVerifier(),
+                Next:     r.URL.Query().Get("next"),
+                Started:  time.Now(),
+        }
+        value, err := l.sessions.codec.Encode(oidcLoginCookie, pending)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+        }
+        l.sessions.setCookie(w, r, oidcLoginCookie, value, int(oidcLoginTimeout.Seconds()), true)
+
+        opts := []oauth2.AuthCodeOption{oidc.Nonce(pending.Nonce), oauth2.S256ChallengeOption(pending.Verifier)}
+        if hint := r.URL.Query().Get("login_hint"); hint != "" {
+                opts = append(opts, oauth2.SetAuthURLParam("login_hint", hint))
+        }
+        http.Redirect(w, r, l.config(provider).AuthCodeURL(pending.State, opts...), http.StatusFound)
+}
+
+// The provider sends the browser back here with a code, which is traded
+// for tokens with the PKCE verifier only this browser's cookie holds
+func (l *OIDCLogin) callback(w http.ResponseWriter, r *http.Request) {
+        var pending oidcPending
+        cookie, err := r.Cookie(oidcLoginCookie)
+        if err != nil || l.sessions.codec.Decode(oidcLoginCookie, cookie.Value, &pending) != nil || time.Since(pending.Started) > oidcLoginTimeout {
+                http.Error(w, "sign-in expired or was not started in this browser; try again", http.StatusBadRequest)
+                return
+        }
+        l.sessions.setCookie(w, r, oidcLoginCookie, "", -1, true)
+
+        q := r.URL.Query()
+        if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(pending.State)) != 1 {
+                http.Error(w, "sign-in state does not match; try again", http.StatusBadRequest)
+                return
+        }
+        if e := q.Get("error"); e != "" {
+                log.Printf("oidc: provider refused sign-in: %s %s", e, q.Get("error_description"))
+                http.Error(w, "sign-in failed: "+e, http.StatusUnauthorized)
+                return
+        }
+
+        provider, err := l.discover(r.Context())
+        if err != nil {
+                log.Printf("oidc: %v", err)
+                http.Error(w, errIdPUnavailable.Error(), http.StatusBadGateway)
+                return
+        }
+        ctx := oidc.ClientContext(r.Context(), l.client)
+        token, err := l.config(provider).Exchange(ctx, q.Get("code"), oauth2.VerifierOption(pending.Verifier))
+        if err != nil {
+                l.tokenError(w, err)
+                return
+        }
+        idToken, who, err := l.verify(ctx, provider, token)
+        if err != nil {
+                log.Printf("oidc: %v", err)
+                http.Error(w, "sign-in failed: invalid ID token", http.StatusUnauthorized)
+                return
+        }
+        if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(pending.Nonce)) != 1 {
+                http.Error(w, "sign-in failed: ID token is not for this sign-in", http.StatusUnauthorized)
+                return
+        }
+
+        s, err := l.sessions.Login(w, r, who.User, who.Tenant)
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        l.storeToken(s, token)
+        if err := l.sessions.Save(r.Context(), s); err != nil {
+                dbError(w, err)
+                return
+        }
+
+        // Only follow paths on this site, so sign-in cannot be used to send
+        // users elsewhere
+        next := pending.Next
+        if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+                next = "/v2/items"
+        }
+        http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (l *OIDCLogin) logout(w http.ResponseWriter, r *http.Request) {
+        if err := l.sessions.Logout(w, r); err != nil {
+                dbError(w, err)
+                return
+        }
+        w.WriteHeader(http.StatusNoContent)
+}
+
+// Who an ID token names: the user, by their email if the provider has
+// verified it or else the subject, and the tenant from the "tenant" claim.
+// Users the provider gives no tenant belong to the default one.
+type oidcIdentity struct {
+        User   string
+        Tenant string
+}
+
+// verify checks the token response's ID token and returns who it names
+func (l *OIDCLogin) verify(ctx context.Context, provider *oidc.Provider, token *oauth2.Token) (*oidc.IDToken, oidcIdentity, error) {
+        var who oidcIdentity
+        raw, _ := token.Extra("id_token").(string)
+        if raw == "" {
+                return nil, who, errors.New("token response has no ID token")
+        }
+        idToken, err := provider.Verifier(&oidc.Config{ClientID: l.oauth.ClientID}).Verify(ctx, raw)
+        if err != nil {
+                return nil, who, err
+        }
+        var claims struct {
+                Email         string `json:"email"`
+                EmailVerified bool   `json:"email_verified"`
+                Tenant        string `json:"tenant"`
+        }
+        if err := idToken.Claims(&claims); err != nil {
+                return nil, who, err
+        }
+
+        who.User, who.Tenant = idToken.Subject, claims.Tenant
+        if claims.Email != "" && claims.EmailVerified {
+                who.User = claims.Email
+        }
+        if who.Tenant == "" {
+                who.Tenant = defaultTenant
+        }
+        if !tenantPattern.MatchString(who.Tenant) {
+                return nil, who, fmt.Errorf("%w %q in ID token", errInvalidTenant, who.Tenant)
+        }
+        return idToken, who, nil
+}
+
+// Keep what is needed to refresh the tokens. The access token itself is
+// not kept: the API only trusts the session.
+func (l *OIDCLogin) storeToken(s *Session, token *oauth2.Token) {
+        s.Values[oidcIssuerValue] = l.issuer
+        if token.RefreshToken != "" {
+                s.Values[oidcRefreshValue] = token.RefreshToken
+        }
+        if token.Expiry.IsZero() {
+                delete(s.Values, oidcExpiryValue)
+        } else {
+                s.Values[oidcExpiryValue] = token.Expiry.UTC().Format(time.RFC3339)
+        }
+}
+
+// Write an error from the token endpoint: 401 if the provider said no,
+// 502 if it could not be asked
+func (l *OIDCLogin) tokenError(w http.ResponseWriter, err error) {
+        log.Printf("oidc: token request: %v", err)
+        if oidcRefused(err) {
+                http.Error(w, "sign-in failed", http.StatusUnauthorized)
+                return
+        }
+        http.Error(w, errIdPUnavailable.Error(), http.StatusBadGateway)
+}
+
+// Whether the provider turned a request down, as opposed to failing to
+// answer it. oauth2 flattens network errors to text, so only a refusal can
+// be told apart.
+func oidcRefused(err error) bool {
+        var refused *oauth2.RetrieveError
+        if errors.As(err, &refused) {
+                return refused.Response == nil || refused.Response.StatusCode < 500
+        }
+        return errors.Is(err, errOIDCNoRefresh) || errors.Is(err, errOIDCOtherUser)
+}
+
+// Middleware refreshes the tokens of a session signed in through the
+// provider once its access token has expired. If the provider refuses,
+// the session ends; if it cannot be reached, the request fails and the
+// session is kept. It runs after the session middleware; nil does nothing.
+func (l *OIDCLogin) Middleware(next http.Handler) http.Handler {
+        if l == nil {
+                return next
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                s := requestUserSession(r)
+                if s == nil || s.Values[oidcIssuerValue] == "" || !l.expired(s) {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+
+                token, err := l.refresh(r.Context(), s)
+                if err != nil && oidcRefused(err) {
+                        log.Printf("oidc: session of %s ended: %v", s.User, err)
+                        if err := l.sessions.Logout(w, r); err != nil {
+                                dbError(w, err)
+                                return
+                        }
+                        http.Error(w, "session ended; sign in again", http.StatusUnauthorized)
+                        return
+                } else if err != nil {
+                        log.Printf("oidc: refreshing %s: %v", s.User, err)
+                        http.Error(w, errIdPUnavailable.Error(), http.StatusBadGateway)
+                        return
+                }
+
+                l.storeToken(s, token)
+                if err := l.sessions.Save(r.Context(), s); err != nil {
+                        dbError(w, err)
+                        return
+                }
+                next.ServeHTTP(w, r)
+        })
+}
+
+// Whether the session's access token has expired, or is about to. A
+// session from another issuer, such as before a change of provider, counts
+// as expired and fails to refresh.
+func (l *OIDCLogin) expired(s *Session) bool {
+        if s.Values[oidcIssuerValue] != l.issuer {
+                return true
+        }
+        expiry, err := time.Parse(time.RFC3339, s.Values[oidcExpiryValue])
+        return err == nil && time.Until(expiry) < 10*time.Second
+}
+
+// refresh spends the session's refresh token once, however many requests
+// need it. New tokens are kept for a minute after, for requests that loaded
+// the session before it was saved with them; a failure is not kept, so the
+// next request tries again.
+func (l *OIDCLogin) refresh(ctx context.Context, s *Session) (*oauth2.Token, error) {
+        spent := s.Values[oidcRefreshValue]
+        if spent == "" || s.Values[oidcIssuerValue] != l.issuer {
+                return nil, errOIDCNoRefresh
+        }
+
+        l.refreshMu.Lock()
+        call, running := l.refreshing[spent]
+        if !running {
+                call = &oidcRefresh{done: make(chan struct{})}
+                l.refreshing[spent] = call
+        }
+        l.refreshMu.Unlock()
+        if running {
+                select {
+                case <-call.done:
+                        return call.token, call.err
+                case <-ctx.Done():
+                        return nil, ctx.Err()
+                }
+        }
+
+        // One caller giving up must not fail the others
+        call.token, call.err = l.refreshToken(context.WithoutCancel(ctx), oidcIdentity{User: s.User, Tenant: s.Tenant()}, spent)
+        close(call.done)
+        forget := func() {
+                l.refreshMu.Lock()
+                delete(l.refreshing, spent)
+                l.refreshMu.Unlock()
+        }
+        if call.err != nil {
+                forget()
+        } else {
+                time.AfterFunc(time.Minute, forget)
+        }
+        return call.token, call.err
+}
+
+func (l *OIDCLogin) refreshToken(ctx context.Context, who oidcIdentity, refreshToken string) (*oauth2.Token, error) {
+        provider, err := l.discover(ctx)
+        if err != nil {
+                return nil, err
+        }
+        ctx = oidc.ClientContext(ctx, l.client)
+        token, err := l.config(provider).TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+        if err != nil {
+                return nil, err
+        }
+
+        // Providers may send a new ID token; if so it must still be the
+        // same user in the same tenant
+        if _, ok := token.Extra("id_token").(string); ok {
+                _, refreshed, err := l.verify(ctx, provider, token)
+                if err != nil {
+                        return nil, err
+                }
+                if refreshed != who {
+                        return nil, fmt.Errorf("%w: %s in %s", errOIDCOtherUser, refreshed.User, refreshed.Tenant)
+                }
+        }
+        return token, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+        "io"
+        "net/http"
+        "net/http/cookiejar"
+        "net/http/httptest"
+        "net/url"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// newOIDCApp serves a FakeIdP and an app that signs in with it, and
+// returns them with a browser that keeps cookies. The app's /whoami
+// answers with the session's principal and tenant, or 401 without one.
+func newOIDCApp(t *testing.T) (*FakeIdP, *httptest.Server, *http.Client) {
+        t.Helper()
+        conn := newTestEnv(t).DB
+
+        var idp *FakeIdP
+        idpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { idp.ServeHTTP(w, r) }))
+        t.Cleanup(idpServer.Close)
+        idp, err := NewFakeIdP(idpServer.URL, "items", "client-secret")
+        if err != nil {
+                t.Fatal(err)
+        }
+        idp.Tenants["bob"] = "acme"
+
+        sessions := NewSessionManager(NewSQLSessionStore(conn), "session-secret", 30*time.Minute, 12*time.Hour)
+        root := mux.NewRouter()
+        app := httptest.NewServer(root)
+        t.Cleanup(app.Close)
+        login := NewOIDCLogin(idpServer.URL, "items", "client-secret", app.URL+"/auth/callback", []string{"openid", "email", "offline_access"}, sessions)
+
+        router := mux.NewRouter()
+        router.Use(sessions.Middleware, login.Middleware, tenancy.Middleware)
+        router.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+                if requestUserSession(r) == nil {
+                        http.Error(w, "signed out", http.StatusUnauthorized)
+                        return
+                }
+                io.WriteString(w, requestPrincipal(r)+" in "+requestTenant(r))
+        })
+        root.PathPrefix("/auth/").Handler(login.Handler())
+        root.PathPrefix("/").Handler(router)
+
+        jar, _ := cookiejar.New(nil)
+        return idp, app, &http.Client{Jar: jar}
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+        t.Helper()
+        resp, err := client.Get(url)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        b, _ := io.ReadAll(resp.Body)
+        return resp.StatusCode, string(b)
+}
+
+func TestOIDCLoginRefreshRotationAndRevoke(t *testing.T) {
+        idp, app, browser := newOIDCApp(t)
+        // Access tokens this short are refreshed on every request
+        idp.AccessTTL = 5 * time.Second
+
+        // PKCE sign-in, following the redirects through the provider and back
+        code, body := get(t, browser, app.URL+"/auth/login?login_hint=bob&next=/whoami")
+        if code != http.StatusOK || body != "bob@example.com in acme" {
+                t.Fatalf("after sign-in: %d %q", code, body)
+        }
+
+        // Each request spends the refresh token from the last, so a second
+        // one only works if the new token was kept
+        for i := 0; i < 2; i++ {
+                if code, body := get(t, browser, app.URL+"/whoami"); code != http.StatusOK || body != "bob@example.com in acme" {
+                        t.Fatalf("refresh %d: %d %q", i+1, code, body)
+                }
+        }
+
+        // ID tokens signed with a new key verify once its JWKS is fetched
+        if err := idp.RotateKey(); err != nil {
+                t.Fatal(err)
+        }
+        if code, body := get(t, browser, app.URL+"/whoami"); code != http.StatusOK {
+                t.Fatalf("after key rotation: %d %q", code, body)
+        }
+
+        // Once the provider revokes the user, the session ends
+        idp.Revoke("bob")
+        if code, _ := get(t, browser, app.URL+"/whoami"); code != http.StatusUnauthorized {
+                t.Errorf("after revoke: got %d, want 401", code)
+        }
+        if code, body := get(t, browser, app.URL+"/whoami"); code != http.StatusUnauthorized || body != "signed out\n" {
+                t.Errorf("session outlived the revoke: %d %q", code, body)
+        }
+}
+
+func TestOIDCCallbackNeedsTheBrowserThatStarted(t *testing.T) {
+        _, app, browser := newOIDCApp(t)
+        noRedirects := &http.Client{Jar: browser.Jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+        // Start the sign-in, and take the provider's answer to another browser
+        resp, err := noRedirects.Get(app.URL + "/auth/login")
+        if err != nil {
+                t.Fatal(err)
+        }
+        resp.Body.Close()
+        resp, err = noRedirects.Get(resp.Header.Get("Location"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        resp.Body.Close()
+        callback, err := url.Parse(resp.Header.Get("Location"))
+        if err != nil || callback.Query().Get("code") == "" {
+                t.Fatalf("provider answered %s", resp.Header.Get("Location"))
+        }
+
+        if code, _ := get(t, http.DefaultClient, callback.String()); code != http.StatusBadRequest {
+                t.Errorf("callback without the login cookie: got %d, want 400", code)
+        }
+        tampered := callback.Query()
+        tampered.Set("state", "forged")
+        callback.RawQuery = tampered.Encode()
+        if code, _ := get(t, browser, callback.String()); code != http.StatusBadRequest {
+                t.Errorf("callback with a forged state: got %d, want 400", code)
+        }
+}
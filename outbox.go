@@ -0,0 +1,134 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "log"
+        "time"
+)
+
+// Record an item change in the outbox as part of tx. item is the state
+// after the change, or the deleted row; its tenant scopes the event.
+func writeOutbox(tx *Tx, eventType string, itemID int, item *Item) error {
+        tenant := defaultTenant
+        var payload json.RawMessage
+        if item != nil {
+                tenant = item.Tenant
+                var err error
+                if payload, err = json.Marshal(item); err != nil {
+                        return err
+                }
+        }
+
+        _, err := tx.Exec("INSERT INTO outbox (tenant_id, event_type, item_id, payload, created_at) VALUES (?, ?, ?, ?, ?)",
+                tenant, eventType, itemID, nullJSON(payload), time.Now().UTC())
+        return err
+}
+
+// OutboxRelay polls the outbox table and publishes pending events.
+// Rows are marked published only after the sink accepts them, so every
+// event is delivered at least once and in outbox order.
+type OutboxRelay struct {
+        db           *DB
+        sink         EventSink
+        interval     time.Duration // Poll interval when the outbox is empty
+        batchSize    int
+        maxRetries   int           // Attempts per event before backing off to the next poll
+        retryBackoff time.Duration // Initial delay between attempts, doubled each time
+}
+
+// Create a relay that publishes outbox rows from db to sink
+func NewOutboxRelay(db *DB, sink EventSink) *OutboxRelay {
+        return &OutboxRelay{
+                db:           db,
+                sink:         sink,
+                interval:     time.Second,
+                batchSize:    100,
+                maxRetries:   5,
+                retryBackoff: 100 * time.Millisecond,
+        }
+}
+
+// Run relays events until ctx is cancelled
+func (r *OutboxRelay) Run(ctx context.Context) {
+        for {
+                n, err := r.relayBatch(ctx)
+                if err != nil {
+                        log.Printf("outbox relay: %v", err)
+                }
+
+                // Keep draining while there is a backlog, otherwise wait for the next poll
+                if err == nil && n == r.batchSize {
+                        continue
+                }
+                select {
+                case <-ctx.Done():
+                        return
+                case <-time.After(r.interval):
+                }
+        }
+}
+
+// relayBatch publishes up to batchSize pending events and returns how many were sent
+func (r *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+        rows, err := r.db.QueryContext(ctx,
+                "SELECT id, tenant_id, event_type, item_id, payload, created_at FROM outbox WHERE published_at IS NULL ORDER BY id LIMIT ?",
+                r.batchSize)
+        if err != nil {
+                return 0, err
+        }
+
+        events := []ItemEvent{}
+        for rows.Next() {
+                var event ItemEvent
+                var payload []byte
+                if err := rows.Scan(&event.ID, &event.Tenant, &event.Type, &event.ItemID, &payload, &event.OccurredAt); err != nil {
+                        rows.Close()
+                        return 0, err
+                }
+                if payload != nil {
+                        event.Item = &Item{}
+                        if err := json.Unmarshal(payload, event.Item); err != nil {
+                                rows.Close()
+                                return 0, err
+                        }
+                        event.Item.Tenant = event.Tenant
+                }
+                events = append(events, event)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return 0, err
+        }
+
+        for i, event := range events {
+                if err := r.publish(ctx, event); err != nil {
+                        // Stop here so later events are not delivered ahead of this one
+                        r.db.ExecContext(ctx, "UPDATE outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?", err.Error(), event.ID)
+                        return i, err
+                }
+                if _, err := r.db.ExecContext(ctx, "UPDATE outbox SET published_at = ? WHERE id = ?", time.Now().UTC(), event.ID); err != nil {
+                        return i, err
+                }
+        }
+        return len(events), nil
+}
+
+// publish retries a single event with exponential backoff
+func (r *OutboxRelay) publish(ctx context.Context, event ItemEvent) error {
+        backoff := r.retryBackoff
+        var err error
+        for attempt := 0; attempt < r.maxRetries; attempt++ {
+                if err = r.sink.Publish(ctx, event); err == nil {
+                        return nil
+                }
+
+                select {
+                case <-ctx.Done():
+                        return ctx.Err()
+                case <-time.After(backoff):
+                }
+                backoff *= 2
+        }
+        return err
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+        "strconv"
+        "strings"
+
+        _ "github.com/lib/pq" // Postgres driver
+)
+
+// Postgres takes $n placeholders, double-quoted identifiers and
+// ON CONFLICT in place of INSERT IGNORE
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string         { return "postgres" }
+func (postgresDialect) Returning() bool      { return true }
+func (postgresDialect) Migrations() []string { return postgresMigrations }
+
+func (postgresDialect) MigrationsTable() string {
+        return `CREATE TABLE IF NOT EXISTS schema_migrations (
+                version INT PRIMARY KEY,
+                applied_at TIMESTAMP(6) NOT NULL
+        )`
+}
+
+// Rebind numbers ? placeholders and swaps backticks for double quotes,
+// leaving string literals alone
+func (postgresDialect) Rebind(query string) string {
+        ignore := strings.HasPrefix(query, "INSERT IGNORE ")
+        if ignore {
+                query = "INSERT " + strings.TrimPrefix(query, "INSERT IGNORE ")
+        }
+
+        var b strings.Builder
+        n := 0
+        inString := false
+        for i := 0; i < len(query); i++ {
+                c := query[i]
+                switch {
+                case c == '\'':
+                        inString = !inString // A doubled '' toggles twice and stays inside
+                case inString:
+                case c == '?':
+                        n++
+                        b.WriteString("$" + strconv.Itoa(n))
+                        continue
+                case c == '`':
+                        c = '"'
+                }
+                b.WriteByte(c)
+        }
+
+        if ignore {
+                b.WriteString(" ON CONFLICT DO NOTHING")
+        }
+        return b.String()
+}
+
+// The Postgres schema, version for version the same as migrations.
+// Statements without arguments may be batched with semicolons.
+var postgresMigrations = []string{
+        // 1: items
+        "CREATE TABLE IF NOT EXISTS items (" +
+                "id SERIAL PRIMARY KEY, " +
+                "name VARCHAR(255) NOT NULL, " +
+                "\"desc\" TEXT NOT NULL)",
+        // 2: transactional outbox
+        "CREATE TABLE IF NOT EXISTS outbox (" +
+                "id BIGSERIAL PRIMARY KEY, " +
+                "event_type VARCHAR(64) NOT NULL, " +
+                "item_id INT NOT NULL, " +
+                "payload JSON NULL, " +
+                "created_at TIMESTAMP(6) NOT NULL, " +
+                "published_at TIMESTAMP(6) NULL, " +
+                "attempts INT NOT NULL DEFAULT 0, " +
+                "last_error TEXT NULL); " +
+                "CREATE INDEX IF NOT EXISTS idx_outbox_unpublished ON outbox (published_at, id)",
+        // 3: modification time for Last-Modified; timestamps are stored as UTC
+        "ALTER TABLE items ADD COLUMN updated_at TIMESTAMP(6) NOT NULL DEFAULT (now() AT TIME ZONE 'utc')",
+        // 4: tags
+        "CREATE TABLE IF NOT EXISTS tags (" +
+                "id SERIAL PRIMARY KEY, " +
+                "name VARCHAR(255) NOT NULL UNIQUE)",
+        // 5: item <-> tag links
+        "CREATE TABLE IF NOT EXISTS item_tags (" +
+                "item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE, " +
+                "tag_id INT NOT NULL REFERENCES tags (id) ON DELETE CASCADE, " +
+                "PRIMARY KEY (item_id, tag_id)); " +
+                "CREATE INDEX IF NOT EXISTS item_tags_tag_id ON item_tags (tag_id)",
+        // 6: category tree
+        "CREATE TABLE IF NOT EXISTS categories (" +
+                "id SERIAL PRIMARY KEY, " +
+                "name VARCHAR(255) NOT NULL, " +
+                "parent_id INT NULL REFERENCES categories (id) ON DELETE CASCADE); " +
+                "CREATE INDEX IF NOT EXISTS categories_parent_id ON categories (parent_id)",
+        // 7: item <-> category links
+        "CREATE TABLE IF NOT EXISTS item_categories (" +
+                "item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE, " +
+                "category_id INT NOT NULL REFERENCES categories (id) ON DELETE CASCADE, " +
+                "PRIMARY KEY (item_id, category_id)); " +
+                "CREATE INDEX IF NOT EXISTS item_categories_category_id ON item_categories (category_id)",
+        // 8: revision history; kept after the item is deleted
+        "CREATE TABLE IF NOT EXISTS item_revisions (" +
+                "item_id INT NOT NULL, " +
+                "revision INT NOT NULL, " +
+                "action VARCHAR(16) NOT NULL, " +
+                "principal VARCHAR(255) NOT NULL, " +
+                "name VARCHAR(255) NOT NULL, " +
+                "\"desc\" TEXT NOT NULL, " +
+                "diff JSON NOT NULL, " +
+                "reverted_from INT NULL, " +
+                "created_at TIMESTAMP(6) NOT NULL, " +
+                "PRIMARY KEY (item_id, revision)); " +
+                "CREATE INDEX IF NOT EXISTS item_revisions_created_at ON item_revisions (item_id, created_at)",
+        // 9: a first revision for items that predate history
+        "INSERT INTO item_revisions (item_id, revision, action, principal, name, \"desc\", diff, created_at) " +
+                "SELECT id, 1, 'created', 'migration', name, \"desc\", '{}', updated_at FROM items",
+        // 10: hash-chained audit log
+        "CREATE TABLE IF NOT EXISTS audit_log (" +
+                "id BIGSERIAL PRIMARY KEY, " +
+                "occurred_at TIMESTAMP(6) NOT NULL, " +
+                "principal VARCHAR(255) NOT NULL, " +
+                "request_id VARCHAR(128) NOT NULL, " +
+                "route VARCHAR(255) NOT NULL, " +
+                "item_id INT NOT NULL DEFAULT 0, " +
+                "\"before\" TEXT NULL, " +
+                "\"after\" TEXT NULL, " +
+                "outcome VARCHAR(16) NOT NULL, " +
+                "status VARCHAR(255) NOT NULL, " +
+                "prev_hash CHAR(64) NOT NULL, " +
+                "hash CHAR(64) NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS audit_log_occurred_at ON audit_log (occurred_at); " +
+                "CREATE INDEX IF NOT EXISTS audit_log_principal ON audit_log (principal); " +
+                "CREATE INDEX IF NOT EXISTS audit_log_item_id ON audit_log (item_id)",
+        // 11: the latest audit hash, locked to serialise appends
+        "CREATE TABLE IF NOT EXISTS audit_head (" +
+                "id SMALLINT PRIMARY KEY, " +
+                "hash CHAR(64) NOT NULL)",
+        // 12
+        "INSERT INTO audit_head (id, hash) VALUES (1, '" + auditGenesis + "') ON CONFLICT DO NOTHING",
+        // 13: attachment metadata; the blobs live in the BlobStore
+        "CREATE TABLE IF NOT EXISTS attachments (" +
+                "id SERIAL PRIMARY KEY, " +
+                "item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE, " +
+                "filename VARCHAR(255) NOT NULL, " +
+                "content_type VARCHAR(255) NOT NULL, " +
+                "size BIGINT NOT NULL, " +
+                "sha256 CHAR(64) NOT NULL, " +
+                "created_at TIMESTAMP(6) NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS attachments_item_id ON attachments (item_id)",
+        // 14-20: tenant scoping; existing rows belong to the default tenant
+        "ALTER TABLE items ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'; " +
+                "CREATE INDEX IF NOT EXISTS items_tenant_id ON items (tenant_id, id)",
+        "ALTER TABLE tags ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default', " +
+                "DROP CONSTRAINT tags_name_key, ADD UNIQUE (tenant_id, name)",
+        "ALTER TABLE categories ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'; " +
+                "CREATE INDEX IF NOT EXISTS categories_tenant_id ON categories (tenant_id)",
+        "ALTER TABLE item_revisions ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'",
+        "ALTER TABLE audit_log ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'; " +
+                "CREATE INDEX IF NOT EXISTS audit_log_tenant_id ON audit_log (tenant_id, id)",
+        "ALTER TABLE attachments ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'",
+        "ALTER TABLE outbox ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'",
+        // 21: per-tenant overrides of defaultQuota
+        "CREATE TABLE IF NOT EXISTS tenant_quotas (" +
+                "tenant_id VARCHAR(64) PRIMARY KEY, " +
+                "max_items INT NOT NULL, " +
+                "requests_per_second DOUBLE PRECISION NOT NULL, " +
+                "burst INT NOT NULL)",
+        // 22-23: heartbeat written on the primary to measure replica lag
+        "CREATE TABLE IF NOT EXISTS replica_heartbeat (" +
+                "id SMALLINT PRIMARY KEY, " +
+                "beat_at TIMESTAMP(6) NOT NULL)",
+        "INSERT INTO replica_heartbeat (id, beat_at) VALUES (1, '1970-01-01 00:00:00') ON CONFLICT DO NOTHING",
+        // 24-25: ID counters for rows spread over shards
+        "CREATE TABLE IF NOT EXISTS id_counters (" +
+                "name VARCHAR(32) PRIMARY KEY, " +
+                "last_id BIGINT NOT NULL)",
+        "INSERT INTO id_counters (name, last_id) VALUES ('items', 0), ('attachments', 0) ON CONFLICT DO NOTHING",
+        // 26: where a forwarded shard event came from
+        "ALTER TABLE outbox ADD COLUMN source VARCHAR(128) NULL UNIQUE",
+        // 27-36: 64-bit item IDs for generated IDs; foreign keys may join
+        // columns of different integer types, so they stay
+        "ALTER TABLE item_tags ALTER COLUMN item_id TYPE BIGINT",
+        "ALTER TABLE item_categories ALTER COLUMN item_id TYPE BIGINT",
+        "ALTER TABLE attachments ALTER COLUMN item_id TYPE BIGINT",
+        "ALTER TABLE items ALTER COLUMN id TYPE BIGINT; ALTER SEQUENCE items_id_seq AS BIGINT",
+        noMigration,
+        noMigration,
+        noMigration,
+        "ALTER TABLE item_revisions ALTER COLUMN item_id TYPE BIGINT",
+        "ALTER TABLE audit_log ALTER COLUMN item_id TYPE BIGINT",
+        "ALTER TABLE outbox ALTER COLUMN item_id TYPE BIGINT",
+        // 37: browser sessions, keyed by a hash of the session ID
+        "CREATE TABLE IF NOT EXISTS sessions (" +
+                "id CHAR(64) PRIMARY KEY, " +
+                "principal VARCHAR(255) NOT NULL, " +
+                "data TEXT NOT NULL, " +
+                "created_at TIMESTAMP(6) NOT NULL, " +
+                "last_seen_at TIMESTAMP(6) NOT NULL, " +
+                "expires_at TIMESTAMP(6) NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions (expires_at)",
+        // 38-39: shard rebalance lease
+        "CREATE TABLE IF NOT EXISTS shard_rebalance (" +
+                "id SMALLINT PRIMARY KEY, " +
+                "holder VARCHAR(255) NOT NULL, " +
+                "expires_at TIMESTAMP(6) NOT NULL, " +
+                "ring VARCHAR(1024) NOT NULL)",
+        "INSERT INTO shard_rebalance (id, holder, expires_at, ring) VALUES (1, '', '1970-01-01 00:00:00', '') ON CONFLICT DO NOTHING",
+        // 40-41: webhooks and their deliveries
+        "CREATE TABLE IF NOT EXISTS webhooks (" +
+                "id SERIAL PRIMARY KEY, " +
+                "tenant_id VARCHAR(64) NOT NULL, " +
+                "url VARCHAR(2048) NOT NULL, " +
+                "events TEXT NOT NULL, " +
+                "secret VARCHAR(255) NOT NULL, " +
+                "created_at TIMESTAMP(6) NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS webhooks_tenant ON webhooks (tenant_id)",
+        "CREATE TABLE IF NOT EXISTS webhook_deliveries (" +
+                "id BIGSERIAL PRIMARY KEY, " +
+                "webhook_id INT NOT NULL, " +
+                "tenant_id VARCHAR(64) NOT NULL, " +
+                "event TEXT NOT NULL, " +
+                "event_key VARCHAR(64) NULL UNIQUE, " +
+                "status VARCHAR(16) NOT NULL, " +
+                "attempts INT NOT NULL DEFAULT 0, " +
+                "last_status INT NOT NULL DEFAULT 0, " +
+                "last_error TEXT NULL, " +
+                "next_retry TIMESTAMP(6) NOT NULL, " +
+                "updated_at TIMESTAMP(6) NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_retry); " +
+                "CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id); " +
+                "CREATE INDEX IF NOT EXISTS webhook_deliveries_tenant ON webhook_deliveries (tenant_id, status)",
+        // 42-45: an audit chain per tenant on each database
+        "CREATE TABLE IF NOT EXISTS audit_heads (" +
+                "tenant_id VARCHAR(64) PRIMARY KEY, " +
+                "hash CHAR(64) NOT NULL, " +
+                "since_id BIGINT NOT NULL DEFAULT 0)",
+        "INSERT INTO audit_heads (tenant_id, hash, since_id) " +
+                "SELECT tenant_id, '" + auditGenesis + "', MAX(id) FROM audit_log GROUP BY tenant_id ON CONFLICT DO NOTHING",
+        "INSERT INTO id_counters (name, last_id) VALUES ('audit_log', 0) ON CONFLICT DO NOTHING",
+        "DROP TABLE IF EXISTS audit_head",
+        // 46: a row per tenant that inserts lock to check the item quota in turn
+        "CREATE TABLE IF NOT EXISTS tenant_locks (tenant_id VARCHAR(64) PRIMARY KEY)",
+}
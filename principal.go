@@ -0,0 +1,61 @@
+package main
+
+import (
+        "context"
+        "net"
+        "net/http"
+
+        "google.golang.org/grpc/metadata"
+        "google.golang.org/grpc/peer"
+)
+
+type principalKey struct{}
+
+// Identify the caller. Until real authentication exists this is the
+// subject of a verified bearer token, the X-User-ID header, or the
+// client address.
+func requestPrincipal(r *http.Request) string {
+        if principal, ok := r.Context().Value(principalKey{}).(string); ok {
+                return principal
+        }
+        if user := r.Header.Get("X-User-ID"); user != "" {
+                return user
+        }
+        host, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+                return r.RemoteAddr
+        }
+        return host
+}
+
+// The caller proven by a verified bearer token or a session, unlike
+// requestPrincipal which falls back to what the client says about itself
+func authenticatedPrincipal(r *http.Request) (string, bool) {
+        principal, ok := r.Context().Value(principalKey{}).(string)
+        return principal, ok && principal != ""
+}
+
+// Carry the caller through code that only sees a context, such as resolvers
+func withPrincipal(ctx context.Context, principal string) context.Context {
+        return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Identify the caller of a gRPC method or a GraphQL resolver. gRPC clients
+// send the x-user-id metadata key, like the HTTP header.
+func contextPrincipal(ctx context.Context) string {
+        if principal, ok := ctx.Value(principalKey{}).(string); ok {
+                return principal
+        }
+        if md, ok := metadata.FromIncomingContext(ctx); ok {
+                if users := md.Get("x-user-id"); len(users) > 0 && users[0] != "" {
+                        return users[0]
+                }
+        }
+        if p, ok := peer.FromContext(ctx); ok {
+                if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+                        return host
+                }
+                return p.Addr.String()
+        }
+        return "unknown"
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+        "context"
+        "database/sql"
+        "fmt"
+        "log"
+        "net/http"
+        "sync"
+        "sync/atomic"
+        "time"
+)
+
+// How ReplicaSet picks among healthy replicas
+type ReplicaPolicy int
+
+const (
+        RoundRobin   ReplicaPolicy = iota
+        LeastLatency               // Lowest smoothed ping time
+)
+
+type replica struct {
+        db   *DB
+        name string // For logs; DSNs may hold passwords
+
+        mu      sync.Mutex
+        healthy bool
+        latency time.Duration // Exponentially weighted ping time
+}
+
+// ReplicaSet routes reads to read replicas and everything else to the
+// primary. A replica serves reads only while it answers health checks and
+// its copy of the heartbeat row is at most maxLag behind the primary's.
+// With no healthy replica, reads go to the primary.
+type ReplicaSet struct {
+        primary  *DB
+        replicas []*replica
+        policy   ReplicaPolicy
+        maxLag   time.Duration
+        interval time.Duration // Between heartbeats and health checks
+
+        next uint64 // Round-robin position
+}
+
+// Create a replica set; it has no effect until Run has checked the replicas
+func NewReplicaSet(primary *DB, replicas []*DB, policy ReplicaPolicy, maxLag time.Duration) *ReplicaSet {
+        s := &ReplicaSet{primary: primary, policy: policy, maxLag: maxLag, interval: time.Second}
+        for i, db := range replicas {
+                s.replicas = append(s.replicas, &replica{db: db, name: fmt.Sprintf("replica %d", i+1)})
+        }
+        return s
+}
+
+// Run writes the heartbeat on the primary and checks each replica against
+// it until ctx is cancelled
+func (s *ReplicaSet) Run(ctx context.Context) {
+        if len(s.replicas) == 0 {
+                return
+        }
+        ticker := time.NewTicker(s.interval)
+        defer ticker.Stop()
+        for {
+                s.check(ctx)
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                }
+        }
+}
+
+func (s *ReplicaSet) check(ctx context.Context) {
+        beat := modifiedNow()
+        if _, err := s.primary.ExecContext(ctx, "UPDATE replica_heartbeat SET beat_at = ? WHERE id = 1", beat); err != nil {
+                log.Printf("replicas: writing heartbeat: %v", err)
+                return
+        }
+
+        for _, r := range s.replicas {
+                start := time.Now()
+                var seen time.Time
+                err := r.db.QueryRowContext(ctx, "SELECT beat_at FROM replica_heartbeat WHERE id = 1").Scan(&seen)
+                elapsed := time.Since(start)
+
+                // Another instance may have written a newer beat than ours
+                lag := beat.Sub(seen)
+                if lag < 0 {
+                        lag = 0
+                }
+                if err != nil {
+                        r.setHealth(false, "%v", err)
+                } else if lag > s.maxLag {
+                        r.setHealth(false, "%s behind", lag)
+                } else {
+                        r.setHealth(true, "%s behind", lag)
+                }
+
+                r.mu.Lock()
+                if r.latency == 0 {
+                        r.latency = elapsed
+                } else {
+                        r.latency = (r.latency*4 + elapsed) / 5
+                }
+                r.mu.Unlock()
+        }
+}
+
+// setHealth records whether a replica may serve reads, logging changes
+func (r *replica) setHealth(healthy bool, format string, args ...interface{}) {
+        r.mu.Lock()
+        changed := r.healthy != healthy
+        r.healthy = healthy
+        r.mu.Unlock()
+
+        if changed && healthy {
+                log.Printf("replicas: %s in rotation, "+format, append([]interface{}{r.name}, args...)...)
+        } else if changed {
+                log.Printf("replicas: %s out of rotation, "+format, append([]interface{}{r.name}, args...)...)
+        }
+}
+
+// pick chooses a healthy replica, or nil if there is none
+func (s *ReplicaSet) pick() *replica {
+        var healthy []*replica
+        var best *replica
+        var bestLatency time.Duration
+        for _, r := range s.replicas {
+                r.mu.Lock()
+                if r.healthy {
+                        healthy = append(healthy, r)
+                        if best == nil || r.latency < bestLatency {
+                                best, bestLatency = r, r.latency
+                        }
+                }
+                r.mu.Unlock()
+        }
+        if len(healthy) == 0 || s.policy == LeastLatency {
+                return best
+        }
+        return healthy[atomic.AddUint64(&s.next, 1)%uint64(len(healthy))]
+}
+
+type pinKey struct{}
+
+// Middleware pins requests that may write to the primary, so any read
+// they make afterwards, such as the audit snapshot, sees their own writes
+func (s *ReplicaSet) Middleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                switch r.Method {
+                case http.MethodGet, http.MethodHead, http.MethodOptions:
+                        next.ServeHTTP(w, r)
+                default:
+                        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pinKey{}, true)))
+                }
+        })
+}
+
+// Read runs fn against a replica, or the primary when the request is
+// pinned or no replica is healthy. If the replica fails, it is taken out
+// of rotation and fn runs again on the primary.
+func (s *ReplicaSet) Read(ctx context.Context, fn func(conn *DB) error) error {
+        if s == nil {
+                return fn(db)
+        }
+        r := s.pick()
+        if r == nil || ctx.Value(pinKey{}) != nil {
+                return fn(s.primary)
+        }
+
+        err := fn(r.db)
+        if err == nil || err == sql.ErrNoRows || ctx.Err() != nil {
+                return err
+        }
+        r.setHealth(false, "%v", err)
+        return fn(s.primary)
+}
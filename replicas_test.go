@@ -0,0 +1,146 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "net/http"
+        "path/filepath"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// newTestReplica migrates a second SQLite database to stand in for a
+// replica. Its heartbeat is as old as the migration left it unless fresh
+// is set.
+func newTestReplica(t *testing.T, name string, fresh bool) *DB {
+        t.Helper()
+        conn, err := openDB("sqlite://" + filepath.Join(t.TempDir(), name+".db"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        t.Cleanup(func() { conn.Close() })
+        if err := migrate(conn); err != nil {
+                t.Fatal(err)
+        }
+        if fresh {
+                if _, err := conn.Exec("UPDATE replica_heartbeat SET beat_at = ? WHERE id = 1", modifiedNow()); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        return conn
+}
+
+func TestReplicaSetEjectsLaggingReplicas(t *testing.T) {
+        e := newTestEnv(t)
+        fresh, stale := newTestReplica(t, "fresh", true), newTestReplica(t, "stale", false)
+        s := NewReplicaSet(e.DB, []*DB{stale, fresh}, RoundRobin, time.Minute)
+
+        if r := s.pick(); r != nil {
+                t.Fatalf("%s picked before any check", r.name)
+        }
+        s.check(context.Background())
+        for i := 0; i < 4; i++ {
+                if r := s.pick(); r == nil || r.db != fresh {
+                        t.Fatalf("pick %d: got %v, want the fresh replica", i, r)
+                }
+        }
+
+        // A replica that stops following the primary leaves the rotation
+        if _, err := fresh.Exec("UPDATE replica_heartbeat SET beat_at = ? WHERE id = 1", modifiedNow().Add(-time.Hour)); err != nil {
+                t.Fatal(err)
+        }
+        s.check(context.Background())
+        if r := s.pick(); r != nil {
+                t.Errorf("%s still picked an hour behind", r.name)
+        }
+}
+
+func TestReplicaSetPolicies(t *testing.T) {
+        e := newTestEnv(t)
+        a, b := newTestReplica(t, "a", true), newTestReplica(t, "b", true)
+
+        s := NewReplicaSet(e.DB, []*DB{a, b}, RoundRobin, time.Minute)
+        s.check(context.Background())
+        seen := map[*DB]int{}
+        for i := 0; i < 6; i++ {
+                seen[s.pick().db]++
+        }
+        if seen[a] != 3 || seen[b] != 3 {
+                t.Errorf("round robin spread reads %d/%d", seen[a], seen[b])
+        }
+
+        s = NewReplicaSet(e.DB, []*DB{a, b}, LeastLatency, time.Minute)
+        s.check(context.Background())
+        s.replicas[0].latency, s.replicas[1].latency = 5*time.Millisecond, time.Millisecond
+        for i := 0; i < 3; i++ {
+                if r := s.pick(); r.db != b {
+                        t.Fatalf("least latency picked %s", r.name)
+                }
+        }
+}
+
+// Reads made while handling a write see the primary, so the request reads
+// back what it wrote
+func TestReplicaSetPinsWritesToThePrimary(t *testing.T) {
+        e := newTestEnv(t)
+        replica := newTestReplica(t, "replica", true)
+        replicas = NewReplicaSet(e.DB, []*DB{replica}, RoundRobin, time.Minute)
+        replicas.check(context.Background())
+
+        srv := e.serve(func(router *mux.Router) {
+                router.HandleFunc("/which", func(w http.ResponseWriter, r *http.Request) {
+                        replicas.Read(r.Context(), func(conn *DB) error {
+                                if conn == e.DB {
+                                        fmt.Fprint(w, "primary")
+                                } else {
+                                        fmt.Fprint(w, "replica")
+                                }
+                                return nil
+                        })
+                })
+        })
+
+        for method, want := range map[string]string{"GET": "replica", "POST": "primary", "PUT": "primary", "DELETE": "primary"} {
+                if _, body := do(t, method, srv.URL+"/which", "", nil); body != want {
+                        t.Errorf("%s read from the %s, want the %s", method, body, want)
+                }
+        }
+}
+
+func TestReplicaSetReadFallsBackToThePrimary(t *testing.T) {
+        e := newTestEnv(t)
+        replica := newTestReplica(t, "replica", true)
+        s := NewReplicaSet(e.DB, []*DB{replica}, RoundRobin, time.Minute)
+        s.check(context.Background())
+
+        // A replica that fails a read is taken out of rotation and the
+        // read is retried on the primary
+        replica.Close()
+        var tried []*DB
+        err := s.Read(context.Background(), func(conn *DB) error {
+                tried = append(tried, conn)
+                var n int
+                return conn.QueryRow("SELECT COUNT(*) FROM items").Scan(&n)
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        if len(tried) != 2 || tried[0] != replica || tried[1] != e.DB {
+                t.Errorf("read went to %v, want the replica then the primary", tried)
+        }
+        if r := s.pick(); r != nil {
+                t.Errorf("%s kept in rotation after failing", r.name)
+        }
+
+        // With no healthy replica, reads go straight to the primary
+        tried = nil
+        s.Read(context.Background(), func(conn *DB) error {
+                tried = append(tried, conn)
+                return nil
+        })
+        if len(tried) != 1 || tried[0] != e.DB {
+                t.Errorf("read went to %v, want the primary", tried)
+        }
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+        "encoding/xml"
+        "html"
+        "math"
+        "net/http"
+        "sort"
+        "strconv"
+        "strings"
+        "sync"
+        "unicode"
+)
+
+// BM25 parameters
+const (
+        bm25K1 = 1.2
+        bm25B  = 0.75
+)
+
+// Item fields that are indexed, each with its own statistics
+var searchFields = []string{"name", "desc"}
+
+// Extra weight for matches in the name
+var fieldBoost = map[string]float64{"name": 2.0, "desc": 1.0}
+
+type fieldIndex struct {
+        postings map[string]map[int]int // term -> item ID -> term frequency
+        lengths  map[int]int            // Tokens per item in this field
+        total    int                    // Sum of lengths, for the average
+}
+
+// tenantIndex holds one tenant's items and the statistics they are
+// ranked by, so no tenant's documents move another's scores
+type tenantIndex struct {
+        items  map[int]Item
+        fields map[string]*fieldIndex
+        terms  []string // Sorted vocabulary for prefix lookups
+}
+
+func newTenantIndex() *tenantIndex {
+        ti := &tenantIndex{items: make(map[int]Item), fields: make(map[string]*fieldIndex)}
+        for _, f := range searchFields {
+                ti.fields[f] = &fieldIndex{postings: make(map[string]map[int]int), lengths: make(map[int]int)}
+        }
+        return ti
+}
+
+// SearchIndex is an in-process inverted index over item names and
+// descriptions, kept per tenant
+type SearchIndex struct {
+        mu       sync.RWMutex
+        tenants  map[string]*tenantIndex
+        tenantOf map[int]string // Item ID -> tenant, for removals
+
+        rebuilding bool
+        pending    []ItemEvent // Events seen while a rebuild was loading items
+}
+
+// Create an empty search index
+func NewSearchIndex() *SearchIndex {
+        idx := &SearchIndex{}
+        idx.reset()
+        return idx
+}
+
+func (idx *SearchIndex) reset() {
+        idx.tenants = make(map[string]*tenantIndex)
+        idx.tenantOf = make(map[int]string)
+}
+
+// tokenize lowercases text and splits it on anything that is not a letter or digit
+func tokenize(text string) []string {
+        return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+                return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+        })
+}
+
+func fieldText(item Item, field string) string {
+        if field == "name" {
+                return item.Name
+        }
+        return item.Desc
+}
+
+// Index or re-index an item; the caller holds idx.mu
+func (idx *SearchIndex) put(item Item) {
+        idx.remove(item.ID)
+        ti, ok := idx.tenants[item.Tenant]
+        if !ok {
+                ti = newTenantIndex()
+                idx.tenants[item.Tenant] = ti
+        }
+        idx.tenantOf[item.ID] = item.Tenant
+        ti.put(item)
+}
+
+// Drop an item from the index; the caller holds idx.mu
+func (idx *SearchIndex) remove(id int) {
+        tenant, ok := idx.tenantOf[id]
+        if !ok {
+                return
+        }
+        delete(idx.tenantOf, id)
+        ti := idx.tenants[tenant]
+        ti.remove(id)
+        if len(ti.items) == 0 {
+                delete(idx.tenants, tenant)
+        }
+}
+
+func (ti *tenantIndex) put(item Item) {
+        ti.items[item.ID] = item
+        for _, field := range searchFields {
+                fi := ti.fields[field]
+                tokens := tokenize(fieldText(item, field))
+                fi.lengths[item.ID] = len(tokens)
+                fi.total += len(tokens)
+
+                for _, term := range tokens {
+                        docs, ok := fi.postings[term]
+                        if !ok {
+                                docs = make(map[int]int)
+                                fi.postings[term] = docs
+                                ti.addTerm(term)
+                        }
+                        docs[item.ID]++
+                }
+        }
+}
+
+func (ti *tenantIndex) remove(id int) {
+        item, ok := ti.items[id]
+        if !ok {
+                return
+        }
+        delete(ti.items, id)
+
+        for _, field := range searchFields {
+                fi := ti.fields[field]
+                fi.total -= fi.lengths[id]
+                delete(fi.lengths, id)
+
+                for _, term := range tokenize(fieldText(item, field)) {
+                        if docs, ok := fi.postings[term]; ok {
+                                delete(docs, id)
+                                if len(docs) == 0 {
+                                        delete(fi.postings, term)
+                                        ti.dropTerm(term)
+                                }
+                        }
+                }
+        }
+}
+
+func (ti *tenantIndex) addTerm(term string) {
+        i := sort.SearchStrings(ti.terms, term)
+        if i < len(ti.terms) && ti.terms[i] == term {
+                return
+        }
+        ti.terms = append(ti.terms, "")
+        copy(ti.terms[i+1:], ti.terms[i:])
+        ti.terms[i] = term
+}
+
+// dropTerm removes a term once no field uses it any more
+func (ti *tenantIndex) dropTerm(term string) {
+        for _, fi := range ti.fields {
+                if _, ok := fi.postings[term]; ok {
+                        return
+                }
+        }
+        i := sort.SearchStrings(ti.terms, term)
+        if i < len(ti.terms) && ti.terms[i] == term {
+                ti.terms = append(ti.terms[:i], ti.terms[i+1:]...)
+        }
+}
+
+// Apply keeps the index in step with item changes. It is an EventBus
+// handler; replays of the same event are harmless.
+func (idx *SearchIndex) Apply(event ItemEvent) {
+        idx.mu.Lock()
+        defer idx.mu.Unlock()
+
+        if idx.rebuilding {
+                idx.pending = append(idx.pending, event)
+        }
+        idx.apply(event)
+}
+
+func (idx *SearchIndex) apply(event ItemEvent) {
+        switch event.Type {
+        case EventItemCreated, EventItemUpdated:
+                if event.Item != nil {
+                        item := *event.Item
+                        item.Tenant = event.Tenant
+                        idx.put(item)
+                }
+        case EventItemDeleted:
+                idx.remove(event.ItemID)
+        }
+}
+
+// Rebuild replaces the index with the current contents of the store
+func (idx *SearchIndex) Rebuild(load func() ([]Item, error)) error {
+        idx.mu.Lock()
+        idx.rebuilding = true
+        idx.pending = nil
+        idx.mu.Unlock()
+
+        items, err := load()
+
+        idx.mu.Lock()
+        defer idx.mu.Unlock()
+        idx.rebuilding = false
+        if err != nil {
+                idx.pending = nil
+                return err
+        }
+
+        idx.reset()
+        for _, item := range items {
+                idx.put(item)
+        }
+        // Changes that raced with the load are newer than what it returned
+        for _, event := range idx.pending {
+                idx.apply(event)
+        }
+        idx.pending = nil
+        return nil
+}
+
+// SearchHit is one ranked result
+type SearchHit struct {
+        Item       Item              `json:"item"`
+        Score      float64           `json:"score"`
+        Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// queryTerm is a query token and the index terms it expands to
+type queryTerm struct {
+        text     string
+        expanded []string
+}
+
+// Search ranks a tenant's items against query with BM25. The last query
+// term, and any term ending in '*', also matches index terms it is a
+// prefix of. Document counts, frequencies and lengths are the tenant's
+// own.
+func (idx *SearchIndex) Search(tenant, query string, limit int) []SearchHit {
+        idx.mu.RLock()
+        defer idx.mu.RUnlock()
+        ti, ok := idx.tenants[tenant]
+        if !ok {
+                return []SearchHit{}
+        }
+
+        raw := strings.Fields(query)
+        qterms := []queryTerm{}
+        for i, word := range raw {
+                prefix := strings.HasSuffix(word, "*") || i == len(raw)-1
+                for _, tok := range tokenize(word) {
+                        qt := queryTerm{text: tok}
+                        if prefix {
+                                qt.expanded = ti.prefixed(tok)
+                        } else {
+                                qt.expanded = []string{tok}
+                        }
+                        qterms = append(qterms, qt)
+                }
+        }
+
+        n := float64(len(ti.items))
+        scores := map[int]float64{}
+        matched := map[string]bool{} // Index terms that contributed, for highlighting
+        for _, qt := range qterms {
+                for _, term := range qt.expanded {
+                        for _, field := range searchFields {
+                                fi := ti.fields[field]
+                                docs := fi.postings[term]
+                                if len(docs) == 0 {
+                                        continue
+                                }
+                                matched[term] = true
+
+                                df := float64(len(docs))
+                                idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+                                avg := float64(fi.total) / n
+                                for id, freq := range docs {
+                                        tf := float64(freq)
+                                        norm := 1 - bm25B + bm25B*float64(fi.lengths[id])/avg
+                                        scores[id] += fieldBoost[field] * idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+                                }
+                        }
+                }
+        }
+
+        hits := make([]SearchHit, 0, len(scores))
+        for id, score := range scores {
+                hits = append(hits, SearchHit{Item: ti.items[id], Score: score})
+        }
+        sort.Slice(hits, func(i, j int) bool {
+                if hits[i].Score != hits[j].Score {
+                        return hits[i].Score > hits[j].Score
+                }
+                return hits[i].Item.ID < hits[j].Item.ID
+        })
+        if limit > 0 && len(hits) > limit {
+                hits = hits[:limit]
+        }
+
+        for i := range hits {
+                hits[i].Highlights = map[string]string{}
+                for _, field := range searchFields {
+                        if snippet, ok := highlight(fieldText(hits[i].Item, field), matched); ok {
+                                hits[i].Highlights[field] = snippet
+                        }
+                }
+        }
+        return hits
+}
+
+// prefixed returns the index terms starting with prefix
+func (ti *tenantIndex) prefixed(prefix string) []string {
+        out := []string{}
+        for i := sort.SearchStrings(ti.terms, prefix); i < len(ti.terms); i++ {
+                if !strings.HasPrefix(ti.terms[i], prefix) {
+                        break
+                }
+                out = append(out, ti.terms[i])
+        }
+        return out
+}
+
+// How many words of context a snippet keeps around the first match
+const snippetWords = 8
+
+// highlight wraps matched words in <mark> and trims long text to a window
+// around the first match. The rest of the text is HTML-escaped.
+func highlight(text string, matched map[string]bool) (string, bool) {
+        words := strings.Fields(text)
+        first := -1
+        out := make([]string, len(words))
+        for i, word := range words {
+                out[i] = html.EscapeString(word)
+                for _, tok := range tokenize(word) {
+                        if matched[tok] {
+                                out[i] = "<mark>" + html.EscapeString(word) + "</mark>"
+                                if first < 0 {
+                                        first = i
+                                }
+                                break
+                        }
+                }
+        }
+        if first < 0 {
+                return "", false
+        }
+
+        start, end := first-snippetWords, first+snippetWords+1
+        prefix, suffix := "", ""
+        if start <= 0 {
+                start = 0
+        } else {
+                prefix = "… "
+        }
+        if end >= len(out) {
+                end = len(out)
+        } else {
+                suffix = " …"
+        }
+        return prefix + strings.Join(out[start:end], " ") + suffix, true
+}
+
+// searchResults is a search response, with each hit's item in the shape
+// of the request's API version
+type searchResults struct {
+        XMLName xml.Name        `json:"-" xml:"search"`
+        Query   string          `json:"query" xml:"query"`
+        Hits    []searchHitWire `json:"hits" xml:"hits>hit"`
+}
+
+type searchHitWire struct {
+        Item       interface{}       `json:"item" xml:"item"`
+        Score      float64           `json:"score" xml:"score"`
+        Highlights map[string]string `json:"highlights,omitempty" xml:"-"`
+
+        // XML has no maps, so it lists the highlights instead
+        HighlightList []fieldHighlight `json:"-" xml:"highlights>highlight,omitempty"`
+}
+
+type fieldHighlight struct {
+        Field string `xml:"field,attr"`
+        Text  string `xml:",chardata"`
+}
+
+// Search items: GET /items/search?q=&limit=
+func (idx *SearchIndex) serveSearch(w http.ResponseWriter, r *http.Request) {
+        if !acceptable(w, r, false) {
+                return
+        }
+        query := strings.TrimSpace(r.URL.Query().Get("q"))
+        if query == "" {
+                http.Error(w, "q is required", http.StatusBadRequest)
+                return
+        }
+
+        limit := 20
+        if v := r.URL.Query().Get("limit"); v != "" {
+                n, err := strconv.Atoi(v)
+                if err != nil || n < 1 || n > 100 {
+                        http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+                        return
+                }
+                limit = n
+        }
+
+        version := requestVersion(r)
+        results := searchResults{Query: query, Hits: []searchHitWire{}}
+        for _, hit := range idx.Search(requestTenant(r), query, limit) {
+                wire := searchHitWire{Item: version.wire(hit.Item), Score: hit.Score, Highlights: hit.Highlights}
+                for _, field := range searchFields {
+                        if text, ok := hit.Highlights[field]; ok {
+                                wire.HighlightList = append(wire.HighlightList, fieldHighlight{field, text})
+                        }
+                }
+                results.Hits = append(results.Hits, wire)
+        }
+        writeResponse(w, r, http.StatusOK, results)
+}
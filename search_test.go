@@ -0,0 +1,120 @@
+package main
+
+import (
+        "encoding/json"
+        "encoding/xml"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// One tenant's documents must not move another's scores, or scores
+// would tell a tenant what words the others use
+func TestSearchStatisticsArePerTenant(t *testing.T) {
+        idx := NewSearchIndex()
+        idx.put(Item{ID: 1, Tenant: "acme", Name: "red widget"})
+        idx.put(Item{ID: 2, Tenant: "acme", Name: "blue gadget"})
+        before := idx.Search("acme", "widget", 0)
+
+        for id := 10; id < 60; id++ {
+                idx.put(Item{ID: id, Tenant: "globex", Name: "widget widget widget", Desc: "a much longer description of a widget"})
+        }
+        after := idx.Search("acme", "widget", 0)
+        if len(before) != 1 || len(after) != 1 || before[0].Score != after[0].Score {
+                t.Fatalf("acme's scores changed with globex's items: %v then %v", before, after)
+        }
+
+        // Prefixes only expand to the tenant's own terms
+        idx.put(Item{ID: 60, Tenant: "globex", Name: "secretproject"})
+        if hits := idx.Search("acme", "secret", 0); len(hits) != 0 {
+                t.Errorf("acme found %v", hits)
+        }
+
+        idx.remove(1)
+        idx.remove(2)
+        if _, ok := idx.tenants["acme"]; ok {
+                t.Error("emptied tenant kept")
+        }
+}
+
+func TestSearchResponsesAreNegotiatedAndVersioned(t *testing.T) {
+        idx := NewSearchIndex()
+        idx.put(Item{ID: 7, Tenant: defaultTenant, Name: "red widget", Desc: "shiny", UpdatedAt: time.Now()})
+        srv := newTestEnv(t).serve(func(router *mux.Router) {
+                versionRoutes(router, func(router *mux.Router) {
+                        router.HandleFunc("/items/search", idx.serveSearch).Methods("GET")
+                })
+        })
+
+        code, body := do(t, "GET", srv.URL+"/v2/items/search?q=widget", "", nil)
+        var v2 struct {
+                Hits []struct {
+                        Item       map[string]interface{} `json:"item"`
+                        Highlights map[string]string      `json:"highlights"`
+                } `json:"hits"`
+        }
+        if code != http.StatusOK || json.Unmarshal([]byte(body), &v2) != nil || len(v2.Hits) != 1 {
+                t.Fatalf("v2: %d %s", code, body)
+        }
+        if item := v2.Hits[0].Item; item["id"] != "7" || item["description"] != "shiny" {
+                t.Errorf("v2 hit in the wrong shape: %v", item)
+        }
+        if v2.Hits[0].Highlights["name"] != "red <mark>widget</mark>" {
+                t.Errorf("highlights %v", v2.Hits[0].Highlights)
+        }
+
+        code, body = do(t, "GET", srv.URL+"/items/search?q=widget", "", map[string]string{"Accept": "application/xml"})
+        var v1 struct {
+                XMLName xml.Name `xml:"search"`
+                Query   string   `xml:"query"`
+                Hits    []struct {
+                        ID         int `xml:"item>id"`
+                        Highlights []struct {
+                                Field string `xml:"field,attr"`
+                                Text  string `xml:",chardata"`
+                        } `xml:"highlights>highlight"`
+                } `xml:"hits>hit"`
+        }
+        if code != http.StatusOK || xml.Unmarshal([]byte(body), &v1) != nil || len(v1.Hits) != 1 {
+                t.Fatalf("xml: %d %s", code, body)
+        }
+        if v1.Query != "widget" || v1.Hits[0].ID != 7 || len(v1.Hits[0].Highlights) != 1 || v1.Hits[0].Highlights[0].Field != "name" {
+                t.Errorf("xml %s", body)
+        }
+
+        if code, _ := do(t, "GET", srv.URL+"/items/search?q=widget", "", map[string]string{"Accept": "text/csv"}); code != http.StatusNotAcceptable {
+                t.Errorf("csv: got %d, want 406", code)
+        }
+}
+
+// Rebuilding loads every tenant's items, so only admins may ask for it
+func TestSearchRebuildNeedsAnAdmin(t *testing.T) {
+        conn := newTestEnv(t).DB
+        if _, err := insertItem(Actor{Tenant: defaultTenant}, Item{Name: "widget"}); err != nil {
+                t.Fatal(err)
+        }
+        idx := NewSearchIndex()
+        sessions := NewSessionManager(NewSQLSessionStore(conn), "secret", time.Minute, time.Hour)
+        console, err := NewAdminConsole("", sessions, idx)
+        if err != nil {
+                t.Fatal(err)
+        }
+        srv := httptest.NewServer(console.Handler())
+        defer srv.Close()
+
+        noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+        resp, err := noRedirects.Post(srv.URL+"/admin/search/rebuild", "application/x-www-form-urlencoded", nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode == http.StatusSeeOther && resp.Header.Get("Location") == "/admin/items" {
+                t.Error("rebuild accepted without an admin session")
+        }
+        if hits := idx.Search(defaultTenant, "widget", 0); len(hits) != 0 {
+                t.Errorf("index rebuilt: %v", hits)
+        }
+}
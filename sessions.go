@@ -0,0 +1,449 @@
+package main
+
+import (
+        "context"
+        "crypto/hmac"
+        "crypto/sha256"
+        "crypto/subtle"
+        "database/sql"
+        "encoding/base64"
+        "encoding/hex"
+        "encoding/json"
+        "errors"
+        "log"
+        "mime"
+        "net/http"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/gorilla/securecookie"
+)
+
+// Session is a signed-in browser. The cookie only carries its ID; the
+// rest stays in the SessionStore.
+type Session struct {
+        ID        string
+        User      string
+        Values    map[string]string
+        CreatedAt time.Time
+        LastSeen  time.Time
+}
+
+var errNoSession = errors.New("no such session")
+
+// SessionStore keeps sessions on the server side. Load returns
+// errNoSession for unknown and expired sessions alike.
+type SessionStore interface {
+        Load(ctx context.Context, id string) (*Session, error)
+        Save(ctx context.Context, s *Session, expires time.Time) error
+        Delete(ctx context.Context, id string) error
+        DeleteExpired(ctx context.Context, now time.Time) error
+}
+
+// MemorySessionStore keeps sessions in this process; they end with it
+type MemorySessionStore struct {
+        mu       sync.Mutex
+        sessions map[string]memorySession
+}
+
+type memorySession struct {
+        session Session
+        expires time.Time
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+        return &MemorySessionStore{sessions: map[string]memorySession{}}
+}
+
+func (m *MemorySessionStore) Load(ctx context.Context, id string) (*Session, error) {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        stored, ok := m.sessions[id]
+        if !ok || !time.Now().Before(stored.expires) {
+                return nil, errNoSession
+        }
+        s := stored.session
+        s.Values = copyValues(stored.session.Values)
+        return &s, nil
+}
+
+func (m *MemorySessionStore) Save(ctx context.Context, s *Session, expires time.Time) error {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        stored := *s
+        stored.Values = copyValues(s.Values)
+        m.sessions[s.ID] = memorySession{session: stored, expires: expires}
+        return nil
+}
+
+func (m *MemorySessionStore) Delete(ctx context.Context, id string) error {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        delete(m.sessions, id)
+        return nil
+}
+
+func (m *MemorySessionStore) DeleteExpired(ctx context.Context, now time.Time) error {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        for id, stored := range m.sessions {
+                if !now.Before(stored.expires) {
+                        delete(m.sessions, id)
+                }
+        }
+        return nil
+}
+
+func copyValues(values map[string]string) map[string]string {
+        out := make(map[string]string, len(values))
+        for k, v := range values {
+                out[k] = v
+        }
+        return out
+}
+
+// SQLSessionStore keeps sessions in the sessions table, so they survive
+// restarts and are shared between instances. Rows are keyed by a hash of
+// the session ID, so reading the table does not give away live sessions.
+type SQLSessionStore struct {
+        db *DB
+}
+
+func NewSQLSessionStore(db *DB) *SQLSessionStore {
+        return &SQLSessionStore{db: db}
+}
+
+func sessionKeyHash(id string) string {
+        sum := sha256.Sum256([]byte(id))
+        return hex.EncodeToString(sum[:])
+}
+
+func (m *SQLSessionStore) Load(ctx context.Context, id string) (*Session, error) {
+        s := &Session{ID: id}
+        var data string
+        err := m.db.QueryRowContext(ctx, "SELECT principal, data, created_at, last_seen_at FROM sessions WHERE id = ? AND expires_at > ?", sessionKeyHash(id), time.Now().UTC()).
+                Scan(&s.User, &data, &s.CreatedAt, &s.LastSeen)
+        if err == sql.ErrNoRows {
+                return nil, errNoSession
+        } else if err != nil {
+                return nil, err
+        }
+        if err := json.Unmarshal([]byte(data), &s.Values); err != nil {
+                return nil, err
+        }
+        return s, nil
+}
+
+// Save updates the row, or inserts it if there is none. An update that
+// changes nothing also reports no rows on MySQL, and the insert is then
+// ignored.
+func (m *SQLSessionStore) Save(ctx context.Context, s *Session, expires time.Time) error {
+        data, err := json.Marshal(s.Values)
+        if err != nil {
+                return err
+        }
+        key := sessionKeyHash(s.ID)
+        result, err := m.db.ExecContext(ctx, "UPDATE sessions SET principal = ?, data = ?, last_seen_at = ?, expires_at = ? WHERE id = ?",
+                s.User, string(data), s.LastSeen.UTC(), expires.UTC(), key)
+        if err != nil {
+                return err
+        }
+        if n, err := result.RowsAffected(); err != nil || n > 0 {
+                return err
+        }
+        _, err = m.db.ExecContext(ctx, "INSERT IGNORE INTO sessions (id, principal, data, created_at, last_seen_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+                key, s.User, string(data), s.CreatedAt.UTC(), s.LastSeen.UTC(), expires.UTC())
+        return err
+}
+
+func (m *SQLSessionStore) Delete(ctx context.Context, id string) error {
+        _, err := m.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", sessionKeyHash(id))
+        return err
+}
+
+func (m *SQLSessionStore) DeleteExpired(ctx context.Context, now time.Time) error {
+        _, err := m.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at <= ?", now.UTC())
+        return err
+}
+
+const (
+        sessionCookie = "session"
+        csrfCookie    = "csrf_token"
+        csrfHeader    = "X-CSRF-Token"
+        csrfField     = "csrf_token"
+
+        // Session value naming the tenant the session may act in
+        sessionTenantValue = "tenant"
+)
+
+// SessionManager ties browsers to sessions with a signed and encrypted
+// cookie, like express-session does for app.js: HttpOnly, SameSite=Lax
+// and Secure over HTTPS. A session ends after idleTimeout without a
+// request, and after absoluteTimeout whatever happens.
+//
+// CSRF protection is the signed double-submit pattern: a readable
+// csrf_token cookie, bound to the session by an HMAC, that unsafe requests
+// must echo in the X-CSRF-Token header or a csrf_token form field.
+type SessionManager struct {
+        store           SessionStore
+        codec           *securecookie.SecureCookie
+        csrfKey         []byte
+        idleTimeout     time.Duration
+        absoluteTimeout time.Duration
+}
+
+// Derive the cookie and CSRF keys from secret. Without a secret they are
+// random, and sessions end when the process does.
+func NewSessionManager(store SessionStore, secret string, idleTimeout, absoluteTimeout time.Duration) *SessionManager {
+        key := func(purpose string) []byte {
+                if secret == "" {
+                        return securecookie.GenerateRandomKey(32)
+                }
+                sum := sha256.Sum256([]byte(purpose + ":" + secret))
+                return sum[:]
+        }
+        codec := securecookie.New(key("session signing"), key("session encryption"))
+        codec.MaxAge(int(absoluteTimeout.Seconds()))
+        return &SessionManager{
+                store:           store,
+                codec:           codec,
+                csrfKey:         key("csrf"),
+                idleTimeout:     idleTimeout,
+                absoluteTimeout: absoluteTimeout,
+        }
+}
+
+// Run deletes expired sessions from the store until ctx is cancelled
+func (m *SessionManager) Run(ctx context.Context) {
+        ticker := time.NewTicker(time.Minute)
+        defer ticker.Stop()
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                        if err := m.store.DeleteExpired(ctx, time.Now()); err != nil {
+                                log.Printf("sessions: deleting expired: %v", err)
+                        }
+                }
+        }
+}
+
+type sessionKey struct{}
+
+// Middleware loads the session named by the cookie, if it is still live,
+// and makes its user the principal. Unsafe requests in a session need a
+// CSRF token; clients without one, such as API callers with bearer
+// tokens, are not affected.
+func (m *SessionManager) Middleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                s, err := m.load(r)
+                if err != nil {
+                        dbError(w, err)
+                        return
+                }
+                if s == nil {
+                        // A cookie for a session that has ended grants nothing
+                        if _, err := r.Cookie(sessionCookie); err == nil {
+                                m.setCookie(w, r, sessionCookie, "", -1, true)
+                        }
+                        next.ServeHTTP(w, r)
+                        return
+                }
+                if unsafeMethod(r) && !m.validCSRF(r, s) {
+                        http.Error(w, "invalid CSRF token", http.StatusForbidden)
+                        return
+                }
+
+                // The idle clock only needs to be as precise as a tenth of
+                // the timeout, which saves a write on most requests
+                if now := time.Now(); now.Sub(s.LastSeen) > m.idleTimeout/10 {
+                        s.LastSeen = now
+                        if err := m.Save(r.Context(), s); err != nil {
+                                dbError(w, err)
+                                return
+                        }
+                }
+                ctx := withPrincipal(context.WithValue(r.Context(), sessionKey{}, s), s.User)
+                next.ServeHTTP(w, r.WithContext(ctx))
+        })
+}
+
+// RequireCSRF checks the CSRF token on every unsafe request, signed in or
+// not, for routes only browsers use, such as login forms
+func (m *SessionManager) RequireCSRF(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if unsafeMethod(r) && !m.validCSRF(r, requestUserSession(r)) {
+                        http.Error(w, "invalid CSRF token; reload the page and try again", http.StatusForbidden)
+                        return
+                }
+                next.ServeHTTP(w, r)
+        })
+}
+
+func unsafeMethod(r *http.Request) bool {
+        switch r.Method {
+        case http.MethodGet, http.MethodHead, http.MethodOptions:
+                return false
+        }
+        return true
+}
+
+// The live session the cookie names, or nil
+func (m *SessionManager) load(r *http.Request) (*Session, error) {
+        cookie, err := r.Cookie(sessionCookie)
+        if err != nil {
+                return nil, nil
+        }
+        var id string
+        if err := m.codec.Decode(sessionCookie, cookie.Value, &id); err != nil {
+                return nil, nil // Forged, too old, or signed with an old key
+        }
+        s, err := m.store.Load(r.Context(), id)
+        if err == errNoSession {
+                return nil, nil
+        }
+        return s, err
+}
+
+// The request's session, or nil if it is not signed in
+func requestUserSession(r *http.Request) *Session {
+        s, _ := r.Context().Value(sessionKey{}).(*Session)
+        return s
+}
+
+// The tenant the request's session is bound to, or "" without a session
+func sessionTenant(r *http.Request) string {
+        if s := requestUserSession(r); s != nil {
+                return s.Tenant()
+        }
+        return ""
+}
+
+// Tenant is the tenant the session is bound to. Sessions from before they
+// were bound belong to the default tenant.
+func (s *Session) Tenant() string {
+        if tenant := s.Values[sessionTenantValue]; tenant != "" {
+                return tenant
+        }
+        return defaultTenant
+}
+
+// When s ends: after the idle timeout, or the absolute one if sooner
+func (m *SessionManager) expires(s *Session) time.Time {
+        idle, absolute := s.LastSeen.Add(m.idleTimeout), s.CreatedAt.Add(m.absoluteTimeout)
+        if absolute.Before(idle) {
+                return absolute
+        }
+        return idle
+}
+
+// Save stores changes to a session's values
+func (m *SessionManager) Save(ctx context.Context, s *Session) error {
+        return m.store.Save(ctx, s, m.expires(s))
+}
+
+// Login starts a session for user, bound to tenant. Any session the
+// browser already had is dropped and the new one gets a fresh ID and CSRF
+// token, so an ID planted before login is worthless after it.
+func (m *SessionManager) Login(w http.ResponseWriter, r *http.Request, user, tenant string) (*Session, error) {
+        if old, err := m.load(r); err != nil {
+                return nil, err
+        } else if old != nil {
+                if err := m.store.Delete(r.Context(), old.ID); err != nil {
+                        return nil, err
+                }
+        }
+
+        now := time.Now()
+        s := &Session{ID: randomToken(), User: user, Values: map[string]string{sessionTenantValue: tenant}, CreatedAt: now, LastSeen: now}
+        if err := m.Save(r.Context(), s); err != nil {
+                return nil, err
+        }
+        value, err := m.codec.Encode(sessionCookie, s.ID)
+        if err != nil {
+                return nil, err
+        }
+        m.setCookie(w, r, sessionCookie, value, int(m.absoluteTimeout.Seconds()), true)
+        m.issueCSRF(w, r, s)
+        return s, nil
+}
+
+// Logout ends the request's session and clears its cookies
+func (m *SessionManager) Logout(w http.ResponseWriter, r *http.Request) error {
+        if s := requestUserSession(r); s != nil {
+                if err := m.store.Delete(r.Context(), s.ID); err != nil {
+                        return err
+                }
+        }
+        m.setCookie(w, r, sessionCookie, "", -1, true)
+        m.setCookie(w, r, csrfCookie, "", -1, false)
+        return nil
+}
+
+func (m *SessionManager) setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int, httpOnly bool) {
+        http.SetCookie(w, &http.Cookie{
+                Name:     name,
+                Value:    value,
+                Path:     "/",
+                MaxAge:   maxAge,
+                HttpOnly: httpOnly,
+                Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+                SameSite: http.SameSiteLaxMode,
+        })
+}
+
+func randomToken() string {
+        return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+// CSRFToken returns the token for forms on this page, setting the cookie
+// if the browser has no valid one yet. Call it before writing the header.
+func (m *SessionManager) CSRFToken(w http.ResponseWriter, r *http.Request) string {
+        s := requestUserSession(r)
+        if cookie, err := r.Cookie(csrfCookie); err == nil && m.csrfBound(cookie.Value, s) {
+                return cookie.Value
+        }
+        return m.issueCSRF(w, r, s)
+}
+
+// A token is a random nonce and its HMAC with the session ID, or with
+// nothing before login. Another site can plant a cookie but not sign one.
+func (m *SessionManager) issueCSRF(w http.ResponseWriter, r *http.Request, s *Session) string {
+        nonce := randomToken()
+        token := nonce + "." + m.csrfMAC(nonce, s)
+        m.setCookie(w, r, csrfCookie, token, 0, false) // Readable, so scripts can echo it
+        return token
+}
+
+func (m *SessionManager) csrfMAC(nonce string, s *Session) string {
+        id := ""
+        if s != nil {
+                id = s.ID
+        }
+        mac := hmac.New(sha256.New, m.csrfKey)
+        mac.Write([]byte(id + "|" + nonce))
+        return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (m *SessionManager) csrfBound(token string, s *Session) bool {
+        nonce, sig, ok := strings.Cut(token, ".")
+        return ok && hmac.Equal([]byte(sig), []byte(m.csrfMAC(nonce, s)))
+}
+
+// The cookie and the echoed token must match, and be signed for the
+// session. Only plain HTML forms may send the token in the body; other
+// bodies, such as multipart uploads, are left for their handlers to read
+// within their own limits, so those requests need the header.
+func (m *SessionManager) validCSRF(r *http.Request, s *Session) bool {
+        cookie, err := r.Cookie(csrfCookie)
+        if err != nil {
+                return false
+        }
+        sent := r.Header.Get(csrfHeader)
+        if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); sent == "" && mediaType == "application/x-www-form-urlencoded" {
+                sent = r.PostFormValue(csrfField)
+        }
+        return subtle.ConstantTimeCompare([]byte(sent), []byte(cookie.Value)) == 1 && m.csrfBound(cookie.Value, s)
+}
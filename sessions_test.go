@@ -0,0 +1,52 @@
+package main
+
+import (
+        "bytes"
+        "mime/multipart"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "strings"
+        "testing"
+        "time"
+)
+
+func TestCSRFTokenOnlyReadFromURLEncodedForms(t *testing.T) {
+        m := NewSessionManager(NewMemorySessionStore(), "secret", time.Minute, time.Hour)
+        s := &Session{ID: "session"}
+        nonce := randomToken()
+        token := nonce + "." + m.csrfMAC(nonce, s)
+        cookie := &http.Cookie{Name: csrfCookie, Value: token}
+
+        form := httptest.NewRequest("POST", "/items", strings.NewReader(url.Values{csrfField: {token}}.Encode()))
+        form.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        form.AddCookie(cookie)
+        if !m.validCSRF(form, s) {
+                t.Error("token in a form body refused")
+        }
+
+        // A multipart body is not parsed here, token or no token
+        var body bytes.Buffer
+        mw := multipart.NewWriter(&body)
+        mw.WriteField(csrfField, token)
+        mw.Close()
+        upload := httptest.NewRequest("POST", "/items/1/attachments", &body)
+        upload.Header.Set("Content-Type", mw.FormDataContentType())
+        upload.AddCookie(cookie)
+        if m.validCSRF(upload, s) {
+                t.Error("token in a multipart body accepted")
+        }
+        if upload.MultipartForm != nil || body.Len() == 0 {
+                t.Error("multipart body read while checking CSRF")
+        }
+
+        upload.Header.Set(csrfHeader, token)
+        if !m.validCSRF(upload, s) {
+                t.Error("token in the header refused")
+        }
+
+        other := &Session{ID: "other"}
+        if m.validCSRF(upload, other) {
+                t.Error("token accepted for another session")
+        }
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+        "context"
+        "crypto/rand"
+        "database/sql"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "hash/crc32"
+        "log"
+        "net/http"
+        "os"
+        "sort"
+        "strconv"
+        "strings"
+        "sync"
+        "sync/atomic"
+        "time"
+)
+
+// HashRing maps keys to nodes by consistent hashing. Each node owns many
+// points (virtual nodes) on a 32-bit ring, which evens out the load and
+// means adding a node moves only about 1/N of the keys.
+type HashRing struct {
+        vnodes int
+        points []uint32 // Sorted
+        owners map[uint32]string
+}
+
+// Create a ring giving each node vnodes points
+func NewHashRing(vnodes int, nodes ...string) *HashRing {
+        r := &HashRing{vnodes: vnodes, owners: make(map[uint32]string)}
+        for _, node := range nodes {
+                r.Add(node)
+        }
+        return r
+}
+
+// Add places a node's points on the ring
+func (r *HashRing) Add(node string) {
+        for i := 0; i < r.vnodes; i++ {
+                point := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+                if _, taken := r.owners[point]; taken {
+                        continue // Keep the first owner so placement does not depend on order
+                }
+                r.owners[point] = node
+                r.points = append(r.points, point)
+        }
+        sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Get returns the node owning key: the first point clockwise from its hash
+func (r *HashRing) Get(key string) string {
+        if len(r.points) == 0 {
+                return ""
+        }
+        h := crc32.ChecksumIEEE([]byte(key))
+        i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+        if i == len(r.points) {
+                i = 0
+        }
+        return r.owners[r.points[i]]
+}
+
+// Shard is one backend database of a ShardSet
+type Shard struct {
+        Name string
+        DB   *DB
+}
+
+// ShardSet spreads items over several databases by item ID. An item's
+// revisions, links and attachments live on its shard. Tags and
+// categories are reference tables, copied to every shard so the joins
+// against them stay local. Audit entries for changes to items are written
+// on the shard the change was made on. The main database, itself the
+// first shard, holds the ID counters, the rest of the audit log and the
+// outbox every other shard forwards its events to.
+type ShardSet struct {
+        main   *DB
+        shards []Shard
+        byName map[string]*DB
+        ring   *HashRing
+
+        running     sync.Mutex // Held by this process's rebalance
+        rebalancing int32      // Set while this process rebalances
+        moved       int64
+        holder      string // Names this process in the rebalance lease
+        settled     int32  // Set once every item is known to be on its owner
+        checkedAt   int64  // When settled was last read, in Unix nanoseconds
+}
+
+// Create a shard set over main and the other shards
+func NewShardSet(main *DB, others []Shard, vnodes int) *ShardSet {
+        s := &ShardSet{
+                main:   main,
+                shards: append([]Shard{{Name: "main", DB: main}}, others...),
+                byName: make(map[string]*DB),
+                ring:   NewHashRing(vnodes),
+                holder: leaseHolder(),
+        }
+        for _, shard := range s.shards {
+                s.byName[shard.Name] = shard.DB
+                s.ring.Add(shard.Name)
+        }
+        return s
+}
+
+// Parse DATABASE_SHARDS: comma-separated name=dsn pairs
+func parseShards(v string) ([]Shard, error) {
+        var shards []Shard
+        for _, pair := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' }) {
+                name, dsn, ok := strings.Cut(strings.TrimSpace(pair), "=")
+                if !ok || name == "" || name == "main" {
+                        return nil, fmt.Errorf("invalid shard %q, want name=dsn", pair)
+                }
+                conn, err := openDB(dsn)
+                if err != nil {
+                        return nil, err
+                }
+                shards = append(shards, Shard{Name: name, DB: conn})
+        }
+        return shards, nil
+}
+
+// owner is the shard the ring assigns an item to
+func (s *ShardSet) owner(id int) *DB {
+        return s.byName[s.ring.Get(strconv.Itoa(id))]
+}
+
+// For returns the shard holding an item. Until a rebalance over this
+// ring has finished it may still be on an old shard, so every shard is
+// checked, the owner first: after an interrupted move its copy is the one
+// kept.
+func (s *ShardSet) For(id int) *DB {
+        owner := s.owner(id)
+        if s.placed() || holds(owner, id) {
+                return owner
+        }
+        for _, shard := range s.shards {
+                if shard.DB != owner && holds(shard.DB, id) {
+                        return shard.DB
+                }
+        }
+        return owner
+}
+
+// holds reports whether conn has an item or, once it is deleted, its history
+func holds(conn *DB, id int) bool {
+        var exists int
+        return conn.QueryRow("SELECT 1 FROM items WHERE id = ?", id).Scan(&exists) == nil ||
+                conn.QueryRow("SELECT 1 FROM item_revisions WHERE item_id = ? LIMIT 1", id).Scan(&exists) == nil
+}
+
+// placed reports whether every item is on the shard this ring assigns
+// it: a rebalance over the same ring has finished, here or on another
+// instance. The main database is asked at most once a second until it is.
+func (s *ShardSet) placed() bool {
+        if atomic.LoadInt32(&s.settled) != 0 {
+                return true
+        }
+        now := time.Now().UnixNano()
+        last := atomic.LoadInt64(&s.checkedAt)
+        if now-last < int64(time.Second) || !atomic.CompareAndSwapInt64(&s.checkedAt, last, now) {
+                return false
+        }
+        var ring string
+        if err := s.main.QueryRow("SELECT ring FROM shard_rebalance WHERE id = 1").Scan(&ring); err != nil || ring != s.ringID() {
+                return false
+        }
+        atomic.StoreInt32(&s.settled, 1)
+        return true
+}
+
+// ringID names the placement the ring gives, which depends only on the
+// shard names and the points each has
+func (s *ShardSet) ringID() string {
+        names := make([]string, 0, len(s.shards))
+        for _, shard := range s.shards {
+                names = append(names, shard.Name)
+        }
+        sort.Strings(names)
+        return strconv.Itoa(s.ring.vnodes) + ":" + strings.Join(names, ",")
+}
+
+// The database holding an item: its shard, or db when unsharded
+func itemDB(id int) *DB {
+        if shards == nil {
+                return db
+        }
+        return shards.For(id)
+}
+
+// Every database items may be on
+func itemDBs() []*DB {
+        if shards == nil {
+                return []*DB{db}
+        }
+        dbs := []*DB{}
+        for _, shard := range shards.shards {
+                dbs = append(dbs, shard.DB)
+        }
+        return dbs
+}
+
+// The database a new item goes to, which needs no lookup
+func newItemDB(id int) *DB {
+        if shards == nil {
+                return db
+        }
+        return shards.owner(id)
+}
+
+// nextID allocates an ID from a counter on the main database. Sharded
+// rows cannot use AUTO_INCREMENT, as each shard would count on its own.
+func (s *ShardSet) nextID(counter string) (int, error) {
+        tx, err := s.main.Begin()
+        if err != nil {
+                return 0, err
+        }
+        defer tx.Rollback()
+
+        id, err := takeID(tx, counter)
+        if err != nil {
+                return 0, err
+        }
+        return id, tx.Commit()
+}
+
+// takeID advances counter within tx, which runs on the main database
+func takeID(tx *Tx, counter string) (int, error) {
+        if _, err := tx.Exec("UPDATE id_counters SET last_id = last_id + 1 WHERE name = ?", counter); err != nil {
+                return 0, err
+        }
+        var id int
+        err := tx.QueryRow("SELECT last_id FROM id_counters WHERE name = ?", counter).Scan(&id)
+        return id, err
+}
+
+// syncCounters moves each counter past the highest ID on any shard, so
+// rows created before sharding keep their IDs
+func (s *ShardSet) syncCounters() error {
+        for counter, table := range map[string]string{"items": "items", "attachments": "attachments", "audit_log": "audit_log"} {
+                for _, shard := range s.shards {
+                        var max int
+                        if err := shard.DB.QueryRow("SELECT COALESCE(MAX(id), 0) FROM " + table).Scan(&max); err != nil {
+                                return err
+                        }
+                        if _, err := s.main.Exec("UPDATE id_counters SET last_id = ? WHERE name = ? AND last_id < ?", max, counter, max); err != nil {
+                                return err
+                        }
+                }
+        }
+        return nil
+}
+
+// What *DB and *Tx have in common for inserts
+type inserter interface {
+        Exec(query string, args ...interface{}) (sql.Result, error)
+        InsertID(query string, args ...interface{}) (int64, error)
+}
+
+// newID allocates an ID for counter's table: from itemIDs for items when
+// set, from the shared counter when sharded, and otherwise 0 so the table
+// assigns one
+func newID(counter string) (int, error) {
+        if counter == "items" && itemIDs != nil {
+                id, err := itemIDs.NextID()
+                return int(id), err
+        }
+        if shards == nil {
+                return 0, nil
+        }
+        return shards.nextID(counter)
+}
+
+// insertRow inserts into table and returns the row's id: id itself, or
+// the one the table assigned if id is 0. columns and args leave out the id.
+func insertRow(conn inserter, id int, table, columns string, args ...interface{}) (int, error) {
+        placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+        if id == 0 {
+                assigned, err := conn.InsertID("INSERT INTO "+table+" ("+columns+") VALUES ("+placeholders+")", args...)
+                return int(assigned), err
+        }
+        _, err := conn.Exec("INSERT INTO "+table+" (id, "+columns+") VALUES (?, "+placeholders+")", append([]interface{}{id}, args...)...)
+        return id, err
+}
+
+// replicate runs a reference table insert on every shard but main.
+// A shard that misses one is caught up by the next rebalance.
+func (s *ShardSet) replicate(query string, args ...interface{}) error {
+        for _, shard := range s.shards[1:] {
+                if _, err := shard.DB.Exec(query, args...); err != nil {
+                        return fmt.Errorf("shard %s: %v", shard.Name, err)
+                }
+        }
+        return nil
+}
+
+// Copy a reference row to the other shards when sharded
+func replicateReference(query string, args ...interface{}) error {
+        if shards == nil {
+                return nil
+        }
+        return shards.replicate(query, args...)
+}
+
+// queryItems runs a list query, which must order by id, on every shard
+// at once and merges the results into one list ordered by id
+func (s *ShardSet) queryItems(query string, args ...interface{}) ([]Item, error) {
+        results := make([][]Item, len(s.shards))
+        errs := make([]error, len(s.shards))
+        var wg sync.WaitGroup
+        for i, shard := range s.shards {
+                wg.Add(1)
+                go func(i int, conn *DB) {
+                        defer wg.Done()
+                        results[i], errs[i] = scanItems(conn.Query(query, args...))
+                }(i, shard.DB)
+        }
+        wg.Wait()
+        for i, err := range errs {
+                if err != nil {
+                        return nil, fmt.Errorf("shard %s: %v", s.shards[i].Name, err)
+                }
+        }
+
+        // k-way merge: repeatedly take the lowest head. An interrupted move
+        // can leave an item on two shards; the owner's copy is the one kept.
+        merged := []Item{}
+        for {
+                next := -1
+                for i, items := range results {
+                        if len(items) == 0 {
+                                continue
+                        }
+                        if next < 0 || items[0].ID < results[next][0].ID ||
+                                items[0].ID == results[next][0].ID && s.shards[i].DB == s.owner(items[0].ID) {
+                                next = i
+                        }
+                }
+                if next < 0 {
+                        return merged, nil
+                }
+                item := results[next][0]
+                if n := len(merged); n == 0 || merged[n-1].ID != item.ID {
+                        merged = append(merged, item)
+                }
+                results[next] = results[next][1:]
+        }
+}
+
+// count totals a COUNT query over every shard
+func (s *ShardSet) count(query string, args ...interface{}) (int, error) {
+        total := 0
+        for _, shard := range s.shards {
+                var n int
+                if err := shard.DB.QueryRow(query, args...).Scan(&n); err != nil {
+                        return 0, fmt.Errorf("shard %s: %v", shard.Name, err)
+                }
+                total += n
+        }
+        return total, nil
+}
+
+// groupByShard splits item IDs by the database holding them
+func groupByShard(ids []int) map[*DB][]int {
+        groups := map[*DB][]int{}
+        for _, id := range ids {
+                conn := itemDB(id)
+                groups[conn] = append(groups[conn], id)
+        }
+        return groups
+}
+
+// countItems counts a tenant's items on every shard other than skip
+func (s *ShardSet) countItems(tenant string, skip *DB) (int, error) {
+        total := 0
+        for _, shard := range s.shards {
+                if shard.DB == skip {
+                        continue
+                }
+                var n int
+                if err := shard.DB.QueryRow("SELECT COUNT(*) FROM items WHERE tenant_id = ?", tenant).Scan(&n); err != nil {
+                        return 0, err
+                }
+                total += n
+        }
+        return total, nil
+}
+
+// outboxForwarder moves a shard's events into the main outbox, whose
+// relay publishes them with IDs ordered across every shard. The source
+// column makes a repeated forward a no-op.
+type outboxForwarder struct {
+        main  *DB
+        shard string
+}
+
+func (f outboxForwarder) Publish(ctx context.Context, event ItemEvent) error {
+        var payload json.RawMessage
+        if event.Item != nil {
+                var err error
+                if payload, err = json.Marshal(event.Item); err != nil {
+                        return err
+                }
+        }
+        _, err := f.main.ExecContext(ctx, "INSERT IGNORE INTO outbox (tenant_id, event_type, item_id, payload, created_at, source) VALUES (?, ?, ?, ?, ?, ?)",
+                event.Tenant, event.Type, event.ItemID, nullJSON(payload), event.OccurredAt, f.shard+":"+strconv.FormatInt(event.ID, 10))
+        return err
+}
+
+// Relay forwards each other shard's outbox to main until ctx is cancelled
+func (s *ShardSet) Relay(ctx context.Context) {
+        for _, shard := range s.shards[1:] {
+                go NewOutboxRelay(shard.DB, outboxForwarder{main: s.main, shard: shard.Name}).Run(ctx)
+        }
+}
+
+// Tables moved with an item, parents first
+var shardedTables = []struct {
+        table, columns, key string
+}{
+        {"items", "id, tenant_id, name, `desc`, updated_at", "id"},
+        {"item_revisions", "tenant_id, item_id, revision, action, principal, name, `desc`, diff, reverted_from, created_at", "item_id"},
+        {"item_tags", "item_id, tag_id", "item_id"},
+        {"item_categories", "item_id, category_id", "item_id"},
+        {"attachments", "id, tenant_id, item_id, filename, content_type, size, sha256, created_at", "item_id"},
+}
+
+// How long a rebalance holds its lease without renewing it. An instance
+// that dies mid-rebalance hands over to another after this long.
+const rebalanceLease = 30 * time.Second
+
+var errLeaseLost = errors.New("rebalance lease lost to another instance")
+
+// leaseHolder names this process uniquely among the instances sharing
+// the main database
+func leaseHolder() string {
+        host, _ := os.Hostname()
+        b := make([]byte, 4)
+        rand.Read(b)
+        return fmt.Sprintf("%s:%d:%x", host, os.Getpid(), b)
+}
+
+// lease takes or renews the rebalance lease, reporting whether this
+// process holds it
+func (s *ShardSet) lease() (bool, error) {
+        now := time.Now().UTC()
+        result, err := s.main.Exec("UPDATE shard_rebalance SET holder = ?, expires_at = ? WHERE id = 1 AND (holder = ? OR holder = '' OR expires_at < ?)",
+                s.holder, now.Add(rebalanceLease), s.holder, now)
+        if err != nil {
+                return false, err
+        }
+        n, err := result.RowsAffected()
+        return n == 1, err
+}
+
+// release gives up the lease, recording the ring as placed if the
+// rebalance finished
+func (s *ShardSet) release(finished bool) error {
+        if !finished {
+                _, err := s.main.Exec("UPDATE shard_rebalance SET holder = '' WHERE id = 1 AND holder = ?", s.holder)
+                return err
+        }
+        _, err := s.main.Exec("UPDATE shard_rebalance SET holder = '', ring = ? WHERE id = 1 AND holder = ?", s.ringID(), s.holder)
+        if err == nil {
+                atomic.StoreInt32(&s.settled, 1)
+        }
+        return err
+}
+
+// Rebalance starts moving every item to the shard the ring now assigns
+// it, such as after a shard is added, and reports false if a rebalance is
+// already running here or on another instance. Every instance starts one
+// at startup; the lease on the main database lets only one of them run.
+// Lookups check every shard until a rebalance over the ring finishes.
+func (s *ShardSet) Rebalance() bool {
+        if !s.running.TryLock() {
+                return false
+        }
+        held, err := s.lease()
+        if err != nil {
+                log.Printf("shards: rebalance lease: %v", err)
+        }
+        if !held {
+                s.running.Unlock()
+                return false
+        }
+        atomic.StoreInt32(&s.rebalancing, 1)
+        go func() {
+                defer s.running.Unlock()
+                defer atomic.StoreInt32(&s.rebalancing, 0)
+                err := s.rebalance(context.Background())
+                if err != nil {
+                        log.Printf("shards: rebalance: %v", err)
+                }
+                if err := s.release(err == nil); err != nil {
+                        log.Printf("shards: rebalance lease: %v", err)
+                }
+        }()
+        return true
+}
+
+func (s *ShardSet) rebalance(ctx context.Context) error {
+        if err := s.syncReferences(); err != nil {
+                return err
+        }
+        renewed := time.Now()
+        renew := func() error {
+                if time.Since(renewed) < rebalanceLease/3 {
+                        return nil
+                }
+                held, err := s.lease()
+                if err == nil && !held {
+                        err = errLeaseLost
+                }
+                renewed = time.Now()
+                return err
+        }
+        for _, src := range s.shards {
+                after := 0
+                for {
+                        // Every item has revisions, which outlive it, so this finds
+                        // deleted items' history too
+                        rows, err := src.DB.QueryContext(ctx, "SELECT item_id FROM item_revisions WHERE item_id > ? GROUP BY item_id ORDER BY item_id LIMIT 500", after)
+                        if err != nil {
+                                return err
+                        }
+                        var ids []int
+                        for rows.Next() {
+                                var id int
+                                if err := rows.Scan(&id); err != nil {
+                                        rows.Close()
+                                        return err
+                                }
+                                ids = append(ids, id)
+                        }
+                        rows.Close()
+                        if err := rows.Err(); err != nil {
+                                return err
+                        }
+                        if len(ids) == 0 {
+                                break
+                        }
+                        after = ids[len(ids)-1]
+
+                        for _, id := range ids {
+                                if err := renew(); err != nil {
+                                        return err
+                                }
+                                if dst := s.owner(id); dst != src.DB {
+                                        if err := s.move(id, src.DB, dst); err != nil {
+                                                return fmt.Errorf("moving item %d from shard %s: %v", id, src.Name, err)
+                                        }
+                                        atomic.AddInt64(&s.moved, 1)
+                                }
+                        }
+                }
+        }
+        return nil
+}
+
+// syncReferences copies tags and categories missing from a shard
+func (s *ShardSet) syncReferences() error {
+        for _, ref := range []struct{ table, columns string }{
+                {"tags", "id, tenant_id, name"},
+                {"categories", "id, tenant_id, name, parent_id"}, // Parents have lower IDs, so id order is safe
+        } {
+                rows, err := s.main.Query("SELECT " + ref.columns + " FROM " + ref.table + " ORDER BY id")
+                if err != nil {
+                        return err
+                }
+                values, err := scanRows(rows)
+                if err != nil {
+                        return err
+                }
+                placeholders := strings.TrimSuffix(strings.Repeat("?, ", strings.Count(ref.columns, ",")+1), ", ")
+                for _, row := range values {
+                        if err := s.replicate("INSERT IGNORE INTO "+ref.table+" ("+ref.columns+") VALUES ("+placeholders+")", row...); err != nil {
+                                return err
+                        }
+                }
+        }
+        return nil
+}
+
+// move copies an item and everything hanging off it to dst, then removes
+// it from src. Its rows on src stay locked throughout, so a write racing
+// the move waits, misses the item and looks it up again on dst (see
+// inItemTx). The copy commits before src is cleared, so a crash in between
+// leaves the item on both; lookups prefer the owner's copy from then on,
+// and moving the item again keeps that copy and only clears src.
+func (s *ShardSet) move(id int, src, dst *DB) error {
+        from, err := src.Begin()
+        if err != nil {
+                return err
+        }
+        defer from.Rollback()
+
+        var exists int
+        err = from.QueryRow("SELECT 1 FROM items WHERE id = ? FOR UPDATE", id).Scan(&exists)
+        if err != nil && err != sql.ErrNoRows {
+                return err
+        }
+        // Locking the history too holds off a revert recreating a deleted item
+        rows, err := from.Query("SELECT revision FROM item_revisions WHERE item_id = ? FOR UPDATE", id)
+        if err != nil {
+                return err
+        }
+        revisions, err := scanRows(rows)
+        if err != nil || len(revisions) == 0 {
+                return err // Nothing left to move
+        }
+
+        var copied int
+        if err := dst.QueryRow("SELECT COUNT(*) FROM item_revisions WHERE item_id = ?", id).Scan(&copied); err != nil {
+                return err
+        }
+        if copied == 0 {
+                if err := copyItem(from, dst, id); err != nil {
+                        return err
+                }
+        }
+
+        // Links and attachments go with the item through their foreign keys
+        if _, err := from.Exec("DELETE FROM items WHERE id = ?", id); err != nil {
+                return err
+        }
+        if _, err := from.Exec("DELETE FROM item_revisions WHERE item_id = ?", id); err != nil {
+                return err
+        }
+        return from.Commit()
+}
+
+// copyItem copies an item's rows from a transaction on its shard to dst,
+// in one transaction so dst has all of them or none
+func copyItem(from *Tx, dst *DB, id int) error {
+        to, err := dst.Begin()
+        if err != nil {
+                return err
+        }
+        defer to.Rollback()
+
+        for _, t := range shardedTables {
+                rows, err := from.Query("SELECT "+t.columns+" FROM "+t.table+" WHERE "+t.key+" = ?", id)
+                if err != nil {
+                        return err
+                }
+                values, err := scanRows(rows)
+                if err != nil {
+                        return err
+                }
+                placeholders := strings.TrimSuffix(strings.Repeat("?, ", strings.Count(t.columns, ",")+1), ", ")
+                for _, row := range values {
+                        if _, err := to.Exec("INSERT INTO "+t.table+" ("+t.columns+") VALUES ("+placeholders+")", row...); err != nil {
+                                return err
+                        }
+                }
+        }
+        return to.Commit()
+}
+
+// scanRows reads rows into generic values that can be inserted elsewhere.
+// Bytes become strings, which every driver accepts for text and JSON.
+func scanRows(rows *sql.Rows) ([][]interface{}, error) {
+        defer rows.Close()
+        columns, err := rows.Columns()
+        if err != nil {
+                return nil, err
+        }
+        var values [][]interface{}
+        for rows.Next() {
+                row := make([]interface{}, len(columns))
+                ptrs := make([]interface{}, len(columns))
+                for i := range row {
+                        ptrs[i] = &row[i]
+                }
+                if err := rows.Scan(ptrs...); err != nil {
+                        return nil, err
+                }
+                for i, v := range row {
+                        if b, ok := v.([]byte); ok {
+                                row[i] = string(b)
+                        }
+                }
+                values = append(values, row)
+        }
+        return values, rows.Err()
+}
+
+// Shard status for operators: GET /shards
+func (s *ShardSet) serveStatus(w http.ResponseWriter, r *http.Request) {
+        type shardStatus struct {
+                Name  string `json:"name"`
+                Items int    `json:"items"`
+        }
+        status := struct {
+                Shards      []shardStatus `json:"shards"`
+                Placed      bool          `json:"placed"`
+                Rebalancing bool          `json:"rebalancing"`
+                Moved       int64         `json:"moved"`
+        }{
+                Shards:      []shardStatus{},
+                Placed:      s.placed(),
+                Rebalancing: atomic.LoadInt32(&s.rebalancing) > 0,
+                Moved:       atomic.LoadInt64(&s.moved),
+        }
+        for _, shard := range s.shards {
+                st := shardStatus{Name: shard.Name}
+                if err := shard.DB.QueryRow("SELECT COUNT(*) FROM items").Scan(&st.Items); err != nil {
+                        dbError(w, err)
+                        return
+                }
+                status.Shards = append(status.Shards, st)
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(status)
+}
+
+// Start a rebalance in the background: POST /shards/rebalance
+func (s *ShardSet) serveRebalance(w http.ResponseWriter, r *http.Request) {
+        if !s.Rebalance() {
+                http.Error(w, "rebalance already running here or on another instance", http.StatusConflict)
+                return
+        }
+        w.WriteHeader(http.StatusAccepted)
+}
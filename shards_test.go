@@ -0,0 +1,130 @@
+package main
+
+import (
+        "path/filepath"
+        "testing"
+)
+
+// newTestShards adds a second SQLite shard beside e's database and
+// returns the set that spreads items over both. Until a test installs
+// it, items are all created on e's database.
+func newTestShards(e *testEnv) *ShardSet {
+        e.t.Helper()
+        other, err := openDB("sqlite://" + filepath.Join(e.t.TempDir(), "other.db"))
+        if err != nil {
+                e.t.Fatal(err)
+        }
+        if err := migrate(other); err != nil {
+                e.t.Fatal(err)
+        }
+        e.t.Cleanup(func() { other.Close() })
+        shards = NewShardSet(e.DB, nil, 64)
+        return NewShardSet(e.DB, []Shard{{Name: "other", DB: other}}, 64)
+}
+
+// itemOwnedBy creates items on main, as before a shard was added, until
+// one belongs on dst under set's ring
+func itemOwnedBy(t *testing.T, set *ShardSet, dst *DB) Item {
+        t.Helper()
+        for i := 0; i < 100; i++ {
+                item, err := insertItem(Actor{Tenant: defaultTenant}, Item{Name: "widget"})
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if set.owner(item.ID) == dst {
+                        return item
+                }
+        }
+        t.Fatal("no item landed on the new shard")
+        return Item{}
+}
+
+func TestShardMoveKeepsCopyAfterInterruptedMove(t *testing.T) {
+        set := newTestShards(newTestEnv(t))
+        src, dst := set.shards[0].DB, set.shards[1].DB
+        item := itemOwnedBy(t, set, dst)
+        shards = set
+
+        // Crash after the copy committed but before the source was cleared
+        from, err := src.Begin()
+        if err != nil {
+                t.Fatal(err)
+        }
+        if err := copyItem(from, dst, item.ID); err != nil {
+                t.Fatal(err)
+        }
+        from.Rollback()
+
+        if got := itemDB(item.ID); got != dst {
+                t.Fatalf("lookup went to the stale copy")
+        }
+        items, err := listItems(defaultTenant)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if n := len(items); n != 1 {
+                t.Errorf("listed %d copies of the item, want 1", n)
+        }
+        if _, err := saveItem(Actor{Tenant: defaultTenant}, Item{ID: item.ID, Name: "renamed"}); err != nil {
+                t.Fatal(err)
+        }
+
+        // The repeated move keeps the copy written since and clears src
+        if err := set.move(item.ID, src, dst); err != nil {
+                t.Fatal(err)
+        }
+        if holds(src, item.ID) {
+                t.Errorf("item left on its old shard")
+        }
+        got, err := loadItem(defaultTenant, item.ID)
+        if err != nil || got.Name != "renamed" {
+                t.Errorf("got %+v, %v; want the write made after the crash", got, err)
+        }
+}
+
+func TestShardWriteFollowsMovedItem(t *testing.T) {
+        set := newTestShards(newTestEnv(t))
+        src, dst := set.shards[0].DB, set.shards[1].DB
+        item := itemOwnedBy(t, set, dst)
+
+        // The write resolves the shard while the item is still on src, then
+        // the move lands before it takes the lock
+        if err := set.move(item.ID, src, dst); err != nil {
+                t.Fatal(err)
+        }
+        calls := 0
+        err := inItemTx(item.ID, func(tx *Tx) error {
+                calls++
+                shards = set
+                _, err := lockItem(tx, defaultTenant, item.ID)
+                return err
+        })
+        if err != nil || calls != 2 {
+                t.Errorf("got %v after %d calls; want the write retried on the new shard", err, calls)
+        }
+}
+
+func TestRebalanceLeaseElectsOneInstance(t *testing.T) {
+        set := newTestShards(newTestEnv(t))
+        other := NewShardSet(set.main, set.shards[1:], 64)
+
+        if held, err := set.lease(); err != nil || !held {
+                t.Fatalf("first instance: %v, %v; want the lease", held, err)
+        }
+        if other.Rebalance() {
+                t.Errorf("second instance rebalanced while the lease was held")
+        }
+        if other.placed() {
+                t.Errorf("items counted as placed before any rebalance finished")
+        }
+
+        if err := set.release(true); err != nil {
+                t.Fatal(err)
+        }
+        if !NewShardSet(set.main, set.shards[1:], 64).placed() {
+                t.Errorf("finished rebalance not seen by other instances")
+        }
+        if held, err := other.lease(); err != nil || !held {
+                t.Errorf("lease not released: %v, %v", held, err)
+        }
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+        "os"
+        "path/filepath"
+        "strings"
+
+        _ "github.com/mattn/go-sqlite3" // SQLite driver
+)
+
+// SQLite takes ? placeholders and backticks as they are. Transactions
+// start with BEGIN IMMEDIATE, which takes the write lock FOR UPDATE
+// would otherwise ask for, so the clause is dropped.
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string         { return "sqlite" }
+func (sqliteDialect) Returning() bool      { return false }
+func (sqliteDialect) Migrations() []string { return sqliteMigrations }
+
+func (sqliteDialect) MigrationsTable() string {
+        return `CREATE TABLE IF NOT EXISTS schema_migrations (
+                version INT PRIMARY KEY,
+                applied_at DATETIME NOT NULL
+        )`
+}
+
+func (sqliteDialect) Rebind(query string) string {
+        if strings.HasPrefix(query, "INSERT IGNORE ") {
+                query = "INSERT OR IGNORE " + strings.TrimPrefix(query, "INSERT IGNORE ")
+        }
+        return strings.ReplaceAll(query, " FOR UPDATE", "")
+}
+
+// Turn a sqlite:// DSN into a go-sqlite3 one: WAL so readers never wait
+// on the writer, a busy timeout so writers queue rather than fail, and
+// foreign keys for the ON DELETE CASCADE links
+func sqliteDSN(dsn string) (string, error) {
+        path, params, _ := strings.Cut(strings.TrimPrefix(dsn, "sqlite://"), "?")
+        if dir := filepath.Dir(path); dir != "." {
+                if err := os.MkdirAll(dir, 0o755); err != nil {
+                        return "", err
+                }
+        }
+        defaults := "_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=1&_txlock=immediate"
+        if params != "" {
+                defaults += "&" + params
+        }
+        return "file:" + path + "?" + defaults, nil
+}
+
+// The SQLite schema, version for version the same as migrations. Time
+// columns are plain DATETIME, the only spelling go-sqlite3 scans into
+// time.Time.
+var sqliteMigrations = []string{
+        // 1: items
+        "CREATE TABLE IF NOT EXISTS items (" +
+                "id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+                "name VARCHAR(255) NOT NULL, " +
+                "`desc` TEXT NOT NULL)",
+        // 2: transactional outbox
+        "CREATE TABLE IF NOT EXISTS outbox (" +
+                "id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+                "event_type VARCHAR(64) NOT NULL, " +
+                "item_id INT NOT NULL, " +
+                "payload JSON NULL, " +
+                "created_at DATETIME NOT NULL, " +
+                "published_at DATETIME NULL, " +
+                "attempts INT NOT NULL DEFAULT 0, " +
+                "last_error TEXT NULL); " +
+                "CREATE INDEX IF NOT EXISTS idx_outbox_unpublished ON outbox (published_at, id)",
+        // 3: modification time for Last-Modified; SQLite only takes a
+        // constant default when adding a column
+        "ALTER TABLE items ADD COLUMN updated_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00+00:00'",
+        // 4: tags
+        "CREATE TABLE IF NOT EXISTS tags (" +
+                "id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+                "name VARCHAR(255) NOT NULL); " +
+                "CREATE UNIQUE INDEX IF NOT EXISTS tags_name ON tags (name)",
+        // 5: item <-> tag links
+        "CREATE TABLE IF NOT EXISTS item_tags (" +
+                "item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE, " +
+                "tag_id INT NOT NULL REFERENCES tags (id) ON DELETE CASCADE, " +
+                "PRIMARY KEY (item_id, tag_id)); " +
+                "CREATE INDEX IF NOT EXISTS item_tags_tag_id ON item_tags (tag_id)",
+        // 6: category tree
+        "CREATE TABLE IF NOT EXISTS categories (" +
+                "id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+                "name VARCHAR(255) NOT NULL, " +
+                "parent_id INT NULL REFERENCES categories (id) ON DELETE CASCADE); " +
+                "CREATE INDEX IF NOT EXISTS categories_parent_id ON categories (parent_id)",
+        // 7: item <-> category links
+        "CREATE TABLE IF NOT EXISTS item_categories (" +
+                "item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE, " +
+                "category_id INT NOT NULL REFERENCES categories (id) ON DELETE CASCADE, " +
+                "PRIMARY KEY (item_id, category_id)); " +
+                "CREATE INDEX IF NOT EXISTS item_categories_category_id ON item_categories (category_id)",
+        // 8: revision history; kept after the item is deleted
+        "CREATE TABLE IF NOT EXISTS item_revisions (" +
+                "item_id INT NOT NULL, " +
+                "revision INT NOT NULL, " +
+                "action VARCHAR(16) NOT NULL, " +
+                "principal VARCHAR(255) NOT NULL, " +
+                "name VARCHAR(255) NOT NULL, " +
+                "`desc` TEXT NOT NULL, " +
+                "diff JSON NOT NULL, " +
+                "reverted_from INT NULL, " +
+                "created_at DATETIME NOT NULL, " +
+                "PRIMARY KEY (item_id, revision)); " +
+                "CREATE INDEX IF NOT EXISTS item_revisions_created_at ON item_revisions (item_id, created_at)",
+        // 9: a first revision for items that predate history
+        "INSERT INTO item_revisions (item_id, revision, action, principal, name, `desc`, diff, created_at) " +
+                "SELECT id, 1, 'created', 'migration', name, `desc`, '{}', updated_at FROM items",
+        // 10: hash-chained audit log
+        "CREATE TABLE IF NOT EXISTS audit_log (" +
+                "id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+                "occurred_at DATETIME NOT NULL, " +
+                "principal VARCHAR(255) NOT NULL, " +
+                "request_id VARCHAR(128) NOT NULL, " +
+                "route VARCHAR(255) NOT NULL, " +
+                "item_id INT NOT NULL DEFAULT 0, " +
+                "`before` TEXT NULL, " +
+                "`after` TEXT NULL, " +
+                "outcome VARCHAR(16) NOT NULL, " +
+                "status VARCHAR(255) NOT NULL, " +
+                "prev_hash CHAR(64) NOT NULL, " +
+                "hash CHAR(64) NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS audit_log_occurred_at ON audit_log (occurred_at); " +
+                "CREATE INDEX IF NOT EXISTS audit_log_principal ON audit_log (principal); " +
+                "CREATE INDEX IF NOT EXISTS audit_log_item_id ON audit_log (item_id)",
+        // 11: the latest audit hash, locked to serialise appends
+        "CREATE TABLE IF NOT EXISTS audit_head (" +
+                "id INT PRIMARY KEY, " +
+                "hash CHAR(64) NOT NULL)",
+        // 12
+        "INSERT OR IGNORE INTO audit_head (id, hash) VALUES (1, '" + auditGenesis + "')",
+        // 13: attachment metadata; the blobs live in the BlobStore
+        "CREATE TABLE IF NOT EXISTS attachments (" +
+                "id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+                "item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE, " +
+                "filename VARCHAR(255) NOT NULL, " +
+                "content_type VARCHAR(255) NOT NULL, " +
+                "size BIGINT NOT NULL, " +
+                "sha256 CHAR(64) NOT NULL, " +
+                "created_at DATETIME NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS attachments_item_id ON attachments (item_id)",
+        // 14-20: tenant scoping; existing rows belong to the default tenant
+        "ALTER TABLE items ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'; " +
+                "CREATE INDEX IF NOT EXISTS items_tenant_id ON items (tenant_id, id)",
+        "DROP INDEX IF EXISTS tags_name; " +
+                "ALTER TABLE tags ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'; " +
+                "CREATE UNIQUE INDEX IF NOT EXISTS tags_tenant_name ON tags (tenant_id, name)",
+        "ALTER TABLE categories ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'; " +
+                "CREATE INDEX IF NOT EXISTS categories_tenant_id ON categories (tenant_id)",
+        "ALTER TABLE item_revisions ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'",
+        "ALTER TABLE audit_log ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'; " +
+                "CREATE INDEX IF NOT EXISTS audit_log_tenant_id ON audit_log (tenant_id, id)",
+        "ALTER TABLE attachments ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'",
+        "ALTER TABLE outbox ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'",
+        // 21: per-tenant overrides of defaultQuota
+        "CREATE TABLE IF NOT EXISTS tenant_quotas (" +
+                "tenant_id VARCHAR(64) PRIMARY KEY, " +
+                "max_items INT NOT NULL, " +
+                "requests_per_second REAL NOT NULL, " +
+                "burst INT NOT NULL)",
+        // 22-23: heartbeat written on the primary to measure replica lag
+        "CREATE TABLE IF NOT EXISTS replica_heartbeat (" +
+                "id INT PRIMARY KEY, " +
+                "beat_at DATETIME NOT NULL)",
+        "INSERT OR IGNORE INTO replica_heartbeat (id, beat_at) VALUES (1, '1970-01-01 00:00:00')",
+        // 24-25: ID counters for rows spread over shards
+        "CREATE TABLE IF NOT EXISTS id_counters (" +
+                "name VARCHAR(32) PRIMARY KEY, " +
+                "last_id BIGINT NOT NULL)",
+        "INSERT OR IGNORE INTO id_counters (name, last_id) VALUES ('items', 0), ('attachments', 0)",
+        // 26: where a forwarded shard event came from
+        "ALTER TABLE outbox ADD COLUMN source VARCHAR(128) NULL; " +
+                "CREATE UNIQUE INDEX IF NOT EXISTS outbox_source ON outbox (source)",
+        // 27-36: 64-bit item IDs elsewhere; SQLite integers already are
+        noMigration, noMigration, noMigration, noMigration, noMigration,
+        noMigration, noMigration, noMigration, noMigration, noMigration,
+        // 37: browser sessions, keyed by a hash of the session ID
+        "CREATE TABLE IF NOT EXISTS sessions (" +
+                "id CHAR(64) PRIMARY KEY, " +
+                "principal VARCHAR(255) NOT NULL, " +
+                "data TEXT NOT NULL, " +
+                "created_at DATETIME NOT NULL, " +
+                "last_seen_at DATETIME NOT NULL, " +
+                "expires_at DATETIME NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions (expires_at)",
+        // 38-39: shard rebalance lease
+        "CREATE TABLE IF NOT EXISTS shard_rebalance (" +
+                "id INT PRIMARY KEY, " +
+                "holder VARCHAR(255) NOT NULL, " +
+                "expires_at DATETIME NOT NULL, " +
+                "ring VARCHAR(1024) NOT NULL)",
+        "INSERT OR IGNORE INTO shard_rebalance (id, holder, expires_at, ring) VALUES (1, '', '1970-01-01 00:00:00', '')",
+        // 40-41: webhooks and their deliveries
+        "CREATE TABLE IF NOT EXISTS webhooks (" +
+                "id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+                "tenant_id VARCHAR(64) NOT NULL, " +
+                "url VARCHAR(2048) NOT NULL, " +
+                "events TEXT NOT NULL, " +
+                "secret VARCHAR(255) NOT NULL, " +
+                "created_at DATETIME NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS webhooks_tenant ON webhooks (tenant_id)",
+        "CREATE TABLE IF NOT EXISTS webhook_deliveries (" +
+                "id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+                "webhook_id INT NOT NULL, " +
+                "tenant_id VARCHAR(64) NOT NULL, " +
+                "event TEXT NOT NULL, " +
+                "event_key VARCHAR(64) NULL UNIQUE, " +
+                "status VARCHAR(16) NOT NULL, " +
+                "attempts INT NOT NULL DEFAULT 0, " +
+                "last_status INT NOT NULL DEFAULT 0, " +
+                "last_error TEXT NULL, " +
+                "next_retry DATETIME NOT NULL, " +
+                "updated_at DATETIME NOT NULL); " +
+                "CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_retry); " +
+                "CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id); " +
+                "CREATE INDEX IF NOT EXISTS webhook_deliveries_tenant ON webhook_deliveries (tenant_id, status)",
+        // 42-45: an audit chain per tenant on each database
+        "CREATE TABLE IF NOT EXISTS audit_heads (" +
+                "tenant_id VARCHAR(64) PRIMARY KEY, " +
+                "hash CHAR(64) NOT NULL, " +
+                "since_id BIGINT NOT NULL DEFAULT 0)",
+        "INSERT OR IGNORE INTO audit_heads (tenant_id, hash, since_id) " +
+                "SELECT tenant_id, '" + auditGenesis + "', MAX(id) FROM audit_log GROUP BY tenant_id",
+        "INSERT OR IGNORE INTO id_counters (name, last_id) VALUES ('audit_log', 0)",
+        "DROP TABLE IF EXISTS audit_head",
+        // 46: a row per tenant that inserts lock to check the item quota in turn
+        "CREATE TABLE IF NOT EXISTS tenant_locks (tenant_id VARCHAR(64) PRIMARY KEY)",
+}
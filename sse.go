@@ -0,0 +1,190 @@
+package main
+
+import (
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+// SSEHub streams item events to Server-Sent Events clients.
+// Recent events are kept in a bounded replay buffer so clients that
+// reconnect with Last-Event-ID pick up where they left off. The buffer
+// only lives in memory: a client asking for an event it no longer holds,
+// such as one sent before a restart, is told to refetch instead.
+type SSEHub struct {
+        mu         sync.Mutex
+        replay     []ItemEvent // In delivery order, at most replaySize long
+        replaySize int
+        seen       *seenEvents
+        clients    map[*sseClient]struct{}
+
+        heartbeat time.Duration
+        clientBuf int // Events queued per client before it is dropped
+}
+
+type sseClient struct {
+        tenant  string
+        events  chan ItemEvent
+        overrun chan struct{} // Closed when the client falls too far behind
+}
+
+// Create a hub that keeps the last replaySize events
+func NewSSEHub(replaySize int) *SSEHub {
+        return &SSEHub{
+                replaySize: replaySize,
+                seen:       newSeenEvents(seenEventsSize),
+                clients:    make(map[*sseClient]struct{}),
+                heartbeat:  15 * time.Second,
+                clientBuf:  64,
+        }
+}
+
+// Publish records an event and fans it out to connected clients.
+// It never blocks; use it as an EventBus handler.
+func (h *SSEHub) Publish(event ItemEvent) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        // The outbox delivers at least once, so skip anything already seen
+        if !h.seen.add(event.ID) {
+                return
+        }
+
+        h.replay = append(h.replay, event)
+        if len(h.replay) > h.replaySize {
+                h.replay = h.replay[1:]
+        }
+
+        for c := range h.clients {
+                if c.tenant != event.Tenant {
+                        continue
+                }
+                select {
+                case c.events <- event:
+                default:
+                        // Slow consumer: disconnect it rather than block everyone else.
+                        // It can reconnect and resume from the replay buffer.
+                        close(c.overrun)
+                        delete(h.clients, c)
+                }
+        }
+}
+
+// subscribe registers a client for a tenant and returns the tenant's
+// buffered events delivered after lastID. Events arrive in commit order,
+// not ID order, so "after" goes by position in the buffer. ok is false
+// when lastID is not in the buffer, as events since may be lost.
+func (h *SSEHub) subscribe(tenant string, lastID int64) (c *sseClient, missed []ItemEvent, ok bool) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        c = &sseClient{
+                tenant:  tenant,
+                events:  make(chan ItemEvent, h.clientBuf),
+                overrun: make(chan struct{}),
+        }
+        h.clients[c] = struct{}{}
+
+        if lastID == 0 {
+                return c, nil, true
+        }
+        for i, event := range h.replay {
+                if event.ID != lastID {
+                        continue
+                }
+                for _, later := range h.replay[i+1:] {
+                        if later.Tenant == tenant {
+                                missed = append(missed, later)
+                        }
+                }
+                return c, missed, true
+        }
+        return c, nil, false
+}
+
+func (h *SSEHub) unsubscribe(c *sseClient) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        delete(h.clients, c)
+}
+
+// Stream item events: GET /items/events
+func (h *SSEHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+                http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+                return
+        }
+
+        lastID := r.Header.Get("Last-Event-ID")
+        if lastID == "" {
+                lastID = r.URL.Query().Get("lastEventId")
+        }
+        var since int64
+        if lastID != "" {
+                var err error
+                if since, err = strconv.ParseInt(lastID, 10, 64); err != nil {
+                        http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+                        return
+                }
+        }
+
+        version := requestVersion(r)
+        c, missed, complete := h.subscribe(requestTenant(r), since)
+        defer h.unsubscribe(c)
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.Header().Set("Connection", "keep-alive")
+        w.Header().Set("X-Accel-Buffering", "no")
+        w.WriteHeader(http.StatusOK)
+        fmt.Fprintf(w, "retry: %d\n\n", 3000)
+
+        if !complete {
+                // Tell the client it missed events and should refetch GET /items
+                fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+        }
+        for _, event := range missed {
+                if err := writeSSE(w, version, event); err != nil {
+                        return
+                }
+        }
+        flusher.Flush()
+
+        heartbeat := time.NewTicker(h.heartbeat)
+        defer heartbeat.Stop()
+
+        for {
+                select {
+                case <-r.Context().Done():
+                        return
+                case <-c.overrun:
+                        return
+                case event := <-c.events:
+                        if err := writeSSE(w, version, event); err != nil {
+                                return
+                        }
+                        flusher.Flush()
+                case <-heartbeat.C:
+                        if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+                                return
+                        }
+                        flusher.Flush()
+                }
+        }
+}
+
+// Write one event in text/event-stream framing, in version's shape
+func writeSSE(w http.ResponseWriter, version *APIVersion, event ItemEvent) error {
+        data, err := json.Marshal(version.wire(event))
+        if err != nil {
+                return err
+        }
+        name := strings.TrimPrefix(event.Type, "item.")
+        _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, name, data)
+        return err
+}
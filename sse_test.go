@@ -0,0 +1,96 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http/httptest"
+        "strings"
+        "testing"
+)
+
+func TestSeenEventsDropsOnlyRepeats(t *testing.T) {
+        seen := newSeenEvents(3)
+        for _, id := range []int64{11, 10, 12} {
+                if !seen.add(id) {
+                        t.Errorf("event %d dropped on first delivery", id)
+                }
+        }
+        if seen.add(10) {
+                t.Errorf("repeat of event 10 not dropped")
+        }
+        seen.add(13) // Pushes out 11, the oldest
+        if !seen.add(11) {
+                t.Errorf("event 11 still remembered past the window")
+        }
+}
+
+func TestSSEHubDeliversEventsCommittedOutOfOrder(t *testing.T) {
+        h := NewSSEHub(10)
+        c, _, _ := h.subscribe("acme", 0)
+
+        // Row 11 committed before row 10; the relay retries row 10 too
+        for _, id := range []int64{11, 10, 10} {
+                h.Publish(ItemEvent{ID: id, Tenant: "acme", Type: EventItemUpdated})
+        }
+
+        var got []int64
+        for len(c.events) > 0 {
+                got = append(got, (<-c.events).ID)
+        }
+        if len(got) != 2 || got[0] != 11 || got[1] != 10 {
+                t.Errorf("delivered %v, want [11 10]", got)
+        }
+}
+
+func TestSSEHubReplaysByDeliveryOrder(t *testing.T) {
+        h := NewSSEHub(4)
+        for _, event := range []ItemEvent{{ID: 11, Tenant: "acme"}, {ID: 10, Tenant: "acme"}, {ID: 13, Tenant: "globex"}, {ID: 12, Tenant: "acme"}} {
+                h.Publish(event)
+        }
+
+        // 10 was delivered after 11, so a client that saw 11 has not seen it
+        _, missed, ok := h.subscribe("acme", 11)
+        if !ok || len(missed) != 2 || missed[0].ID != 10 || missed[1].ID != 12 {
+                t.Errorf("after 11: got %v, %v; want [10 12], true", missed, ok)
+        }
+
+        h.Publish(ItemEvent{ID: 14, Tenant: "acme"}) // Pushes out 11
+        if _, missed, ok := h.subscribe("acme", 11); ok || missed != nil {
+                t.Errorf("after evicted 11: got %v, %v; want a reset", missed, ok)
+        }
+}
+
+func TestSSEHubResetsAfterRestart(t *testing.T) {
+        // A fresh hub, as after a restart, holds nothing to replay from
+        h := NewSSEHub(10)
+        if _, _, ok := h.subscribe("acme", 42); ok {
+                t.Errorf("Last-Event-ID from before a restart counted as replayable")
+        }
+        if _, _, ok := h.subscribe("acme", 0); !ok {
+                t.Errorf("new client asked to reset")
+        }
+}
+
+func TestSSEEventsAreInTheRequestVersion(t *testing.T) {
+        event := ItemEvent{ID: 3, Tenant: "acme", Type: EventItemUpdated, ItemID: 7, Item: &Item{ID: 7, Name: "widget", Desc: "shiny"}}
+        for _, tc := range []struct {
+                version *APIVersion
+                field   string
+        }{{apiV1, "desc"}, {apiV2, "description"}} {
+                rec := httptest.NewRecorder()
+                if err := writeSSE(rec, tc.version, event); err != nil {
+                        t.Fatal(err)
+                }
+                var data struct {
+                        ItemID string                 `json:"item_id"`
+                        Item   map[string]interface{} `json:"item"`
+                }
+                for _, line := range strings.Split(rec.Body.String(), "\n") {
+                        if strings.HasPrefix(line, "data: ") {
+                                json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data)
+                        }
+                }
+                if data.ItemID != "7" || data.Item[tc.field] != "shiny" {
+                        t.Errorf("%s: %s", tc.version.Name, rec.Body.String())
+                }
+        }
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+        "database/sql"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+        "unicode/utf8"
+)
+
+// Data access for items, shared by the REST handlers and the other
+// transports. Every query is scoped to one tenant. Mutations write their
+// outbox row in the same transaction and invalidate the item cache once
+// committed.
+
+// List all of a tenant's items
+func listItems(tenant string) ([]Item, error) {
+        return listItemsFiltered(db, tenant, ItemFilter{})
+}
+
+// List a tenant's items matching a filter, reading from conn
+func listItemsFiltered(conn *DB, tenant string, filter ItemFilter) ([]Item, error) {
+        where, args := filter.where(tenant)
+        return queryItems(conn, "SELECT id, name, `desc`, updated_at, tenant_id FROM items"+where+" ORDER BY id", args...)
+}
+
+// List one page of a tenant's items matching a filter, in id order, and
+// how many match in all
+func pageItems(conn *DB, tenant string, filter ItemFilter, limit, offset int) ([]Item, int, error) {
+        where, args := filter.where(tenant)
+        total, err := countRows(conn, "SELECT COUNT(*) FROM items"+where, args...)
+        if err != nil || offset >= total || limit == 0 {
+                return []Item{}, total, err
+        }
+
+        query := "SELECT id, name, `desc`, updated_at, tenant_id FROM items" + where + " ORDER BY id LIMIT ?"
+        if shards == nil {
+                items, err := scanItems(conn.Query(query+" OFFSET ?", append(args, limit, offset)...))
+                return items, total, err
+        }
+        // The page is within the first offset+limit rows of every shard
+        items, err := shards.queryItems(query, append(args, offset+limit)...)
+        if err != nil {
+                return nil, 0, err
+        }
+        if offset > len(items) {
+                offset = len(items)
+        }
+        items = items[offset:]
+        if len(items) > limit {
+                items = items[:limit]
+        }
+        return items, total, nil
+}
+
+// Run a COUNT query on conn, or total it over every shard when sharded
+func countRows(conn *DB, query string, args ...interface{}) (int, error) {
+        if shards != nil {
+                return shards.count(query, args...)
+        }
+        var n int
+        err := conn.QueryRow(query, args...).Scan(&n)
+        return n, err
+}
+
+// List every tenant's items. Only for process-wide state such as the
+// search index, which scopes its own results.
+func listAllItems() ([]Item, error) {
+        return queryItems(db, "SELECT id, name, `desc`, updated_at, tenant_id FROM items ORDER BY id")
+}
+
+// Run a list query on conn, or on every shard when sharded
+func queryItems(conn *DB, query string, args ...interface{}) ([]Item, error) {
+        if shards != nil {
+                return shards.queryItems(query, args...)
+        }
+        return scanItems(conn.Query(query, args...))
+}
+
+func scanItems(rows *sql.Rows, err error) ([]Item, error) {
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        items := []Item{}
+        for rows.Next() {
+                var item Item
+                if err := rows.Scan(&item.ID, &item.Name, &item.Desc, &item.UpdatedAt, &item.Tenant); err != nil {
+                        return nil, err
+                }
+                items = append(items, item)
+        }
+        return items, rows.Err()
+}
+
+// Load a single item from the database
+func loadItem(tenant string, id int) (Item, error) {
+        item := Item{Tenant: tenant}
+        err := itemDB(id).QueryRow("SELECT id, name, `desc`, updated_at FROM items WHERE id = ? AND tenant_id = ?", id, tenant).Scan(&item.ID, &item.Name, &item.Desc, &item.UpdatedAt)
+        return item, err
+}
+
+// Lock an item row for the rest of tx
+func lockItem(tx *Tx, tenant string, id int) (Item, error) {
+        item := Item{Tenant: tenant}
+        err := tx.QueryRow("SELECT id, name, `desc`, updated_at FROM items WHERE id = ? AND tenant_id = ? FOR UPDATE", id, tenant).Scan(&item.ID, &item.Name, &item.Desc, &item.UpdatedAt)
+        return item, err
+}
+
+// inItemTx runs fn in a transaction on the database holding item id and
+// commits if it succeeds. A rebalance may move the item off that shard
+// while fn waits for its lock, in which case fn misses it with
+// sql.ErrNoRows and is run again where the item went.
+func inItemTx(id int, fn func(tx *Tx) error) error {
+        conn := itemDB(id)
+        for attempt := 1; ; attempt++ {
+                tx, err := conn.Begin()
+                if err != nil {
+                        return err
+                }
+                if err = fn(tx); err == nil {
+                        err = tx.Commit()
+                }
+                tx.Rollback()
+                if err == sql.ErrNoRows && attempt < 3 {
+                        if moved := itemDB(id); moved != conn {
+                                conn = moved
+                                continue
+                        }
+                }
+                return err
+        }
+}
+
+// ValidationError says what is wrong with each invalid field
+type ValidationError map[string]string
+
+func (e ValidationError) Error() string {
+        fields := make([]string, 0, len(e))
+        for field := range e {
+                fields = append(fields, field)
+        }
+        sort.Strings(fields)
+        msgs := make([]string, len(fields))
+        for i, field := range fields {
+                msgs[i] = field + " " + e[field]
+        }
+        return strings.Join(msgs, "; ")
+}
+
+// Column sizes: name is VARCHAR(255), desc a TEXT of up to 64KB
+const (
+        maxNameLength = 255
+        maxDescBytes  = 65535
+)
+
+// Check an item's fields before they are stored. Every way of writing an
+// item goes through here, so the API and the admin console agree.
+func validateItem(item Item) error {
+        errs := ValidationError{}
+        switch {
+        case strings.TrimSpace(item.Name) == "":
+                errs["name"] = "is required"
+        case !utf8.ValidString(item.Name):
+                errs["name"] = "must be UTF-8"
+        case utf8.RuneCountInString(item.Name) > maxNameLength:
+                errs["name"] = "must be at most " + strconv.Itoa(maxNameLength) + " characters"
+        }
+        switch {
+        case !utf8.ValidString(item.Desc):
+                errs["desc"] = "must be UTF-8"
+        case len(item.Desc) > maxDescBytes:
+                errs["desc"] = "must be at most " + strconv.Itoa(maxDescBytes) + " bytes"
+        }
+        if len(errs) > 0 {
+                return errs
+        }
+        return nil
+}
+
+// Insert a new item and return it with its ID set
+func insertItem(actor Actor, item Item) (Item, error) {
+        if err := validateItem(item); err != nil {
+                return item, err
+        }
+        id, err := newID("items")
+        if err != nil {
+                return item, err
+        }
+        tx, err := newItemDB(id).Begin()
+        if err != nil {
+                return item, err
+        }
+        defer tx.Rollback()
+
+        if err := tenancy.checkItemQuota(tx, actor.Tenant); err != nil {
+                return item, err
+        }
+
+        item.Tenant = actor.Tenant
+        item.UpdatedAt = modifiedNow()
+        item.ID, err = insertRow(tx, id, "items", "tenant_id, name, `desc`, updated_at", item.Tenant, item.Name, item.Desc, item.UpdatedAt)
+        if err != nil {
+                return item, err
+        }
+
+        if err := writeRevision(tx, RevisionCreated, actor, nil, &item, 0); err != nil {
+                return item, err
+        }
+        if err := writeOutbox(tx, EventItemCreated, item.ID, &item); err != nil {
+                return item, err
+        }
+        return item, tx.Commit()
+}
+
+// Modification time at the precision of the updated_at column
+func modifiedNow() time.Time {
+        return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// Overwrite an existing item and return it as stored. It returns
+// sql.ErrNoRows if the item does not exist, and a ValidationError for
+// invalid fields.
+func saveItem(actor Actor, item Item) (Item, error) {
+        if err := validateItem(item); err != nil {
+                return item, err
+        }
+        err := inItemTx(item.ID, func(tx *Tx) error {
+                before, err := lockItem(tx, actor.Tenant, item.ID)
+                if err != nil {
+                        return err
+                }
+
+                item.Tenant = actor.Tenant
+                item.UpdatedAt = modifiedNow()
+                _, err = tx.Exec("UPDATE items SET name = ?, `desc` = ?, updated_at = ? WHERE id = ? AND tenant_id = ?", item.Name, item.Desc, item.UpdatedAt, item.ID, item.Tenant)
+                if err != nil {
+                        return err
+                }
+                if err := writeRevision(tx, RevisionUpdated, actor, &before, &item, 0); err != nil {
+                        return err
+                }
+                return writeOutbox(tx, EventItemUpdated, item.ID, &item)
+        })
+        if err != nil {
+                return item, err
+        }
+        cache.Invalidate(item.Tenant, item.ID)
+        return item, nil
+}
+
+// Delete an item. The event carries the deleted row so subscribers
+// filtering on its fields still see the delete. It returns sql.ErrNoRows
+// if the item does not exist or belongs to another tenant.
+func removeItem(actor Actor, id int) error {
+        err := inItemTx(id, func(tx *Tx) error {
+                old, err := lockItem(tx, actor.Tenant, id)
+                if err != nil {
+                        return err
+                }
+
+                _, err = tx.Exec("DELETE FROM items WHERE id = ? AND tenant_id = ?", id, actor.Tenant)
+                if err != nil {
+                        return err
+                }
+                if err := writeRevision(tx, RevisionDeleted, actor, &old, &old, 0); err != nil {
+                        return err
+                }
+                return writeOutbox(tx, EventItemDeleted, id, &old)
+        })
+        if err != nil {
+                return err
+        }
+        cache.Invalidate(actor.Tenant, id)
+        return nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/xml"
+        "fmt"
+        "net/http"
+        "strconv"
+        "strings"
+
+        "github.com/gorilla/mux"
+)
+
+// Tag is a free-form label; items and tags are many-to-many
+type Tag struct {
+        XMLName xml.Name `json:"-" xml:"tag"`
+        ID      int      `json:"id" xml:"id"`
+        Name    string   `json:"name" xml:"name"`
+}
+
+// tagList is a list of tags, with a root element in XML
+type tagList []Tag
+
+func (l tagList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+        return encodeXMLList(e, "tags", []Tag(l))
+}
+
+// Category is a node in the category tree
+type Category struct {
+        XMLName  xml.Name `json:"-" xml:"category"`
+        ID       int      `json:"id" xml:"id"`
+        Name     string   `json:"name" xml:"name"`
+        ParentID *int     `json:"parent_id" xml:"parent_id,omitempty"` // Nil for top-level categories
+}
+
+// categoryList is a list of categories, with a root element in XML
+type categoryList []Category
+
+func (l categoryList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+        return encodeXMLList(e, "categories", []Category(l))
+}
+
+// ItemFilter narrows a listing; the zero value lists everything
+type ItemFilter struct {
+        Tag          string // Tag name
+        Category     int    // Category ID, matching its whole subtree
+        IDs          []int  // Any of these items; none means no filter
+        NameContains string // Case-insensitive substring of the name
+}
+
+// Build the WHERE clause for a filter within a tenant
+func (f ItemFilter) where(tenant string) (string, []interface{}) {
+        conds := []string{"items.tenant_id = ?"}
+        args := []interface{}{tenant}
+        if f.Tag != "" {
+                conds = append(conds, "EXISTS (SELECT 1 FROM item_tags it JOIN tags t ON t.id = it.tag_id WHERE it.item_id = items.id AND t.tenant_id = ? AND t.name = ?)")
+                args = append(args, tenant, f.Tag)
+        }
+        if f.Category != 0 {
+                conds = append(conds, "EXISTS (SELECT 1 FROM item_categories ic WHERE ic.item_id = items.id AND ic.category_id IN ("+
+                        "WITH RECURSIVE subtree AS (SELECT id FROM categories WHERE id = ? AND tenant_id = ? "+
+                        "UNION ALL SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id) "+
+                        "SELECT id FROM subtree))")
+                args = append(args, f.Category, tenant)
+        }
+        if len(f.IDs) > 0 {
+                conds = append(conds, "items.id IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(f.IDs)), ", ")+")")
+                for _, id := range f.IDs {
+                        args = append(args, id)
+                }
+        }
+        if f.NameContains != "" {
+                conds = append(conds, "LOWER(items.name) LIKE ? ESCAPE '!'")
+                args = append(args, "%"+likeEscaper.Replace(strings.ToLower(f.NameContains))+"%")
+        }
+        return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Escapes LIKE wildcards with !, which no dialect treats specially in strings
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// Parse ?tag= and ?category= from a request
+func filterFromRequest(r *http.Request) (ItemFilter, error) {
+        q := r.URL.Query()
+        f := ItemFilter{Tag: q.Get("tag")}
+        if v := q.Get("category"); v != "" {
+                id, err := strconv.Atoi(v)
+                if err != nil {
+                        return f, fmt.Errorf("invalid category %q", v)
+                }
+                f.Category = id
+        }
+        return f, nil
+}
+
+// Parse ?expand=tags,categories from a request
+func expandFromRequest(r *http.Request) ([]string, error) {
+        v := r.URL.Query().Get("expand")
+        if v == "" {
+                return nil, nil
+        }
+        fields := strings.Split(v, ",")
+        for _, f := range fields {
+                if f != "tags" && f != "categories" {
+                        return nil, fmt.Errorf("cannot expand %q", f)
+                }
+        }
+        return fields, nil
+}
+
+// expandItems fills in the requested relations with one query per
+// relation, and per shard when sharded
+func expandItems(items []Item, fields []string) error {
+        if len(items) == 0 || len(fields) == 0 {
+                return nil
+        }
+
+        index := map[int]*Item{}
+        ids := make([]int, len(items))
+        for i := range items {
+                index[items[i].ID] = &items[i]
+                ids[i] = items[i].ID
+                for _, field := range fields {
+                        if field == "tags" {
+                                items[i].Tags = []Tag{}
+                        } else {
+                                items[i].Categories = []Category{}
+                        }
+                }
+        }
+
+        for conn, ids := range groupByShard(ids) {
+                if err := expandOn(conn, index, ids, fields); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+func expandOn(conn *DB, index map[int]*Item, ids []int, fields []string) error {
+        placeholders := make([]string, len(ids))
+        args := make([]interface{}, len(ids))
+        for i, id := range ids {
+                placeholders[i] = "?"
+                args[i] = id
+        }
+        in := "(" + strings.Join(placeholders, ", ") + ")"
+
+        for _, field := range fields {
+                switch field {
+                case "tags":
+                        rows, err := conn.Query("SELECT it.item_id, t.id, t.name FROM item_tags it JOIN tags t ON t.id = it.tag_id WHERE it.item_id IN "+in+" ORDER BY t.name", args...)
+                        if err != nil {
+                                return err
+                        }
+                        for rows.Next() {
+                                var itemID int
+                                var tag Tag
+                                if err := rows.Scan(&itemID, &tag.ID, &tag.Name); err != nil {
+                                        rows.Close()
+                                        return err
+                                }
+                                index[itemID].Tags = append(index[itemID].Tags, tag)
+                        }
+                        rows.Close()
+                        if err := rows.Err(); err != nil {
+                                return err
+                        }
+
+                case "categories":
+                        rows, err := conn.Query("SELECT ic.item_id, c.id, c.name, c.parent_id FROM item_categories ic JOIN categories c ON c.id = ic.category_id WHERE ic.item_id IN "+in+" ORDER BY c.name", args...)
+                        if err != nil {
+                                return err
+                        }
+                        for rows.Next() {
+                                var itemID int
+                                var cat Category
+                                if err := rows.Scan(&itemID, &cat.ID, &cat.Name, &cat.ParentID); err != nil {
+                                        rows.Close()
+                                        return err
+                                }
+                                index[itemID].Categories = append(index[itemID].Categories, cat)
+                        }
+                        rows.Close()
+                        if err := rows.Err(); err != nil {
+                                return err
+                        }
+                }
+        }
+        return nil
+}
+
+// Create a tag: POST /tags
+func createTag(w http.ResponseWriter, r *http.Request) {
+        if !acceptable(w, r, false) {
+                return
+        }
+        var tag Tag
+        if !decodeRequest(w, r, &tag) {
+                return
+        }
+        tag.Name = strings.TrimSpace(tag.Name)
+        if tag.Name == "" {
+                http.Error(w, "name is required", http.StatusBadRequest)
+                return
+        }
+
+        id, err := db.InsertID("INSERT INTO tags (tenant_id, name) VALUES (?, ?)", requestTenant(r), tag.Name)
+        if err != nil && duplicateKey(err) {
+                http.Error(w, "tag "+strconv.Quote(tag.Name)+" already exists", http.StatusConflict)
+                return
+        } else if err != nil {
+                dbError(w, err)
+                return
+        }
+        tag.ID = int(id)
+        if err := replicateReference("INSERT IGNORE INTO tags (id, tenant_id, name) VALUES (?, ?, ?)", tag.ID, requestTenant(r), tag.Name); err != nil {
+                dbError(w, err)
+                return
+        }
+
+        auditResult(r, tag)
+        writeResponse(w, r, http.StatusCreated, tag)
+}
+
+// List tags: GET /tags
+func getTags(w http.ResponseWriter, r *http.Request) {
+        if !acceptable(w, r, false) {
+                return
+        }
+        rows, err := db.Query("SELECT id, name FROM tags WHERE tenant_id = ? ORDER BY name", requestTenant(r))
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        defer rows.Close()
+
+        tags := []Tag{}
+        for rows.Next() {
+                var tag Tag
+                if err := rows.Scan(&tag.ID, &tag.Name); err != nil {
+                        dbError(w, err)
+                        return
+                }
+                tags = append(tags, tag)
+        }
+
+        writeResponse(w, r, http.StatusOK, tagList(tags))
+}
+
+// Create a category, optionally under a parent: POST /categories
+func createCategory(w http.ResponseWriter, r *http.Request) {
+        if !acceptable(w, r, false) {
+                return
+        }
+        var cat Category
+        if !decodeRequest(w, r, &cat) {
+                return
+        }
+        cat.Name = strings.TrimSpace(cat.Name)
+        if cat.Name == "" {
+                http.Error(w, "name is required", http.StatusBadRequest)
+                return
+        }
+
+        // Categories can only hang off an existing one, so the tree has no cycles
+        if cat.ParentID != nil {
+                var exists int
+                err := db.QueryRow("SELECT 1 FROM categories WHERE id = ? AND tenant_id = ?", *cat.ParentID, requestTenant(r)).Scan(&exists)
+                if err == sql.ErrNoRows {
+                        http.Error(w, "parent category not found", http.StatusBadRequest)
+                        return
+                } else if err != nil {
+                        dbError(w, err)
+                        return
+                }
+        }
+
+        id, err := db.InsertID("INSERT INTO categories (tenant_id, name, parent_id) VALUES (?, ?, ?)", requestTenant(r), cat.Name, cat.ParentID)
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        cat.ID = int(id)
+        if err := replicateReference("INSERT IGNORE INTO categories (id, tenant_id, name, parent_id) VALUES (?, ?, ?, ?)", cat.ID, requestTenant(r), cat.Name, cat.ParentID); err != nil {
+                dbError(w, err)
+                return
+        }
+
+        auditResult(r, cat)
+        writeResponse(w, r, http.StatusCreated, cat)
+}
+
+// List all categories; clients build the tree from parent_id: GET /categories
+func getCategories(w http.ResponseWriter, r *http.Request) {
+        if !acceptable(w, r, false) {
+                return
+        }
+        rows, err := db.Query("SELECT id, name, parent_id FROM categories WHERE tenant_id = ? ORDER BY id", requestTenant(r))
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        defer rows.Close()
+
+        cats := []Category{}
+        for rows.Next() {
+                var cat Category
+                if err := rows.Scan(&cat.ID, &cat.Name, &cat.ParentID); err != nil {
+                        dbError(w, err)
+                        return
+                }
+                cats = append(cats, cat)
+        }
+
+        writeResponse(w, r, http.StatusOK, categoryList(cats))
+}
+
+// Link tables and the row each one points at
+var relations = map[string]struct {
+        link, column, target string
+}{
+        "tags":       {"item_tags", "tag_id", "tags"},
+        "categories": {"item_categories", "category_id", "categories"},
+}
+
+// Attach or detach a tag or category:
+// PUT/DELETE /items/{id}/tags/{tagId} and /items/{id}/categories/{categoryId}
+func linkItem(relation string, attach bool) http.HandlerFunc {
+        rel := relations[relation]
+        return func(w http.ResponseWriter, r *http.Request) {
+                params := mux.Vars(r)
+                id, err := strconv.Atoi(params["id"])
+                if err != nil {
+                        http.Error(w, "Invalid ID", http.StatusBadRequest)
+                        return
+                }
+                targetID, err := strconv.Atoi(params["target"])
+                if err != nil {
+                        http.Error(w, "Invalid ID", http.StatusBadRequest)
+                        return
+                }
+                if !acceptable(w, r, false) {
+                        return
+                }
+
+                actor := requestActor(r)
+                tenant := actor.Tenant
+                err = inItemTx(id, func(tx *Tx) error {
+                        // Lock the item and check both ends exist in this tenant
+                        item, err := lockItem(tx, tenant, id)
+                        if err != nil {
+                                return err
+                        }
+                        var exists int
+                        if err := tx.QueryRow("SELECT 1 FROM "+rel.target+" WHERE id = ? AND tenant_id = ?", targetID, tenant).Scan(&exists); err != nil {
+                                return err
+                        }
+                        linked, err := linkedIDs(tx, relation, id)
+                        if err != nil {
+                                return err
+                        }
+
+                        if attach {
+                                _, err = tx.Exec("INSERT IGNORE INTO "+rel.link+" (item_id, "+rel.column+") VALUES (?, ?)", id, targetID)
+                        } else {
+                                _, err = tx.Exec("DELETE FROM "+rel.link+" WHERE item_id = ? AND "+rel.column+" = ?", id, targetID)
+                        }
+                        if err != nil {
+                                return err
+                        }
+
+                        // The item's representation changed, so bump its validators and tell subscribers
+                        before := item
+                        item.UpdatedAt = modifiedNow()
+                        if _, err := tx.Exec("UPDATE items SET updated_at = ? WHERE id = ? AND tenant_id = ?", item.UpdatedAt, id, tenant); err != nil {
+                                return err
+                        }
+                        after, err := linkedIDs(tx, relation, id)
+                        if err != nil {
+                                return err
+                        }
+                        if after != linked {
+                                diff := map[string]FieldChange{relation: {From: &linked, To: &after}}
+                                if err := appendRevision(tx, RevisionUpdated, actor, &before, &item, diff, 0); err != nil {
+                                        return err
+                                }
+                        }
+                        return writeOutbox(tx, EventItemUpdated, id, &item)
+                })
+                if err == sql.ErrNoRows {
+                        http.NotFound(w, r)
+                        return
+                } else if err != nil {
+                        dbError(w, err)
+                        return
+                }
+                cache.Invalidate(tenant, id)
+
+                w.WriteHeader(http.StatusNoContent)
+        }
+}
+
+// linkedIDs lists the tags or categories linked to an item, as a sorted
+// comma-separated string for revision diffs
+func linkedIDs(tx *Tx, relation string, id int) (string, error) {
+        rel := relations[relation]
+        rows, err := tx.Query("SELECT "+rel.column+" FROM "+rel.link+" WHERE item_id = ? ORDER BY "+rel.column, id)
+        if err != nil {
+                return "", err
+        }
+        defer rows.Close()
+        ids := []string{}
+        for rows.Next() {
+                var target int
+                if err := rows.Scan(&target); err != nil {
+                        return "", err
+                }
+                ids = append(ids, strconv.Itoa(target))
+        }
+        return strings.Join(ids, ","), rows.Err()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+        "encoding/json"
+        "encoding/xml"
+        "net/http"
+        "strconv"
+        "testing"
+
+        "github.com/gorilla/mux"
+)
+
+func taxonomyRoutes(router *mux.Router) {
+        router.HandleFunc("/tags", createTag).Methods("POST")
+        router.HandleFunc("/tags", getTags).Methods("GET")
+        router.HandleFunc("/categories", createCategory).Methods("POST")
+        router.HandleFunc("/categories", getCategories).Methods("GET")
+        router.HandleFunc("/items/{id}/history", getHistory).Methods("GET")
+        router.HandleFunc("/items/{id}/tags/{target}", linkItem("tags", true)).Methods("PUT")
+        router.HandleFunc("/items/{id}/tags/{target}", linkItem("tags", false)).Methods("DELETE")
+}
+
+func TestDuplicateTagConflicts(t *testing.T) {
+        srv := newTestEnv(t).serve(taxonomyRoutes)
+        if code, body := do(t, "POST", srv.URL+"/tags", `{"name":"red"}`, nil); code != http.StatusCreated {
+                t.Fatalf("create: %d %s", code, body)
+        }
+        if code, body := do(t, "POST", srv.URL+"/tags", `{"name":" red "}`, nil); code != http.StatusConflict || body != "tag \"red\" already exists\n" {
+                t.Errorf("duplicate: got %d %q, want 409", code, body)
+        }
+}
+
+// Linking and unlinking a tag each leave a revision saying what changed
+func TestLinkChangesWriteRevisions(t *testing.T) {
+        srv := newTestEnv(t).serve(taxonomyRoutes)
+        item, err := insertItem(Actor{Tenant: defaultTenant}, Item{Name: "widget"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        code, body := do(t, "POST", srv.URL+"/tags", `{"name":"red"}`, nil)
+        var tag Tag
+        if code != http.StatusCreated || json.Unmarshal([]byte(body), &tag) != nil {
+                t.Fatalf("create tag: %d %s", code, body)
+        }
+
+        link := srv.URL + "/items/" + strconv.Itoa(item.ID) + "/tags/" + strconv.Itoa(tag.ID)
+        for _, method := range []string{"PUT", "PUT", "DELETE"} {
+                if code, body := do(t, method, link, "", nil); code != http.StatusNoContent {
+                        t.Fatalf("%s: %d %s", method, code, body)
+                }
+        }
+
+        code, body = do(t, "GET", srv.URL+"/items/"+strconv.Itoa(item.ID)+"/history", "", nil)
+        var history []Revision
+        if code != http.StatusOK || json.Unmarshal([]byte(body), &history) != nil {
+                t.Fatalf("history: %d %s", code, body)
+        }
+        // Created, tagged, and untagged; attaching twice changed nothing
+        if len(history) != 3 {
+                t.Fatalf("got %d revisions: %s", len(history), body)
+        }
+        id := strconv.Itoa(tag.ID)
+        for _, want := range []FieldChange{{From: new(string), To: &id}, {From: &id, To: new(string)}} {
+                var found bool
+                for _, rev := range history {
+                        if change, ok := rev.Diff["tags"]; ok && *change.From == *want.From && *change.To == *want.To {
+                                found = rev.Action == RevisionUpdated && rev.Name == "widget"
+                        }
+                }
+                if !found {
+                        t.Errorf("no revision changing tags from %q to %q: %s", *want.From, *want.To, body)
+                }
+        }
+}
+
+// Tags and categories answer in the formats items do, and a request for
+// one they cannot give changes nothing
+func TestTaxonomyNegotiatesResponses(t *testing.T) {
+        e := newTestEnv(t)
+        srv := e.serve(taxonomyRoutes)
+        item, err := insertItem(Actor{Tenant: defaultTenant}, Item{Name: "widget"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        xmlAccept := map[string]string{"Accept": "application/xml"}
+        pngAccept := map[string]string{"Accept": "image/png"}
+
+        code, body := do(t, "POST", srv.URL+"/tags", `{"name":"red"}`, xmlAccept)
+        var tag Tag
+        if code != http.StatusCreated || xml.Unmarshal([]byte(body), &tag) != nil || tag.Name != "red" {
+                t.Fatalf("create tag as XML: %d %s", code, body)
+        }
+        code, body = do(t, "GET", srv.URL+"/tags", "", xmlAccept)
+        var tags struct {
+                XMLName xml.Name `xml:"tags"`
+                Tags    []Tag    `xml:"tag"`
+        }
+        if code != http.StatusOK || xml.Unmarshal([]byte(body), &tags) != nil || len(tags.Tags) != 1 || tags.Tags[0].ID != tag.ID {
+                t.Errorf("tags as XML: %d %s", code, body)
+        }
+        var jsonTags []Tag
+        if code, body := do(t, "GET", srv.URL+"/tags", "", nil); code != http.StatusOK || json.Unmarshal([]byte(body), &jsonTags) != nil || len(jsonTags) != 1 {
+                t.Errorf("tags as JSON: %d %s", code, body)
+        }
+
+        // CSV is only for items
+        if code, _ := do(t, "GET", srv.URL+"/categories", "", map[string]string{"Accept": "text/csv"}); code != http.StatusNotAcceptable {
+                t.Errorf("categories as CSV: got %d, want 406", code)
+        }
+        if code, _ := do(t, "POST", srv.URL+"/categories", `{"name":"tools"}`, pngAccept); code != http.StatusNotAcceptable {
+                t.Errorf("create category as PNG: got %d, want 406", code)
+        }
+        code, body = do(t, "GET", srv.URL+"/categories", "", xmlAccept)
+        var cats struct {
+                XMLName    xml.Name   `xml:"categories"`
+                Categories []Category `xml:"category"`
+        }
+        if code != http.StatusOK || xml.Unmarshal([]byte(body), &cats) != nil || len(cats.Categories) != 0 {
+                t.Errorf("categories after a refused create: %d %s", code, body)
+        }
+
+        link := srv.URL + "/items/" + strconv.Itoa(item.ID) + "/tags/" + strconv.Itoa(tag.ID)
+        if code, _ := do(t, "PUT", link, "", pngAccept); code != http.StatusNotAcceptable {
+                t.Errorf("link as PNG: got %d, want 406", code)
+        }
+        var links int
+        if err := e.DB.QueryRow("SELECT COUNT(*) FROM item_tags").Scan(&links); err != nil || links != 0 {
+                t.Errorf("refused link made: %d, %v", links, err)
+        }
+}
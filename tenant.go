@@ -0,0 +1,457 @@
+package main
+
+import (
+        "context"
+        "crypto/hmac"
+        "crypto/sha256"
+        "database/sql"
+        "encoding/base64"
+        "encoding/json"
+        "errors"
+        "math"
+        "net"
+        "net/http"
+        "regexp"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+
+        "google.golang.org/grpc"
+        "google.golang.org/grpc/codes"
+        "google.golang.org/grpc/metadata"
+        "google.golang.org/grpc/status"
+)
+
+// Tenant used when a request names none, so single-team deployments
+// keep working unchanged
+const defaultTenant = "default"
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+var (
+        errInvalidTenant  = errors.New("invalid tenant")
+        errInvalidToken   = errors.New("invalid bearer token")
+        errMissingToken   = errors.New("bearer token required")
+        errTenantMismatch = errors.New("tenant does not match credentials")
+        errQuotaExceeded  = errors.New("item quota exceeded")
+)
+
+// Actor is who made a change and the tenant they made it in
+type Actor struct {
+        Tenant    string
+        Principal string
+        Audit     *AuditEntry // The request's pending entry; nil when not audited
+}
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+        return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// The tenant resolved for a request by Tenancy
+func contextTenant(ctx context.Context) string {
+        if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+                return tenant
+        }
+        return defaultTenant
+}
+
+func requestTenant(r *http.Request) string {
+        return contextTenant(r.Context())
+}
+
+func requestActor(r *http.Request) Actor {
+        return Actor{Tenant: requestTenant(r), Principal: requestPrincipal(r), Audit: contextAuditEntry(r.Context())}
+}
+
+func contextActor(ctx context.Context) Actor {
+        return Actor{Tenant: contextTenant(ctx), Principal: contextPrincipal(ctx), Audit: contextAuditEntry(ctx)}
+}
+
+// TenantQuota limits what one tenant may use
+type TenantQuota struct {
+        MaxItems          int
+        RequestsPerSecond float64
+        Burst             int
+}
+
+// Quota for tenants without a row in tenant_quotas
+var defaultQuota = TenantQuota{MaxItems: 10000, RequestsPerSecond: 50, Burst: 100}
+
+// How long a tenant's quota is cached before it is read again
+const quotaTTL = time.Minute
+
+type cachedQuota struct {
+        quota  TenantQuota
+        loaded time.Time
+}
+
+type tokenBucket struct {
+        tokens float64
+        last   time.Time
+}
+
+// Tenancy resolves the tenant for each request and applies its quotas.
+// The tenant comes from, in order: the "tenant" claim of an HS256 bearer
+// token, the tenant the session is bound to, the X-Tenant-ID header, or
+// the subdomain under baseDomain. Once tokens are configured the last two
+// only pick between the tenants the credentials allow.
+type Tenancy struct {
+        db          *DB
+        baseDomain  string // e.g. items.example.com; empty disables subdomains
+        tokenSecret []byte // Empty disables bearer tokens
+
+        mu        sync.Mutex
+        quotas    map[string]cachedQuota
+        buckets   map[string]*tokenBucket
+        lastSweep time.Time
+}
+
+// Create a tenancy resolver
+func NewTenancy(db *DB, baseDomain string, tokenSecret []byte) *Tenancy {
+        return &Tenancy{
+                db:          db,
+                baseDomain:  baseDomain,
+                tokenSecret: tokenSecret,
+                quotas:      make(map[string]cachedQuota),
+                buckets:     make(map[string]*tokenBucket),
+        }
+}
+
+// Claims read from a bearer token
+type tokenClaims struct {
+        Tenant  string `json:"tenant"`
+        Subject string `json:"sub"`
+        Expires int64  `json:"exp"`
+}
+
+// verifyToken checks an HS256 JWT and returns its claims
+func (t *Tenancy) verifyToken(token string) (tokenClaims, error) {
+        var claims tokenClaims
+        parts := strings.Split(token, ".")
+        if len(t.tokenSecret) == 0 || len(parts) != 3 {
+                return claims, errInvalidToken
+        }
+
+        header, err := base64.RawURLEncoding.DecodeString(parts[0])
+        if err != nil {
+                return claims, errInvalidToken
+        }
+        var h struct {
+                Alg string `json:"alg"`
+        }
+        if json.Unmarshal(header, &h) != nil || h.Alg != "HS256" {
+                return claims, errInvalidToken
+        }
+
+        sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+        if err != nil {
+                return claims, errInvalidToken
+        }
+        mac := hmac.New(sha256.New, t.tokenSecret)
+        mac.Write([]byte(parts[0] + "." + parts[1]))
+        if !hmac.Equal(sig, mac.Sum(nil)) {
+                return claims, errInvalidToken
+        }
+
+        payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+        if err != nil || json.Unmarshal(payload, &claims) != nil {
+                return claims, errInvalidToken
+        }
+        if claims.Expires != 0 && time.Now().Unix() >= claims.Expires {
+                return claims, errInvalidToken
+        }
+        return claims, nil
+}
+
+// resolve picks the tenant for a request. Credentials decide it: the
+// "tenant" claim of a bearer token, or the tenant a session was bound to
+// at login. The X-Tenant-ID header and the subdomain may only name that
+// same tenant. Without credentials the header or subdomain is taken at
+// its word, unless bearer tokens are configured, in which case they are
+// required. The principal is the token subject, if there is one.
+func (t *Tenancy) resolve(authorization, header, host, bound string) (tenant, principal string, err error) {
+        if token := strings.TrimPrefix(authorization, "Bearer "); token != authorization && len(t.tokenSecret) > 0 {
+                claims, err := t.verifyToken(token)
+                if err != nil {
+                        return "", "", err
+                }
+                tenant, principal = claims.Tenant, claims.Subject
+                if tenant == "" {
+                        tenant = defaultTenant
+                }
+                if bound != "" && bound != tenant {
+                        return "", "", errTenantMismatch
+                }
+        } else if bound != "" {
+                tenant = bound
+        } else if len(t.tokenSecret) > 0 {
+                return "", "", errMissingToken
+        }
+
+        sub := t.hostTenant(host)
+        if tenant != "" {
+                if (header != "" && header != tenant) || (sub != "" && sub != tenant) {
+                        return "", "", errTenantMismatch
+                }
+        } else {
+                tenant = t.requested(header, host)
+        }
+        if !tenantPattern.MatchString(tenant) {
+                return "", "", errInvalidTenant
+        }
+        return tenant, principal, nil
+}
+
+// The tenant a request asks for, before any credentials are checked: the
+// header, else the subdomain, else the default
+func (t *Tenancy) requested(header, host string) string {
+        if header != "" {
+                return header
+        }
+        if sub := t.hostTenant(host); sub != "" {
+                return sub
+        }
+        return defaultTenant
+}
+
+// The subdomain of host under baseDomain, or ""
+func (t *Tenancy) hostTenant(host string) string {
+        if t.baseDomain == "" {
+                return ""
+        }
+        if h, _, err := net.SplitHostPort(host); err == nil {
+                host = h
+        }
+        if sub := strings.TrimSuffix(strings.ToLower(host), "."+t.baseDomain); sub != host && !strings.Contains(sub, ".") {
+                return sub
+        }
+        return ""
+}
+
+// LoginTenant is the tenant a session started by r is bound to, for
+// logins that do not carry a tenant of their own
+func (t *Tenancy) LoginTenant(r *http.Request) (string, error) {
+        tenant := t.requested(r.Header.Get("X-Tenant-ID"), r.Host)
+        if !tenantPattern.MatchString(tenant) {
+                return "", errInvalidTenant
+        }
+        return tenant, nil
+}
+
+// Quota returns a tenant's limits, reading tenant_quotas at most once per quotaTTL
+func (t *Tenancy) Quota(tenant string) TenantQuota {
+        t.mu.Lock()
+        cached, ok := t.quotas[tenant]
+        t.mu.Unlock()
+        if ok && time.Since(cached.loaded) < quotaTTL {
+                return cached.quota
+        }
+
+        quota := defaultQuota
+        err := t.db.QueryRow("SELECT max_items, requests_per_second, burst FROM tenant_quotas WHERE tenant_id = ?", tenant).
+                Scan(&quota.MaxItems, &quota.RequestsPerSecond, &quota.Burst)
+        if err != nil && err != sql.ErrNoRows {
+                if ok {
+                        return cached.quota // Keep the last known quota through database errors
+                }
+                return defaultQuota
+        }
+
+        t.mu.Lock()
+        t.quotas[tenant] = cachedQuota{quota: quota, loaded: time.Now()}
+        t.mu.Unlock()
+        return quota
+}
+
+// allow takes a token from the tenant's bucket. When the bucket is empty
+// it returns false and how long until the next token.
+func (t *Tenancy) allow(tenant string) (bool, time.Duration) {
+        quota := t.Quota(tenant)
+        if quota.RequestsPerSecond <= 0 {
+                return true, 0
+        }
+
+        t.mu.Lock()
+        defer t.mu.Unlock()
+
+        now := time.Now()
+        if now.Sub(t.lastSweep) >= quotaTTL {
+                t.sweep(now)
+        }
+        b, ok := t.buckets[tenant]
+        if !ok {
+                b = &tokenBucket{tokens: float64(quota.Burst), last: now}
+                t.buckets[tenant] = b
+        }
+        b.tokens = math.Min(float64(quota.Burst), b.tokens+now.Sub(b.last).Seconds()*quota.RequestsPerSecond)
+        b.last = now
+        if b.tokens < 1 {
+                return false, time.Duration((1 - b.tokens) / quota.RequestsPerSecond * float64(time.Second))
+        }
+        b.tokens--
+        return true, 0
+}
+
+// sweep forgets quotas due to be read again and buckets that have filled
+// back up, which are no different from new ones, so tenants that stop
+// calling, or names that never were tenants, do not stay in memory.
+// t.mu must be held.
+func (t *Tenancy) sweep(now time.Time) {
+        t.lastSweep = now
+        for tenant, b := range t.buckets {
+                quota := defaultQuota
+                if cached, ok := t.quotas[tenant]; ok {
+                        quota = cached.quota
+                }
+                if quota.RequestsPerSecond <= 0 || b.tokens+now.Sub(b.last).Seconds()*quota.RequestsPerSecond >= float64(quota.Burst) {
+                        delete(t.buckets, tenant)
+                }
+        }
+        for tenant, cached := range t.quotas {
+                if now.Sub(cached.loaded) >= quotaTTL {
+                        delete(t.quotas, tenant)
+                }
+        }
+}
+
+// checkItemQuota fails with errQuotaExceeded when the tenant is full.
+// Inserts for a tenant lock its tenant_locks row first, so they count in
+// turn. Locking only the rows counted would not: a tenant with no items
+// locks nothing, and Postgres rechecks just the rows it locked, never
+// another insert's new one. The count still locks, as MySQL only reads
+// past the transaction's snapshot in a locking read; the lock sits in a
+// derived table as Postgres will not take it alongside an aggregate.
+func (t *Tenancy) checkItemQuota(tx *Tx, tenant string) error {
+        if t == nil {
+                return nil
+        }
+        max := t.Quota(tenant).MaxItems
+        if max <= 0 {
+                return nil
+        }
+        if _, err := tx.Exec("INSERT IGNORE INTO tenant_locks (tenant_id) VALUES (?)", tenant); err != nil {
+                return err
+        }
+        var locked string
+        if err := tx.QueryRow("SELECT tenant_id FROM tenant_locks WHERE tenant_id = ? FOR UPDATE", tenant).Scan(&locked); err != nil {
+                return err
+        }
+        var count int
+        if err := tx.QueryRow("SELECT COUNT(*) FROM (SELECT id FROM items WHERE tenant_id = ? FOR UPDATE) locked", tenant).Scan(&count); err != nil {
+                return err
+        }
+        if shards != nil {
+                // Other shards are counted without a lock, so concurrent
+                // inserts landing on different shards may overshoot slightly
+                others, err := shards.countItems(tenant, tx.db)
+                if err != nil {
+                        return err
+                }
+                count += others
+        }
+        if count >= max {
+                return errQuotaExceeded
+        }
+        return nil
+}
+
+// Middleware resolves the tenant and enforces its rate limit
+func (t *Tenancy) Middleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                tenant, principal, err := t.resolve(r.Header.Get("Authorization"), r.Header.Get("X-Tenant-ID"), r.Host, sessionTenant(r))
+                switch err {
+                case nil:
+                case errInvalidToken:
+                        w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+                        http.Error(w, err.Error(), http.StatusUnauthorized)
+                        return
+                case errMissingToken:
+                        w.Header().Set("WWW-Authenticate", "Bearer")
+                        http.Error(w, err.Error(), http.StatusUnauthorized)
+                        return
+                case errTenantMismatch:
+                        http.Error(w, err.Error(), http.StatusForbidden)
+                        return
+                default:
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+
+                if ok, wait := t.allow(tenant); !ok {
+                        w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+                        http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+                        return
+                }
+
+                ctx := withTenant(r.Context(), tenant)
+                if principal != "" {
+                        ctx = withPrincipal(ctx, principal)
+                }
+                next.ServeHTTP(w, r.WithContext(ctx))
+        })
+}
+
+// Resolve the tenant for a gRPC call from its metadata
+func (t *Tenancy) grpcContext(ctx context.Context) (context.Context, error) {
+        md, _ := metadata.FromIncomingContext(ctx)
+        first := func(key string) string {
+                if v := md.Get(key); len(v) > 0 {
+                        return v[0]
+                }
+                return ""
+        }
+
+        tenant, principal, err := t.resolve(first("authorization"), first("x-tenant-id"), first(":authority"), "")
+        switch err {
+        case nil:
+        case errInvalidToken, errMissingToken:
+                return nil, status.Error(codes.Unauthenticated, err.Error())
+        case errTenantMismatch:
+                return nil, status.Error(codes.PermissionDenied, err.Error())
+        default:
+                return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
+        if ok, _ := t.allow(tenant); !ok {
+                return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+        }
+
+        ctx = withTenant(ctx, tenant)
+        if principal != "" {
+                ctx = withPrincipal(ctx, principal)
+        }
+        return ctx, nil
+}
+
+// UnaryInterceptor resolves the tenant for unary gRPC calls
+func (t *Tenancy) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+        if t == nil || strings.HasPrefix(info.FullMethod, "/grpc.health.") {
+                return handler(ctx, req)
+        }
+        ctx, err := t.grpcContext(ctx)
+        if err != nil {
+                return nil, err
+        }
+        return handler(ctx, req)
+}
+
+type tenantStream struct {
+        grpc.ServerStream
+        ctx context.Context
+}
+
+func (s tenantStream) Context() context.Context { return s.ctx }
+
+// StreamInterceptor resolves the tenant for streaming gRPC calls
+func (t *Tenancy) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+        if t == nil || !strings.HasPrefix(info.FullMethod, "/items.v1.") {
+                return handler(srv, ss)
+        }
+        ctx, err := t.grpcContext(ss.Context())
+        if err != nil {
+                return err
+        }
+        return handler(srv, tenantStream{ServerStream: ss, ctx: ctx})
+}
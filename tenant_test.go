@@ -0,0 +1,233 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "strconv"
+        "sync"
+        "testing"
+        "time"
+)
+
+const testTokenSecret = "test-secret"
+
+func bearer(tenant, subject string) map[string]string {
+        token := signToken(testTokenSecret, map[string]interface{}{"tenant": tenant, "sub": subject})
+        return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func TestCrossTenantAccessIsNotFound(t *testing.T) {
+        srv := newTestEnv(t, withTokens("")).serve(itemRoutes)
+
+        code, body := do(t, "POST", srv.URL+"/items", `{"name":"acme widget"}`, bearer("acme", "ann"))
+        if code != http.StatusCreated {
+                t.Fatalf("create: %d %s", code, body)
+        }
+        var created Item
+        if err := json.Unmarshal([]byte(body), &created); err != nil {
+                t.Fatal(err)
+        }
+        url := srv.URL + "/items/" + strconv.Itoa(created.ID)
+
+        globex := bearer("globex", "gus")
+        for _, tc := range []struct{ method, body string }{
+                {"GET", ""},
+                {"PUT", `{"name":"stolen"}`},
+                {"DELETE", ""},
+        } {
+                if code, body := do(t, tc.method, url, tc.body, globex); code != http.StatusNotFound {
+                        t.Errorf("%s from another tenant: got %d %s, want 404", tc.method, code, body)
+                }
+        }
+        if code, body := do(t, "GET", srv.URL+"/items", "", globex); code != http.StatusOK || body != "[]\n" {
+                t.Errorf("list from another tenant: got %d %s, want an empty list", code, body)
+        }
+
+        code, body = do(t, "GET", url, "", bearer("acme", "ann"))
+        if code != http.StatusOK {
+                t.Fatalf("get as owner: %d %s", code, body)
+        }
+        var got Item
+        json.Unmarshal([]byte(body), &got)
+        if got.Name != "acme widget" {
+                t.Errorf("item changed by another tenant: %+v", got)
+        }
+}
+
+func TestTenantMustMatchCredentials(t *testing.T) {
+        srv := newTestEnv(t, withTokens("items.example.com")).serve(itemRoutes)
+
+        tests := []struct {
+                name    string
+                headers map[string]string
+                host    string
+                want    int
+        }{
+                {"token alone", bearer("acme", "ann"), "", http.StatusOK},
+                {"header matches token", merge(bearer("acme", "ann"), map[string]string{"X-Tenant-ID": "acme"}), "", http.StatusOK},
+                {"header names another tenant", merge(bearer("acme", "ann"), map[string]string{"X-Tenant-ID": "globex"}), "", http.StatusForbidden},
+                {"subdomain names another tenant", bearer("acme", "ann"), "globex.items.example.com", http.StatusForbidden},
+                {"header without a token", map[string]string{"X-Tenant-ID": "acme"}, "", http.StatusUnauthorized},
+                {"subdomain without a token", nil, "acme.items.example.com", http.StatusUnauthorized},
+                {"forged token", map[string]string{"Authorization": "Bearer " + signToken("wrong", map[string]interface{}{"tenant": "acme"})}, "", http.StatusUnauthorized},
+        }
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        req, _ := http.NewRequest("GET", srv.URL+"/items", nil)
+                        for k, v := range tc.headers {
+                                req.Header.Set(k, v)
+                        }
+                        if tc.host != "" {
+                                req.Host = tc.host
+                        }
+                        resp, err := http.DefaultClient.Do(req)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        resp.Body.Close()
+                        if resp.StatusCode != tc.want {
+                                t.Errorf("got %d, want %d", resp.StatusCode, tc.want)
+                        }
+                })
+        }
+}
+
+func merge(a, b map[string]string) map[string]string {
+        out := map[string]string{}
+        for k, v := range a {
+                out[k] = v
+        }
+        for k, v := range b {
+                out[k] = v
+        }
+        return out
+}
+
+func TestResolveSessionTenant(t *testing.T) {
+        tests := []struct {
+                name                  string
+                secret, header, bound string
+                want                  string
+                err                   error
+        }{
+                {name: "no credentials, no secret", header: "acme", want: "acme"},
+                {name: "no credentials at all", want: defaultTenant},
+                {name: "no credentials with a secret", secret: testTokenSecret, header: "acme", err: errMissingToken},
+                {name: "session", secret: testTokenSecret, bound: "acme", want: "acme"},
+                {name: "session and matching header", secret: testTokenSecret, bound: "acme", header: "acme", want: "acme"},
+                {name: "session and other header", secret: testTokenSecret, bound: "acme", header: "globex", err: errTenantMismatch},
+                {name: "session and other header, no secret", bound: "acme", header: "globex", err: errTenantMismatch},
+                {name: "invalid tenant", header: "Not A Tenant", err: errInvalidTenant},
+        }
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        tenant, _, err := NewTenancy(nil, "", []byte(tc.secret)).resolve("", tc.header, "", tc.bound)
+                        if err != tc.err || tenant != tc.want {
+                                t.Errorf("got %q, %v; want %q, %v", tenant, err, tc.want, tc.err)
+                        }
+                })
+        }
+}
+
+func TestCacheKeysScopedPerTenant(t *testing.T) {
+        c := NewItemCache(NewLRUCache(10), time.Minute)
+        loads := map[string]int{}
+        load := func(tenant string, id int) (Item, error) {
+                loads[tenant]++
+                return Item{ID: id, Name: tenant + " item", Tenant: tenant}, nil
+        }
+
+        a, _ := c.Get("acme", 1, load)
+        b, _ := c.Get("globex", 1, load)
+        if a.Name != "acme item" || b.Name != "globex item" {
+                t.Fatalf("tenants share a cache entry: %+v %+v", a, b)
+        }
+        c.Get("acme", 1, load)
+        if loads["acme"] != 1 || loads["globex"] != 1 {
+                t.Errorf("loads = %v, want one per tenant", loads)
+        }
+
+        c.Invalidate("globex", 1)
+        if got, _ := c.Get("acme", 1, load); got.Name != "acme item" || loads["acme"] != 1 {
+                t.Errorf("invalidating one tenant's item dropped another's")
+        }
+        if itemKey("acme", 1) == itemKey("globex", 1) {
+                t.Errorf("item keys do not include the tenant")
+        }
+}
+
+func TestCachedItemNotServedToOtherTenant(t *testing.T) {
+        srv := newTestEnv(t).serve(itemRoutes)
+
+        _, body := do(t, "POST", srv.URL+"/items", `{"name":"cached"}`, map[string]string{"X-Tenant-ID": "acme"})
+        var created Item
+        json.Unmarshal([]byte(body), &created)
+        url := srv.URL + "/items/" + strconv.Itoa(created.ID)
+
+        // Warm the cache for acme, then ask as globex
+        if code, _ := do(t, "GET", url, "", map[string]string{"X-Tenant-ID": "acme"}); code != http.StatusOK {
+                t.Fatalf("get as owner: %d", code)
+        }
+        if code, _ := do(t, "GET", url, "", map[string]string{"X-Tenant-ID": "globex"}); code != http.StatusNotFound {
+                t.Errorf("cached item served to another tenant: %d", code)
+        }
+}
+
+func TestTenancySweepForgetsIdleTenants(t *testing.T) {
+        ten := NewTenancy(nil, "", nil)
+        now := time.Now()
+        ten.quotas["acme"] = cachedQuota{quota: defaultQuota, loaded: now}
+        ten.quotas["gone"] = cachedQuota{quota: defaultQuota, loaded: now.Add(-2 * quotaTTL)}
+        ten.buckets["acme"] = &tokenBucket{tokens: 0, last: now}
+        ten.buckets["gone"] = &tokenBucket{tokens: 0, last: now.Add(-time.Hour)}
+
+        ten.sweep(now)
+        if _, ok := ten.buckets["gone"]; ok {
+                t.Errorf("full bucket kept")
+        }
+        if _, ok := ten.quotas["gone"]; ok {
+                t.Errorf("stale quota kept")
+        }
+        if _, ok := ten.buckets["acme"]; !ok {
+                t.Errorf("bucket still refilling was dropped")
+        }
+}
+
+// Concurrent inserts for a tenant with no items yet must still count one
+// another, so only one fits under a quota of one
+func TestItemQuotaHoldsUnderConcurrentInserts(t *testing.T) {
+        conn := newTestEnv(t).DB
+        if _, err := conn.Exec("INSERT INTO tenant_quotas (tenant_id, max_items, requests_per_second, burst) VALUES ('acme', 1, 0, 0)"); err != nil {
+                t.Fatal(err)
+        }
+
+        const inserts = 8
+        var wg sync.WaitGroup
+        errs := make(chan error, inserts)
+        for i := 0; i < inserts; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        _, err := insertItem(Actor{Tenant: "acme"}, Item{Name: "widget"})
+                        errs <- err
+                }()
+        }
+        wg.Wait()
+        close(errs)
+
+        created := 0
+        for err := range errs {
+                if err == nil {
+                        created++
+                } else if err != errQuotaExceeded {
+                        t.Error(err)
+                }
+        }
+        var count int
+        if err := conn.QueryRow("SELECT COUNT(*) FROM items WHERE tenant_id = 'acme'").Scan(&count); err != nil {
+                t.Fatal(err)
+        }
+        if created != 1 || count != 1 {
+                t.Errorf("created %d, %d rows; want 1", created, count)
+        }
+}
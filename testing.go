@@ -1,30 +1,53 @@
 package main
 
 import (
+        "context"
         "database/sql"
-        "encoding/json"
         "fmt"
         "log"
         "net/http"
+        "os"
         "strconv"
+        "strings"
+        "time"
 
         _ "github.com/go-sql-driver/mysql" // MySQL driver
-        "github.com/gorilla/mux"        // Router
+        "github.com/gorilla/mux"           // Router
 )
 
 // Define the struct for your data
 type Item struct {
-        ID   int    `json:"id"`
-        Name string `json:"name"`
-        Desc string `json:"desc"`
+        ID        int       `json:"id" xml:"id"`
+        Name      string    `json:"name" xml:"name"`
+        Desc      string    `json:"desc" xml:"desc"`
+        UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+        Tenant    string    `json:"-" xml:"-"`
+
+        // Only filled in when asked for with ?expand=
+        Tags       []Tag      `json:"tags,omitempty" xml:"tags>tag,omitempty"`
+        Categories []Category `json:"categories,omitempty" xml:"categories>category,omitempty"`
 }
 
-var db *sql.DB
+var db *DB
+var cache *ItemCache
+var bus *EventBus
+var events *SSEHub
+var audit *AuditLog
+var tenancy *Tenancy
+var replicas *ReplicaSet
+var shards *ShardSet
 
 func main() {
         // Connect to the database
         var err error
-        db, err = sql.Open("mysql", "user:password@tcp(127.0.0.1:3306)/dbname") // Replace with your credentials
+        // DATABASE_URL names a MySQL DSN such as
+        // user:password@tcp(127.0.0.1:3306)/dbname?parseTime=true, or a
+        // postgres:// URL. Without one the items live in a local SQLite file.
+        dsn := os.Getenv("DATABASE_URL")
+        if dsn == "" {
+                dsn = "sqlite://data/items.db"
+        }
+        db, err = openDB(dsn)
         if err != nil {
                 log.Fatal(err)
         }
@@ -38,42 +61,244 @@ func main() {
 
         fmt.Println("Database connected!")
 
+        if err := migrate(db); err != nil {
+                log.Fatal(err)
+        }
+
+        // ITEM_IDS=snowflake or random has the service generate item IDs
+        // rather than the database; snowflake needs a distinct NODE_ID
+        // (0-1023) on every instance, while random IDs can collide across
+        // instances. The two lay IDs out differently, so pick one and keep it.
+        if mode := os.Getenv("ITEM_IDS"); mode != "" {
+                if itemIDs, err = newIDGenerator(mode, os.Getenv("NODE_ID")); err != nil {
+                        log.Fatal(err)
+                }
+        }
+
+        // Fail fast with 503 while the database keeps dropping connections,
+        // rather than piling more requests onto it
+        dbBreaker = NewCircuitBreaker("database", 5, 10*time.Second)
+        db.Breaker = dbBreaker
+
+        // Reads that can tolerate a little lag go to DATABASE_REPLICA_URLS,
+        // a comma-separated list of DSNs, while they keep up with the primary
+        var replicaDBs []*DB
+        for _, dsn := range strings.FieldsFunc(os.Getenv("DATABASE_REPLICA_URLS"), func(r rune) bool { return r == ',' }) {
+                replica, err := openDB(strings.TrimSpace(dsn))
+                if err != nil {
+                        log.Fatal(err)
+                }
+                defer replica.Close()
+                replicaDBs = append(replicaDBs, replica)
+        }
+        policy := RoundRobin
+        if os.Getenv("REPLICA_POLICY") == "least-latency" {
+                policy = LeastLatency
+        }
+        replicas = NewReplicaSet(db, replicaDBs, policy, 5*time.Second)
+        go replicas.Run(context.Background())
+
+        // DATABASE_SHARDS spreads items over more databases: comma-separated
+        // name=dsn pairs, alongside the main database. Adding one moves the
+        // items it now owns in the background.
+        if v := os.Getenv("DATABASE_SHARDS"); v != "" {
+                others, err := parseShards(v)
+                if err != nil {
+                        log.Fatal(err)
+                }
+                for _, shard := range others {
+                        defer shard.DB.Close()
+                        shard.DB.Breaker = dbBreaker // Any shard out is reported as the database out
+                        if err := migrate(shard.DB); err != nil {
+                                log.Fatalf("shard %s: %v", shard.Name, err)
+                        }
+                }
+                shards = NewShardSet(db, others, 128)
+                if err := shards.syncCounters(); err != nil {
+                        log.Fatal(err)
+                }
+                shards.Relay(context.Background())
+                shards.Rebalance() // Runs on whichever instance takes the lease
+        }
+
+        // Cache hot items in memory; swap the backend to share it between instances
+        cache = NewItemCache(NewLRUCache(10000), 5*time.Minute)
+
+        audit = NewAuditLog(db)
+
+        // Tenants come from a signed token or the session, or else X-Tenant-ID
+        // or a subdomain of TENANT_BASE_DOMAIN. With TENANT_TOKEN_SECRET set,
+        // requests without a session need a token.
+        tenancy = NewTenancy(db, os.Getenv("TENANT_BASE_DOMAIN"), []byte(os.Getenv("TENANT_TOKEN_SECRET")))
+
+        // Relay item changes from the outbox to in-process subscribers,
+        // webhooks and stdout
+        bus = NewEventBus()
+        webhooks := NewWebhookDispatcher(db, 4)
+        relay := NewOutboxRelay(db, MultiSink{bus, webhooks, NewStdoutSink()})
+        go relay.Run(context.Background())
+        go webhooks.Run(context.Background())
+
+        events = NewSSEHub(1000)
+        bus.Subscribe(events.Publish)
+
+        search := NewSearchIndex()
+        bus.Subscribe(search.Apply)
+        if err := search.Rebuild(listAllItems); err != nil {
+                log.Fatal(err)
+        }
+
+        blobs, err := NewLocalBlobStore("data/attachments")
+        if err != nil {
+                log.Fatal(err)
+        }
+        attachments := NewAttachmentService(blobs, 10<<20)
+        bus.Subscribe(attachments.Apply)
+        go attachments.Run(context.Background())
+
+        // Browser sessions live in the database unless SESSION_STORE=memory.
+        // SESSION_SECRET keeps their cookies valid across restarts and
+        // between instances.
+        var sessionStore SessionStore = NewSQLSessionStore(db)
+        if os.Getenv("SESSION_STORE") == "memory" {
+                sessionStore = NewMemorySessionStore()
+        }
+        sessions := NewSessionManager(sessionStore, os.Getenv("SESSION_SECRET"), 30*time.Minute, 12*time.Hour)
+        go sessions.Run(context.Background())
+
+        // OIDC_ISSUER turns on sign-in through the company IdP at /auth/login
+        var oidcLogin *OIDCLogin
+        issuer := os.Getenv("OIDC_ISSUER")
+        if issuer != "" {
+                redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+                if redirectURL == "" {
+                        redirectURL = "http://localhost:8080/auth/callback"
+                }
+                scopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+                if len(scopes) == 0 {
+                        scopes = []string{"openid", "email", "profile", "offline_access"}
+                }
+                oidcLogin = NewOIDCLogin(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), redirectURL, scopes, sessions)
+        }
+
         // Create the router
         router := mux.NewRouter()
+        router.Use(sessions.Middleware, oidcLogin.Middleware, tenancy.Middleware, replicas.Middleware, audit.Middleware)
+
+        // Define routes. The item API is served under /v1 and /v2, and the
+        // unversioned paths stay v1 for consumers from before versioning.
+        ws := NewWSServer(10)
+        versionRoutes(router, func(router *mux.Router) {
+                router.HandleFunc("/items", getItems).Methods("GET")
+                router.Handle("/items/events", events).Methods("GET")
+                router.Handle("/items/ws", ws).Methods("GET")
+                router.HandleFunc("/items/search", search.serveSearch).Methods("GET")
+                router.HandleFunc("/items/{id}", getItem).Methods("GET")
+                router.HandleFunc("/items/{id}/history", getHistory).Methods("GET")
+                router.HandleFunc("/items/{id}/revisions/{revision}/revert", revertRevision).Methods("POST")
+                router.HandleFunc("/items/{id}/attachments", attachments.upload).Methods("POST")
+                router.HandleFunc("/items/{id}/attachments", attachments.list).Methods("GET")
+                router.HandleFunc("/items/{id}/attachments/{attachmentId}", attachments.download).Methods("GET", "HEAD")
+                router.HandleFunc("/items/{id}/attachments/{attachmentId}", attachments.remove).Methods("DELETE")
+                router.HandleFunc("/items/{id}/tags/{target}", linkItem("tags", true)).Methods("PUT")
+                router.HandleFunc("/items/{id}/tags/{target}", linkItem("tags", false)).Methods("DELETE")
+                router.HandleFunc("/items/{id}/categories/{target}", linkItem("categories", true)).Methods("PUT")
+                router.HandleFunc("/items/{id}/categories/{target}", linkItem("categories", false)).Methods("DELETE")
+                router.HandleFunc("/items", createItem).Methods("POST")
+                router.HandleFunc("/items/{id}", updateItem).Methods("PUT")
+                router.HandleFunc("/items/{id}", deleteItem).Methods("DELETE")
+        })
+
+        router.HandleFunc("/tags", createTag).Methods("POST")
+        router.HandleFunc("/tags", getTags).Methods("GET")
+        router.HandleFunc("/categories", createCategory).Methods("POST")
+        router.HandleFunc("/categories", getCategories).Methods("GET")
+
+        router.HandleFunc("/audit", audit.serveQuery).Methods("GET")
+        router.HandleFunc("/audit/verify", audit.serveVerify).Methods("GET")
 
-        // Define routes
-        router.HandleFunc("/items", getItems).Methods("GET")
-        router.HandleFunc("/items/{id}", getItem).Methods("GET")
-        router.HandleFunc("/items", createItem).Methods("POST")
-        router.HandleFunc("/items/{id}", updateItem).Methods("PUT")
-        router.HandleFunc("/items/{id}", deleteItem).Methods("DELETE")
+        if shards != nil {
+                router.HandleFunc("/shards", shards.serveStatus).Methods("GET")
+                router.HandleFunc("/shards/rebalance", shards.serveRebalance).Methods("POST")
+        }
+
+        router.HandleFunc("/debug/breaker", dbBreaker.serveStatus).Methods("GET")
+        router.HandleFunc("/debug/versions", serveVersions).Methods("GET")
+
+        router.HandleFunc("/graphql", serveGraphQL).Methods("GET", "POST")
+
+        router.HandleFunc("/webhooks", webhooks.createWebhook).Methods("POST")
+        router.HandleFunc("/webhooks", webhooks.listWebhooks).Methods("GET")
+        router.HandleFunc("/webhooks/dead-letters", webhooks.listDeadLetters).Methods("GET")
+        router.HandleFunc("/webhooks/deliveries/{id}/replay", webhooks.replayDelivery).Methods("POST")
+        router.HandleFunc("/webhooks/{id}", webhooks.getWebhook).Methods("GET")
+        router.HandleFunc("/webhooks/{id}", webhooks.deleteWebhook).Methods("DELETE")
+        router.HandleFunc("/webhooks/{id}/deliveries", webhooks.listDeliveries).Methods("GET")
+
+        // Serve gRPC for internal services on its own port
+        go func() {
+                fmt.Println("gRPC listening on port 9090...")
+                log.Fatal(serveGRPC(":9090"))
+        }()
+
+        // ADMIN_USERS, comma-separated name:bcrypt-hash pairs such as
+        // htpasswd -nbB prints, turns on the admin console at /admin
+        root := mux.NewRouter()
+        if users := os.Getenv("ADMIN_USERS"); users != "" {
+                console, err := NewAdminConsole(users, sessions, search)
+                if err != nil {
+                        log.Fatal(err)
+                }
+                root.PathPrefix("/admin/").Handler(console.Handler())
+                root.Handle("/admin", http.RedirectHandler("/admin/", http.StatusMovedPermanently))
+        }
+        if oidcLogin != nil {
+                root.PathPrefix("/auth/").Handler(oidcLogin.Handler())
+        }
+        root.PathPrefix("/").Handler(router)
 
         // Start the server
         fmt.Println("Server listening on port 8080...")
-        log.Fatal(http.ListenAndServe(":8080", router))
+        log.Fatal(http.ListenAndServe(":8080", compress(root, 1024)))
 }
 
 // Get all items
 func getItems(w http.ResponseWriter, r *http.Request) {
-        rows, err := db.Query("SELECT id, name, desc FROM items")
+        if !acceptable(w, r, true) {
+                return
+        }
+        filter, err := filterFromRequest(r)
         if err != nil {
-                http.Error(w, err.Error(), http.StatusInternalServerError)
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        expand, err := expandFromRequest(r)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
                 return
         }
-        defer rows.Close()
 
-        items := []Item{}
-        for rows.Next() {
-                var item Item
-                if err := rows.Scan(&item.ID, &item.Name, &item.Desc); err != nil {
-                        http.Error(w, err.Error(), http.StatusInternalServerError)
-                        return
-                }
-                items = append(items, item)
+        var items []Item
+        err = dbBreaker.Do(r.Context(), func() error {
+                return replicas.Read(r.Context(), func(conn *DB) (err error) {
+                        items, err = listItemsFiltered(conn, requestTenant(r), filter)
+                        return err
+                })
+        })
+        if err != nil {
+                dbError(w, err)
+                return
         }
 
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(items)
+        modified, etag := listValidators(items)
+        if setValidators(w, r, modified, etag) {
+                return
+        }
+        if err := dbBreaker.Do(r.Context(), func() error { return expandItems(items, expand) }); err != nil {
+                dbError(w, err)
+                return
+        }
+        writeResponse(w, r, http.StatusOK, items)
 }
 
 // Get a single item
@@ -84,47 +309,92 @@ func getItem(w http.ResponseWriter, r *http.Request) {
                 http.Error(w, "Invalid ID", http.StatusBadRequest)
                 return
         }
+        if !acceptable(w, r, false) {
+                return
+        }
+
+        expand, err := expandFromRequest(r)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        // ?asOf= reads the item back from its revision history. Otherwise the
+        // cache is filled from the primary, as a lagging replica could
+        // re-cache an item just after it was invalidated.
+        load := cache.Get
+        if v := r.URL.Query().Get("asOf"); v != "" {
+                at, err := time.Parse(time.RFC3339Nano, v)
+                if err != nil {
+                        http.Error(w, "asOf must be an RFC 3339 timestamp", http.StatusBadRequest)
+                        return
+                }
+                if expand != nil {
+                        http.Error(w, "expand cannot be combined with asOf", http.StatusBadRequest)
+                        return
+                }
+                load = func(tenant string, id int, _ func(string, int) (Item, error)) (item Item, err error) {
+                        err = replicas.Read(r.Context(), func(conn *DB) (err error) {
+                                item, err = loadItemAsOf(conn, tenant, id, at)
+                                return err
+                        })
+                        return item, err
+                }
+        }
 
         var item Item
-        err = db.QueryRow("SELECT id, name, desc FROM items WHERE id = ?", id).Scan(&item.ID, &item.Name, &item.Desc)
+        err = dbBreaker.Do(r.Context(), func() (err error) {
+                item, err = load(requestTenant(r), id, loadItem)
+                return err
+        })
         if err != nil {
                 if err == sql.ErrNoRows {
                         http.NotFound(w, r)
                         return
                 }
-                http.Error(w, err.Error(), http.StatusInternalServerError)
+                dbError(w, err)
                 return
         }
 
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(item)
+        if setValidators(w, r, item.UpdatedAt, itemETag(item)) {
+                return
+        }
+        // Expand a copy so the cached item stays bare
+        expanded := []Item{item}
+        if err := dbBreaker.Do(r.Context(), func() error { return expandItems(expanded, expand) }); err != nil {
+                dbError(w, err)
+                return
+        }
+        item = expanded[0]
+        writeResponse(w, r, http.StatusOK, item)
 }
 
 // Create a new item
 func createItem(w http.ResponseWriter, r *http.Request) {
-        var item Item
-        if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
-                http.Error(w, err.Error(), http.StatusBadRequest)
+        if !acceptable(w, r, false) {
                 return
         }
-
-        result, err := db.Exec("INSERT INTO items (name, desc) VALUES (?, ?)", item.Name, item.Desc)
-        if err != nil {
-                http.Error(w, err.Error(), http.StatusInternalServerError)
+        var item Item
+        if !decodeRequest(w, r, &item) {
                 return
         }
 
-        id, err := result.LastInsertId()
-        if err != nil {
-                http.Error(w, err.Error(), http.StatusInternalServerError)
+        err := dbBreaker.Do(r.Context(), func() (err error) {
+                item, err = insertItem(requestActor(r), item)
+                return err
+        })
+        if _, invalid := err.(ValidationError); invalid {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        } else if err == errQuotaExceeded {
+                http.Error(w, err.Error(), http.StatusForbidden)
+                return
+        } else if err != nil {
+                dbError(w, err)
                 return
         }
 
-        item.ID = int(id)
-
-        w.Header().Set("Content-Type", "application/json")
-        w.WriteHeader(http.StatusCreated)
-        json.NewEncoder(w).Encode(item)
+        writeResponse(w, r, http.StatusCreated, item)
 }
 
 // Update an existing item
@@ -136,22 +406,32 @@ func updateItem(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        if !acceptable(w, r, false) {
+                return
+        }
         var item Item
-        if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
-                http.Error(w, err.Error(), http.StatusBadRequest)
+        if !decodeRequest(w, r, &item) {
                 return
         }
 
-        _, err = db.Exec("UPDATE items SET name = ?, desc = ? WHERE id = ?", item.Name, item.Desc, id)
-        if err != nil {
-                http.Error(w, err.Error(), http.StatusInternalServerError)
+        item.ID = id
+
+        err = dbBreaker.Do(r.Context(), func() (err error) {
+                item, err = saveItem(requestActor(r), item)
+                return err
+        })
+        if _, invalid := err.(ValidationError); invalid {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        } else if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return
+        } else if err != nil {
+                dbError(w, err)
                 return
         }
 
-        item.ID = id;
-
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(item)
+        writeResponse(w, r, http.StatusOK, item)
 }
 
 // Delete an item
@@ -163,11 +443,14 @@ func deleteItem(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        _, err = db.Exec("DELETE FROM items WHERE id = ?", id)
-        if err != nil {
-                http.Error(w, err.Error(), http.StatusInternalServerError)
+        err = dbBreaker.Do(r.Context(), func() error { return removeItem(requestActor(r), id) })
+        if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return
+        } else if err != nil {
+                dbError(w, err)
                 return
         }
 
         w.WriteHeader(http.StatusNoContent)
-}
\ No newline at end of file
+}
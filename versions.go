@@ -0,0 +1,240 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "encoding/xml"
+        "net/http"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// APIVersion is one version of the item API. Handlers work with Item;
+// writeResponse and decodeRequest map it to and from the version's shape,
+// and wire maps the events, search hits and revisions that carry an item.
+// Attachments carry no item fields and are the same in every version.
+type APIVersion struct {
+        Name        string
+        Deprecation time.Time // Zero while the version is current
+        Sunset      time.Time // When it stops being served
+        Successor   string    // Name of the version to move to
+
+        // Mappers between Item and the version's wire shape; nil for Item as is
+        toWire    func(Item) interface{}
+        newBody   func() wireItem
+        csvHeader []string
+        fields    map[string]string // Item fields the version names differently, for diffs
+
+        mu       sync.Mutex
+        requests uint64
+        lastSeen time.Time
+        tenants  map[string]uint64 // Who still calls it
+}
+
+// A request body that maps onto an Item
+type wireItem interface {
+        item() Item
+}
+
+// v1 is the original shape, also served on the unversioned paths
+var apiV1 = &APIVersion{
+        Name:        "v1",
+        Deprecation: time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+        Sunset:      time.Date(2027, 4, 19, 0, 0, 0, 0, time.UTC),
+        Successor:   "v2",
+        csvHeader:   []string{"id", "name", "desc"},
+        tenants:     map[string]uint64{},
+}
+
+var apiV2 = &APIVersion{
+        Name:      "v2",
+        toWire:    func(item Item) interface{} { return newItemV2(item) },
+        newBody:   func() wireItem { return &ItemV2{} },
+        csvHeader: []string{"id", "name", "description"},
+        fields:    map[string]string{"desc": "description"},
+        tenants:   map[string]uint64{},
+}
+
+var apiVersions = []*APIVersion{apiV1, apiV2}
+
+// ItemV2 is an item as v2 sends it: the ID as a string, since generated
+// IDs are past what JavaScript numbers hold exactly, and desc spelled out
+type ItemV2 struct {
+        XMLName     xml.Name   `json:"-" xml:"item"`
+        ID          string     `json:"id" xml:"id"`
+        Name        string     `json:"name" xml:"name"`
+        Description string     `json:"description" xml:"description"`
+        UpdatedAt   time.Time  `json:"updated_at" xml:"updated_at"`
+        Tags        []Tag      `json:"tags,omitempty" xml:"tags>tag,omitempty"`
+        Categories  []Category `json:"categories,omitempty" xml:"categories>category,omitempty"`
+}
+
+func newItemV2(item Item) ItemV2 {
+        return ItemV2{
+                ID:          strconv.Itoa(item.ID),
+                Name:        item.Name,
+                Description: item.Desc,
+                UpdatedAt:   item.UpdatedAt,
+                Tags:        item.Tags,
+                Categories:  item.Categories,
+        }
+}
+
+// The ID in a body is ignored; it comes from the path
+func (v *ItemV2) item() Item {
+        return Item{Name: v.Name, Desc: v.Description}
+}
+
+type versionKey struct{}
+
+// The API version serving r; requests outside a version group get v1
+func requestVersion(r *http.Request) *APIVersion {
+        if version, ok := r.Context().Value(versionKey{}).(*APIVersion); ok {
+                return version
+        }
+        return apiV1
+}
+
+// Middleware tags requests with the version, counts them and warns
+// callers of a deprecated version when it goes away and what replaces it
+func (v *APIVersion) Middleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                v.mu.Lock()
+                v.requests++
+                v.lastSeen = time.Now()
+                v.tenants[requestTenant(r)]++
+                v.mu.Unlock()
+
+                if !v.Deprecation.IsZero() {
+                        w.Header().Set("Deprecation", "@"+strconv.FormatInt(v.Deprecation.Unix(), 10))
+                        w.Header().Set("Sunset", v.Sunset.Format(http.TimeFormat))
+                        w.Header().Add("Link", `</`+v.Successor+`/items>; rel="successor-version"`)
+                }
+                next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), versionKey{}, v)))
+        })
+}
+
+// wire maps an Item, []Item, ItemEvent or revisionList to the version's shape
+func (v *APIVersion) wire(body interface{}) interface{} {
+        if v.toWire == nil {
+                return body
+        }
+        switch body := body.(type) {
+        case Item:
+                return v.toWire(body)
+        case []Item:
+                mapped := make([]interface{}, len(body))
+                for i, item := range body {
+                        mapped[i] = v.toWire(item)
+                }
+                return mapped
+        case ItemEvent:
+                event := wireEvent{ID: body.ID, Type: body.Type, ItemID: jsonID(body.ItemID), OccurredAt: body.OccurredAt}
+                if body.Item != nil {
+                        event.Item = v.toWire(*body.Item)
+                }
+                return event
+        case revisionList:
+                mapped := make(wireRevisionList, len(body))
+                for i, rev := range body {
+                        diff := fieldChanges{}
+                        for field, change := range rev.Diff {
+                                if name, ok := v.fields[field]; ok {
+                                        field = name
+                                }
+                                diff[field] = change
+                        }
+                        mapped[i] = wireRevision{Revision: rev.Revision, Action: rev.Action, Principal: rev.Principal,
+                                Item: v.toWire(rev.Item()), Diff: diff, RevertedFrom: rev.RevertedFrom, CreatedAt: rev.CreatedAt}
+                }
+                return mapped
+        }
+        return body
+}
+
+// An ItemEvent with its item in a version's shape
+type wireEvent struct {
+        ID         int64       `json:"id"`
+        Type       string      `json:"type"`
+        ItemID     jsonID      `json:"item_id"`
+        Item       interface{} `json:"item,omitempty"`
+        OccurredAt time.Time   `json:"occurred_at"`
+}
+
+// A Revision in versions after v1, which carry the item in the version's
+// shape rather than its fields alongside the revision's
+type wireRevision struct {
+        XMLName      xml.Name     `json:"-" xml:"revision"`
+        Revision     int          `json:"revision" xml:"revision"`
+        Action       string       `json:"action" xml:"action"`
+        Principal    string       `json:"principal" xml:"principal"`
+        Item         interface{}  `json:"item" xml:"item"`
+        Diff         fieldChanges `json:"diff" xml:"diff"`
+        RevertedFrom int          `json:"reverted_from,omitempty" xml:"reverted_from,omitempty"`
+        CreatedAt    time.Time    `json:"created_at" xml:"created_at"`
+}
+
+type wireRevisionList []wireRevision
+
+func (l wireRevisionList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+        return encodeXMLList(e, "revisions", []wireRevision(l))
+}
+
+// path without the version prefix it was served under, if any
+func unversionedPath(path string) string {
+        for _, version := range apiVersions {
+                if rest := strings.TrimPrefix(path, "/"+version.Name); rest != path && strings.HasPrefix(rest, "/") {
+                        return rest
+                }
+        }
+        return path
+}
+
+// Serve the item routes under a path prefix per version, with the
+// unversioned paths kept as v1
+func versionRoutes(router *mux.Router, routes func(*mux.Router)) {
+        legacy := router.NewRoute().Subrouter()
+        legacy.Use(apiV1.Middleware)
+        routes(legacy)
+
+        for _, version := range apiVersions {
+                sub := router.PathPrefix("/" + version.Name).Subrouter()
+                sub.Use(version.Middleware)
+                routes(sub)
+        }
+}
+
+// Requests per version, so we know when an old one can go
+func serveVersions(w http.ResponseWriter, r *http.Request) {
+        type versionStatus struct {
+                Name        string            `json:"name"`
+                Requests    uint64            `json:"requests"`
+                LastRequest *time.Time        `json:"last_request,omitempty"`
+                Deprecation *time.Time        `json:"deprecation,omitempty"`
+                Sunset      *time.Time        `json:"sunset,omitempty"`
+                Tenants     map[string]uint64 `json:"tenants"`
+        }
+        status := []versionStatus{}
+        for _, v := range apiVersions {
+                v.mu.Lock()
+                st := versionStatus{Name: v.Name, Requests: v.requests, Tenants: map[string]uint64{}}
+                for tenant, n := range v.tenants {
+                        st.Tenants[tenant] = n
+                }
+                if !v.lastSeen.IsZero() {
+                        lastSeen := v.lastSeen
+                        st.LastRequest = &lastSeen
+                }
+                v.mu.Unlock()
+                if !v.Deprecation.IsZero() {
+                        st.Deprecation, st.Sunset = &v.Deprecation, &v.Sunset
+                }
+                status = append(status, st)
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,722 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/hmac"
+        "crypto/rand"
+        "crypto/sha256"
+        "database/sql"
+        "encoding/hex"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "net"
+        "net/http"
+        "net/url"
+        "strconv"
+        "strings"
+        "syscall"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// Webhook is a partner subscription to item lifecycle events
+type Webhook struct {
+        ID        int       `json:"id"`
+        Tenant    string    `json:"-"` // Only receives this tenant's events
+        URL       string    `json:"url"`
+        Events    []string  `json:"events"`           // Empty means all events
+        Secret    string    `json:"secret,omitempty"` // Only returned when the webhook is created
+        CreatedAt time.Time `json:"created_at"`
+}
+
+func (h Webhook) wants(eventType string) bool {
+        if len(h.Events) == 0 {
+                return true
+        }
+        for _, e := range h.Events {
+                if e == eventType {
+                        return true
+                }
+        }
+        return false
+}
+
+// Delivery statuses
+const (
+        DeliveryPending   = "pending"
+        DeliverySucceeded = "succeeded"
+        DeliveryDead      = "dead" // Retries exhausted, kept in the dead-letter list
+)
+
+// Delivery is one event sent (or being sent) to one webhook
+type Delivery struct {
+        ID         int       `json:"id"`
+        WebhookID  int       `json:"webhook_id"`
+        Event      ItemEvent `json:"event"`
+        Status     string    `json:"status"`
+        Attempts   int       `json:"attempts"`
+        LastStatus int       `json:"last_status,omitempty"` // HTTP status of the last attempt
+        LastError  string    `json:"last_error,omitempty"`
+        NextRetry  time.Time `json:"next_retry,omitempty"`
+        UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// WebhookDispatcher manages subscriptions and delivers signed events to
+// them. Subscriptions and deliveries live in the database, so every
+// instance serves the same webhooks and any of them may send a delivery.
+type WebhookDispatcher struct {
+        db            *DB
+        client        *http.Client
+        workers       int
+        maxAttempts   int
+        backoff       time.Duration // Delay before the first retry, doubled after each failure
+        maxBackoff    time.Duration
+        claimTimeout  time.Duration // How long a sender has before another instance may retry its delivery
+        interval      time.Duration // Poll for due deliveries at least this often
+        logSize       int           // Delivered deliveries kept per webhook
+        deadLetterTTL time.Duration // How long exhausted deliveries are kept for replay
+
+        // Lets tests send to receivers on loopback; never set in production
+        allowPrivate bool
+
+        wake chan struct{}
+}
+
+// Create a dispatcher on db with workers concurrent senders
+func NewWebhookDispatcher(db *DB, workers int) *WebhookDispatcher {
+        d := &WebhookDispatcher{
+                db:            db,
+                workers:       workers,
+                maxAttempts:   6,
+                backoff:       time.Second,
+                maxBackoff:    5 * time.Minute,
+                claimTimeout:  time.Minute,
+                interval:      time.Second,
+                logSize:       100,
+                deadLetterTTL: 7 * 24 * time.Hour,
+                wake:          make(chan struct{}, 1),
+        }
+
+        // Receivers are checked again as they are dialled, so a name that
+        // resolves elsewhere later, or a redirect, cannot reach inside.
+        // Proxies are not used: they would be dialled instead.
+        dialer := &net.Dialer{Timeout: 5 * time.Second, Control: d.checkDial}
+        d.client = &http.Client{
+                Timeout: 10 * time.Second,
+                Transport: &http.Transport{
+                        DialContext:         dialer.DialContext,
+                        TLSHandshakeTimeout: 5 * time.Second,
+                        MaxIdleConnsPerHost: 2,
+                },
+        }
+        return d
+}
+
+// Run sends due deliveries and trims old ones until ctx is cancelled
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+        for i := 0; i < d.workers; i++ {
+                go d.worker(ctx)
+        }
+
+        ticker := time.NewTicker(time.Minute)
+        defer ticker.Stop()
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                        if err := d.trim(time.Now()); err != nil {
+                                log.Printf("webhooks: trimming deliveries: %v", err)
+                        }
+                }
+        }
+}
+
+// Publish queues a delivery for every webhook interested in the event.
+// It is a sink of the outbox relay, so an event whose deliveries cannot
+// all be queued stays in the outbox and is offered again. Every instance
+// relays the event, and the event key lets only the first one queue each
+// delivery.
+func (d *WebhookDispatcher) Publish(ctx context.Context, event ItemEvent) error {
+        hooks, err := d.hooks(event.Tenant)
+        if err != nil {
+                return fmt.Errorf("webhooks: queueing event %d: %v", event.ID, err)
+        }
+        var failed error
+        queued := false
+        for _, hook := range hooks {
+                if !hook.wants(event.Type) {
+                        continue
+                }
+                key := fmt.Sprintf("%d:%d", hook.ID, event.ID)
+                if _, err := d.newDelivery(hook.ID, event, &key); err != nil {
+                        failed = fmt.Errorf("webhooks: queueing event %d for webhook %d: %v", event.ID, hook.ID, err)
+                        continue
+                }
+                queued = true
+        }
+        if queued {
+                d.nudge()
+        }
+        return failed
+}
+
+// hooks lists tenant's webhooks, with their secrets
+func (d *WebhookDispatcher) hooks(tenant string) ([]Webhook, error) {
+        rows, err := d.db.Query("SELECT id, tenant_id, url, events, secret, created_at FROM webhooks WHERE tenant_id = ? ORDER BY id", tenant)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        hooks := []Webhook{}
+        for rows.Next() {
+                hook, err := scanWebhook(rows)
+                if err != nil {
+                        return nil, err
+                }
+                hooks = append(hooks, hook)
+        }
+        return hooks, rows.Err()
+}
+
+// newDelivery records a pending delivery, due now. A key already taken
+// means another instance queued it first, which is not an error.
+func (d *WebhookDispatcher) newDelivery(hookID int, event ItemEvent, key *string) (int64, error) {
+        body, err := json.Marshal(event)
+        if err != nil {
+                return 0, err
+        }
+        now := time.Now().UTC()
+        if key != nil {
+                _, err := d.db.Exec("INSERT IGNORE INTO webhook_deliveries (webhook_id, tenant_id, event, event_key, status, next_retry, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+                        hookID, event.Tenant, string(body), *key, DeliveryPending, now, now)
+                return 0, err
+        }
+        return d.db.InsertID("INSERT INTO webhook_deliveries (webhook_id, tenant_id, event, status, next_retry, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+                hookID, event.Tenant, string(body), DeliveryPending, now, now)
+}
+
+// nudge wakes a worker without waiting for one to be free
+func (d *WebhookDispatcher) nudge() {
+        select {
+        case d.wake <- struct{}{}:
+        default:
+        }
+}
+
+func (d *WebhookDispatcher) worker(ctx context.Context) {
+        for {
+                id, err := d.claim(time.Now())
+                if err != nil {
+                        log.Printf("webhooks: claiming a delivery: %v", err)
+                }
+                if id != 0 {
+                        d.attempt(id)
+                        continue
+                }
+                select {
+                case <-ctx.Done():
+                        return
+                case <-d.wake:
+                case <-time.After(d.interval):
+                }
+        }
+}
+
+// claim takes one due delivery by pushing its next retry past the claim
+// timeout, so no other sender picks it up meanwhile but a sender that
+// dies before recording the attempt does not lose it. Returns 0 when
+// nothing is due.
+func (d *WebhookDispatcher) claim(now time.Time) (int, error) {
+        now = now.UTC()
+        rows, err := d.db.Query("SELECT id FROM webhook_deliveries WHERE status = ? AND next_retry <= ? ORDER BY next_retry LIMIT 10", DeliveryPending, now)
+        if err != nil {
+                return 0, err
+        }
+        ids := []int{}
+        for rows.Next() {
+                var id int
+                if err := rows.Scan(&id); err != nil {
+                        rows.Close()
+                        return 0, err
+                }
+                ids = append(ids, id)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return 0, err
+        }
+
+        for _, id := range ids {
+                result, err := d.db.Exec("UPDATE webhook_deliveries SET next_retry = ? WHERE id = ? AND status = ? AND next_retry <= ?",
+                        now.Add(d.claimTimeout), id, DeliveryPending, now)
+                if err != nil {
+                        return 0, err
+                }
+                if n, err := result.RowsAffected(); err != nil {
+                        return 0, err
+                } else if n == 1 {
+                        return id, nil
+                }
+                // Another sender claimed it first
+        }
+        return 0, nil
+}
+
+// attempt sends one claimed delivery and schedules a retry or dead-letters it
+func (d *WebhookDispatcher) attempt(id int) {
+        var (
+                body     string
+                attempts int
+                target   string
+                secret   string
+        )
+        err := d.db.QueryRow("SELECT d.event, d.attempts, w.url, w.secret FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE d.id = ?", id).
+                Scan(&body, &attempts, &target, &secret)
+        if err == sql.ErrNoRows {
+                return // Webhook was deleted
+        } else if err != nil {
+                log.Printf("webhooks: loading delivery %d: %v", id, err)
+                return // Retried once the claim times out
+        }
+        var event ItemEvent
+        if err := json.Unmarshal([]byte(body), &event); err != nil {
+                log.Printf("webhooks: decoding delivery %d: %v", id, err)
+                return
+        }
+
+        status, err := d.send(target, secret, id, event)
+
+        attempts++
+        now := time.Now().UTC()
+        state, lastError, next := DeliverySucceeded, "", now
+        if err != nil {
+                lastError = err.Error()
+                state = DeliveryPending
+                if attempts >= d.maxAttempts {
+                        state = DeliveryDead
+                }
+                wait := d.backoff << (attempts - 1)
+                if wait > d.maxBackoff || wait <= 0 {
+                        wait = d.maxBackoff
+                }
+                next = now.Add(wait)
+        }
+        if _, err := d.db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status = ?, last_error = ?, next_retry = ?, updated_at = ? WHERE id = ?",
+                state, attempts, status, lastError, next, now, id); err != nil {
+                log.Printf("webhooks: recording delivery %d: %v", id, err)
+        }
+}
+
+// trim deletes dead letters past their TTL and all but the newest
+// logSize delivered deliveries of each webhook
+func (d *WebhookDispatcher) trim(now time.Time) error {
+        if _, err := d.db.Exec("DELETE FROM webhook_deliveries WHERE status = ? AND updated_at < ?", DeliveryDead, now.UTC().Add(-d.deadLetterTTL)); err != nil {
+                return err
+        }
+
+        rows, err := d.db.Query("SELECT id FROM webhooks")
+        if err != nil {
+                return err
+        }
+        hooks := []int{}
+        for rows.Next() {
+                var id int
+                if err := rows.Scan(&id); err != nil {
+                        rows.Close()
+                        return err
+                }
+                hooks = append(hooks, id)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+
+        for _, hook := range hooks {
+                var oldest int64
+                err := d.db.QueryRow("SELECT id FROM webhook_deliveries WHERE webhook_id = ? AND status = ? ORDER BY id DESC LIMIT 1 OFFSET ?", hook, DeliverySucceeded, d.logSize).
+                        Scan(&oldest)
+                if err == sql.ErrNoRows {
+                        continue
+                } else if err != nil {
+                        return err
+                }
+                if _, err := d.db.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ? AND status = ? AND id <= ?", hook, DeliverySucceeded, oldest); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+// send POSTs a signed event and returns the response status
+func (d *WebhookDispatcher) send(url, secret string, deliveryID int, event ItemEvent) (int, error) {
+        body, err := json.Marshal(event)
+        if err != nil {
+                return 0, err
+        }
+
+        req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+        if err != nil {
+                return 0, err
+        }
+        timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("X-Webhook-ID", strconv.Itoa(deliveryID))
+        req.Header.Set("X-Webhook-Event", event.Type)
+        req.Header.Set("X-Webhook-Timestamp", timestamp)
+        req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(secret, timestamp, body))
+
+        resp, err := d.client.Do(req)
+        if err != nil {
+                return 0, err
+        }
+        defer resp.Body.Close()
+        io.Copy(io.Discard, resp.Body)
+
+        if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+                return resp.StatusCode, fmt.Errorf("receiver returned %s", resp.Status)
+        }
+        return resp.StatusCode, nil
+}
+
+// signWebhook returns hex(HMAC-SHA256(secret, timestamp + "." + body)).
+// Receivers recompute it and compare with hmac.Equal; including the
+// timestamp lets them reject replayed requests.
+func signWebhook(secret, timestamp string, body []byte) string {
+        mac := hmac.New(sha256.New, []byte(secret))
+        mac.Write([]byte(timestamp))
+        mac.Write([]byte("."))
+        mac.Write(body)
+        return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+        b := make([]byte, 32)
+        if _, err := rand.Read(b); err != nil {
+                return "", err
+        }
+        return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Networks webhooks may not be sent to: the service's own host and
+// network, and addresses that are not routed on the internet
+var blockedNetworks = func() []*net.IPNet {
+        nets := []*net.IPNet{}
+        for _, cidr := range []string{
+                "0.0.0.0/8",     // "This" network
+                "100.64.0.0/10", // Carrier-grade NAT
+                "192.0.0.0/24",  // IETF protocol assignments
+                "198.18.0.0/15", // Benchmarking
+                "240.0.0.0/4",   // Reserved
+                "64:ff9b::/96",  // NAT64, which can reach any IPv4 address
+        } {
+                _, n, _ := net.ParseCIDR(cidr)
+                nets = append(nets, n)
+        }
+        return nets
+}()
+
+// publicIP reports whether ip is a unicast internet address
+func publicIP(ip net.IP) bool {
+        if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+                ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+                return false
+        }
+        for _, n := range blockedNetworks {
+                if n.Contains(ip) {
+                        return false
+                }
+        }
+        return true
+}
+
+var errPrivateReceiver = errors.New("webhook receivers must be public internet addresses")
+
+// checkDial refuses connections to addresses webhooks may not reach
+func (d *WebhookDispatcher) checkDial(network, address string, _ syscall.RawConn) error {
+        host, _, err := net.SplitHostPort(address)
+        if err != nil {
+                return err
+        }
+        if ip := net.ParseIP(host); ip == nil || !publicIP(ip) && !d.allowPrivate {
+                return errPrivateReceiver
+        }
+        return nil
+}
+
+// checkURL rejects receiver URLs other than plain http(s) to a host whose
+// every address is public. Sending checks the address again.
+func (d *WebhookDispatcher) checkURL(ctx context.Context, raw string) error {
+        u, err := url.Parse(raw)
+        if err != nil {
+                return err
+        }
+        if u.Scheme != "http" && u.Scheme != "https" {
+                return errors.New("url must be http or https")
+        }
+        if u.Hostname() == "" {
+                return errors.New("url must name a host")
+        }
+        if u.User != nil {
+                return errors.New("url must not carry credentials")
+        }
+        if d.allowPrivate {
+                return nil
+        }
+
+        ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+        defer cancel()
+        addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+        if err != nil {
+                return fmt.Errorf("resolving %s: %v", u.Hostname(), err)
+        }
+        for _, addr := range addrs {
+                if !publicIP(addr.IP) {
+                        return errPrivateReceiver
+                }
+        }
+        return nil
+}
+
+func scanWebhook(row scanner) (Webhook, error) {
+        var hook Webhook
+        var events string
+        if err := row.Scan(&hook.ID, &hook.Tenant, &hook.URL, &events, &hook.Secret, &hook.CreatedAt); err != nil {
+                return Webhook{}, err
+        }
+        return hook, json.Unmarshal([]byte(events), &hook.Events)
+}
+
+const deliveryColumns = "id, webhook_id, tenant_id, event, status, attempts, last_status, last_error, next_retry, updated_at"
+
+func scanDelivery(row scanner) (Delivery, error) {
+        var del Delivery
+        var tenant, event string
+        var lastError sql.NullString
+        if err := row.Scan(&del.ID, &del.WebhookID, &tenant, &event, &del.Status, &del.Attempts, &del.LastStatus, &lastError, &del.NextRetry, &del.UpdatedAt); err != nil {
+                return Delivery{}, err
+        }
+        if err := json.Unmarshal([]byte(event), &del.Event); err != nil {
+                return Delivery{}, err
+        }
+        del.Event.Tenant = tenant
+        del.LastError = lastError.String
+        if del.Status != DeliveryPending {
+                del.NextRetry = time.Time{}
+        }
+        return del, nil
+}
+
+func (d *WebhookDispatcher) queryDeliveries(query string, args ...interface{}) ([]Delivery, error) {
+        rows, err := d.db.Query(query, args...)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        deliveries := []Delivery{}
+        for rows.Next() {
+                del, err := scanDelivery(rows)
+                if err != nil {
+                        return nil, err
+                }
+                deliveries = append(deliveries, del)
+        }
+        return deliveries, rows.Err()
+}
+
+func writeWebhookJSON(w http.ResponseWriter, status int, v interface{}) {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(status)
+        json.NewEncoder(w).Encode(v)
+}
+
+// Create a webhook: POST /webhooks
+func (d *WebhookDispatcher) createWebhook(w http.ResponseWriter, r *http.Request) {
+        var hook Webhook
+        if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if hook.URL == "" {
+                http.Error(w, "url is required", http.StatusBadRequest)
+                return
+        }
+        if err := d.checkURL(r.Context(), hook.URL); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if hook.Secret == "" {
+                secret, err := newWebhookSecret()
+                if err != nil {
+                        dbError(w, err)
+                        return
+                }
+                hook.Secret = secret
+        }
+        if hook.Events == nil {
+                hook.Events = []string{}
+        }
+        events, err := json.Marshal(hook.Events)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        hook.Tenant = requestTenant(r)
+        hook.CreatedAt = time.Now().UTC()
+        id, err := d.db.InsertID("INSERT INTO webhooks (tenant_id, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?)",
+                hook.Tenant, hook.URL, string(events), hook.Secret, hook.CreatedAt)
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        hook.ID = int(id)
+
+        logged := hook
+        logged.Secret = ""
+        auditResult(r, logged)
+        writeWebhookJSON(w, http.StatusCreated, hook)
+}
+
+// List webhooks: GET /webhooks
+func (d *WebhookDispatcher) listWebhooks(w http.ResponseWriter, r *http.Request) {
+        hooks, err := d.hooks(requestTenant(r))
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        for i := range hooks {
+                hooks[i].Secret = ""
+        }
+
+        writeWebhookJSON(w, http.StatusOK, hooks)
+}
+
+// Look up the webhook named in the URL, writing an error if there is none
+func (d *WebhookDispatcher) webhookFromRequest(w http.ResponseWriter, r *http.Request) (Webhook, bool) {
+        id, err := strconv.Atoi(mux.Vars(r)["id"])
+        if err != nil {
+                http.Error(w, "Invalid ID", http.StatusBadRequest)
+                return Webhook{}, false
+        }
+
+        hook, err := scanWebhook(d.db.QueryRow("SELECT id, tenant_id, url, events, secret, created_at FROM webhooks WHERE id = ? AND tenant_id = ?", id, requestTenant(r)))
+        if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return Webhook{}, false
+        } else if err != nil {
+                dbError(w, err)
+                return Webhook{}, false
+        }
+        hook.Secret = ""
+        return hook, true
+}
+
+// Get a webhook: GET /webhooks/{id}
+func (d *WebhookDispatcher) getWebhook(w http.ResponseWriter, r *http.Request) {
+        hook, ok := d.webhookFromRequest(w, r)
+        if !ok {
+                return
+        }
+
+        writeWebhookJSON(w, http.StatusOK, hook)
+}
+
+// Delete a webhook and its deliveries: DELETE /webhooks/{id}
+func (d *WebhookDispatcher) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+        hook, ok := d.webhookFromRequest(w, r)
+        if !ok {
+                return
+        }
+
+        tx, err := d.db.Begin()
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        defer tx.Rollback()
+        if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", hook.ID); err != nil {
+                dbError(w, err)
+                return
+        }
+        if _, err := tx.Exec("DELETE FROM webhooks WHERE id = ?", hook.ID); err != nil {
+                dbError(w, err)
+                return
+        }
+        if err := tx.Commit(); err != nil {
+                dbError(w, err)
+                return
+        }
+
+        w.WriteHeader(http.StatusNoContent)
+}
+
+// Delivery log for a webhook, newest first: GET /webhooks/{id}/deliveries
+func (d *WebhookDispatcher) listDeliveries(w http.ResponseWriter, r *http.Request) {
+        hook, ok := d.webhookFromRequest(w, r)
+        if !ok {
+                return
+        }
+
+        deliveries, err := d.queryDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?", hook.ID, d.logSize)
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+
+        writeWebhookJSON(w, http.StatusOK, deliveries)
+}
+
+// Deliveries that exhausted their retries and have not yet expired:
+// GET /webhooks/dead-letters
+func (d *WebhookDispatcher) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+        deliveries, err := d.queryDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE tenant_id = ? AND status = ? ORDER BY id", requestTenant(r), DeliveryDead)
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+
+        writeWebhookJSON(w, http.StatusOK, deliveries)
+}
+
+// Send a delivery again as a new delivery: POST /webhooks/deliveries/{id}/replay
+func (d *WebhookDispatcher) replayDelivery(w http.ResponseWriter, r *http.Request) {
+        id, err := strconv.Atoi(mux.Vars(r)["id"])
+        if err != nil {
+                http.Error(w, "Invalid ID", http.StatusBadRequest)
+                return
+        }
+
+        // The join skips deliveries whose webhook was deleted
+        old, err := scanDelivery(d.db.QueryRow("SELECT d."+strings.ReplaceAll(deliveryColumns, ", ", ", d.")+" FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE d.id = ? AND d.tenant_id = ?",
+                id, requestTenant(r)))
+        if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return
+        } else if err != nil {
+                dbError(w, err)
+                return
+        }
+
+        newID, err := d.newDelivery(old.WebhookID, old.Event, nil)
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        del, err := scanDelivery(d.db.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE id = ?", newID))
+        if err != nil {
+                dbError(w, err)
+                return
+        }
+        d.nudge()
+
+        writeWebhookJSON(w, http.StatusAccepted, del)
+}
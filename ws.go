@@ -0,0 +1,409 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "errors"
+        "net/http"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/gorilla/websocket"
+)
+
+const (
+        wsWriteWait    = 10 * time.Second
+        wsPongWait     = 60 * time.Second
+        wsPingInterval = wsPongWait * 9 / 10
+        wsMaxMessage   = 64 * 1024
+)
+
+// Frame sent by the client
+type wsRequest struct {
+        Op     string          `json:"op"`            // subscribe, unsubscribe, get, list, create, update, delete
+        Ref    string          `json:"ref,omitempty"` // Echoed back so the client can match replies
+        Sub    string          `json:"sub,omitempty"` // Subscription ID chosen by the client
+        Filter *wsFilter       `json:"filter,omitempty"`
+        ID     jsonID          `json:"id,omitempty"`
+        Item   json.RawMessage `json:"item,omitempty"` // In the connection's API version
+}
+
+// Frame sent by the server. Items and events are in the connection's API version.
+type wsResponse struct {
+        Type  string      `json:"type"` // result, error or change
+        Ref   string      `json:"ref,omitempty"`
+        Sub   string      `json:"sub,omitempty"`
+        Error string      `json:"error,omitempty"`
+        Item  interface{} `json:"item,omitempty"`
+        Items interface{} `json:"items,omitempty"`
+        Event interface{} `json:"event,omitempty"`
+}
+
+// wsFilter selects which item changes a subscription receives.
+// An empty filter matches everything.
+type wsFilter struct {
+        IDs    []jsonID `json:"ids,omitempty"`
+        Prefix string   `json:"prefix,omitempty"` // Name prefix
+}
+
+func (f wsFilter) matches(event ItemEvent) bool {
+        if len(f.IDs) > 0 {
+                found := false
+                for _, id := range f.IDs {
+                        if int(id) == event.ItemID {
+                                found = true
+                                break
+                        }
+                }
+                if !found {
+                        return false
+                }
+        }
+        if f.Prefix != "" {
+                if event.Item == nil || !strings.HasPrefix(event.Item.Name, f.Prefix) {
+                        return false
+                }
+        }
+        return true
+}
+
+// WSServer serves the item subscription API over WebSocket
+type WSServer struct {
+        upgrader websocket.Upgrader
+        maxSubs  int // Concurrent subscriptions per principal across all sockets
+
+        mu   sync.Mutex
+        subs map[string]int // Open subscriptions per tenant and principal
+}
+
+// Create a WebSocket server allowing maxSubs subscriptions per
+// authenticated principal
+func NewWSServer(maxSubs int) *WSServer {
+        return &WSServer{
+                upgrader: websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024},
+                maxSubs:  maxSubs,
+                subs:     make(map[string]int),
+        }
+}
+
+// Reserve a subscription slot for c's principal
+func (s *WSServer) acquire(c *wsConn) bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        holder := c.tenant + "/" + c.principal
+        if s.subs[holder] >= s.maxSubs {
+                return false
+        }
+        s.subs[holder]++
+        return true
+}
+
+func (s *WSServer) release(c *wsConn, n int) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        holder := c.tenant + "/" + c.principal
+        s.subs[holder] -= n
+        if s.subs[holder] <= 0 {
+                delete(s.subs, holder)
+        }
+}
+
+// wsConn is one client socket
+type wsConn struct {
+        server    *WSServer
+        conn      *websocket.Conn
+        tenant    string
+        principal string
+        version   *APIVersion
+        send      chan wsResponse
+        closed    chan struct{}
+        closeOnce sync.Once
+
+        mu   sync.Mutex
+        subs map[string]wsFilter
+        seen *seenEvents
+}
+
+// Upgrade and serve a socket: GET /items/ws. Subscriptions are capped per
+// principal, so the caller must prove who it is with a token or session;
+// X-User-ID and the client address are not enough.
+func (s *WSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+        principal, ok := authenticatedPrincipal(r)
+        if !ok {
+                w.Header().Set("WWW-Authenticate", "Bearer")
+                http.Error(w, "a bearer token or session is required", http.StatusUnauthorized)
+                return
+        }
+        conn, err := s.upgrader.Upgrade(w, r, nil)
+        if err != nil {
+                return // Upgrade already replied with an error
+        }
+
+        c := &wsConn{
+                server:    s,
+                conn:      conn,
+                tenant:    requestTenant(r),
+                principal: principal,
+                version:   requestVersion(r),
+                send:      make(chan wsResponse, 64),
+                closed:    make(chan struct{}),
+                subs:      make(map[string]wsFilter),
+                seen:      newSeenEvents(seenEventsSize),
+        }
+
+        unsubscribe := bus.Subscribe(c.deliver)
+        defer func() {
+                unsubscribe()
+                c.close()
+                c.mu.Lock()
+                s.release(c, len(c.subs))
+                c.mu.Unlock()
+        }()
+
+        go c.writePump()
+        c.readPump()
+}
+
+func (c *wsConn) close() {
+        c.closeOnce.Do(func() {
+                close(c.closed)
+                c.conn.Close()
+        })
+}
+
+// Queue a frame, dropping the connection if the client cannot keep up
+func (c *wsConn) reply(resp wsResponse) {
+        select {
+        case c.send <- resp:
+        case <-c.closed:
+        default:
+                c.close()
+        }
+}
+
+func (c *wsConn) actor() Actor {
+        return Actor{Tenant: c.tenant, Principal: c.principal}
+}
+
+// Read a request's item in the connection's API version
+func (c *wsConn) item(req wsRequest) (Item, error) {
+        if len(req.Item) == 0 {
+                return Item{}, errors.New("item is required")
+        }
+        if c.version.newBody == nil {
+                var item Item
+                err := json.Unmarshal(req.Item, &item)
+                return item, err
+        }
+        body := c.version.newBody()
+        if err := json.Unmarshal(req.Item, body); err != nil {
+                return Item{}, err
+        }
+        return body.item(), nil
+}
+
+// What a client is told of a failed store call: its own mistakes in full,
+// and of a database error no more than dbError would say
+func storeFailure(err error) string {
+        if _, invalid := err.(ValidationError); invalid || err == errQuotaExceeded {
+                return err.Error()
+        }
+        return dbErrorMessage(err)
+}
+
+// deliver is the EventBus handler; it must not block
+func (c *wsConn) deliver(event ItemEvent) {
+        if event.Tenant != c.tenant {
+                return
+        }
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        // The outbox delivers at least once, so skip anything already seen
+        if !c.seen.add(event.ID) {
+                return
+        }
+        for id, filter := range c.subs {
+                if filter.matches(event) {
+                        c.reply(wsResponse{Type: "change", Sub: id, Event: c.version.wire(event)})
+                }
+        }
+}
+
+func (c *wsConn) readPump() {
+        c.conn.SetReadLimit(wsMaxMessage)
+        c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+        c.conn.SetPongHandler(func(string) error {
+                return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+        })
+
+        for {
+                var req wsRequest
+                if err := c.conn.ReadJSON(&req); err != nil {
+                        return
+                }
+                c.handle(req)
+        }
+}
+
+func (c *wsConn) writePump() {
+        ping := time.NewTicker(wsPingInterval)
+        defer ping.Stop()
+
+        for {
+                select {
+                case <-c.closed:
+                        return
+                case resp := <-c.send:
+                        c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+                        if err := c.conn.WriteJSON(resp); err != nil {
+                                c.close()
+                                return
+                        }
+                case <-ping.C:
+                        c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+                        if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                                c.close()
+                                return
+                        }
+                }
+        }
+}
+
+// Handle a single client frame
+func (c *wsConn) handle(req wsRequest) {
+        actor := c.actor()
+        var failure string
+        var created *int // Where the create op reports the new item's ID
+        fail := func(msg string) {
+                failure = msg
+                c.reply(wsResponse{Type: "error", Ref: req.Ref, Sub: req.Sub, Error: msg})
+        }
+
+        // Mutations are audited like their REST counterparts
+        if req.Op == "create" || req.Op == "update" || req.Op == "delete" {
+                entry := AuditEntry{
+                        Tenant:     c.tenant,
+                        OccurredAt: time.Now(),
+                        Principal:  c.principal,
+                        RequestID:  requestID(req.Ref),
+                        Route:      "ws " + req.Op,
+                        ItemID:     int(req.ID),
+                }
+                if req.Op != "create" {
+                        entry.Before = auditItem(c.tenant, int(req.ID))
+                }
+                pending := entry
+                actor.Audit = &pending
+                defer func() {
+                        if pending.committed() {
+                                return // Written with the change
+                        }
+                        if entry.ItemID != 0 {
+                                entry.After = auditItem(c.tenant, entry.ItemID)
+                        }
+                        entry.Status = failure
+                        entry.Outcome = outcome(failure != "")
+                        audit.Record(entry)
+                }()
+                created = &entry.ItemID
+        }
+
+        switch req.Op {
+        case "subscribe":
+                if req.Sub == "" {
+                        fail("sub is required")
+                        return
+                }
+                filter := wsFilter{}
+                if req.Filter != nil {
+                        filter = *req.Filter
+                }
+
+                c.mu.Lock()
+                _, exists := c.subs[req.Sub]
+                if !exists && !c.server.acquire(c) {
+                        c.mu.Unlock()
+                        fail("too many subscriptions")
+                        return
+                }
+                c.subs[req.Sub] = filter
+                c.mu.Unlock()
+                c.reply(wsResponse{Type: "result", Ref: req.Ref, Sub: req.Sub})
+
+        case "unsubscribe":
+                c.mu.Lock()
+                if _, ok := c.subs[req.Sub]; ok {
+                        delete(c.subs, req.Sub)
+                        c.server.release(c, 1)
+                }
+                c.mu.Unlock()
+                c.reply(wsResponse{Type: "result", Ref: req.Ref, Sub: req.Sub})
+
+        case "list":
+                items, err := listItems(c.tenant)
+                if err != nil {
+                        fail(storeFailure(err))
+                        return
+                }
+                c.reply(wsResponse{Type: "result", Ref: req.Ref, Items: c.version.wire(items)})
+
+        case "get":
+                item, err := cache.Get(c.tenant, int(req.ID), loadItem)
+                if err == sql.ErrNoRows {
+                        fail("not found")
+                        return
+                } else if err != nil {
+                        fail(storeFailure(err))
+                        return
+                }
+                c.reply(wsResponse{Type: "result", Ref: req.Ref, Item: c.version.wire(item)})
+
+        case "create":
+                create, err := c.item(req)
+                if err != nil {
+                        fail(err.Error())
+                        return
+                }
+                item, err := insertItem(actor, create)
+                if err != nil {
+                        fail(storeFailure(err))
+                        return
+                }
+                *created = item.ID
+                c.reply(wsResponse{Type: "result", Ref: req.Ref, Item: c.version.wire(item)})
+
+        case "update":
+                update, err := c.item(req)
+                if err != nil {
+                        fail(err.Error())
+                        return
+                }
+                update.ID = int(req.ID)
+                item, err := saveItem(actor, update)
+                if err == sql.ErrNoRows {
+                        fail("not found")
+                        return
+                } else if err != nil {
+                        fail(storeFailure(err))
+                        return
+                }
+                c.reply(wsResponse{Type: "result", Ref: req.Ref, Item: c.version.wire(item)})
+
+        case "delete":
+                if err := removeItem(actor, int(req.ID)); err == sql.ErrNoRows {
+                        fail("not found")
+                        return
+                } else if err != nil {
+                        fail(storeFailure(err))
+                        return
+                }
+                c.reply(wsResponse{Type: "result", Ref: req.Ref})
+
+        default:
+                fail("unknown op " + req.Op)
+        }
+}
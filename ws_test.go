@@ -0,0 +1,107 @@
+package main
+
+import (
+        "context"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+        "github.com/gorilla/websocket"
+)
+
+// wsRoutes serves a socket allowing maxSubs subscriptions per principal
+func wsRoutes(maxSubs int) func(router *mux.Router) {
+        return func(router *mux.Router) {
+                router.Handle("/items/ws", NewWSServer(maxSubs)).Methods("GET")
+        }
+}
+
+func dialWS(t *testing.T, srv *httptest.Server, headers map[string]string) (*websocket.Conn, int) {
+        t.Helper()
+        header := http.Header{}
+        for name, value := range headers {
+                header.Set(name, value)
+        }
+        conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/items/ws", header)
+        if err != nil {
+                if resp == nil {
+                        t.Fatal(err)
+                }
+                return nil, resp.StatusCode
+        }
+        t.Cleanup(func() { conn.Close() })
+        return conn, resp.StatusCode
+}
+
+func subscribeWS(t *testing.T, conn *websocket.Conn, sub string) wsResponse {
+        t.Helper()
+        if err := conn.WriteJSON(wsRequest{Op: "subscribe", Ref: sub, Sub: sub}); err != nil {
+                t.Fatal(err)
+        }
+        var resp wsResponse
+        if err := conn.ReadJSON(&resp); err != nil {
+                t.Fatal(err)
+        }
+        return resp
+}
+
+// The cap counts what a token proves, so renaming yourself in X-User-ID
+// does not buy more subscriptions
+func TestWSSubscriptionCapFollowsTheToken(t *testing.T) {
+        srv := newTestEnv(t, withTokens("")).serve(wsRoutes(1))
+
+        if _, code := dialWS(t, srv, map[string]string{"X-User-ID": "ann", "X-Tenant-ID": "acme"}); code != http.StatusUnauthorized {
+                t.Errorf("without a token: got %d, want 401", code)
+        }
+
+        headers := func(tenant, subject, claimed string) map[string]string {
+                h := bearer(tenant, subject)
+                h["X-User-ID"] = claimed
+                return h
+        }
+        first, _ := dialWS(t, srv, headers("acme", "ann", "ann"))
+        if resp := subscribeWS(t, first, "a"); resp.Type != "result" {
+                t.Fatalf("first subscription: %+v", resp)
+        }
+        second, _ := dialWS(t, srv, headers("acme", "ann", "someone-else"))
+        if resp := subscribeWS(t, second, "b"); resp.Type != "error" {
+                t.Errorf("second subscription for ann allowed: %+v", resp)
+        }
+
+        // The same subject in another tenant is someone else
+        other, _ := dialWS(t, srv, headers("globex", "ann", "ann"))
+        if resp := subscribeWS(t, other, "c"); resp.Type != "result" {
+                t.Errorf("globex's ann refused: %+v", resp)
+        }
+}
+
+// The outbox may relay an event again; the socket sends it once
+func TestWSDropsRepeatedEvents(t *testing.T) {
+        srv := newTestEnv(t, withTokens("")).serve(wsRoutes(1))
+
+        conn, _ := dialWS(t, srv, bearer("acme", "ann"))
+        if resp := subscribeWS(t, conn, "all"); resp.Type != "result" {
+                t.Fatalf("subscribe: %+v", resp)
+        }
+        for _, id := range []int64{5, 5, 6} {
+                bus.Publish(context.Background(), ItemEvent{ID: id, Tenant: "acme", Type: EventItemUpdated, ItemID: 7})
+        }
+
+        conn.SetReadDeadline(time.Now().Add(time.Second))
+        var got []int64
+        for len(got) < 2 {
+                var frame struct {
+                        Event ItemEvent `json:"event"`
+                }
+                if err := conn.ReadJSON(&frame); err != nil {
+                        t.Fatal(err)
+                }
+                got = append(got, frame.Event.ID)
+        }
+        if got[0] != 5 || got[1] != 6 {
+                t.Errorf("got events %v, want [5 6]", got)
+        }
+}